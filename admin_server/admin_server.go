@@ -2,9 +2,12 @@
 package main
 
 import (
+	"config"
+	"config/schema"
 	"database/sql"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"math"
@@ -20,8 +23,14 @@ import (
 	_ "github.com/lib/pq"
 )
 
+var (
+	videoBaseDir  string
+	tempVideosDir string
+	adBreakTarget float64
+	outputDefault config.OutputConfig
+)
+
 const (
-	videoBaseDir                   = "Z:/Videos"
 	adBreakFadeToBlackDetectorPath = "./ad_break_fade_to_black_detector.exe"
 	adBreakHardCutDetectorPath     = "./ad_break_hard_cut_detector.exe"
 )
@@ -76,6 +85,34 @@ type Station struct {
 	ID        int64 `json:"id"`
 	Name      string `json:"name"`
 	UnixStart int64 `json:"unix_start"`
+	// Ad break length for the station; null uses the config's ads section.
+	AdBreakTarget    *float64 `json:"ad_break_target_seconds"`
+	AdBreakTolerance *float64 `json:"ad_break_tolerance_seconds"`
+	// Output profile for the station; null fields use the config's output
+	// section.
+	OutputWidth  *int    `json:"output_width"`
+	OutputHeight *int    `json:"output_height"`
+	OutputFPS    *string `json:"output_fps"`
+	OutputFit    *string `json:"output_fit"`
+}
+
+// validateOutput checks the station's output profile as video_server will
+// apply it, over the config's.
+func (s Station) validateOutput() error {
+	o := outputDefault
+	if s.OutputWidth != nil {
+		o.Width = *s.OutputWidth
+	}
+	if s.OutputHeight != nil {
+		o.Height = *s.OutputHeight
+	}
+	if s.OutputFPS != nil {
+		o.FPS = *s.OutputFPS
+	}
+	if s.OutputFit != nil {
+		o.Fit = *s.OutputFit
+	}
+	return config.ValidateOutput(o)
 }
 
 type UpdateBreakReq struct {
@@ -102,17 +139,31 @@ type PreviewFadeReq struct {
 var db *sql.DB
 
 func main() {
+	configPath := flag.String("config", "", "path to the shared config file")
+	flag.Parse()
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Loaded config from %s", cfg.Source())
+	videoBaseDir = cfg.Paths.VideoBaseDir
+	tempVideosDir = cfg.Paths.TempDir
+	adBreakTarget = cfg.Ads.BreakTargetSeconds
+	outputDefault = cfg.Output
+
 	r := gin.Default()
 	r.Use(customRecovery())
 	r.Use(customErrorHandler())
 	loadTemplatesSafely(r, "templates/*.html")
 
-	var err error
-	db, err = sql.Open("postgres", "user=postgres password=aaaaaaaaaa dbname=webrtc_tv sslmode=disable host=localhost port=5432")
+	db, err = sql.Open("postgres", cfg.Database.DSN)
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer db.Close()
+	if err := schema.Ensure(db); err != nil {
+		log.Fatal(err)
+	}
 
 	cwd, err := os.Getwd()
 	if err != nil {
@@ -121,10 +172,10 @@ func main() {
 		log.Printf("Current working directory: %s", cwd)
 	}
 
-	publicDir := "./public"
+	publicDir := cfg.Paths.PublicDir
 	r.StaticFS("/public_html", http.Dir(publicDir))
 	r.StaticFS("/videos", http.Dir(videoBaseDir))
-	r.StaticFS("/temp_videos", http.Dir("./temp_videos"))
+	r.StaticFS("/temp_videos", http.Dir(tempVideosDir))
 
 	r.POST("/videos/:id/tags", func(c *gin.Context) {
 		idStr := c.Param("id")
@@ -250,6 +301,18 @@ func main() {
 	r.POST("/api/stations", apiCreateStationHandler)
 	r.PUT("/api/stations/:id", apiUpdateStationHandler)
 	r.DELETE("/api/stations/:id", apiDeleteStationHandler)
+	r.GET("/api/stations/:id/schedule", apiScheduleBlocksHandler)
+	r.POST("/api/stations/:id/schedule", apiCreateScheduleBlockHandler)
+	r.GET("/api/stations/:id/schedule/preview", apiSchedulePreviewHandler)
+	r.PUT("/api/schedule-blocks/:id", apiUpdateScheduleBlockHandler)
+	r.DELETE("/api/schedule-blocks/:id", apiDeleteScheduleBlockHandler)
+	r.GET("/api/campaigns", apiCampaignsHandler)
+	r.POST("/api/campaigns", apiCreateCampaignHandler)
+	r.GET("/api/campaigns/:id", apiCampaignHandler)
+	r.PUT("/api/campaigns/:id", apiUpdateCampaignHandler)
+	r.DELETE("/api/campaigns/:id", apiDeleteCampaignHandler)
+	r.GET("/api/as-run", apiAsRunHandler)
+	r.GET("/api/reports/ad-impressions", apiAdImpressionsHandler)
 	r.GET("/api/videos", apiVideosHandler)
 	r.POST("/api/assign-video-title/:vid/:tid", apiAssignVideoToTitleHandler)
 	r.DELETE("/api/assign-video-title/:vid", apiRemoveVideoFromTitleHandler)
@@ -261,7 +324,7 @@ func main() {
 		c.HTML(http.StatusNotFound, "404.html", gin.H{"error": "404"})
 	})
 
-	r.Run(":8082")
+	r.Run(cfg.AdminServer.Listen)
 }
 
 func customRecovery() gin.HandlerFunc {
@@ -735,7 +798,7 @@ func fixVideoHandler(c *gin.Context) {
 		c.JSON(http.StatusNotFound, gin.H{"error": "File not found: " + fullPath})
 		return
 	}
-	tempDir := "./temp_videos"
+	tempDir := tempVideosDir
 	if err := os.MkdirAll(tempDir, os.ModePerm); err != nil {
 		log.Printf("Failed to create temp directory %s: %v", tempDir, err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create temp directory: " + err.Error()})
@@ -913,7 +976,7 @@ func previewFadeHandler(c *gin.Context) {
         return
     }
 
-    tempDir := "./temp_videos"
+    tempDir := tempVideosDir
     if err := os.MkdirAll(tempDir, os.ModePerm); err != nil {
         c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create temp directory"})
         return
@@ -1244,7 +1307,7 @@ func apiStationsHandler(c *gin.Context) {
 			offset = o
 		}
 	}
-	query := `SELECT id, name, unix_start FROM stations`
+	query := `SELECT id, name, unix_start, ad_break_target_seconds, ad_break_tolerance_seconds, output_width, output_height, output_fps, output_fit FROM stations`
 	args := []interface{}{}
 	if search != "" {
 		query += ` WHERE name ILIKE $1`
@@ -1261,7 +1324,7 @@ func apiStationsHandler(c *gin.Context) {
 	var stations []Station
 	for rows.Next() {
 		var s Station
-		if err := rows.Scan(&s.ID, &s.Name, &s.UnixStart); err != nil {
+		if err := rows.Scan(&s.ID, &s.Name, &s.UnixStart, &s.AdBreakTarget, &s.AdBreakTolerance, &s.OutputWidth, &s.OutputHeight, &s.OutputFPS, &s.OutputFit); err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
@@ -1276,7 +1339,12 @@ func apiCreateStationHandler(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	err := db.QueryRow(`INSERT INTO stations (name, unix_start) VALUES ($1, $2) RETURNING id`, s.Name, s.UnixStart).Scan(&s.ID)
+	if err := s.validateOutput(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	err := db.QueryRow(`INSERT INTO stations (name, unix_start, ad_break_target_seconds, ad_break_tolerance_seconds, output_width, output_height, output_fps, output_fit) VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id`,
+		s.Name, s.UnixStart, s.AdBreakTarget, s.AdBreakTolerance, s.OutputWidth, s.OutputHeight, s.OutputFPS, s.OutputFit).Scan(&s.ID)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -1296,7 +1364,12 @@ func apiUpdateStationHandler(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	_, err = db.Exec(`UPDATE stations SET name = $1, unix_start = $2 WHERE id = $3`, s.Name, s.UnixStart, id)
+	if err := s.validateOutput(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	_, err = db.Exec(`UPDATE stations SET name = $1, unix_start = $2, ad_break_target_seconds = $3, ad_break_tolerance_seconds = $4, output_width = $5, output_height = $6, output_fps = $7, output_fit = $8 WHERE id = $9`,
+		s.Name, s.UnixStart, s.AdBreakTarget, s.AdBreakTolerance, s.OutputWidth, s.OutputHeight, s.OutputFPS, s.OutputFit, id)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -0,0 +1,147 @@
+// asrun.go
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const maxAsRunRows = 50000
+
+// AsRunEntry is one program segment or ad video_server transmitted.
+type AsRunEntry struct {
+	ID          int64     `json:"id"`
+	StationID   int64     `json:"station_id"`
+	StationName string    `json:"station_name"`
+	AdsEnabled  bool      `json:"ads_enabled"`
+	VideoID     int64     `json:"video_id"`
+	URI         string    `json:"uri"`
+	Title       string    `json:"title"`
+	IsAd        bool      `json:"is_ad"`
+	PodID       *int64    `json:"pod_id"`
+	SourceIn    float64   `json:"source_in"`
+	SourceOut   float64   `json:"source_out"`
+	StartedAt   time.Time `json:"started_at"`
+	EndedAt     time.Time `json:"ended_at"`
+	Viewers     int       `json:"viewers"`
+	Completed   bool      `json:"completed"`
+}
+
+// apiAsRunHandler serves the as-run log, oldest first. Filters:
+//
+//	station      station ID or exact name
+//	ads_enabled  true or false for one variant of the station
+//	at           RFC 3339; only what was airing at that instant
+//	from, to     RFC 3339 window, default the last 24 hours
+//	ads_only     true for ads and bumpers only
+//	format       csv to download instead of JSON
+func apiAsRunHandler(c *gin.Context) {
+	query := `SELECT a.id, a.station_id, a.station_name, a.ads_enabled, a.video_id, COALESCE(v.uri, ''), COALESCE(t.name, ''),
+			a.is_ad, a.pod_id, a.source_in, a.source_out, a.started_at, a.ended_at, a.viewers, a.completed
+		FROM as_run a LEFT JOIN videos v ON v.id = a.video_id LEFT JOIN titles t ON t.id = v.title_id
+		WHERE true`
+	var args []interface{}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
+	}
+	if s := c.Query("station"); s != "" {
+		if id, err := strconv.ParseInt(s, 10, 64); err == nil {
+			query += ` AND a.station_id = ` + arg(id)
+		} else {
+			query += ` AND a.station_name = ` + arg(s)
+		}
+	}
+	if s := c.Query("ads_enabled"); s != "" {
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ads_enabled"})
+			return
+		}
+		query += ` AND a.ads_enabled = ` + arg(b)
+	}
+	if c.Query("ads_only") == "true" {
+		query += ` AND a.is_ad`
+	}
+	if s := c.Query("at"); s != "" {
+		at, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid at, expected RFC 3339"})
+			return
+		}
+		p := arg(at)
+		query += ` AND a.started_at <= ` + p + ` AND a.ended_at > ` + p
+	} else {
+		to := time.Now()
+		from := to.Add(-24 * time.Hour)
+		var err error
+		if s := c.Query("from"); s != "" {
+			if from, err = time.Parse(time.RFC3339, s); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid from, expected RFC 3339"})
+				return
+			}
+		}
+		if s := c.Query("to"); s != "" {
+			if to, err = time.Parse(time.RFC3339, s); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid to, expected RFC 3339"})
+				return
+			}
+		}
+		query += ` AND a.ended_at > ` + arg(from) + ` AND a.started_at < ` + arg(to)
+	}
+	query += ` ORDER BY a.started_at, a.id LIMIT ` + strconv.Itoa(maxAsRunRows)
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+	entries := []AsRunEntry{}
+	for rows.Next() {
+		var e AsRunEntry
+		var podID sql.NullInt64
+		if err := rows.Scan(&e.ID, &e.StationID, &e.StationName, &e.AdsEnabled, &e.VideoID, &e.URI, &e.Title,
+			&e.IsAd, &podID, &e.SourceIn, &e.SourceOut, &e.StartedAt, &e.EndedAt, &e.Viewers, &e.Completed); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if podID.Valid {
+			e.PodID = &podID.Int64
+		}
+		entries = append(entries, e)
+	}
+	if err := rows.Err(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if c.Query("format") != "csv" {
+		c.JSON(http.StatusOK, entries)
+		return
+	}
+	c.Header("Content-Type", "text/csv")
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="as_run_%s.csv"`, time.Now().Format("20060102_150405")))
+	w := csv.NewWriter(c.Writer)
+	w.Write([]string{"id", "station_id", "station_name", "ads_enabled", "video_id", "uri", "title", "is_ad", "pod_id",
+		"source_in", "source_out", "started_at", "ended_at", "duration", "viewers", "completed"})
+	for _, e := range entries {
+		podID := ""
+		if e.PodID != nil {
+			podID = strconv.FormatInt(*e.PodID, 10)
+		}
+		w.Write([]string{
+			strconv.FormatInt(e.ID, 10), strconv.FormatInt(e.StationID, 10), e.StationName, strconv.FormatBool(e.AdsEnabled),
+			strconv.FormatInt(e.VideoID, 10), e.URI, e.Title, strconv.FormatBool(e.IsAd), podID,
+			strconv.FormatFloat(e.SourceIn, 'f', 3, 64), strconv.FormatFloat(e.SourceOut, 'f', 3, 64),
+			e.StartedAt.Format(time.RFC3339Nano), e.EndedAt.Format(time.RFC3339Nano),
+			strconv.FormatFloat(e.EndedAt.Sub(e.StartedAt).Seconds(), 'f', 3, 64),
+			strconv.Itoa(e.Viewers), strconv.FormatBool(e.Completed),
+		})
+	}
+	w.Flush()
+}
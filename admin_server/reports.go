@@ -0,0 +1,152 @@
+// reports.go
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// reportDimension is a column ad impression reports can be grouped by.
+type reportDimension struct {
+	columns []string // output names
+	exprs   []string // SQL, in the same order
+}
+
+var reportDimensions = map[string]reportDimension{
+	"ad":       {[]string{"video_id", "uri"}, []string{"a.video_id", "COALESCE(v.uri, '')"}},
+	"campaign": {[]string{"campaign_id", "campaign"}, []string{"a.campaign_id", "COALESCE(cp.name, '')"}},
+	"station":  {[]string{"station_id", "station_name"}, []string{"a.station_id", "a.station_name"}},
+	"day":      {[]string{"day"}, []string{"to_char(a.started_at, 'YYYY-MM-DD')"}},
+}
+
+var reportMetrics = []string{"airings", "ad_seconds", "peers_at_start", "reached", "completed_views", "dropped"}
+
+// apiAdImpressionsHandler rolls up the reach of every ad airing in the as-run
+// log. Parameters:
+//
+//	group_by     comma-separated ad, campaign, station, day (default ad,day)
+//	from, to     dates (YYYY-MM-DD, to inclusive) or RFC 3339, default the last 7 days
+//	station      station ID; campaign  campaign ID; video  commercial video ID
+//	bumpers      true to include bumpers and other uncampaigned ads (default true)
+//	format       csv to download instead of JSON
+func apiAdImpressionsHandler(c *gin.Context) {
+	groupBy := c.DefaultQuery("group_by", "ad,day")
+	var columns, exprs []string
+	for _, name := range strings.Split(groupBy, ",") {
+		dim, ok := reportDimensions[strings.TrimSpace(name)]
+		if !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid group_by %q; use ad, campaign, station or day", name)})
+			return
+		}
+		columns = append(columns, dim.columns...)
+		exprs = append(exprs, dim.exprs...)
+	}
+	to := time.Now()
+	from := to.AddDate(0, 0, -7)
+	var err error
+	if s := c.Query("from"); s != "" {
+		if from, err = parseReportTime(s, false); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid from: " + err.Error()})
+			return
+		}
+	}
+	if s := c.Query("to"); s != "" {
+		if to, err = parseReportTime(s, true); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid to: " + err.Error()})
+			return
+		}
+	}
+	args := []interface{}{from, to}
+	where := `a.is_ad AND a.reached IS NOT NULL AND a.started_at >= $1 AND a.started_at < $2`
+	for param, column := range map[string]string{"station": "a.station_id", "campaign": "a.campaign_id", "video": "a.video_id"} {
+		if s := c.Query(param); s != "" {
+			id, err := strconv.ParseInt(s, 10, 64)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid " + param})
+				return
+			}
+			args = append(args, id)
+			where += fmt.Sprintf(` AND %s = $%d`, column, len(args))
+		}
+	}
+	if c.Query("bumpers") == "false" {
+		where += ` AND a.campaign_id IS NOT NULL`
+	}
+	query := `SELECT ` + strings.Join(exprs, ", ") + `,
+			count(*), COALESCE(sum(EXTRACT(EPOCH FROM a.ended_at - a.started_at)), 0)::float8,
+			COALESCE(sum(a.peers_at_start), 0), COALESCE(sum(a.reached), 0), COALESCE(sum(a.completed_views), 0), COALESCE(sum(a.dropped), 0)
+		FROM as_run a LEFT JOIN videos v ON v.id = a.video_id LEFT JOIN ad_campaigns cp ON cp.id = a.campaign_id
+		WHERE ` + where + `
+		GROUP BY ` + strings.Join(exprs, ", ") + `
+		ORDER BY ` + strings.Join(exprs, ", ")
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+	var report []map[string]interface{}
+	for rows.Next() {
+		values := make([]interface{}, len(columns)+len(reportMetrics))
+		ptrs := make([]interface{}, len(values))
+		for i := range values {
+			ptrs[i] = &values[i]
+		}
+		if err := rows.Scan(ptrs...); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		row := make(map[string]interface{}, len(values))
+		for i, name := range append(append([]string{}, columns...), reportMetrics...) {
+			if b, ok := values[i].([]byte); ok {
+				values[i] = string(b)
+			}
+			row[name] = values[i]
+		}
+		report = append(report, row)
+	}
+	if err := rows.Err(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if c.Query("format") != "csv" {
+		if report == nil {
+			report = []map[string]interface{}{}
+		}
+		c.JSON(http.StatusOK, report)
+		return
+	}
+	header := append(append([]string{}, columns...), reportMetrics...)
+	c.Header("Content-Type", "text/csv")
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="ad_impressions_%s_%s.csv"`, from.Format("20060102"), to.Format("20060102")))
+	w := csv.NewWriter(c.Writer)
+	w.Write(header)
+	for _, row := range report {
+		record := make([]string, len(header))
+		for i, name := range header {
+			if row[name] != nil {
+				record[i] = fmt.Sprint(row[name])
+			}
+		}
+		w.Write(record)
+	}
+	w.Flush()
+}
+
+// parseReportTime reads a date or an RFC 3339 time. A date used as the end of
+// a range includes the whole day.
+func parseReportTime(s string, end bool) (time.Time, error) {
+	if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		if end {
+			t = t.AddDate(0, 0, 1)
+		}
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
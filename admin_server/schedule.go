@@ -0,0 +1,142 @@
+// schedule.go
+package main
+
+import (
+	"config/schedule"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func apiScheduleBlocksHandler(c *gin.Context) {
+	stationID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+	blocks, err := schedule.LoadBlocks(db, stationID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if blocks == nil {
+		blocks = []schedule.Block{}
+	}
+	c.JSON(http.StatusOK, blocks)
+}
+
+func apiCreateScheduleBlockHandler(c *gin.Context) {
+	stationID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+	var b schedule.Block
+	if err := c.BindJSON(&b); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	b.StationID = stationID
+	if err := b.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := schedule.CreateBlock(db, &b); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, b)
+}
+
+func apiUpdateScheduleBlockHandler(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+	existing, err := schedule.GetBlock(db, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Block not found"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	var b schedule.Block
+	if err := c.BindJSON(&b); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	b.ID = id
+	b.StationID = existing.StationID
+	if err := b.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := schedule.UpdateBlock(db, &b); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, b)
+}
+
+func apiDeleteScheduleBlockHandler(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+	if err := schedule.DeleteBlock(db, id); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+// apiSchedulePreviewHandler simulates what a station would air between from
+// and to (RFC 3339, default the next 24 hours) without recording anything.
+func apiSchedulePreviewHandler(c *gin.Context) {
+	stationID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+	from := time.Now()
+	if s := c.Query("from"); s != "" {
+		if from, err = time.Parse(time.RFC3339, s); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid from, expected RFC 3339"})
+			return
+		}
+	}
+	to := from.Add(24 * time.Hour)
+	if s := c.Query("to"); s != "" {
+		if to, err = time.Parse(time.RFC3339, s); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid to, expected RFC 3339"})
+			return
+		}
+	}
+	if !to.After(from) || to.Sub(from) > 14*24*time.Hour {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "to must be after from and at most 14 days later"})
+		return
+	}
+	engine := &schedule.Engine{DB: db}
+	if c.Query("ads") != "false" {
+		if engine.PodSeconds, err = schedule.PodSeconds(db, stationID, adBreakTarget); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	picks, err := engine.Preview(stationID, from, to)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if picks == nil {
+		picks = []schedule.Pick{}
+	}
+	c.JSON(http.StatusOK, picks)
+}
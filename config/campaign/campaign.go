@@ -0,0 +1,413 @@
+// Package campaign is the ad campaign layer shared by video_server, whose pod
+// builder asks it which commercials may air, and admin_server, which edits
+// campaigns.
+//
+// A campaign groups commercials under a flight (start and end dates), a
+// daypart and days of the week, station include/exclude lists, a per-station
+// frequency cap and a minimum separation between airings of the same ad. Its
+// category keeps competing advertisers from airing back to back. Commercials
+// in no campaign are house ads and may air anywhere.
+package campaign
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	dateLayout = "2006-01-02"
+	timeLayout = "15:04:05"
+	allDays    = 0x7F
+)
+
+// Campaign is one row of ad_campaigns with its commercials and station lists.
+type Campaign struct {
+	ID                   int64   `json:"id"`
+	Name                 string  `json:"name"`
+	Advertiser           string  `json:"advertiser"`
+	Category             string  `json:"category"`
+	StartDate            string  `json:"start_date,omitempty"`
+	EndDate              string  `json:"end_date,omitempty"`
+	DaypartStart         string  `json:"daypart_start,omitempty"`
+	DaypartEnd           string  `json:"daypart_end,omitempty"`
+	DaysOfWeek           int     `json:"days_of_week"`
+	MaxPlaysPerHour      int     `json:"max_plays_per_hour"`
+	MinSeparationSeconds float64 `json:"min_separation_seconds"`
+	Active               bool    `json:"active"`
+	VideoIDs             []int64 `json:"video_ids"`
+	IncludeStations      []int64 `json:"include_stations"`
+	ExcludeStations      []int64 `json:"exclude_stations"`
+}
+
+// Play is a commercial that aired, or is queued to air, on a station.
+type Play struct {
+	VideoID int64
+	At      time.Time
+}
+
+func parseClock(s string) (time.Duration, error) {
+	for _, layout := range []string{timeLayout, "15:04"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid time of day %q, expected HH:MM[:SS]", s)
+}
+
+// Validate normalises defaults and rejects campaigns the rules cannot apply.
+func (c *Campaign) Validate() error {
+	if strings.TrimSpace(c.Name) == "" {
+		return errors.New("name is required")
+	}
+	for _, d := range []string{c.StartDate, c.EndDate} {
+		if d == "" {
+			continue
+		}
+		if _, err := time.Parse(dateLayout, d); err != nil {
+			return fmt.Errorf("invalid date %q: %w", d, err)
+		}
+	}
+	if c.StartDate != "" && c.EndDate != "" && c.EndDate < c.StartDate {
+		return errors.New("end_date is before start_date")
+	}
+	if (c.DaypartStart == "") != (c.DaypartEnd == "") {
+		return errors.New("daypart_start and daypart_end go together")
+	}
+	for _, t := range []string{c.DaypartStart, c.DaypartEnd} {
+		if t == "" {
+			continue
+		}
+		if _, err := parseClock(t); err != nil {
+			return err
+		}
+	}
+	if c.DaysOfWeek == 0 {
+		c.DaysOfWeek = allDays
+	}
+	if c.DaysOfWeek&^allDays != 0 {
+		return errors.New("days_of_week has bits past Saturday (bit 0 = Sunday)")
+	}
+	if c.MaxPlaysPerHour < 0 || c.MinSeparationSeconds < 0 {
+		return errors.New("max_plays_per_hour and min_separation_seconds cannot be negative")
+	}
+	c.Category = strings.ToLower(strings.TrimSpace(c.Category))
+	return nil
+}
+
+// Running reports whether the campaign's flight, days and daypart include at.
+func (c *Campaign) Running(at time.Time) bool {
+	if !c.Active {
+		return false
+	}
+	date := at.Format(dateLayout)
+	if (c.StartDate != "" && date < c.StartDate) || (c.EndDate != "" && date > c.EndDate) {
+		return false
+	}
+	if c.DaysOfWeek&(1<<uint(at.Weekday())) == 0 {
+		return false
+	}
+	if c.DaypartStart == "" {
+		return true
+	}
+	start, _ := parseClock(c.DaypartStart)
+	end, _ := parseClock(c.DaypartEnd)
+	now := time.Duration(at.Hour())*time.Hour + time.Duration(at.Minute())*time.Minute + time.Duration(at.Second())*time.Second
+	if start <= end {
+		return now >= start && now < end
+	}
+	// The daypart wraps past midnight.
+	return now >= start || now < end
+}
+
+// airsOn reports whether the station lists allow stationID.
+func (c *Campaign) airsOn(stationID int64) bool {
+	for _, id := range c.ExcludeStations {
+		if id == stationID {
+			return false
+		}
+	}
+	if len(c.IncludeStations) == 0 {
+		return true
+	}
+	for _, id := range c.IncludeStations {
+		if id == stationID {
+			return true
+		}
+	}
+	return false
+}
+
+const campaignColumns = `id, name, advertiser, category, COALESCE(to_char(start_date, 'YYYY-MM-DD'), ''), COALESCE(to_char(end_date, 'YYYY-MM-DD'), ''),
+	COALESCE(to_char(daypart_start, 'HH24:MI:SS'), ''), COALESCE(to_char(daypart_end, 'HH24:MI:SS'), ''), days_of_week, max_plays_per_hour, min_separation_seconds, active`
+
+func scanCampaign(scan func(...interface{}) error) (Campaign, error) {
+	var c Campaign
+	err := scan(&c.ID, &c.Name, &c.Advertiser, &c.Category, &c.StartDate, &c.EndDate, &c.DaypartStart, &c.DaypartEnd, &c.DaysOfWeek, &c.MaxPlaysPerHour, &c.MinSeparationSeconds, &c.Active)
+	return c, err
+}
+
+func nullString(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// List returns every campaign with its commercials and station lists.
+func List(db *sql.DB) ([]Campaign, error) {
+	rows, err := db.Query(`SELECT ` + campaignColumns + ` FROM ad_campaigns ORDER BY name, id`)
+	if err != nil {
+		return nil, err
+	}
+	var campaigns []Campaign
+	index := make(map[int64]int)
+	for rows.Next() {
+		c, err := scanCampaign(rows.Scan)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		index[c.ID] = len(campaigns)
+		campaigns = append(campaigns, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if err := loadMembers(db, campaigns, index); err != nil {
+		return nil, err
+	}
+	return campaigns, nil
+}
+
+func loadMembers(db *sql.DB, campaigns []Campaign, index map[int64]int) error {
+	rows, err := db.Query(`SELECT campaign_id, video_id FROM ad_campaign_videos ORDER BY campaign_id, video_id`)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var cid, vid int64
+		if err := rows.Scan(&cid, &vid); err != nil {
+			rows.Close()
+			return err
+		}
+		if i, ok := index[cid]; ok {
+			campaigns[i].VideoIDs = append(campaigns[i].VideoIDs, vid)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows, err = db.Query(`SELECT campaign_id, station_id, include FROM ad_campaign_stations ORDER BY campaign_id, station_id`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var cid, sid int64
+		var include bool
+		if err := rows.Scan(&cid, &sid, &include); err != nil {
+			return err
+		}
+		i, ok := index[cid]
+		if !ok {
+			continue
+		}
+		if include {
+			campaigns[i].IncludeStations = append(campaigns[i].IncludeStations, sid)
+		} else {
+			campaigns[i].ExcludeStations = append(campaigns[i].ExcludeStations, sid)
+		}
+	}
+	return rows.Err()
+}
+
+// Get returns one campaign by ID.
+func Get(db *sql.DB, id int64) (Campaign, error) {
+	c, err := scanCampaign(db.QueryRow(`SELECT `+campaignColumns+` FROM ad_campaigns WHERE id = $1`, id).Scan)
+	if err != nil {
+		return c, err
+	}
+	campaigns := []Campaign{c}
+	if err := loadMembers(db, campaigns, map[int64]int{id: 0}); err != nil {
+		return c, err
+	}
+	return campaigns[0], nil
+}
+
+func saveMembers(tx *sql.Tx, c *Campaign) error {
+	if _, err := tx.Exec(`DELETE FROM ad_campaign_videos WHERE campaign_id = $1`, c.ID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM ad_campaign_stations WHERE campaign_id = $1`, c.ID); err != nil {
+		return err
+	}
+	for _, vid := range c.VideoIDs {
+		if _, err := tx.Exec(`INSERT INTO ad_campaign_videos (campaign_id, video_id) VALUES ($1, $2)`, c.ID, vid); err != nil {
+			return fmt.Errorf("video %d: %w", vid, err)
+		}
+	}
+	for _, sid := range c.IncludeStations {
+		if _, err := tx.Exec(`INSERT INTO ad_campaign_stations (campaign_id, station_id, include) VALUES ($1, $2, true)`, c.ID, sid); err != nil {
+			return fmt.Errorf("station %d: %w", sid, err)
+		}
+	}
+	for _, sid := range c.ExcludeStations {
+		if _, err := tx.Exec(`INSERT INTO ad_campaign_stations (campaign_id, station_id, include) VALUES ($1, $2, false)`, c.ID, sid); err != nil {
+			return fmt.Errorf("station %d: %w", sid, err)
+		}
+	}
+	return nil
+}
+
+// Create validates and inserts c, setting its ID.
+func Create(db *sql.DB, c *Campaign) error {
+	if err := c.Validate(); err != nil {
+		return err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	err = tx.QueryRow(
+		`INSERT INTO ad_campaigns (name, advertiser, category, start_date, end_date, daypart_start, daypart_end, days_of_week, max_plays_per_hour, min_separation_seconds, active)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11) RETURNING id`,
+		c.Name, c.Advertiser, c.Category, nullString(c.StartDate), nullString(c.EndDate), nullString(c.DaypartStart), nullString(c.DaypartEnd),
+		c.DaysOfWeek, c.MaxPlaysPerHour, c.MinSeparationSeconds, c.Active,
+	).Scan(&c.ID)
+	if err != nil {
+		return err
+	}
+	if err := saveMembers(tx, c); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Update validates and saves c, replacing its commercials and station lists.
+func Update(db *sql.DB, c *Campaign) error {
+	if err := c.Validate(); err != nil {
+		return err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec(
+		`UPDATE ad_campaigns SET name = $1, advertiser = $2, category = $3, start_date = $4, end_date = $5, daypart_start = $6, daypart_end = $7,
+		 days_of_week = $8, max_plays_per_hour = $9, min_separation_seconds = $10, active = $11 WHERE id = $12`,
+		c.Name, c.Advertiser, c.Category, nullString(c.StartDate), nullString(c.EndDate), nullString(c.DaypartStart), nullString(c.DaypartEnd),
+		c.DaysOfWeek, c.MaxPlaysPerHour, c.MinSeparationSeconds, c.Active, c.ID,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	if err := saveMembers(tx, c); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Delete removes a campaign. Its commercials become house ads.
+func Delete(db *sql.DB, id int64) error {
+	_, err := db.Exec(`DELETE FROM ad_campaigns WHERE id = $1`, id)
+	return err
+}
+
+// Rules answers whether a commercial may air on a station, given what the
+// station has aired recently.
+type Rules struct {
+	stationID int64
+	byVideo   map[int64]*Campaign
+	plays     []Play
+}
+
+// LoadRules loads every campaign and the station's plays over the longest
+// window any rule looks back.
+func LoadRules(db *sql.DB, stationID int64, at time.Time) (*Rules, error) {
+	campaigns, err := List(db)
+	if err != nil {
+		return nil, err
+	}
+	r := &Rules{stationID: stationID, byVideo: make(map[int64]*Campaign)}
+	window := time.Hour
+	for i := range campaigns {
+		c := &campaigns[i]
+		for _, vid := range c.VideoIDs {
+			r.byVideo[vid] = c
+		}
+		if sep := time.Duration(c.MinSeparationSeconds * float64(time.Second)); sep > window {
+			window = sep
+		}
+	}
+	if len(r.byVideo) == 0 {
+		return r, nil
+	}
+	rows, err := db.Query(
+		`SELECT i.video_id, p.created_at FROM ad_pod_items i JOIN ad_pods p ON p.id = i.pod_id
+		 WHERE p.station_id = $1 AND p.created_at >= $2 ORDER BY p.created_at, i.position`,
+		stationID, at.Add(-window))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var p Play
+		if err := rows.Scan(&p.VideoID, &p.At); err != nil {
+			return nil, err
+		}
+		r.plays = append(r.plays, p)
+	}
+	return r, rows.Err()
+}
+
+// Campaign returns the campaign a commercial belongs to, or nil for a house ad.
+func (r *Rules) Campaign(videoID int64) *Campaign {
+	return r.byVideo[videoID]
+}
+
+// Eligible reports whether videoID may air at at, following the station's
+// recent plays and the pod built so far. House ads are always eligible.
+func (r *Rules) Eligible(videoID int64, at time.Time, pod []int64) bool {
+	c := r.byVideo[videoID]
+	if c == nil {
+		return true
+	}
+	if !c.Running(at) || !c.airsOn(r.stationID) {
+		return false
+	}
+	// Competitive separation: not straight after an ad in the same category.
+	if c.Category != "" && len(pod) > 0 {
+		if prev := r.byVideo[pod[len(pod)-1]]; prev != nil && prev.ID != c.ID && prev.Category == c.Category {
+			return false
+		}
+	}
+	sep := time.Duration(c.MinSeparationSeconds * float64(time.Second))
+	hourPlays := 0
+	for _, p := range r.plays {
+		if p.VideoID == videoID && sep > 0 && at.Sub(p.At) < sep {
+			return false
+		}
+		if pc := r.byVideo[p.VideoID]; pc != nil && pc.ID == c.ID && at.Sub(p.At) < time.Hour {
+			hourPlays++
+		}
+	}
+	for _, vid := range pod {
+		if vid == videoID && sep > 0 {
+			return false
+		}
+		if pc := r.byVideo[vid]; pc != nil && pc.ID == c.ID {
+			hourPlays++
+		}
+	}
+	return c.MaxPlaysPerHour == 0 || hourPlays < c.MaxPlaysPerHour
+}
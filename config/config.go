@@ -0,0 +1,509 @@
+// Package config is the configuration shared by video_server, admin_server and
+// user_server. Settings are read from a YAML file and can be overridden with
+// WEBRTC_TV_* environment variables; anything left unset keeps the defaults
+// the servers used to hardcode.
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// EnvConfigPath names the config file to load instead of the default search.
+	EnvConfigPath = "WEBRTC_TV_CONFIG"
+	envPrefix     = "WEBRTC_TV_"
+)
+
+// DefaultPaths is where Load looks for a config file, in order. Each server is
+// started from its own directory, so the shared file normally lives one level up.
+var DefaultPaths = []string{"config.yaml", "../config.yaml"}
+
+type Config struct {
+	Database    DatabaseConfig   `yaml:"database"`
+	Paths       PathsConfig      `yaml:"paths"`
+	VideoServer ServerConfig     `yaml:"video_server"`
+	AdminServer ServerConfig     `yaml:"admin_server"`
+	UserServer  UserServerConfig `yaml:"user_server"`
+	WebRTC      WebRTCConfig     `yaml:"webrtc"`
+	Ads         AdsConfig        `yaml:"ads"`
+	DVR         DVRConfig        `yaml:"dvr"`
+	Output      OutputConfig     `yaml:"output"`
+	path        string
+}
+
+type DatabaseConfig struct {
+	DSN string `yaml:"dsn"`
+}
+
+type PathsConfig struct {
+	VideoBaseDir string `yaml:"video_base_dir"`
+	SegmentDir   string `yaml:"segment_dir"`
+	HLSDir       string `yaml:"hls_dir"`
+	TempDir      string `yaml:"temp_dir"`
+	PublicDir    string `yaml:"public_dir"`
+	AdInsertPath string `yaml:"ad_insert_path"`
+}
+
+type ServerConfig struct {
+	Listen string `yaml:"listen"`
+}
+
+type UserServerConfig struct {
+	Listen    string `yaml:"listen"`
+	SignalURL string `yaml:"signal_url"`
+}
+
+type ICEServer struct {
+	URLs       []string `yaml:"urls" json:"urls"`
+	Username   string   `yaml:"username,omitempty" json:"username,omitempty"`
+	Credential string   `yaml:"credential,omitempty" json:"credential,omitempty"`
+}
+
+// WebRTCConfig controls how peer connections gather candidates. An empty
+// ice_servers list means host candidates only, which is what a LAN-only
+// deployment wants.
+type WebRTCConfig struct {
+	ICEServers           []ICEServer `yaml:"ice_servers"`
+	NetworkTypes         []string    `yaml:"network_types"`
+	IPv6                 bool        `yaml:"ipv6"`
+	UDPPortMin           uint16      `yaml:"udp_port_min"`
+	UDPPortMax           uint16      `yaml:"udp_port_max"`
+	NAT1To1IPs           []string    `yaml:"nat_1to1_ips"`
+	NAT1To1CandidateType string      `yaml:"nat_1to1_candidate_type"`
+	// NACKBufferPackets is how many sent packets per stream are kept to
+	// retransmit on a viewer's NACK: a power of two up to 32768.
+	NACKBufferPackets uint16 `yaml:"nack_buffer_packets"`
+}
+
+// AdsConfig shapes the ad pods video_server inserts at break points. Stations
+// and individual break points can override the target.
+type AdsConfig struct {
+	BreakTargetSeconds    float64 `yaml:"break_target_seconds"`
+	BreakToleranceSeconds float64 `yaml:"break_tolerance_seconds"`
+	// BumperTag names the tag of short station IDs and bumpers used to fill
+	// what commercials leave of a break.
+	BumperTag string `yaml:"bumper_tag"`
+	// DecisionURL is an optional VAST 3/4 or VMAP ad server asked to fill
+	// each break; the internal picker is the fallback when it is empty, fails
+	// or returns nothing playable.
+	DecisionURL            string  `yaml:"decision_url"`
+	DecisionTimeoutSeconds float64 `yaml:"decision_timeout_seconds"`
+	// IngestDir, relative to paths.video_base_dir, is where media files the
+	// ad server returns that are not in the library are downloaded. Empty
+	// skips those ads instead.
+	IngestDir string `yaml:"ingest_dir"`
+	// NoAdsSync keeps the ad-free variant of a station on the same program
+	// timeline as the ad-supported one. Its breaks are filled, for as long as
+	// the main station's pod runs, with NoAdsFiller: "slate" shows SlateImage
+	// (black when empty) over silence, "promos" airs videos tagged PromoTag
+	// and slates whatever they leave.
+	NoAdsSync   bool   `yaml:"no_ads_sync"`
+	NoAdsFiller string `yaml:"no_ads_filler"`
+	SlateImage  string `yaml:"slate_image"`
+	PromoTag    string `yaml:"promo_tag"`
+}
+
+// DVRConfig keeps what each station transmitted on disk so viewers can pause
+// and rewind it. A zero window turns retention off.
+type DVRConfig struct {
+	WindowSeconds float64 `yaml:"window_seconds"`
+	Dir           string  `yaml:"dir"`
+	// QuotaMB caps the retained chunks of all stations together; the oldest
+	// go first. 0 is no cap beyond the window.
+	QuotaMB int64 `yaml:"quota_mb"`
+}
+
+// OutputConfig is the picture every chunk of a station is encoded to, so its
+// SPS, frame rate and RTP cadence stay the same across programs and ads.
+// Stations can override each field. A zero Width keeps every source's native
+// size and frame rate.
+type OutputConfig struct {
+	Width  int    `yaml:"width"`
+	Height int    `yaml:"height"`
+	FPS    string `yaml:"fps"` // "30000/1001" or "25"
+	// Fit is how a source of another aspect ratio fills the frame: "pad"
+	// letterboxes or pillarboxes it, "crop" cuts the overflow and "stretch"
+	// distorts it. Non-square source pixels are corrected first.
+	Fit string `yaml:"fit"`
+	// Renditions are up to two lower-bitrate copies of every chunk, from the
+	// highest down, that viewers on weak links are switched to. Empty sends
+	// everyone the one stream. Unlike the fields above, stations cannot
+	// override them.
+	Renditions []RenditionConfig `yaml:"renditions"`
+}
+
+// RenditionConfig is one lower rung of the ladder: the chunk scaled to
+// Height, keeping its aspect ratio, and capped at MaxrateKbps.
+type RenditionConfig struct {
+	Height      int `yaml:"height"`
+	MaxrateKbps int `yaml:"maxrate_kbps"`
+}
+
+// MaxRenditions is how many renditions processVideo encodes besides the
+// main stream.
+const MaxRenditions = 2
+
+// Output fits.
+const (
+	FitPad     = "pad"
+	FitCrop    = "crop"
+	FitStretch = "stretch"
+)
+
+// ParseFrameRate parses "num/den" or a whole number of frames per second.
+func ParseFrameRate(s string) (int, int, error) {
+	num, den := s, "1"
+	if i := strings.Index(s, "/"); i >= 0 {
+		num, den = s[:i], s[i+1:]
+	}
+	n, err1 := strconv.Atoi(strings.TrimSpace(num))
+	d, err2 := strconv.Atoi(strings.TrimSpace(den))
+	if err1 != nil || err2 != nil || n <= 0 || d <= 0 {
+		return 0, 0, fmt.Errorf("invalid frame rate %q", s)
+	}
+	return n, d, nil
+}
+
+// ValidateOutput checks one output profile, the config's or a station's.
+func ValidateOutput(o OutputConfig) error {
+	if o.Width < 0 || o.Height < 0 || (o.Width == 0) != (o.Height == 0) {
+		return fmt.Errorf("output size %dx%d needs both a width and a height", o.Width, o.Height)
+	}
+	if o.Width%2 != 0 || o.Height%2 != 0 {
+		return fmt.Errorf("output size %dx%d must be even", o.Width, o.Height)
+	}
+	if _, _, err := ParseFrameRate(o.FPS); err != nil {
+		return fmt.Errorf("output fps: %w", err)
+	}
+	switch o.Fit {
+	case FitPad, FitCrop, FitStretch:
+	default:
+		return fmt.Errorf("output fit must be pad, crop or stretch, got %q", o.Fit)
+	}
+	if len(o.Renditions) > MaxRenditions {
+		return fmt.Errorf("output has %d renditions, at most %d are supported", len(o.Renditions), MaxRenditions)
+	}
+	for i, r := range o.Renditions {
+		if r.Height <= 0 || r.Height%2 != 0 || r.MaxrateKbps <= 0 {
+			return fmt.Errorf("output rendition %dp at %dkbps needs an even height and a positive maxrate", r.Height, r.MaxrateKbps)
+		}
+		if i > 0 && (r.Height >= o.Renditions[i-1].Height || r.MaxrateKbps >= o.Renditions[i-1].MaxrateKbps) {
+			return errors.New("output renditions must go from the highest height and maxrate down")
+		}
+	}
+	return nil
+}
+
+// ParseRenditions parses "720:2500,480:1000", height and maxrate in kbps
+// per rendition.
+func ParseRenditions(s string) ([]RenditionConfig, error) {
+	var out []RenditionConfig
+	for _, item := range splitList(s) {
+		h, rate, ok := strings.Cut(item, ":")
+		if !ok {
+			return nil, fmt.Errorf("rendition %q is not height:maxrate_kbps", item)
+		}
+		height, err := strconv.Atoi(h)
+		if err != nil {
+			return nil, fmt.Errorf("rendition %q: %w", item, err)
+		}
+		maxrate, err := strconv.Atoi(rate)
+		if err != nil {
+			return nil, fmt.Errorf("rendition %q: %w", item, err)
+		}
+		out = append(out, RenditionConfig{Height: height, MaxrateKbps: maxrate})
+	}
+	return out, nil
+}
+
+// Default returns the settings the servers ran with before they were
+// configurable.
+func Default() *Config {
+	return &Config{
+		Database: DatabaseConfig{
+			DSN: "user=postgres password=aaaaaaaaaa dbname=webrtc_tv sslmode=disable host=localhost port=5432",
+		},
+		Paths: PathsConfig{
+			VideoBaseDir: "Z:/Videos",
+			SegmentDir:   "./webrtc_segments",
+			HLSDir:       "./hls",
+			TempDir:      "./temp_videos",
+			PublicDir:    "./public",
+			AdInsertPath: "./ad_insert.exe",
+		},
+		VideoServer: ServerConfig{Listen: ":8081"},
+		AdminServer: ServerConfig{Listen: ":8082"},
+		UserServer: UserServerConfig{
+			Listen:    ":80",
+			SignalURL: "http://192.168.0.60:8081/signal",
+		},
+		WebRTC: WebRTCConfig{
+			ICEServers: []ICEServer{
+				{URLs: []string{"stun:stun.l.google.com:19302"}},
+				{URLs: []string{"turn:openrelay.metered.ca:80"}, Username: "openrelayproject", Credential: "openrelayproject"},
+				{URLs: []string{"turn:openrelay.metered.ca:443"}, Username: "openrelayproject", Credential: "openrelayproject"},
+			},
+			NetworkTypes:         []string{"udp4", "tcp4"},
+			NAT1To1CandidateType: "host",
+			NACKBufferPackets:    1024,
+		},
+		Ads: AdsConfig{
+			BreakTargetSeconds:     120,
+			BreakToleranceSeconds:  5,
+			BumperTag:              "bumper",
+			DecisionTimeoutSeconds: 2,
+			NoAdsFiller:            "slate",
+			PromoTag:               "promo",
+		},
+		DVR:    DVRConfig{Dir: "./dvr"},
+		Output: OutputConfig{FPS: "30000/1001", Fit: FitPad},
+	}
+}
+
+// Load reads the config file at path, or the first of $WEBRTC_TV_CONFIG and
+// DefaultPaths that exists when path is empty, then applies environment
+// overrides. A missing file is not an error when path was not given explicitly.
+func Load(path string) (*Config, error) {
+	cfg := Default()
+	explicit := path != ""
+	if !explicit {
+		path = os.Getenv(EnvConfigPath)
+		explicit = path != ""
+	}
+	candidates := []string{path}
+	if !explicit {
+		candidates = DefaultPaths
+	}
+	for _, p := range candidates {
+		data, err := os.ReadFile(p)
+		if errors.Is(err, os.ErrNotExist) && !explicit {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read config %s: %w", p, err)
+		}
+		if err := yaml.Unmarshal(data, cfg); err != nil {
+			return nil, fmt.Errorf("failed to parse config %s: %w", p, err)
+		}
+		cfg.path = p
+		break
+	}
+	if err := cfg.applyEnv(); err != nil {
+		return nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Source reports the file the config was read from, or "defaults".
+func (c *Config) Source() string {
+	if c.path == "" {
+		return "defaults"
+	}
+	return c.path
+}
+
+// applyEnv overrides individual settings from WEBRTC_TV_* variables. List
+// values are comma-separated; WEBRTC_TV_ICE_SERVERS replaces the whole ICE
+// server list with credential-less URLs, and WEBRTC_TV_TURN_USERNAME and
+// WEBRTC_TV_TURN_CREDENTIAL are applied to every turn:/turns: entry.
+func (c *Config) applyEnv() error {
+	str := map[string]*string{
+		"DB_DSN":                  &c.Database.DSN,
+		"VIDEO_BASE_DIR":          &c.Paths.VideoBaseDir,
+		"SEGMENT_DIR":             &c.Paths.SegmentDir,
+		"HLS_DIR":                 &c.Paths.HLSDir,
+		"TEMP_DIR":                &c.Paths.TempDir,
+		"PUBLIC_DIR":              &c.Paths.PublicDir,
+		"AD_INSERT_PATH":          &c.Paths.AdInsertPath,
+		"VIDEO_SERVER_LISTEN":     &c.VideoServer.Listen,
+		"ADMIN_SERVER_LISTEN":     &c.AdminServer.Listen,
+		"USER_SERVER_LISTEN":      &c.UserServer.Listen,
+		"SIGNAL_URL":              &c.UserServer.SignalURL,
+		"NAT_1TO1_CANDIDATE_TYPE": &c.WebRTC.NAT1To1CandidateType,
+		"ADS_BUMPER_TAG":          &c.Ads.BumperTag,
+		"ADS_DECISION_URL":        &c.Ads.DecisionURL,
+		"ADS_INGEST_DIR":          &c.Ads.IngestDir,
+		"ADS_NO_ADS_FILLER":       &c.Ads.NoAdsFiller,
+		"ADS_SLATE_IMAGE":         &c.Ads.SlateImage,
+		"ADS_PROMO_TAG":           &c.Ads.PromoTag,
+		"DVR_DIR":                 &c.DVR.Dir,
+		"OUTPUT_FPS":              &c.Output.FPS,
+		"OUTPUT_FIT":              &c.Output.Fit,
+	}
+	// VIDEO_BASE_DIR predates the shared config and is still honoured.
+	if v, ok := os.LookupEnv("VIDEO_BASE_DIR"); ok && v != "" {
+		c.Paths.VideoBaseDir = v
+	}
+	for name, dst := range str {
+		if v, ok := os.LookupEnv(envPrefix + name); ok {
+			*dst = v
+		}
+	}
+	if v, ok := os.LookupEnv(envPrefix + "NETWORK_TYPES"); ok {
+		c.WebRTC.NetworkTypes = splitList(v)
+	}
+	if v, ok := os.LookupEnv(envPrefix + "OUTPUT_RENDITIONS"); ok {
+		r, err := ParseRenditions(v)
+		if err != nil {
+			return fmt.Errorf("invalid %sOUTPUT_RENDITIONS %q: %w", envPrefix, v, err)
+		}
+		c.Output.Renditions = r
+	}
+	if v, ok := os.LookupEnv(envPrefix + "NAT_1TO1_IPS"); ok {
+		c.WebRTC.NAT1To1IPs = splitList(v)
+	}
+	if v, ok := os.LookupEnv(envPrefix + "ICE_SERVERS"); ok {
+		c.WebRTC.ICEServers = nil
+		for _, url := range splitList(v) {
+			c.WebRTC.ICEServers = append(c.WebRTC.ICEServers, ICEServer{URLs: []string{url}})
+		}
+	}
+	user, hasUser := os.LookupEnv(envPrefix + "TURN_USERNAME")
+	cred, hasCred := os.LookupEnv(envPrefix + "TURN_CREDENTIAL")
+	if hasUser || hasCred {
+		for i, s := range c.WebRTC.ICEServers {
+			if len(s.URLs) > 0 && (strings.HasPrefix(s.URLs[0], "turn:") || strings.HasPrefix(s.URLs[0], "turns:")) {
+				if hasUser {
+					c.WebRTC.ICEServers[i].Username = user
+				}
+				if hasCred {
+					c.WebRTC.ICEServers[i].Credential = cred
+				}
+			}
+		}
+	}
+	if v, ok := os.LookupEnv(envPrefix + "IPV6"); ok {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("invalid %sIPV6 %q: %w", envPrefix, v, err)
+		}
+		c.WebRTC.IPv6 = b
+	}
+	if v, ok := os.LookupEnv(envPrefix + "ADS_NO_ADS_SYNC"); ok {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("invalid %sADS_NO_ADS_SYNC %q: %w", envPrefix, v, err)
+		}
+		c.Ads.NoAdsSync = b
+	}
+	for name, dst := range map[string]*uint16{"UDP_PORT_MIN": &c.WebRTC.UDPPortMin, "UDP_PORT_MAX": &c.WebRTC.UDPPortMax, "NACK_BUFFER_PACKETS": &c.WebRTC.NACKBufferPackets} {
+		if v, ok := os.LookupEnv(envPrefix + name); ok {
+			n, err := strconv.ParseUint(v, 10, 16)
+			if err != nil {
+				return fmt.Errorf("invalid %s%s %q: %w", envPrefix, name, v, err)
+			}
+			*dst = uint16(n)
+		}
+	}
+	for name, dst := range map[string]*float64{"ADS_BREAK_TARGET_SECONDS": &c.Ads.BreakTargetSeconds, "ADS_BREAK_TOLERANCE_SECONDS": &c.Ads.BreakToleranceSeconds, "ADS_DECISION_TIMEOUT_SECONDS": &c.Ads.DecisionTimeoutSeconds, "DVR_WINDOW_SECONDS": &c.DVR.WindowSeconds} {
+		if v, ok := os.LookupEnv(envPrefix + name); ok {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return fmt.Errorf("invalid %s%s %q: %w", envPrefix, name, v, err)
+			}
+			*dst = f
+		}
+	}
+	for name, dst := range map[string]*int{"OUTPUT_WIDTH": &c.Output.Width, "OUTPUT_HEIGHT": &c.Output.Height} {
+		if v, ok := os.LookupEnv(envPrefix + name); ok {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return fmt.Errorf("invalid %s%s %q: %w", envPrefix, name, v, err)
+			}
+			*dst = n
+		}
+	}
+	if v, ok := os.LookupEnv(envPrefix + "DVR_QUOTA_MB"); ok {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid %sDVR_QUOTA_MB %q: %w", envPrefix, v, err)
+		}
+		c.DVR.QuotaMB = n
+	}
+	return nil
+}
+
+func splitList(v string) []string {
+	var out []string
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// Validate checks the settings that would otherwise only fail deep inside a
+// server.
+func (c *Config) Validate() error {
+	if c.Database.DSN == "" {
+		return errors.New("database.dsn is empty")
+	}
+	w := c.WebRTC
+	if (w.UDPPortMin == 0) != (w.UDPPortMax == 0) || w.UDPPortMin > w.UDPPortMax {
+		return fmt.Errorf("webrtc udp port range %d-%d is invalid", w.UDPPortMin, w.UDPPortMax)
+	}
+	for _, nt := range w.NetworkTypes {
+		switch nt {
+		case "udp4", "udp6", "tcp4", "tcp6":
+		default:
+			return fmt.Errorf("unknown webrtc network type %q", nt)
+		}
+	}
+	if len(w.NAT1To1IPs) > 0 && w.NAT1To1CandidateType != "host" && w.NAT1To1CandidateType != "srflx" {
+		return fmt.Errorf("webrtc nat_1to1_candidate_type must be host or srflx, got %q", w.NAT1To1CandidateType)
+	}
+	for _, s := range w.ICEServers {
+		if len(s.URLs) == 0 {
+			return errors.New("webrtc ice server with no urls")
+		}
+	}
+	if w.NACKBufferPackets == 0 || w.NACKBufferPackets&(w.NACKBufferPackets-1) != 0 {
+		return fmt.Errorf("webrtc nack_buffer_packets must be a power of two, got %d", w.NACKBufferPackets)
+	}
+	if c.Ads.BreakTargetSeconds <= 0 || c.Ads.BreakToleranceSeconds < 0 {
+		return fmt.Errorf("ads break target %.1fs ±%.1fs is invalid", c.Ads.BreakTargetSeconds, c.Ads.BreakToleranceSeconds)
+	}
+	if c.Ads.DecisionURL != "" && c.Ads.DecisionTimeoutSeconds <= 0 {
+		return fmt.Errorf("ads.decision_timeout_seconds must be positive, got %v", c.Ads.DecisionTimeoutSeconds)
+	}
+	if c.Ads.NoAdsFiller != "slate" && c.Ads.NoAdsFiller != "promos" {
+		return fmt.Errorf("ads.no_ads_filler must be slate or promos, got %q", c.Ads.NoAdsFiller)
+	}
+	if c.DVR.WindowSeconds < 0 || c.DVR.QuotaMB < 0 {
+		return fmt.Errorf("dvr window %vs and quota %dMB must not be negative", c.DVR.WindowSeconds, c.DVR.QuotaMB)
+	}
+	if c.DVR.WindowSeconds > 0 && c.DVR.Dir == "" {
+		return errors.New("dvr.dir is empty")
+	}
+	return ValidateOutput(c.Output)
+}
+
+// EffectiveNetworkTypes is NetworkTypes with the IPv6 variants added when
+// IPv6 is enabled.
+func (w WebRTCConfig) EffectiveNetworkTypes() []string {
+	types := append([]string(nil), w.NetworkTypes...)
+	if !w.IPv6 {
+		return types
+	}
+	has := make(map[string]bool)
+	for _, t := range types {
+		has[t] = true
+	}
+	for _, t := range w.NetworkTypes {
+		if v6 := strings.TrimSuffix(t, "4") + "6"; strings.HasSuffix(t, "4") && !has[v6] {
+			types = append(types, v6)
+			has[v6] = true
+		}
+	}
+	return types
+}
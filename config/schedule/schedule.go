@@ -0,0 +1,653 @@
+// Package schedule is the time-slot program schedule (EPG) shared by
+// video_server, which asks it what to play next, and admin_server, which edits
+// and previews it.
+//
+// A station's schedule is a set of blocks. Each block airs at a wall-clock
+// start time for a fixed duration, either once or on a recurring rule, and
+// plays a fixed video or episodes of a title. Time a block's content does not
+// fill is covered by filler. Stations without blocks, or moments no block
+// covers, keep looping station_videos.
+package schedule
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+const (
+	RecurrenceOnce     = "once"
+	RecurrenceDaily    = "daily"
+	RecurrenceWeekdays = "weekdays"
+	RecurrenceWeekends = "weekends"
+	RecurrenceWeekly   = "weekly"
+
+	OrderNextUnwatched = "next_unwatched"
+	OrderRandom        = "random"
+
+	FillerAds     = "ads"     // commercials that fit the gap
+	FillerStation = "station" // station_videos that fit the gap
+	FillerNone    = "none"    // start the next block's content early
+
+	dateLayout = "2006-01-02"
+	timeLayout = "15:04:05"
+
+	// An episode may overrun its block by this much before filler is used
+	// instead.
+	overrunTolerance = 120.0
+	// Gaps shorter than this are not worth filling.
+	minFillerGap = 5.0
+	// breakPointMetadataType is metadata_types.id of break_point.
+	breakPointMetadataType = 1
+	// commercialTagID is tags.id of the commercial tag.
+	commercialTagID = 4
+)
+
+// Block is one row of schedule_blocks.
+type Block struct {
+	ID           int64   `json:"id"`
+	StationID    int64   `json:"station_id"`
+	Name         string  `json:"name"`
+	TitleID      *int64  `json:"title_id,omitempty"`
+	VideoID      *int64  `json:"video_id,omitempty"`
+	StartDate    string  `json:"start_date"`
+	EndDate      string  `json:"end_date,omitempty"`
+	StartTime    string  `json:"start_time"`
+	Duration     float64 `json:"duration"`
+	Recurrence   string  `json:"recurrence"`
+	DaysOfWeek   int     `json:"days_of_week"`
+	EpisodeOrder string  `json:"episode_order"`
+	Filler       string  `json:"filler"`
+}
+
+// Slot is one airing of a block.
+type Slot struct {
+	Block Block     `json:"block"`
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+// Pick is the engine's answer to "what airs next".
+type Pick struct {
+	VideoID   int64     `json:"video_id"`
+	Start     time.Time `json:"start"`
+	Duration  float64   `json:"duration"`  // content duration in seconds
+	Estimated float64   `json:"estimated"` // duration including estimated ad pods
+	Filler    bool      `json:"filler"`
+	BlockID   int64     `json:"block_id"`
+	SlotStart time.Time `json:"slot_start"`
+}
+
+// Validate normalises defaults and rejects blocks the engine cannot expand.
+func (b *Block) Validate() error {
+	if b.StationID == 0 {
+		return errors.New("station_id is required")
+	}
+	if (b.TitleID == nil) == (b.VideoID == nil) {
+		return errors.New("exactly one of title_id and video_id is required")
+	}
+	if b.Duration <= 0 {
+		return errors.New("duration must be positive")
+	}
+	if _, err := time.Parse(dateLayout, b.StartDate); err != nil {
+		return fmt.Errorf("invalid start_date %q: %w", b.StartDate, err)
+	}
+	if b.EndDate != "" {
+		if _, err := time.Parse(dateLayout, b.EndDate); err != nil {
+			return fmt.Errorf("invalid end_date %q: %w", b.EndDate, err)
+		}
+	}
+	if _, err := parseClock(b.StartTime); err != nil {
+		return err
+	}
+	if b.Recurrence == "" {
+		b.Recurrence = RecurrenceOnce
+	}
+	switch b.Recurrence {
+	case RecurrenceOnce, RecurrenceDaily, RecurrenceWeekdays, RecurrenceWeekends:
+	case RecurrenceWeekly:
+		if b.DaysOfWeek&0x7F == 0 {
+			return errors.New("weekly blocks need days_of_week (bit 0 = Sunday)")
+		}
+	default:
+		return fmt.Errorf("unknown recurrence %q", b.Recurrence)
+	}
+	if b.EpisodeOrder == "" {
+		b.EpisodeOrder = OrderNextUnwatched
+	}
+	if b.EpisodeOrder != OrderNextUnwatched && b.EpisodeOrder != OrderRandom {
+		return fmt.Errorf("unknown episode_order %q", b.EpisodeOrder)
+	}
+	if b.Filler == "" {
+		b.Filler = FillerAds
+	}
+	if b.Filler != FillerAds && b.Filler != FillerStation && b.Filler != FillerNone {
+		return fmt.Errorf("unknown filler %q", b.Filler)
+	}
+	return nil
+}
+
+func parseClock(s string) (time.Duration, error) {
+	for _, layout := range []string{timeLayout, "15:04"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid start_time %q, expected HH:MM[:SS]", s)
+}
+
+// airsOn reports whether the block has an airing starting on the given day.
+func (b Block) airsOn(day time.Time) bool {
+	date := day.Format(dateLayout)
+	if date < b.StartDate || (b.EndDate != "" && date > b.EndDate) {
+		return false
+	}
+	wd := day.Weekday()
+	switch b.Recurrence {
+	case RecurrenceOnce:
+		return date == b.StartDate
+	case RecurrenceDaily:
+		return true
+	case RecurrenceWeekdays:
+		return wd != time.Saturday && wd != time.Sunday
+	case RecurrenceWeekends:
+		return wd == time.Saturday || wd == time.Sunday
+	case RecurrenceWeekly:
+		return b.DaysOfWeek&(1<<uint(wd)) != 0
+	}
+	return false
+}
+
+// Expand returns the airings of blocks that overlap [from, to), in start
+// order. When airings overlap, the earlier one is cut short where the later
+// one starts.
+func Expand(blocks []Block, from, to time.Time) []Slot {
+	var slots []Slot
+	loc := from.Location()
+	// Start a day early so airings that began yesterday and run past
+	// midnight are included.
+	day := time.Date(from.Year(), from.Month(), from.Day()-1, 0, 0, 0, 0, loc)
+	for ; day.Before(to); day = day.AddDate(0, 0, 1) {
+		for _, b := range blocks {
+			if !b.airsOn(day) {
+				continue
+			}
+			offset, err := parseClock(b.StartTime)
+			if err != nil {
+				continue
+			}
+			// Start times are wall-clock; adding offset to midnight would be
+			// an hour out on days the clocks change.
+			start := time.Date(day.Year(), day.Month(), day.Day(), int(offset/time.Hour), int(offset%time.Hour/time.Minute), int(offset%time.Minute/time.Second), 0, loc)
+			end := start.Add(time.Duration(b.Duration * float64(time.Second)))
+			if end.After(from) && start.Before(to) {
+				slots = append(slots, Slot{Block: b, Start: start, End: end})
+			}
+		}
+	}
+	sort.SliceStable(slots, func(i, j int) bool {
+		return slots[i].Start.Before(slots[j].Start)
+	})
+	for i := 0; i+1 < len(slots); i++ {
+		if slots[i].End.After(slots[i+1].Start) {
+			slots[i].End = slots[i+1].Start
+		}
+	}
+	kept := slots[:0]
+	for _, s := range slots {
+		if s.End.After(s.Start) {
+			kept = append(kept, s)
+		}
+	}
+	return kept
+}
+
+// SlotAt returns the airing covering t, if any.
+func SlotAt(blocks []Block, t time.Time) *Slot {
+	for _, s := range Expand(blocks, t, t.Add(time.Second)) {
+		if !t.Before(s.Start) && t.Before(s.End) {
+			slot := s
+			return &slot
+		}
+	}
+	return nil
+}
+
+// NextSlot returns the first airing starting after t within a week.
+func NextSlot(blocks []Block, t time.Time) *Slot {
+	for _, s := range Expand(blocks, t, t.Add(7*24*time.Hour)) {
+		if s.Start.After(t) {
+			slot := s
+			return &slot
+		}
+	}
+	return nil
+}
+
+const blockColumns = `id, station_id, name, title_id, video_id, to_char(start_date, 'YYYY-MM-DD'), COALESCE(to_char(end_date, 'YYYY-MM-DD'), ''), to_char(start_time, 'HH24:MI:SS'), duration_seconds, recurrence, days_of_week, episode_order, filler`
+
+func scanBlock(scan func(...interface{}) error) (Block, error) {
+	var b Block
+	var titleID, videoID sql.NullInt64
+	err := scan(&b.ID, &b.StationID, &b.Name, &titleID, &videoID, &b.StartDate, &b.EndDate, &b.StartTime, &b.Duration, &b.Recurrence, &b.DaysOfWeek, &b.EpisodeOrder, &b.Filler)
+	if titleID.Valid {
+		b.TitleID = &titleID.Int64
+	}
+	if videoID.Valid {
+		b.VideoID = &videoID.Int64
+	}
+	return b, err
+}
+
+// LoadBlocks returns a station's blocks.
+func LoadBlocks(db *sql.DB, stationID int64) ([]Block, error) {
+	rows, err := db.Query(`SELECT `+blockColumns+` FROM schedule_blocks WHERE station_id = $1 ORDER BY start_time, id`, stationID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var blocks []Block
+	for rows.Next() {
+		b, err := scanBlock(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, b)
+	}
+	return blocks, rows.Err()
+}
+
+// GetBlock returns one block by ID.
+func GetBlock(db *sql.DB, id int64) (Block, error) {
+	return scanBlock(db.QueryRow(`SELECT `+blockColumns+` FROM schedule_blocks WHERE id = $1`, id).Scan)
+}
+
+func nullDate(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// CreateBlock validates and inserts b, setting its ID.
+func CreateBlock(db *sql.DB, b *Block) error {
+	if err := b.Validate(); err != nil {
+		return err
+	}
+	return db.QueryRow(
+		`INSERT INTO schedule_blocks (station_id, name, title_id, video_id, start_date, end_date, start_time, duration_seconds, recurrence, days_of_week, episode_order, filler)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12) RETURNING id`,
+		b.StationID, b.Name, b.TitleID, b.VideoID, b.StartDate, nullDate(b.EndDate), b.StartTime, b.Duration, b.Recurrence, b.DaysOfWeek, b.EpisodeOrder, b.Filler,
+	).Scan(&b.ID)
+}
+
+// UpdateBlock validates and saves b.
+func UpdateBlock(db *sql.DB, b *Block) error {
+	if err := b.Validate(); err != nil {
+		return err
+	}
+	res, err := db.Exec(
+		`UPDATE schedule_blocks SET station_id = $1, name = $2, title_id = $3, video_id = $4, start_date = $5, end_date = $6, start_time = $7,
+		 duration_seconds = $8, recurrence = $9, days_of_week = $10, episode_order = $11, filler = $12 WHERE id = $13`,
+		b.StationID, b.Name, b.TitleID, b.VideoID, b.StartDate, nullDate(b.EndDate), b.StartTime, b.Duration, b.Recurrence, b.DaysOfWeek, b.EpisodeOrder, b.Filler, b.ID,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// DeleteBlock removes a block.
+func DeleteBlock(db *sql.DB, id int64) error {
+	_, err := db.Exec(`DELETE FROM schedule_blocks WHERE id = $1`, id)
+	return err
+}
+
+type video struct {
+	id       int64
+	duration float64
+	breaks   int
+}
+
+// history is what has already aired, as far as picking is concerned.
+type history struct {
+	slotPlays   map[string][]int64 // slot key -> videos picked in that airing
+	lastByTitle map[int64]int64    // title -> last episode picked
+}
+
+func slotKey(blockID int64, start time.Time) string {
+	return fmt.Sprintf("%d@%d", blockID, start.Unix())
+}
+
+func (h *history) record(p Pick, titleID *int64) {
+	key := slotKey(p.BlockID, p.SlotStart)
+	h.slotPlays[key] = append(h.slotPlays[key], p.VideoID)
+	if titleID != nil && !p.Filler {
+		h.lastByTitle[*titleID] = p.VideoID
+	}
+}
+
+// Engine picks videos for scheduled stations.
+type Engine struct {
+	DB *sql.DB
+	// PodSeconds is the expected length of one ad pod, used to estimate
+	// how long an episode occupies the air. Zero for no-ads stations.
+	PodSeconds float64
+	Rand       *rand.Rand
+	videos     map[int64]video
+}
+
+func (e *Engine) loadVideo(id int64) (video, error) {
+	if e.videos == nil {
+		e.videos = make(map[int64]video)
+	}
+	if v, ok := e.videos[id]; ok {
+		return v, nil
+	}
+	v := video{id: id}
+	var dur sql.NullFloat64
+	err := e.DB.QueryRow(
+		`SELECT v.duration, (SELECT COUNT(*) FROM video_metadata vm WHERE vm.video_id = v.id AND vm.metadata_type_id = $2)
+		 FROM videos v WHERE v.id = $1`, id, breakPointMetadataType).Scan(&dur, &v.breaks)
+	if err != nil {
+		return v, fmt.Errorf("video %d: %w", id, err)
+	}
+	v.duration = dur.Float64
+	e.videos[id] = v
+	return v, nil
+}
+
+func (e *Engine) estimate(v video) float64 {
+	return v.duration + float64(v.breaks)*e.PodSeconds
+}
+
+func (e *Engine) idList(query string, args ...interface{}) ([]int64, error) {
+	rows, err := e.DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+func (e *Engine) episodes(titleID int64) ([]int64, error) {
+	return e.idList(`SELECT id FROM videos WHERE title_id = $1 AND duration IS NOT NULL AND duration > 0 ORDER BY uri, id`, titleID)
+}
+
+func (e *Engine) loadHistory(stationID int64, since time.Time) (*history, error) {
+	h := &history{slotPlays: make(map[string][]int64), lastByTitle: make(map[int64]int64)}
+	rows, err := e.DB.Query(
+		`SELECT block_id, slot_start, video_id FROM schedule_plays
+		 WHERE station_id = $1 AND slot_start >= $2 ORDER BY id`, stationID, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var blockID, videoID int64
+		var slotStart time.Time
+		if err := rows.Scan(&blockID, &slotStart, &videoID); err != nil {
+			return nil, err
+		}
+		key := slotKey(blockID, slotStart)
+		h.slotPlays[key] = append(h.slotPlays[key], videoID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows2, err := e.DB.Query(
+		`SELECT DISTINCT ON (v.title_id) v.title_id, p.video_id FROM schedule_plays p JOIN videos v ON v.id = p.video_id
+		 WHERE p.station_id = $1 AND NOT p.filler ORDER BY v.title_id, p.id DESC`, stationID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows2.Close()
+	for rows2.Next() {
+		var titleID, videoID int64
+		if err := rows2.Scan(&titleID, &videoID); err != nil {
+			return nil, err
+		}
+		h.lastByTitle[titleID] = videoID
+	}
+	return h, rows2.Err()
+}
+
+// Next returns what station should air starting at t, or nil if no block
+// covers t and the caller should fall back to looping station_videos. With
+// commit the pick is recorded in schedule_plays, so the next call moves on.
+func (e *Engine) Next(stationID int64, t time.Time, commit bool) (*Pick, error) {
+	blocks, err := LoadBlocks(e.DB, stationID)
+	if err != nil || len(blocks) == 0 {
+		return nil, err
+	}
+	h, err := e.loadHistory(stationID, t.Add(-48*time.Hour))
+	if err != nil {
+		return nil, err
+	}
+	pick, slot, err := e.next(stationID, blocks, h, t)
+	if err != nil || pick == nil {
+		return nil, err
+	}
+	if commit {
+		if _, err := e.DB.Exec(
+			`INSERT INTO schedule_plays (station_id, block_id, slot_start, video_id, filler, starts_at) VALUES ($1, $2, $3, $4, $5, $6)`,
+			stationID, pick.BlockID, pick.SlotStart, pick.VideoID, pick.Filler, pick.Start); err != nil {
+			return nil, fmt.Errorf("failed to record schedule play: %w", err)
+		}
+		h.record(*pick, slot.Block.TitleID)
+	}
+	return pick, nil
+}
+
+// Planner answers successive "what airs at t" questions for one station
+// against an in-memory copy of the play history, so callers can simulate the
+// schedule without recording anything.
+type Planner struct {
+	e         *Engine
+	stationID int64
+	blocks    []Block
+	h         *history
+}
+
+// Planner loads a station's blocks and the history leading up to from.
+func (e *Engine) Planner(stationID int64, from time.Time) (*Planner, error) {
+	blocks, err := LoadBlocks(e.DB, stationID)
+	if err != nil {
+		return nil, err
+	}
+	p := &Planner{e: e, stationID: stationID, blocks: blocks}
+	if len(blocks) == 0 {
+		return p, nil
+	}
+	if p.h, err = e.loadHistory(stationID, from.Add(-48*time.Hour)); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Next returns what airs starting at t, or nil if no block covers t. The pick
+// is remembered so the following call moves on.
+func (p *Planner) Next(t time.Time) (*Pick, error) {
+	if len(p.blocks) == 0 {
+		return nil, nil
+	}
+	pick, slot, err := p.e.next(p.stationID, p.blocks, p.h, t)
+	if err != nil || pick == nil {
+		return nil, err
+	}
+	p.h.record(*pick, slot.Block.TitleID)
+	return pick, nil
+}
+
+// NextSlot returns the first airing starting after t within a week.
+func (p *Planner) NextSlot(t time.Time) *Slot {
+	return NextSlot(p.blocks, t)
+}
+
+// Preview simulates the schedule over [from, to) without recording anything.
+// Gaps no block covers are returned as nothing; the live station loops
+// station_videos there.
+func (e *Engine) Preview(stationID int64, from, to time.Time) ([]Pick, error) {
+	p, err := e.Planner(stationID, from)
+	if err != nil {
+		return nil, err
+	}
+	var picks []Pick
+	t := from
+	for t.Before(to) && len(picks) < 10000 {
+		pick, err := p.Next(t)
+		if err != nil {
+			return picks, err
+		}
+		if pick == nil {
+			next := p.NextSlot(t)
+			if next == nil || !next.Start.Before(to) {
+				break
+			}
+			t = next.Start
+			continue
+		}
+		picks = append(picks, *pick)
+		t = t.Add(time.Duration(pick.Estimated * float64(time.Second)))
+	}
+	return picks, nil
+}
+
+func (e *Engine) rng() *rand.Rand {
+	if e.Rand == nil {
+		e.Rand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	return e.Rand
+}
+
+func (e *Engine) next(stationID int64, blocks []Block, h *history, t time.Time) (*Pick, *Slot, error) {
+	slot := SlotAt(blocks, t)
+	if slot == nil {
+		return nil, nil, nil
+	}
+	remaining := slot.End.Sub(t).Seconds()
+	played := h.slotPlays[slotKey(slot.Block.ID, slot.Start)]
+	content, err := e.content(slot.Block, h, len(played) > 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	if content != nil {
+		est := e.estimate(*content)
+		if len(played) == 0 || est <= remaining+overrunTolerance {
+			return e.pick(*content, t, slot, false), slot, nil
+		}
+	}
+	if remaining >= minFillerGap && slot.Block.Filler != FillerNone {
+		filler, err := e.filler(stationID, slot.Block.Filler, remaining)
+		if err != nil {
+			return nil, nil, err
+		}
+		if filler != nil {
+			return e.pick(*filler, t, slot, true), slot, nil
+		}
+	}
+	// Nothing fits the rest of this airing: start whatever comes next.
+	next := NextSlot(blocks, t)
+	if next == nil || next.Start.After(slot.End.Add(time.Second)) {
+		return nil, nil, nil
+	}
+	content, err = e.content(next.Block, h, len(h.slotPlays[slotKey(next.Block.ID, next.Start)]) > 0)
+	if err != nil || content == nil {
+		return nil, nil, err
+	}
+	return e.pick(*content, t, next, false), next, nil
+}
+
+func (e *Engine) pick(v video, t time.Time, slot *Slot, filler bool) *Pick {
+	return &Pick{
+		VideoID:   v.id,
+		Start:     t,
+		Duration:  v.duration,
+		Estimated: e.estimate(v),
+		Filler:    filler,
+		BlockID:   slot.Block.ID,
+		SlotStart: slot.Start,
+	}
+}
+
+// content returns the block's next video. A fixed-video block has nothing
+// more to offer once it has aired in this slot.
+func (e *Engine) content(b Block, h *history, alreadyPlayed bool) (*video, error) {
+	if b.VideoID != nil {
+		if alreadyPlayed {
+			return nil, nil
+		}
+		v, err := e.loadVideo(*b.VideoID)
+		return &v, err
+	}
+	eps, err := e.episodes(*b.TitleID)
+	if err != nil || len(eps) == 0 {
+		return nil, err
+	}
+	next := eps[0]
+	switch b.EpisodeOrder {
+	case OrderRandom:
+		next = eps[e.rng().Intn(len(eps))]
+	default:
+		if last, ok := h.lastByTitle[*b.TitleID]; ok {
+			for i, id := range eps {
+				if id == last {
+					next = eps[(i+1)%len(eps)]
+					break
+				}
+			}
+		}
+	}
+	v, err := e.loadVideo(next)
+	return &v, err
+}
+
+// filler returns a random video no longer than gap seconds.
+func (e *Engine) filler(stationID int64, mode string, gap float64) (*video, error) {
+	var ids []int64
+	var err error
+	if mode == FillerStation {
+		ids, err = e.idList(
+			`SELECT sv.video_id FROM station_videos sv JOIN videos v ON v.id = sv.video_id
+			 WHERE sv.station_id = $1 AND v.duration > 0 AND v.duration <= $2
+			 AND NOT EXISTS (SELECT 1 FROM video_tags vt WHERE vt.video_id = v.id AND vt.tag_id = $3)`,
+			stationID, gap, commercialTagID)
+	} else {
+		ids, err = e.idList(
+			`SELECT v.id FROM videos v JOIN video_tags vt ON vt.video_id = v.id
+			 WHERE vt.tag_id = $2 AND v.duration > 0 AND v.duration <= $1`,
+			gap, commercialTagID)
+	}
+	if err != nil || len(ids) == 0 {
+		return nil, err
+	}
+	v, err := e.loadVideo(ids[e.rng().Intn(len(ids))])
+	return &v, err
+}
+
+// PodSeconds returns the station's ad break target length, or fallback when
+// the station does not set one.
+func PodSeconds(db *sql.DB, stationID int64, fallback float64) (float64, error) {
+	var target sql.NullFloat64
+	if err := db.QueryRow(`SELECT ad_break_target_seconds FROM stations WHERE id = $1`, stationID).Scan(&target); err != nil {
+		return 0, err
+	}
+	if target.Valid && target.Float64 > 0 {
+		return target.Float64, nil
+	}
+	return fallback, nil
+}
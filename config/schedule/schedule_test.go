@@ -0,0 +1,146 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+	_ "time/tzdata"
+)
+
+func newYork(t *testing.T) *time.Location {
+	t.Helper()
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatalf("LoadLocation: %v", err)
+	}
+	return loc
+}
+
+func daily(id int64, start string, hours float64) Block {
+	return Block{ID: id, StartDate: "2026-01-01", StartTime: start, Duration: hours * 3600, Recurrence: RecurrenceDaily}
+}
+
+// slotTimes formats slots as "block start-end" in loc for comparison.
+func slotTimes(slots []Slot, loc *time.Location) []string {
+	var out []string
+	for _, s := range slots {
+		out = append(out, s.Start.In(loc).Format("Jan 2 15:04 MST")+" - "+s.End.In(loc).Format("Jan 2 15:04 MST"))
+	}
+	return out
+}
+
+func TestExpand(t *testing.T) {
+	ny := newYork(t)
+	at := func(month time.Month, day, hour, min int) time.Time {
+		return time.Date(2026, month, day, hour, min, 0, 0, ny)
+	}
+	weekdays := daily(3, "23:00", 2)
+	weekdays.Recurrence = RecurrenceWeekdays
+	once := Block{ID: 4, StartDate: "2026-06-10", StartTime: "23:30", Duration: 3600, Recurrence: RecurrenceOnce}
+	ended := daily(5, "12:00", 1)
+	ended.EndDate = "2026-06-09"
+	tests := []struct {
+		name     string
+		blocks   []Block
+		from, to time.Time
+		want     []string
+	}{
+		{
+			"airing from yesterday runs past midnight",
+			[]Block{daily(1, "23:00", 2)},
+			at(time.June, 10, 0, 30), at(time.June, 10, 3, 0),
+			[]string{"Jun 9 23:00 EDT - Jun 10 01:00 EDT"},
+		},
+		{
+			"airing across midnight into the window",
+			[]Block{daily(1, "23:00", 2)},
+			at(time.June, 10, 22, 0), at(time.June, 11, 0, 30),
+			[]string{"Jun 10 23:00 EDT - Jun 11 01:00 EDT"},
+		},
+		{
+			"earlier airing is cut where a later one starts",
+			[]Block{daily(2, "22:00", 3), once},
+			at(time.June, 10, 21, 0), at(time.June, 11, 2, 0),
+			[]string{"Jun 10 22:00 EDT - Jun 10 23:30 EDT", "Jun 10 23:30 EDT - Jun 11 00:30 EDT"},
+		},
+		{
+			"friday night weekday block runs into saturday",
+			[]Block{weekdays},
+			at(time.June, 13, 0, 0), at(time.June, 14, 0, 0),
+			[]string{"Jun 12 23:00 EDT - Jun 13 01:00 EDT"},
+		},
+		{
+			"nothing after end_date",
+			[]Block{ended},
+			at(time.June, 9, 0, 0), at(time.June, 11, 0, 0),
+			[]string{"Jun 9 12:00 EDT - Jun 9 13:00 EDT"},
+		},
+		{
+			"spring forward keeps wall-clock start times",
+			[]Block{daily(1, "20:00", 1)},
+			at(time.March, 7, 0, 0), at(time.March, 10, 0, 0),
+			[]string{"Mar 7 20:00 EST - Mar 7 21:00 EST", "Mar 8 20:00 EDT - Mar 8 21:00 EDT", "Mar 9 20:00 EDT - Mar 9 21:00 EDT"},
+		},
+		{
+			"fall back keeps wall-clock start times",
+			[]Block{daily(1, "20:00", 1)},
+			at(time.October, 31, 0, 0), at(time.November, 3, 0, 0),
+			[]string{"Oct 31 20:00 EDT - Oct 31 21:00 EDT", "Nov 1 20:00 EST - Nov 1 21:00 EST", "Nov 2 20:00 EST - Nov 2 21:00 EST"},
+		},
+		{
+			"block spanning the change lasts its duration",
+			[]Block{daily(1, "00:00", 4)},
+			at(time.November, 1, 0, 0), at(time.November, 1, 12, 0),
+			[]string{"Nov 1 00:00 EDT - Nov 1 03:00 EST"},
+		},
+	}
+	for _, tt := range tests {
+		got := slotTimes(Expand(tt.blocks, tt.from, tt.to), ny)
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("%s: slot %d = %s, want %s", tt.name, i, got[i], tt.want[i])
+			}
+		}
+	}
+}
+
+func TestSlotAtAndNextSlot(t *testing.T) {
+	ny := newYork(t)
+	at := func(month time.Month, day, hour, min int) time.Time {
+		return time.Date(2026, month, day, hour, min, 0, 0, ny)
+	}
+	blocks := []Block{daily(1, "20:00", 1), daily(2, "23:30", 1)}
+	tests := []struct {
+		name     string
+		t        time.Time
+		slotAt   string // "" for none
+		nextSlot string
+	}{
+		{"inside the evening block", at(time.March, 8, 20, 30), "Mar 8 20:00 EDT - Mar 8 21:00 EDT", "Mar 8 23:30 EDT - Mar 9 00:30 EDT"},
+		{"an hour late on DST day is outside it", at(time.March, 8, 21, 30), "", "Mar 8 23:30 EDT - Mar 9 00:30 EDT"},
+		{"after midnight in the late block", at(time.March, 9, 0, 15), "Mar 8 23:30 EDT - Mar 9 00:30 EDT", "Mar 9 20:00 EDT - Mar 9 21:00 EDT"},
+		{"at a block's start", at(time.November, 1, 20, 0), "Nov 1 20:00 EST - Nov 1 21:00 EST", "Nov 1 23:30 EST - Nov 2 00:30 EST"},
+	}
+	for _, tt := range tests {
+		var got string
+		if s := SlotAt(blocks, tt.t); s != nil {
+			got = slotTimes([]Slot{*s}, ny)[0]
+		}
+		if got != tt.slotAt {
+			t.Errorf("%s: SlotAt = %q, want %q", tt.name, got, tt.slotAt)
+		}
+		got = ""
+		if s := NextSlot(blocks, tt.t); s != nil {
+			got = slotTimes([]Slot{*s}, ny)[0]
+		}
+		if got != tt.nextSlot {
+			t.Errorf("%s: NextSlot = %q, want %q", tt.name, got, tt.nextSlot)
+		}
+	}
+	if s := NextSlot(nil, at(time.March, 8, 0, 0)); s != nil {
+		t.Errorf("NextSlot with no blocks = %v, want nil", s)
+	}
+}
@@ -0,0 +1,161 @@
+// Package schema creates the tables that were added after misc/database.sql
+// was dumped. admin_server and video_server call Ensure at startup; the
+// statements are idempotent so it does not matter which one runs first.
+// user_server only reads the stations table, which the dump already has.
+package schema
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+var statements = []string{
+	// Playback position of each ad-supported station, so a restart resumes
+	// where viewers left off instead of recomputing from stations.unix_start.
+	`CREATE TABLE IF NOT EXISTS station_state (
+		station_id bigint PRIMARY KEY REFERENCES stations(id) ON DELETE CASCADE,
+		current_video bigint NOT NULL,
+		current_index integer NOT NULL,
+		current_offset double precision NOT NULL,
+		ad_seconds double precision NOT NULL DEFAULT 0,
+		video_rtp_ts bigint NOT NULL DEFAULT 0,
+		audio_rtp_ts bigint NOT NULL DEFAULT 0,
+		saved_at timestamptz NOT NULL DEFAULT now()
+	)`,
+	// Time-slot program schedule. A block airs at start_time on the days its
+	// recurrence selects between start_date and end_date, and plays either a
+	// fixed video or episodes of a title.
+	`CREATE TABLE IF NOT EXISTS schedule_blocks (
+		id bigserial PRIMARY KEY,
+		station_id bigint NOT NULL REFERENCES stations(id) ON DELETE CASCADE,
+		name text NOT NULL DEFAULT '',
+		title_id bigint REFERENCES titles(id) ON DELETE CASCADE,
+		video_id bigint REFERENCES videos(id) ON DELETE CASCADE,
+		start_date date NOT NULL,
+		end_date date,
+		start_time time NOT NULL,
+		duration_seconds double precision NOT NULL,
+		recurrence text NOT NULL DEFAULT 'once',
+		days_of_week integer NOT NULL DEFAULT 0,
+		episode_order text NOT NULL DEFAULT 'next_unwatched',
+		filler text NOT NULL DEFAULT 'ads',
+		created_at timestamptz NOT NULL DEFAULT now()
+	)`,
+	`CREATE INDEX IF NOT EXISTS schedule_blocks_station_idx ON schedule_blocks (station_id)`,
+	// What the schedule engine picked for each airing, so episodes advance
+	// across airings and restarts.
+	`CREATE TABLE IF NOT EXISTS schedule_plays (
+		id bigserial PRIMARY KEY,
+		station_id bigint NOT NULL REFERENCES stations(id) ON DELETE CASCADE,
+		block_id bigint NOT NULL REFERENCES schedule_blocks(id) ON DELETE CASCADE,
+		slot_start timestamptz NOT NULL,
+		video_id bigint NOT NULL REFERENCES videos(id) ON DELETE CASCADE,
+		filler boolean NOT NULL DEFAULT false,
+		starts_at timestamptz NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS schedule_plays_station_idx ON schedule_plays (station_id, slot_start)`,
+	// Per-station ad break length; NULL uses the ads section of the config.
+	`ALTER TABLE stations ADD COLUMN IF NOT EXISTS ad_break_target_seconds double precision`,
+	`ALTER TABLE stations ADD COLUMN IF NOT EXISTS ad_break_tolerance_seconds double precision`,
+	// Per-station output profile; NULL columns use the output section of the
+	// config.
+	`ALTER TABLE stations ADD COLUMN IF NOT EXISTS output_width integer`,
+	`ALTER TABLE stations ADD COLUMN IF NOT EXISTS output_height integer`,
+	`ALTER TABLE stations ADD COLUMN IF NOT EXISTS output_fps text`,
+	`ALTER TABLE stations ADD COLUMN IF NOT EXISTS output_fit text`,
+	// Every ad pod video_server built, with the commercials and bumpers in it.
+	`CREATE TABLE IF NOT EXISTS ad_pods (
+		id bigserial PRIMARY KEY,
+		station_id bigint NOT NULL REFERENCES stations(id) ON DELETE CASCADE,
+		video_id bigint NOT NULL REFERENCES videos(id) ON DELETE CASCADE,
+		break_time double precision NOT NULL,
+		target_seconds double precision NOT NULL,
+		tolerance_seconds double precision NOT NULL,
+		planned_seconds double precision NOT NULL,
+		queued_seconds double precision NOT NULL,
+		created_at timestamptz NOT NULL DEFAULT now()
+	)`,
+	`CREATE INDEX IF NOT EXISTS ad_pods_station_idx ON ad_pods (station_id, created_at)`,
+	`CREATE TABLE IF NOT EXISTS ad_pod_items (
+		pod_id bigint NOT NULL REFERENCES ad_pods(id) ON DELETE CASCADE,
+		position integer NOT NULL,
+		video_id bigint NOT NULL REFERENCES videos(id) ON DELETE CASCADE,
+		duration double precision NOT NULL,
+		bumper boolean NOT NULL DEFAULT false,
+		PRIMARY KEY (pod_id, position)
+	)`,
+	// Ad campaigns. A commercial belongs to at most one campaign; those in
+	// none are house ads. NULL dates and dayparts leave that side open.
+	`CREATE TABLE IF NOT EXISTS ad_campaigns (
+		id bigserial PRIMARY KEY,
+		name text NOT NULL,
+		advertiser text NOT NULL DEFAULT '',
+		category text NOT NULL DEFAULT '',
+		start_date date,
+		end_date date,
+		daypart_start time,
+		daypart_end time,
+		days_of_week integer NOT NULL DEFAULT 127,
+		max_plays_per_hour integer NOT NULL DEFAULT 0,
+		min_separation_seconds double precision NOT NULL DEFAULT 0,
+		active boolean NOT NULL DEFAULT true,
+		created_at timestamptz NOT NULL DEFAULT now()
+	)`,
+	`CREATE TABLE IF NOT EXISTS ad_campaign_videos (
+		campaign_id bigint NOT NULL REFERENCES ad_campaigns(id) ON DELETE CASCADE,
+		video_id bigint NOT NULL UNIQUE REFERENCES videos(id) ON DELETE CASCADE,
+		PRIMARY KEY (campaign_id, video_id)
+	)`,
+	`CREATE TABLE IF NOT EXISTS ad_campaign_stations (
+		campaign_id bigint NOT NULL REFERENCES ad_campaigns(id) ON DELETE CASCADE,
+		station_id bigint NOT NULL REFERENCES stations(id) ON DELETE CASCADE,
+		include boolean NOT NULL,
+		PRIMARY KEY (campaign_id, station_id)
+	)`,
+	// Metadata the contextual ad targeting matches programs and commercials on.
+	// Values are a JSON string or number, or an array of them.
+	`INSERT INTO metadata_types (name, description)
+		SELECT v.name, v.description FROM (VALUES
+			('year', 'Year the title or commercial is from, e.g. 1997, or a decade such as "1990s".'),
+			('country', 'ISO country code(s) the title or commercial was made for, e.g. "US".'),
+			('platform', 'Console or platform, e.g. "N64" or "PS2". Commercials default to their Commercials/<platform>/ folder.')
+		) AS v(name, description)
+		WHERE NOT EXISTS (SELECT 1 FROM metadata_types mt WHERE mt.name = v.name)`,
+	// As-run log: every chunk video_server's sender transmitted, one row per
+	// program segment or ad. Station and video are copied rather than
+	// referenced so the log outlives library changes.
+	`CREATE TABLE IF NOT EXISTS as_run (
+		id bigserial PRIMARY KEY,
+		station_id bigint NOT NULL,
+		station_name text NOT NULL,
+		ads_enabled boolean NOT NULL,
+		video_id bigint NOT NULL,
+		is_ad boolean NOT NULL,
+		pod_id bigint REFERENCES ad_pods(id) ON DELETE SET NULL,
+		source_in double precision NOT NULL,
+		source_out double precision NOT NULL,
+		started_at timestamptz NOT NULL,
+		ended_at timestamptz NOT NULL,
+		viewers integer NOT NULL,
+		completed boolean NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS as_run_station_idx ON as_run (station_id, started_at)`,
+	`CREATE INDEX IF NOT EXISTS as_run_started_idx ON as_run (started_at)`,
+	// Ad reach, counted from the viewers' peer connections; NULL for programs.
+	// campaign_id is the commercial's campaign when it aired.
+	`ALTER TABLE as_run ADD COLUMN IF NOT EXISTS campaign_id bigint`,
+	`ALTER TABLE as_run ADD COLUMN IF NOT EXISTS peers_at_start integer`,
+	`ALTER TABLE as_run ADD COLUMN IF NOT EXISTS reached integer`,
+	`ALTER TABLE as_run ADD COLUMN IF NOT EXISTS completed_views integer`,
+	`ALTER TABLE as_run ADD COLUMN IF NOT EXISTS dropped integer`,
+}
+
+// Ensure creates any missing tables.
+func Ensure(db *sql.DB) error {
+	for _, stmt := range statements {
+		if _, err := db.Exec(stmt); err != nil {
+			return fmt.Errorf("schema: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+// vast_stub is a minimal local VAST 4 / VMAP ad server for exercising
+// video_server's ad decisioning (ads.decision_url). It serves the video files
+// of one directory as ads and logs every tracking request it receives.
+//
+//   go run vast_stub.go -media "Z:/Videos/Commercials/N64" -addr :8090
+//
+// Endpoints:
+//   /vast?dur=120          a pod of ads filling up to dur seconds
+//   /wrapper?dur=120       a wrapper pointing at /vast
+//   /vmap?breaks=300,600   a VMAP with a break at each offset (seconds)
+//   /media/<file>          the ad files themselves
+//   /track                 tracking beacon; logs its query
+package main
+
+import (
+    "encoding/xml"
+    "flag"
+    "fmt"
+    "log"
+    "math/rand"
+    "net/http"
+    "net/url"
+    "os"
+    "os/exec"
+    "path/filepath"
+    "strconv"
+    "strings"
+)
+
+type stubAd struct {
+    name string
+    dur float64
+}
+
+var (
+    addr = flag.String("addr", ":8090", "listen address")
+    mediaDir = flag.String("media", ".", "directory of ad video files")
+    baseURL = flag.String("base", "", "public base URL of this server (default http://localhost<addr>)")
+    ads []stubAd
+)
+
+func probeDuration(path string) float64 {
+    out, err := exec.Command("ffprobe", "-v", "error", "-show_entries", "format=duration", "-of", "default=noprint_wrappers=1:nokey=1", path).Output()
+    if err != nil {
+        return 0
+    }
+    d, _ := strconv.ParseFloat(strings.TrimSpace(string(out)), 64)
+    return d
+}
+
+func vastTime(sec float64) string {
+    ms := int(sec*1000 + 0.5)
+    return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
+
+func esc(s string) string {
+    var b strings.Builder
+    xml.EscapeText(&b, []byte(s))
+    return b.String()
+}
+
+func trackURL(ad, event string) string {
+    return esc(*baseURL + "/track?ad=" + url.QueryEscape(ad) + "&event=" + event + "&t=[TIMESTAMP]&cb=[CACHEBUSTING]")
+}
+
+func podDuration(r *http.Request) float64 {
+    dur, err := strconv.ParseFloat(r.URL.Query().Get("dur"), 64)
+    if err != nil || dur <= 0 {
+        dur = 120
+    }
+    return dur
+}
+
+// vastPod picks ads at random until dur is filled.
+func vastPod(dur float64) string {
+    var b strings.Builder
+    b.WriteString(`<VAST version="4.0">`)
+    total := 0.0
+    seq := 1
+    for _, i := range rand.Perm(len(ads)) {
+        ad := ads[i]
+        if total+ad.dur > dur {
+            continue
+        }
+        total += ad.dur
+        id := strings.TrimSuffix(ad.name, filepath.Ext(ad.name))
+        fmt.Fprintf(&b, `<Ad id="%s" sequence="%d"><InLine><AdSystem>vast_stub</AdSystem><AdTitle>%s</AdTitle>`, esc(id), seq, esc(id))
+        fmt.Fprintf(&b, `<Impression><![CDATA[%s]]></Impression>`, *baseURL+"/track?ad="+url.QueryEscape(id)+"&event=impression")
+        fmt.Fprintf(&b, `<Error><![CDATA[%s]]></Error>`, *baseURL+"/track?ad="+url.QueryEscape(id)+"&event=error&code=[ERRORCODE]")
+        fmt.Fprintf(&b, `<Creatives><Creative><Linear><Duration>%s</Duration><TrackingEvents>`, vastTime(ad.dur))
+        for _, ev := range []string{"creativeView", "start", "firstQuartile", "midpoint", "thirdQuartile", "complete"} {
+            fmt.Fprintf(&b, `<Tracking event="%s">%s</Tracking>`, ev, trackURL(id, ev))
+        }
+        fmt.Fprintf(&b, `</TrackingEvents><MediaFiles><MediaFile delivery="progressive" type="video/mp4">%s</MediaFile></MediaFiles>`, esc(*baseURL+"/media/"+url.PathEscape(ad.name)))
+        b.WriteString(`</Linear></Creative></Creatives></InLine></Ad>`)
+        seq++
+    }
+    b.WriteString(`</VAST>`)
+    return b.String()
+}
+
+func writeXML(w http.ResponseWriter, body string) {
+    w.Header().Set("Content-Type", "application/xml")
+    fmt.Fprint(w, xml.Header+body)
+}
+
+func main() {
+    flag.Parse()
+    if *baseURL == "" {
+        *baseURL = "http://localhost" + *addr
+    }
+    entries, err := os.ReadDir(*mediaDir)
+    if err != nil {
+        log.Fatalf("Failed to read %s: %v", *mediaDir, err)
+    }
+    for _, e := range entries {
+        if e.IsDir() {
+            continue
+        }
+        if d := probeDuration(filepath.Join(*mediaDir, e.Name())); d > 0 {
+            ads = append(ads, stubAd{name: e.Name(), dur: d})
+            log.Printf("Ad %s: %.3fs", e.Name(), d)
+        }
+    }
+    if len(ads) == 0 {
+        log.Fatalf("No video files with a duration in %s", *mediaDir)
+    }
+    http.HandleFunc("/vast", func(w http.ResponseWriter, r *http.Request) {
+        log.Printf("VAST request: %s", r.URL.RawQuery)
+        writeXML(w, vastPod(podDuration(r)))
+    })
+    http.HandleFunc("/wrapper", func(w http.ResponseWriter, r *http.Request) {
+        log.Printf("Wrapper request: %s", r.URL.RawQuery)
+        inner := fmt.Sprintf("%s/vast?dur=%g", *baseURL, podDuration(r))
+        writeXML(w, fmt.Sprintf(`<VAST version="4.0"><Ad id="wrapper"><Wrapper><AdSystem>vast_stub</AdSystem><VASTAdTagURI><![CDATA[%s]]></VASTAdTagURI><Impression><![CDATA[%s]]></Impression></Wrapper></Ad></VAST>`,
+            inner, *baseURL+"/track?ad=wrapper&event=impression"))
+    })
+    http.HandleFunc("/vmap", func(w http.ResponseWriter, r *http.Request) {
+        log.Printf("VMAP request: %s", r.URL.RawQuery)
+        var b strings.Builder
+        b.WriteString(`<vmap:VMAP xmlns:vmap="http://www.iab.net/videosuite/vmap" version="1.0">`)
+        for i, s := range strings.Split(r.URL.Query().Get("breaks"), ",") {
+            sec, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+            if err != nil {
+                continue
+            }
+            fmt.Fprintf(&b, `<vmap:AdBreak timeOffset="%s" breakType="linear" breakId="break%d"><vmap:AdSource id="pod%d"><vmap:VASTAdData>%s</vmap:VASTAdData></vmap:AdSource></vmap:AdBreak>`,
+                vastTime(sec), i+1, i+1, vastPod(podDuration(r)))
+        }
+        b.WriteString(`</vmap:VMAP>`)
+        writeXML(w, b.String())
+    })
+    http.Handle("/media/", http.StripPrefix("/media/", http.FileServer(http.Dir(*mediaDir))))
+    http.HandleFunc("/track", func(w http.ResponseWriter, r *http.Request) {
+        log.Printf("Tracking: %s", r.URL.RawQuery)
+        w.WriteHeader(http.StatusNoContent)
+    })
+    log.Printf("VAST stub serving %d ads from %s on %s", len(ads), *mediaDir, *addr)
+    log.Fatal(http.ListenAndServe(*addr, nil))
+}
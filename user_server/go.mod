@@ -3,3 +3,9 @@ module user_server
 go 1.25.1
 
 require github.com/lib/pq v1.10.9 // indirect
+
+require config v0.0.0
+
+require gopkg.in/yaml.v3 v3.0.1 // indirect
+
+replace config => ../config
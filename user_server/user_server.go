@@ -1,18 +1,26 @@
 package main
 
 import (
+	"config"
 	"database/sql"
 	"encoding/json"
+	"flag"
 	"log"
 	"net/http"
 
 	_ "github.com/lib/pq"
 )
 
-const dbConnString = "user=postgres password=aaaaaaaaaa dbname=webrtc_tv sslmode=disable host=localhost port=5432"
-
 func main() {
-	db, err := sql.Open("postgres", dbConnString)
+	configPath := flag.String("config", "", "path to the shared config file")
+	flag.Parse()
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		log.Fatal("Failed to load config:", err)
+	}
+	log.Printf("Loaded config from %s", cfg.Source())
+
+	db, err := sql.Open("postgres", cfg.Database.DSN)
 	if err != nil {
 		log.Fatal("Failed to connect to database:", err)
 	}
@@ -57,6 +65,16 @@ func main() {
 		json.NewEncoder(w).Encode(stations)
 	})
 
-	log.Println("User server running on :80")
-	log.Fatal(http.ListenAndServe(":80", nil))
+	// Signaling URL and ICE servers for index.html, so the page follows the
+	// deployment instead of hardcoding them
+	http.HandleFunc("/api/client-config", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			SignalURL  string             `json:"signal_url"`
+			ICEServers []config.ICEServer `json:"ice_servers"`
+		}{cfg.UserServer.SignalURL, cfg.WebRTC.ICEServers})
+	})
+
+	log.Printf("User server running on %s", cfg.UserServer.Listen)
+	log.Fatal(http.ListenAndServe(cfg.UserServer.Listen, nil))
 }
\ No newline at end of file
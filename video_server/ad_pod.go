@@ -0,0 +1,235 @@
+package main
+
+import (
+    "database/sql"
+    "fmt"
+    "log"
+    "math"
+    "math/rand"
+    "sort"
+    "time"
+    "config/campaign"
+)
+
+const podBuildAttempts = 20 // random orderings tried before settling for the closest pod
+
+// podCandidate is a commercial or bumper the pod builder can choose.
+type podCandidate struct {
+    id int64
+    dur float64
+    bumper bool
+    track *adTracking // VAST tracking when an ad server chose it
+}
+
+var adCatalog []podCandidate
+var bumperCatalog []podCandidate
+
+// loadPodCatalogs loads every commercial and bumper with a known duration,
+// and the commercials' targeting profiles. Videos tagged as both are treated
+// as bumpers.
+func loadPodCatalogs(db *sql.DB, bumperTag string) error {
+    rows, err := db.Query(
+        `SELECT v.id, v.duration, EXISTS (SELECT 1 FROM video_tags bt JOIN tags t ON t.id = bt.tag_id WHERE bt.video_id = v.id AND t.name = $1)
+         FROM videos v
+         WHERE v.duration > 0 AND (
+             EXISTS (SELECT 1 FROM video_tags vt WHERE vt.video_id = v.id AND vt.tag_id = 4)
+             OR EXISTS (SELECT 1 FROM video_tags bt JOIN tags t ON t.id = bt.tag_id WHERE bt.video_id = v.id AND t.name = $1))
+         ORDER BY v.id`, bumperTag)
+    if err != nil {
+        return err
+    }
+    defer rows.Close()
+    adCatalog, bumperCatalog = nil, nil
+    var ids []int64
+    for rows.Next() {
+        var c podCandidate
+        if err := rows.Scan(&c.id, &c.dur, &c.bumper); err != nil {
+            return err
+        }
+        if c.bumper {
+            bumperCatalog = append(bumperCatalog, c)
+        } else {
+            adCatalog = append(adCatalog, c)
+            ids = append(ids, c.id)
+        }
+    }
+    if err := rows.Err(); err != nil {
+        return err
+    }
+    adProfiles, err = loadAdProfiles(db, ids)
+    return err
+}
+
+// breakTarget is the pod length for a break: the break point's own target,
+// else the station's, else the config default.
+func breakTarget(st *Station, bp *BreakPoint) (float64, float64) {
+    target, tolerance := cfg.Ads.BreakTargetSeconds, cfg.Ads.BreakToleranceSeconds
+    if st.adTarget > 0 {
+        target = st.adTarget
+    }
+    if st.adTolerance >= 0 {
+        tolerance = st.adTolerance
+    }
+    if bp.TargetDuration > 0 {
+        target = bp.TargetDuration
+    }
+    return target, tolerance
+}
+
+// podEligible reports whether commercial c may follow the pod built so far.
+type podEligible func(c podCandidate, pod []podCandidate) bool
+
+// podRules steers the pod builder. A nil eligible accepts every commercial
+// and a nil score tries them in a uniformly random order; bumpers are never
+// checked.
+type podRules struct {
+    eligible podEligible
+    score func(c podCandidate) float64
+}
+
+// buildAdPod chooses commercials whose total lands within tolerance of
+// target, then fills what is left with bumpers. It tries several random
+// orderings, favouring better-scored commercials, and keeps the closest pod;
+// it never goes over target+tolerance.
+func buildAdPod(ads, bumpers []podCandidate, target, tolerance float64, rng *rand.Rand, rules podRules) []podCandidate {
+    byLength := longestFirst(bumpers)
+    var best []podCandidate
+    bestMiss := math.Inf(1)
+    for attempt := 0; attempt < podBuildAttempts; attempt++ {
+        var pod []podCandidate
+        total := 0.0
+        for _, i := range weightedOrder(ads, rules.score, rng) {
+            if total >= target-tolerance {
+                break
+            }
+            if total+ads[i].dur <= target+tolerance && (rules.eligible == nil || rules.eligible(ads[i], pod)) {
+                pod = append(pod, ads[i])
+                total += ads[i].dur
+            }
+        }
+        pod = fillWithBumpers(pod, total, byLength, target, tolerance)
+        total = podDuration(pod)
+        if miss := math.Abs(target - total); miss < bestMiss {
+            best, bestMiss = pod, miss
+        }
+        if bestMiss <= tolerance {
+            break
+        }
+    }
+    return best
+}
+
+func longestFirst(bumpers []podCandidate) []podCandidate {
+    byLength := append([]podCandidate(nil), bumpers...)
+    sort.Slice(byLength, func(i, j int) bool { return byLength[i].dur > byLength[j].dur })
+    return byLength
+}
+
+// fillWithBumpers tops up a pod of total seconds with the longest bumpers that
+// still fit target+tolerance. Bumpers may repeat, but not back to back.
+func fillWithBumpers(pod []podCandidate, total float64, byLength []podCandidate, target, tolerance float64) []podCandidate {
+    var last int64
+    for total < target-tolerance {
+        added := false
+        for _, b := range byLength {
+            if b.id != last && total+b.dur <= target+tolerance {
+                pod = append(pod, b)
+                total += b.dur
+                last = b.id
+                added = true
+                break
+            }
+        }
+        if !added {
+            break
+        }
+    }
+    return pod
+}
+
+// campaignEligibility applies the campaign rules for a break airing at at. If
+// the rules cannot be loaded no commercial is eligible, so a campaign never
+// airs outside its flight; the break is left to bumpers.
+func campaignEligibility(st *Station, db *sql.DB, at time.Time) podEligible {
+    rules, err := campaign.LoadRules(db, st.id, at)
+    if err != nil {
+        errorLogger.Printf("Station %s (adsEnabled: %v): Failed to load ad campaigns, airing bumpers only: %v", st.name, st.adsEnabled, err)
+        return func(c podCandidate, pod []podCandidate) bool { return false }
+    }
+    return func(c podCandidate, pod []podCandidate) bool {
+        ids := make([]int64, 0, len(pod))
+        for _, p := range pod {
+            if !p.bumper {
+                ids = append(ids, p.id)
+            }
+        }
+        return rules.Eligible(c.id, at, ids)
+    }
+}
+
+// podDecision is the pod chosen for an upcoming break while the station lock
+// was released.
+type podDecision struct {
+    videoID int64
+    breakTime float64
+    pod []podCandidate
+}
+
+// decides reports whether d was made for the break at bp in videoID.
+func (d *podDecision) decides(videoID int64, bp *BreakPoint) bool {
+    return d != nil && d.videoID == videoID && d.breakTime == bp.Time
+}
+
+// decidePod chooses the pod for the break at bp in videoID airing at at: the
+// ad server's if it fills the break, else the internal picker's under the
+// campaign rules and targeting, which are only loaded then. It waits on the
+// network and the database, so st.mu must not be held.
+func decidePod(st *Station, db *sql.DB, videoID int64, bp *BreakPoint, target, tolerance float64, at time.Time) []podCandidate {
+    if pod := decideAdPod(st, db, videoID, bp, target, tolerance, at, bumperCatalog); pod != nil {
+        return pod
+    }
+    rules := podRules{eligible: campaignEligibility(st, db, at), score: adScorer(st, db, videoID, at)}
+    return buildAdPod(adCatalog, bumperCatalog, target, tolerance, rand.New(rand.NewSource(time.Now().UnixNano())), rules)
+}
+
+func podDuration(pod []podCandidate) float64 {
+    total := 0.0
+    for _, c := range pod {
+        total += c.dur
+    }
+    return total
+}
+
+// recordAdPod saves a pod as it was queued and returns its ad_pods id. Pods
+// in on-demand video are previews and pods on a viewer's cursor replay breaks
+// already recorded for the live station, so neither is saved.
+func recordAdPod(db *sql.DB, st *Station, videoID int64, bp *BreakPoint, target, tolerance, planned float64, queued []podCandidate) (int64, error) {
+    if st.vod || st.live != nil {
+        return 0, nil
+    }
+    tx, err := db.Begin()
+    if err != nil {
+        return 0, err
+    }
+    defer tx.Rollback()
+    var podID int64
+    err = tx.QueryRow(
+        `INSERT INTO ad_pods (station_id, video_id, break_time, target_seconds, tolerance_seconds, planned_seconds, queued_seconds)
+         VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id`,
+        st.id, videoID, bp.Time, target, tolerance, planned, podDuration(queued)).Scan(&podID)
+    if err != nil {
+        return 0, fmt.Errorf("failed to insert ad pod: %w", err)
+    }
+    for i, c := range queued {
+        if _, err := tx.Exec(
+            `INSERT INTO ad_pod_items (pod_id, position, video_id, duration, bumper) VALUES ($1, $2, $3, $4, $5)`,
+            podID, i, c.id, c.dur, c.bumper); err != nil {
+            return 0, fmt.Errorf("failed to insert ad pod item: %w", err)
+        }
+    }
+    if err := tx.Commit(); err != nil {
+        return 0, err
+    }
+    log.Printf("Station %s (adsEnabled: %v): Recorded ad pod %d: %d items, %.3fs queued for target %.1fs ±%.1fs", st.name, st.adsEnabled, podID, len(queued), podDuration(queued), target, tolerance)
+    return podID, nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+    "math"
+    "math/rand"
+    "testing"
+)
+
+func testAds(durs ...float64) []podCandidate {
+    var out []podCandidate
+    for i, d := range durs {
+        out = append(out, podCandidate{id: int64(i + 1), dur: d})
+    }
+    return out
+}
+
+func testBumpers(durs ...float64) []podCandidate {
+    var out []podCandidate
+    for i, d := range durs {
+        out = append(out, podCandidate{id: int64(100 + i), dur: d, bumper: true})
+    }
+    return out
+}
+
+func TestBuildAdPodTolerance(t *testing.T) {
+    never2 := func(c podCandidate, pod []podCandidate) bool { return c.id != 2 }
+    tests := []struct {
+        name string
+        ads, bumpers []podCandidate
+        target, tolerance float64
+        rules podRules
+        fits bool // a pod within tolerance exists
+        want float64 // exact total, or -1 to only check tolerance
+    }{
+        {"commercials fill exactly", testAds(30, 30, 15), nil, 60, 5, podRules{}, true, -1},
+        {"bumpers top up the rest", testAds(45), testBumpers(10, 5), 60, 2, podRules{}, true, 60},
+        {"zero tolerance", testAds(20, 20, 20, 25), nil, 60, 0, podRules{}, true, 60},
+        {"bumpers repeat but not back to back", nil, testBumpers(10, 5), 30, 0, podRules{}, true, 30},
+        {"too long for the break", testAds(90), testBumpers(20), 60, 5, podRules{}, false, 20},
+        {"ineligible commercial left out", testAds(30, 60, 30), nil, 60, 0, podRules{eligible: never2}, true, 60},
+        {"scored commercials still fit", testAds(15, 15, 30, 45), testBumpers(5), 60, 1, podRules{score: func(c podCandidate) float64 { return float64(c.id) }}, true, -1},
+        {"nothing to air", nil, nil, 60, 5, podRules{}, false, 0},
+    }
+    for _, tt := range tests {
+        for seed := int64(1); seed <= 20; seed++ {
+            pod := buildAdPod(tt.ads, tt.bumpers, tt.target, tt.tolerance, rand.New(rand.NewSource(seed)), tt.rules)
+            total := podDuration(pod)
+            if total > tt.target+tt.tolerance {
+                t.Errorf("%s (seed %d): pod of %.1fs overruns %.1f±%.1f", tt.name, seed, total, tt.target, tt.tolerance)
+            }
+            if tt.fits && math.Abs(total-tt.target) > tt.tolerance {
+                t.Errorf("%s (seed %d): pod of %.1fs misses %.1f±%.1f", tt.name, seed, total, tt.target, tt.tolerance)
+            }
+            if tt.want >= 0 && total != tt.want {
+                t.Errorf("%s (seed %d): pod of %.1fs, want %.1fs", tt.name, seed, total, tt.want)
+            }
+            for i, c := range pod {
+                if c.id == 2 && tt.rules.eligible != nil {
+                    t.Errorf("%s (seed %d): ineligible commercial %d aired", tt.name, seed, c.id)
+                }
+                if i > 0 && c.bumper && pod[i-1].bumper && c.id == pod[i-1].id {
+                    t.Errorf("%s (seed %d): bumper %d aired back to back", tt.name, seed, c.id)
+                }
+                if c.bumper && i+1 < len(pod) && !pod[i+1].bumper {
+                    t.Errorf("%s (seed %d): commercial after a bumper in %v", tt.name, seed, pod)
+                }
+            }
+        }
+    }
+}
+
+func TestFillWithBumpers(t *testing.T) {
+    tests := []struct {
+        name string
+        total, target, tolerance float64
+        bumpers []podCandidate
+        want []int64
+    }{
+        {"longest that fits first", 40, 60, 0, testBumpers(5, 15, 10), []int64{101, 100}},
+        {"already within tolerance", 57, 60, 5, testBumpers(5), nil},
+        {"stops when only the last bumper fits", 0, 20, 0, testBumpers(5, 10), []int64{101, 100}},
+        {"none fit", 58, 60, 1, testBumpers(5), nil},
+    }
+    for _, tt := range tests {
+        pod := fillWithBumpers(nil, tt.total, longestFirst(tt.bumpers), tt.target, tt.tolerance)
+        var got []int64
+        for _, c := range pod {
+            got = append(got, c.id)
+        }
+        if len(got) != len(tt.want) {
+            t.Errorf("%s: bumpers %v, want %v", tt.name, got, tt.want)
+            continue
+        }
+        for i := range got {
+            if got[i] != tt.want[i] {
+                t.Errorf("%s: bumpers %v, want %v", tt.name, got, tt.want)
+                break
+            }
+        }
+    }
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+    "database/sql"
+    "time"
+)
+
+// asRunEntry is one chunk as the sender transmitted it.
+type asRunEntry struct {
+    stationID int64
+    stationName string
+    adsEnabled bool
+    videoID int64
+    isAd bool
+    podID int64 // 0 outside a recorded ad pod
+    sourceIn float64
+    sourceOut float64
+    start time.Time
+    end time.Time
+    viewers int
+    completed bool // false when transmission timed out
+    reach *adReach // ads only
+}
+
+// asRunQueue decouples the sender from the database; entries that do not fit
+// are dropped with an error rather than stalling playout.
+var asRunQueue = make(chan asRunEntry, 256)
+
+// startAsRunWriter writes queued as-run entries until the process exits.
+func startAsRunWriter(db *sql.DB) {
+    go func() {
+        for e := range asRunQueue {
+            var podID sql.NullInt64
+            if e.podID > 0 {
+                podID = sql.NullInt64{Int64: e.podID, Valid: true}
+            }
+            var atStart, reached, completedViews, dropped sql.NullInt64
+            if e.reach != nil {
+                atStart = sql.NullInt64{Int64: int64(e.reach.atStart), Valid: true}
+                reached = sql.NullInt64{Int64: int64(e.reach.reached), Valid: true}
+                completedViews = sql.NullInt64{Int64: int64(e.reach.completed), Valid: true}
+                dropped = sql.NullInt64{Int64: int64(e.reach.dropped), Valid: true}
+            }
+            // The campaign is resolved now so reports keep it if the
+            // commercial is later moved to another campaign.
+            _, err := db.Exec(
+                `INSERT INTO as_run (station_id, station_name, ads_enabled, video_id, is_ad, pod_id, source_in, source_out, started_at, ended_at, viewers, completed,
+                     campaign_id, peers_at_start, reached, completed_views, dropped)
+                 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12,
+                     CASE WHEN $5 THEN (SELECT campaign_id FROM ad_campaign_videos WHERE video_id = $4) END, $13, $14, $15, $16)`,
+                e.stationID, e.stationName, e.adsEnabled, e.videoID, e.isAd, podID, e.sourceIn, e.sourceOut, e.start, e.end, e.viewers, e.completed,
+                atStart, reached, completedViews, dropped)
+            if err != nil {
+                errorLogger.Printf("Station %s (adsEnabled: %v): Failed to write as-run entry for video %d at %s: %v", e.stationName, e.adsEnabled, e.videoID, e.start.Format(time.RFC3339), err)
+            }
+        }
+    }()
+}
+
+// logAsRun queues the as-run entry for a chunk that finished transmitting.
+// A viewer's cursor or on-demand video is not the station's airing and is not
+// logged.
+func logAsRun(st *Station, chunk bufferedChunk, podID int64, start, end time.Time, viewers int, completed bool, reach *adReach) {
+    if st.live != nil || st.vod {
+        return
+    }
+    e := asRunEntry{
+        stationID: st.id,
+        stationName: st.name,
+        adsEnabled: st.adsEnabled,
+        videoID: chunk.videoID,
+        isAd: chunk.isAd && !chunk.filler,
+        podID: podID,
+        sourceIn: chunk.srcIn,
+        sourceOut: chunk.srcIn + chunk.dur,
+        start: start,
+        end: end,
+        viewers: viewers,
+        completed: completed,
+        reach: reach,
+    }
+    select {
+    case asRunQueue <- e:
+    default:
+        errorLogger.Printf("Station %s (adsEnabled: %v): As-run queue full, dropped entry for video %d at %s", st.name, st.adsEnabled, chunk.videoID, start.Format(time.RFC3339))
+    }
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+    "database/sql"
+    "encoding/json"
+    "fmt"
+    "log"
+    "strings"
+    "time"
+    "github.com/pion/webrtc/v3"
+)
+
+// Playback modes a viewer can ask for with ?playback= on /signal or a
+// playback command on the event channel.
+const (
+    PlaybackLive = "live"
+    PlaybackStartOver = "start_over" // the program on air, from its beginning
+    PlaybackPrevious = "previous" // the program before it, from its beginning
+    // Time-shift controls over the station's DVR buffer (event channel only).
+    PlaybackPause = "pause"
+    PlaybackPlay = "play"
+    PlaybackRewind = "rewind" // by seconds, default dvrRewindSeconds
+)
+
+const dvrRewindSeconds = 30.0
+
+// playbackCommand is what a viewer sends on the event channel to move
+// between live and its own cursor, e.g. {"type":"playback","mode":"live"} or
+// {"type":"playback","mode":"rewind","seconds":60}, or to seek on-demand
+// video, e.g. {"type":"seek","position":600}.
+type playbackCommand struct {
+    Type string `json:"type"`
+    Mode string `json:"mode"`
+    Seconds float64 `json:"seconds,omitempty"`
+    Position float64 `json:"position,omitempty"`
+}
+
+type playbackMessage struct {
+    Type string `json:"type"`
+    Mode string `json:"mode,omitempty"`
+    VideoID int64 `json:"video_id"`
+    BehindLive float64 `json:"behind_live,omitempty"` // seconds, when time-shifted
+    Position float64 `json:"position,omitempty"` // seconds into on-demand video, after a seek
+    Error string `json:"error,omitempty"`
+}
+
+// newCursorStation creates a private station for one viewer that replays
+// live's content from the start of the current or the previous program.
+// It runs the normal processing and sender loops, ad breaks included, on its
+// own tracks, and is never registered in stations or noAdsStations.
+func newCursorStation(db *sql.DB, live *Station, mode string) (*Station, error) {
+    live.mu.Lock()
+    from := &Station{
+        videoQueue: append([]int64(nil), live.videoQueue...),
+        currentVideo: live.currentVideo,
+        currentIndex: live.currentIndex,
+    }
+    negotiatedFmtp := live.negotiatedFmtp
+    live.mu.Unlock()
+    switch mode {
+    case PlaybackStartOver:
+    case PlaybackPrevious:
+        prev, err := previousProgram(db, live.id, from)
+        if err != nil {
+            return nil, err
+        }
+        from.currentVideo = prev
+        from.currentIndex = queueIndex(from.videoQueue, prev)
+    default:
+        return nil, fmt.Errorf("unknown playback mode %q", mode)
+    }
+    if from.currentVideo == 0 {
+        return nil, fmt.Errorf("station %s has nothing on air to start over", live.name)
+    }
+    id, err := newSessionID()
+    if err != nil {
+        return nil, err
+    }
+    st := loadStation(live.name, db, live.adsEnabled, from)
+    if st == nil {
+        return nil, fmt.Errorf("failed to load station %s", live.name)
+    }
+    st.live = live
+    st.cursorID = id[:8]
+    st.negotiatedFmtp = negotiatedFmtp
+    log.Printf("Station %s (adsEnabled: %v): Cursor %s playing %s from video %d", st.name, st.adsEnabled, st.cursorID, mode, st.currentVideo)
+    return st, nil
+}
+
+// previousProgram is the program the station aired before from's current
+// one: the last in the as-run log, else the one before it in the queue.
+func previousProgram(db *sql.DB, stationID int64, from *Station) (int64, error) {
+    var prev int64
+    err := db.QueryRow(
+        `SELECT video_id FROM as_run
+         WHERE station_id = $1 AND NOT is_ad AND video_id <> 0 AND video_id <> $2
+         ORDER BY started_at DESC LIMIT 1`, stationID, from.currentVideo).Scan(&prev)
+    if err == nil {
+        return prev, nil
+    }
+    if err != sql.ErrNoRows {
+        return 0, fmt.Errorf("failed to query the as-run log: %v", err)
+    }
+    idx := queueIndex(from.videoQueue, from.currentVideo)
+    if idx < 0 || len(from.videoQueue) < 2 {
+        return 0, fmt.Errorf("no previous program")
+    }
+    return from.videoQueue[(idx+len(from.videoQueue)-1)%len(from.videoQueue)], nil
+}
+
+// liveStation is the station st replays, or st itself when it is live.
+func liveStation(st *Station) *Station {
+    if st.live != nil {
+        return st.live
+    }
+    return st
+}
+
+// segmentBaseName prefixes st's segment files. Cursors add their ID so
+// they never share files with the live station.
+func segmentBaseName(st *Station) string {
+    name := strings.ReplaceAll(st.name, " ", "_")
+    if st.cursorID != "" {
+        name += "_" + st.cursorID
+    }
+    return name
+}
+
+func (vs *viewerSession) station() *Station {
+    sessionsMu.Lock()
+    defer sessionsMu.Unlock()
+    return vs.st
+}
+
+// handlePlaybackCommands lets the viewer switch playback modes, or seek
+// on-demand video, over the event channel dc. It takes over dc's close handler so the channel is
+// dropped from whichever station the session is on by then.
+func (vs *viewerSession) handlePlaybackCommands(db *sql.DB, dc *webrtc.DataChannel) {
+    if dc.Label() != EventChannelLabel {
+        return
+    }
+    dc.OnMessage(func(m webrtc.DataChannelMessage) {
+        var cmd playbackCommand
+        if !m.IsString || json.Unmarshal(m.Data, &cmd) != nil {
+            return
+        }
+        var st *Station
+        var switchErr error
+        switch cmd.Type {
+        case "playback":
+            st, switchErr = vs.switchPlayback(db, dc, cmd)
+        case "seek":
+            st, switchErr = vs.seek(db, dc, cmd.Position)
+        default:
+            return
+        }
+        reply := playbackMessage{Type: cmd.Type, Mode: cmd.Mode}
+        if switchErr != nil {
+            log.Printf("Station %s: Session %s could not %s %s: %v", vs.station().name, vs.id, cmd.Type, cmd.Mode, switchErr)
+            reply.Error = switchErr.Error()
+        } else {
+            st.mu.Lock()
+            reply.VideoID = st.currentVideo
+            if st.vod {
+                reply.Position = st.currentOffset
+            }
+            st.mu.Unlock()
+            if st.dvr != nil {
+                reply.BehindLive = st.dvr.behindLive()
+            }
+        }
+        if err := sendEvent(dc, reply); err != nil {
+            log.Printf("Station %s: Failed to send playback reply on data channel: %v", vs.station().name, err)
+        }
+        if switchErr == nil {
+            sendNowPlaying(st, db, dc)
+        }
+    })
+    dc.OnClose(func() {
+        st := vs.station()
+        st.mu.Lock()
+        delete(st.eventChannels, dc)
+        st.mu.Unlock()
+    })
+}
+
+// switchPlayback moves the session to live or to a new cursor of the
+// station it is watching, swapping the tracks its senders carry. The viewer
+// slot moves with it; a cursor left behind stops once it has no viewers.
+// Pause, play and rewind on a DVR cursor only move its player.
+func (vs *viewerSession) switchPlayback(db *sql.DB, dc *webrtc.DataChannel, cmd playbackCommand) (*Station, error) {
+    mode := cmd.Mode
+    back := cmd.Seconds
+    if back <= 0 {
+        back = dvrRewindSeconds
+    }
+    vs.switchMu.Lock()
+    defer vs.switchMu.Unlock()
+    vs.mu.Lock()
+    closed := !vs.closedAt.IsZero()
+    vs.mu.Unlock()
+    if closed {
+        return nil, fmt.Errorf("session closed")
+    }
+    old := vs.station()
+    if old.vod {
+        return nil, fmt.Errorf("on-demand video seeks instead")
+    }
+    if p := old.dvr; p != nil {
+        switch mode {
+        case PlaybackPause, PlaybackPlay:
+            p.control(func() { p.paused = mode == PlaybackPause })
+            return old, nil
+        case PlaybackRewind:
+            p.control(func() { p.pos = p.pos.Add(-time.Duration(back * float64(time.Second))) })
+            return old, nil
+        }
+    }
+    if mode == PlaybackLive && old.live == nil || mode == PlaybackPlay {
+        return old, nil
+    }
+    if (mode == PlaybackPause || mode == PlaybackRewind) && old.live != nil {
+        return nil, fmt.Errorf("pause and rewind work on live playback, go live first")
+    }
+    // The live station may have been unloaded while nobody watched it.
+    live, errMsg := lookupStation(db, liveStation(old).name, old.adsEnabled)
+    if live == nil {
+        return nil, fmt.Errorf("%s", errMsg)
+    }
+    next := live
+    if mode == PlaybackLive {
+        next.mu.Lock()
+        if next.negotiatedFmtp == "" {
+            next.negotiatedFmtp = old.negotiatedFmtp
+        }
+        next.mu.Unlock()
+    } else if mode == PlaybackPause || mode == PlaybackRewind {
+        at := time.Now()
+        if mode == PlaybackRewind {
+            at = at.Add(-time.Duration(back * float64(time.Second)))
+        }
+        var err error
+        if next, err = newDVRStation(db, live, at, mode == PlaybackPause); err != nil {
+            return nil, err
+        }
+    } else {
+        var err error
+        if next, err = newCursorStation(db, live, mode); err != nil {
+            return nil, err
+        }
+    }
+    if err := vs.moveTo(db, dc, old, next); err != nil {
+        return nil, err
+    }
+    log.Printf("Station %s: Session %s switched to %s", next.name, vs.id, mode)
+    return next, nil
+}
+
+// moveTo hands the session and its event channel dc over from old to next,
+// swapping the tracks its senders carry. The caller holds vs.switchMu.
+func (vs *viewerSession) moveTo(db *sql.DB, dc *webrtc.DataChannel, old, next *Station) error {
+    if err := addViewer(next, db); err != nil {
+        return err
+    }
+    var replaced []*webrtc.RTPSender
+    for _, sender := range vs.pc.GetSenders() {
+        track := sender.Track()
+        if track == nil {
+            continue
+        }
+        replacement := next.trackAudio
+        if track.Kind() == webrtc.RTPCodecTypeVideo {
+            replacement = next.trackVideo
+        }
+        if err := sender.ReplaceTrack(replacement); err != nil {
+            // Put back what the session was watching before giving up.
+            for _, done := range replaced {
+                original := old.trackAudio
+                if done.Track().Kind() == webrtc.RTPCodecTypeVideo {
+                    original = old.trackVideo
+                }
+                if err := done.ReplaceTrack(original); err != nil {
+                    errorLogger.Printf("Station %s: Session %s failed to restore its %s track: %v", old.name, vs.id, done.Track().Kind(), err)
+                }
+            }
+            removeViewer(next)
+            return fmt.Errorf("failed to replace %s track: %v", track.Kind(), err)
+        }
+        replaced = append(replaced, sender)
+    }
+    sessionsMu.Lock()
+    vs.st = next
+    sessionsMu.Unlock()
+    old.mu.Lock()
+    delete(old.eventChannels, dc)
+    old.mu.Unlock()
+    next.mu.Lock()
+    if next.eventChannels == nil {
+        next.eventChannels = make(map[*webrtc.DataChannel]struct{})
+    }
+    next.eventChannels[dc] = struct{}{}
+    next.mu.Unlock()
+    removeViewer(old)
+    return nil
+}
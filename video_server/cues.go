@@ -0,0 +1,131 @@
+package main
+
+import (
+    "database/sql"
+    "encoding/json"
+    "log"
+    "math"
+    "time"
+    "github.com/pion/webrtc/v3"
+    "video_server/video"
+)
+
+const EventChannelLabel = "events" // data channel clients open to receive station events
+
+// adBreak describes one ad pod inserted at a break point. It rides on the
+// first ad chunk of the pod so the sender can announce the break when that
+// chunk actually goes out.
+type adBreak struct {
+    id uint32
+    videoID int64
+    breakTime float64
+    fadeOut float64
+    fadeIn float64
+    podDur float64
+    podID int64 // ad_pods.id, 0 if the pod was not recorded
+}
+
+type cueMessage struct {
+    Type string `json:"type"`
+    BreakID uint32 `json:"break_id"`
+    VideoID int64 `json:"video_id"`
+    BreakTime float64 `json:"break_time"`
+    FadeOut float64 `json:"fade_out"`
+    FadeIn float64 `json:"fade_in"`
+    Duration float64 `json:"duration"`
+    Time time.Time `json:"time"`
+}
+
+// newAdBreak allocates the next break ID for st. Caller holds st.mu.
+func newAdBreak(st *Station, videoID int64, bp *BreakPoint, podDur float64) *adBreak {
+    st.nextBreakID++
+    return &adBreak{
+        id: st.nextBreakID,
+        videoID: videoID,
+        breakTime: bp.Time,
+        fadeOut: math.Max(bp.FadeOut.Video.End, bp.FadeOut.Audio.End) - math.Min(bp.FadeOut.Video.Start, bp.FadeOut.Audio.Start),
+        fadeIn: math.Max(bp.FadeIn.Video.End, bp.FadeIn.Audio.End) - math.Min(bp.FadeIn.Video.Start, bp.FadeIn.Audio.Start),
+        podDur: podDur,
+    }
+}
+
+// chunkCue works out whether chunk, about to be transmitted at now, opens or
+// closes an ad break, announces it on the event channels and returns the cue
+// for the HLS packager.
+func chunkCue(st *Station, chunk bufferedChunk, now time.Time) *video.Cue {
+    st.mu.Lock()
+    var cue *video.Cue
+    var msg cueMessage
+    if chunk.cueOut != nil {
+        b := chunk.cueOut
+        st.openBreak = b
+        st.openBreakStart = now
+        cue = &video.Cue{ID: b.id, Out: true, Duration: b.podDur}
+        msg = cueMessage{Type: "cue_out", BreakID: b.id, VideoID: b.videoID, BreakTime: b.breakTime, FadeOut: b.fadeOut, FadeIn: b.fadeIn, Duration: b.podDur, Time: now}
+    } else if !chunk.isAd && st.openBreak != nil {
+        b := st.openBreak
+        elapsed := now.Sub(st.openBreakStart).Seconds()
+        st.openBreak = nil
+        cue = &video.Cue{ID: b.id, Out: false, Duration: elapsed}
+        msg = cueMessage{Type: "cue_in", BreakID: b.id, VideoID: b.videoID, BreakTime: b.breakTime, FadeOut: b.fadeOut, FadeIn: b.fadeIn, Duration: elapsed, Time: now}
+    }
+    st.mu.Unlock()
+    if cue == nil {
+        return nil
+    }
+    log.Printf("Station %s (adsEnabled: %v): %s for break %d (video %d at %.3fs, %.3fs)", st.name, st.adsEnabled, msg.Type, msg.BreakID, msg.VideoID, msg.BreakTime, msg.Duration)
+    broadcastEvent(st, msg)
+    return cue
+}
+
+// attachEventChannel registers a client-opened data channel for station
+// events and sends it what is on air. Channels with other labels are left
+// alone.
+func attachEventChannel(st *Station, db *sql.DB, dc *webrtc.DataChannel) {
+    if dc.Label() != EventChannelLabel {
+        return
+    }
+    dc.OnOpen(func() {
+        st.mu.Lock()
+        if st.eventChannels == nil {
+            st.eventChannels = make(map[*webrtc.DataChannel]struct{})
+        }
+        st.eventChannels[dc] = struct{}{}
+        st.mu.Unlock()
+        sendNowPlaying(st, db, dc)
+    })
+    dc.OnClose(func() {
+        st.mu.Lock()
+        delete(st.eventChannels, dc)
+        st.mu.Unlock()
+    })
+}
+
+// sendEvent sends v as JSON on one event channel.
+func sendEvent(dc *webrtc.DataChannel, v interface{}) error {
+    payload, err := json.Marshal(v)
+    if err != nil {
+        return err
+    }
+    return dc.SendText(string(payload))
+}
+
+// broadcastEvent sends v as JSON to every open event channel of st.
+func broadcastEvent(st *Station, v interface{}) {
+    payload, err := json.Marshal(v)
+    if err != nil {
+        errorLogger.Printf("Station %s: Failed to marshal event: %v", st.name, err)
+        return
+    }
+    st.mu.Lock()
+    channels := make([]*webrtc.DataChannel, 0, len(st.eventChannels))
+    for dc := range st.eventChannels {
+        channels = append(channels, dc)
+    }
+    st.mu.Unlock()
+    for _, dc := range channels {
+        if err := dc.SendText(string(payload)); err != nil {
+            log.Printf("Station %s: Failed to send event on data channel: %v", st.name, err)
+        }
+    }
+}
@@ -0,0 +1,503 @@
+package main
+
+import (
+    "bufio"
+    "bytes"
+    "database/sql"
+    "encoding/json"
+    "fmt"
+    "io"
+    "log"
+    "os"
+    "path/filepath"
+    "sort"
+    "sync"
+    "time"
+    "github.com/pion/webrtc/v3/pkg/media"
+    "github.com/pion/webrtc/v3/pkg/media/oggreader"
+)
+
+const (
+    dvrIndexName = "index.jsonl"
+    dvrJanitorInterval = time.Minute
+    dvrEdgePoll = 500 * time.Millisecond // how often a player caught up with live looks for the next chunk
+)
+
+type dvrKey struct {
+    name string
+    adsEnabled bool
+}
+
+// dvrChunk is one transmitted chunk kept for time-shifting, as written to
+// the station's index file.
+type dvrChunk struct {
+    Station string `json:"station"`
+    AdsEnabled bool `json:"ads_enabled"`
+    Video string `json:"video"`
+    Audio string `json:"audio"`
+    VideoID int64 `json:"video_id"`
+    IsAd bool `json:"is_ad"`
+    SrcIn float64 `json:"src_in"`
+    Start time.Time `json:"start"`
+    Dur float64 `json:"dur"`
+    FPSNum int `json:"fps_num"`
+    FPSDen int `json:"fps_den"`
+    Bytes int64 `json:"bytes"`
+}
+
+func (c *dvrChunk) end() time.Time {
+    return c.Start.Add(time.Duration(c.Dur * float64(time.Second)))
+}
+
+// dvrBuffer is one station variant's retained chunks, oldest first.
+type dvrBuffer struct {
+    dir string
+    chunks []*dvrChunk
+}
+
+var dvrBuffers = struct {
+    sync.Mutex
+    m map[dvrKey]*dvrBuffer
+}{m: make(map[dvrKey]*dvrBuffer)}
+
+func dvrDir(st *Station) string {
+    return filepath.Join(cfg.DVR.Dir, fmt.Sprintf("%s_%t", segmentBaseName(st), st.adsEnabled))
+}
+
+// retainChunk moves a chunk the sender has finished with into the station's
+// time-shift buffer. It returns false when the files should be deleted as
+// usual: retention is off, st is a viewer's cursor or on-demand video, or the
+// move failed.
+func retainChunk(st *Station, chunk bufferedChunk, segPath, audioPath string, start time.Time) bool {
+    if cfg.DVR.WindowSeconds <= 0 || st.live != nil || st.vod {
+        return false
+    }
+    dir := dvrDir(st)
+    if err := os.MkdirAll(dir, 0755); err != nil {
+        errorLogger.Printf("Station %s (adsEnabled: %v): Failed to create DVR directory %s: %v", st.name, st.adsEnabled, dir, err)
+        return false
+    }
+    prefix := fmt.Sprintf("%d_", start.UnixNano())
+    c := &dvrChunk{
+        Station: st.name,
+        AdsEnabled: st.adsEnabled,
+        Video: filepath.Join(dir, prefix+filepath.Base(segPath)),
+        Audio: filepath.Join(dir, prefix+filepath.Base(audioPath)),
+        VideoID: chunk.videoID,
+        IsAd: chunk.isAd,
+        SrcIn: chunk.srcIn,
+        Start: start,
+        Dur: chunk.dur,
+        FPSNum: chunk.fps.num,
+        FPSDen: chunk.fps.den,
+    }
+    if err := os.Rename(segPath, c.Video); err != nil {
+        errorLogger.Printf("Station %s (adsEnabled: %v): Failed to retain %s: %v", st.name, st.adsEnabled, segPath, err)
+        return false
+    }
+    if err := os.Rename(audioPath, c.Audio); err != nil {
+        errorLogger.Printf("Station %s (adsEnabled: %v): Failed to retain %s: %v", st.name, st.adsEnabled, audioPath, err)
+        os.Remove(c.Video)
+        return false
+    }
+    for _, path := range []string{c.Video, c.Audio} {
+        if fi, err := os.Stat(path); err == nil {
+            c.Bytes += fi.Size()
+        }
+    }
+    key := dvrKey{st.name, st.adsEnabled}
+    dvrBuffers.Lock()
+    b := dvrBuffers.m[key]
+    if b == nil {
+        b = &dvrBuffer{dir: dir}
+        dvrBuffers.m[key] = b
+    }
+    b.chunks = append(b.chunks, c)
+    err := appendDVRIndex(b, c)
+    dvrBuffers.Unlock()
+    if err != nil {
+        errorLogger.Printf("Station %s (adsEnabled: %v): Failed to update DVR index: %v", st.name, st.adsEnabled, err)
+    }
+    collectDVR()
+    return true
+}
+
+func appendDVRIndex(b *dvrBuffer, c *dvrChunk) error {
+    f, err := os.OpenFile(filepath.Join(b.dir, dvrIndexName), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+    if err != nil {
+        return err
+    }
+    defer f.Close()
+    return json.NewEncoder(f).Encode(c)
+}
+
+// writeDVRIndex rewrites the index after chunks were dropped.
+func writeDVRIndex(b *dvrBuffer) error {
+    path := filepath.Join(b.dir, dvrIndexName)
+    var buf bytes.Buffer
+    enc := json.NewEncoder(&buf)
+    for _, c := range b.chunks {
+        if err := enc.Encode(c); err != nil {
+            return err
+        }
+    }
+    if err := os.WriteFile(path+".tmp", buf.Bytes(), 0644); err != nil {
+        return err
+    }
+    return os.Rename(path+".tmp", path)
+}
+
+// loadDVR reads the index of every station's buffer under cfg.DVR.Dir, so
+// what was retained before a restart can still be rewound to.
+func loadDVR() error {
+    indexes, err := filepath.Glob(filepath.Join(cfg.DVR.Dir, "*", dvrIndexName))
+    if err != nil {
+        return err
+    }
+    dvrBuffers.Lock()
+    for _, index := range indexes {
+        f, err := os.Open(index)
+        if err != nil {
+            errorLogger.Printf("Failed to open DVR index %s: %v", index, err)
+            continue
+        }
+        b := &dvrBuffer{dir: filepath.Dir(index)}
+        var key dvrKey
+        scanner := bufio.NewScanner(f)
+        for scanner.Scan() {
+            var c dvrChunk
+            if err := json.Unmarshal(scanner.Bytes(), &c); err != nil {
+                continue
+            }
+            if _, err := os.Stat(c.Video); err != nil {
+                continue
+            }
+            key = dvrKey{c.Station, c.AdsEnabled}
+            b.chunks = append(b.chunks, &c)
+        }
+        f.Close()
+        if len(b.chunks) > 0 {
+            sort.Slice(b.chunks, func(i, j int) bool { return b.chunks[i].Start.Before(b.chunks[j].Start) })
+            dvrBuffers.m[key] = b
+            log.Printf("Station %s (adsEnabled: %v): Loaded %d DVR chunks from %s", key.name, key.adsEnabled, len(b.chunks), b.dir)
+        }
+    }
+    dvrBuffers.Unlock()
+    collectDVR()
+    return nil
+}
+
+// collectDVR deletes chunks that have aged out of the window, then the
+// oldest of any station while the buffers are over the disk quota.
+func collectDVR() {
+    cutoff := time.Now().Add(-time.Duration(cfg.DVR.WindowSeconds * float64(time.Second)))
+    quota := cfg.DVR.QuotaMB << 20
+    dvrBuffers.Lock()
+    defer dvrBuffers.Unlock()
+    changed := make(map[*dvrBuffer]bool)
+    var total int64
+    for _, b := range dvrBuffers.m {
+        for len(b.chunks) > 0 && b.chunks[0].end().Before(cutoff) {
+            dropDVRChunk(b)
+            changed[b] = true
+        }
+        for _, c := range b.chunks {
+            total += c.Bytes
+        }
+    }
+    for quota > 0 && total > quota {
+        var oldest *dvrBuffer
+        for _, b := range dvrBuffers.m {
+            if len(b.chunks) > 0 && (oldest == nil || b.chunks[0].Start.Before(oldest.chunks[0].Start)) {
+                oldest = b
+            }
+        }
+        if oldest == nil {
+            break
+        }
+        total -= oldest.chunks[0].Bytes
+        dropDVRChunk(oldest)
+        changed[oldest] = true
+    }
+    for b := range changed {
+        if err := writeDVRIndex(b); err != nil {
+            errorLogger.Printf("Failed to rewrite DVR index in %s: %v", b.dir, err)
+        }
+    }
+}
+
+func dropDVRChunk(b *dvrBuffer) {
+    c := b.chunks[0]
+    os.Remove(c.Video)
+    os.Remove(c.Audio)
+    b.chunks = b.chunks[1:]
+}
+
+// dvrJanitor collects expired chunks of stations that are no longer on air.
+func dvrJanitor() {
+    ticker := time.NewTicker(dvrJanitorInterval)
+    defer ticker.Stop()
+    for range ticker.C {
+        collectDVR()
+    }
+}
+
+// dvrChunkAt returns a copy of the retained chunk playing at t, or the first
+// one after it; nil when t is at or past the live edge.
+func dvrChunkAt(key dvrKey, t time.Time) *dvrChunk {
+    dvrBuffers.Lock()
+    defer dvrBuffers.Unlock()
+    b := dvrBuffers.m[key]
+    if b == nil {
+        return nil
+    }
+    i := sort.Search(len(b.chunks), func(i int) bool { return b.chunks[i].end().After(t) })
+    if i == len(b.chunks) {
+        return nil
+    }
+    c := *b.chunks[i]
+    return &c
+}
+
+// dvrPlayer is a viewer's position in a station's time-shift buffer.
+type dvrPlayer struct {
+    key dvrKey
+    mu sync.Mutex
+    pos time.Time // air time of what the viewer sees
+    paused bool
+    gen int // bumped by every control so playback in progress starts over
+    wake chan struct{}
+}
+
+// control changes the player's state under its lock and interrupts the
+// chunk being played.
+func (p *dvrPlayer) control(f func()) {
+    p.mu.Lock()
+    f()
+    p.gen++
+    p.mu.Unlock()
+    select {
+    case p.wake <- struct{}{}:
+    default:
+    }
+}
+
+// behindLive is how far the viewer is behind the live station.
+func (p *dvrPlayer) behindLive() float64 {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    return time.Since(p.pos).Seconds()
+}
+
+// advance moves the position on as media goes out, unless a control has
+// happened since generation gen.
+func (p *dvrPlayer) advance(gen int, pos time.Time) bool {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    if p.gen != gen {
+        return false
+    }
+    p.pos = pos
+    return true
+}
+
+// newDVRStation creates a viewer's private station playing live's retained
+// chunks from at.
+func newDVRStation(db *sql.DB, live *Station, at time.Time, paused bool) (*Station, error) {
+    if cfg.DVR.WindowSeconds <= 0 {
+        return nil, fmt.Errorf("pause and rewind are not enabled")
+    }
+    live.mu.Lock()
+    from := &Station{
+        videoQueue: append([]int64(nil), live.videoQueue...),
+        currentVideo: live.currentVideo,
+        currentIndex: live.currentIndex,
+        currentOffset: live.currentOffset,
+    }
+    negotiatedFmtp := live.negotiatedFmtp
+    live.mu.Unlock()
+    id, err := newSessionID()
+    if err != nil {
+        return nil, err
+    }
+    st := loadStation(live.name, db, live.adsEnabled, from)
+    if st == nil {
+        return nil, fmt.Errorf("failed to load station %s", live.name)
+    }
+    st.live = live
+    st.cursorID = id[:8]
+    st.negotiatedFmtp = negotiatedFmtp
+    st.dvr = &dvrPlayer{key: dvrKey{live.name, live.adsEnabled}, pos: at, paused: paused, wake: make(chan struct{}, 1)}
+    log.Printf("Station %s (adsEnabled: %v): DVR cursor %s at %s (paused: %v)", st.name, st.adsEnabled, st.cursorID, at.Format(time.RFC3339), paused)
+    return st, nil
+}
+
+// playDVR plays st's retained chunks from its player's position until the
+// last viewer leaves. It takes the place of manageProcessing and sender.
+func playDVR(st *Station, db *sql.DB) {
+    p := st.dvr
+    st.mu.Lock()
+    stop := st.stopCh
+    st.mu.Unlock()
+    for {
+        p.mu.Lock()
+        paused, pos, gen := p.paused, p.pos, p.gen
+        p.mu.Unlock()
+        var c *dvrChunk
+        if !paused {
+            c = dvrChunkAt(p.key, pos)
+        }
+        if c == nil {
+            // Paused, or caught up with live: the chunk on air is retained
+            // once the sender has finished it.
+            var poll <-chan time.Time
+            if !paused {
+                poll = time.After(dvrEdgePoll)
+            }
+            select {
+            case <-stop:
+                log.Printf("Station %s (adsEnabled: %v): Stopping DVR cursor %s", st.name, st.adsEnabled, st.cursorID)
+                return
+            case <-p.wake:
+            case <-poll:
+            }
+            continue
+        }
+        offset := 0.0
+        if pos.After(c.Start) {
+            offset = pos.Sub(c.Start).Seconds()
+        }
+        if !playDVRChunk(st, db, c, offset, gen, stop) {
+            select {
+            case <-stop:
+                log.Printf("Station %s (adsEnabled: %v): Stopping DVR cursor %s", st.name, st.adsEnabled, st.cursorID)
+                return
+            default:
+            }
+        }
+    }
+}
+
+type dvrSample struct {
+    at float64 // seconds into the chunk
+    video bool
+    sample media.Sample
+}
+
+// playDVRChunk sends c from the last keyframe at or before offset, paced in
+// real time. It returns false when interrupted by a control or stop.
+func playDVRChunk(st *Station, db *sql.DB, c *dvrChunk, offset float64, gen int, stop chan struct{}) bool {
+    p := st.dvr
+    videoData, err := os.ReadFile(c.Video)
+    if err != nil {
+        errorLogger.Printf("Station %s (adsEnabled: %v): DVR chunk %s is gone, skipping: %v", st.name, st.adsEnabled, c.Video, err)
+        return p.advance(gen, c.end())
+    }
+    nalus := splitNALUs(videoData)
+    var spsPPS [][]byte
+    for _, nalu := range nalus {
+        if len(nalu) > 0 && (nalu[0]&0x1F == 7 || nalu[0]&0x1F == 8) {
+            spsPPS = append(spsPPS, nalu)
+            if len(spsPPS) == 2 {
+                break
+            }
+        }
+    }
+    frames := groupFrames(st, nalus, nil, c.Video)
+    if len(frames) == 0 {
+        return p.advance(gen, c.end())
+    }
+    interval := c.Dur / float64(len(frames))
+    first := int(offset / interval)
+    if first >= len(frames) {
+        return p.advance(gen, c.end())
+    }
+    for first > 0 && !isKeyframe(frames[first]) {
+        first--
+    }
+    if first > 0 && len(spsPPS) > 0 {
+        var prefixed bytes.Buffer
+        for _, n := range spsPPS {
+            prefixed.Write([]byte{0x00, 0x00, 0x00, 0x01})
+            prefixed.Write(n)
+        }
+        prefixed.Write(frames[first])
+        frames[first] = prefixed.Bytes()
+    }
+    start := float64(first) * interval
+    var samples []dvrSample
+    for i := first; i < len(frames); i++ {
+        samples = append(samples, dvrSample{at: float64(i) * interval, video: true, sample: media.Sample{Data: frames[i], Duration: time.Duration(interval * float64(time.Second))}})
+    }
+    if audioData, err := os.ReadFile(c.Audio); err == nil {
+        if ogg, _, err := oggreader.NewWith(bytes.NewReader(audioData)); err == nil {
+            var prevGranule uint64
+            for {
+                payload, header, err := ogg.ParseNextPage()
+                if err == io.EOF || err != nil {
+                    break
+                }
+                if len(payload) < 1 || (len(payload) >= 8 && (string(payload[:8]) == "OpusHead" || string(payload[:8]) == "OpusTags")) {
+                    continue
+                }
+                at := float64(prevGranule) / 48000
+                durSamples := header.GranulePosition - prevGranule
+                prevGranule = header.GranulePosition
+                if durSamples == 0 || at < start {
+                    continue
+                }
+                samples = append(samples, dvrSample{at: at, sample: media.Sample{Data: payload, Duration: time.Duration(durSamples) * time.Second / 48000}})
+            }
+        }
+    }
+    sort.SliceStable(samples, func(i, j int) bool { return samples[i].at < samples[j].at })
+    st.mu.Lock()
+    st.currentVideo = c.VideoID
+    if !c.IsAd {
+        st.currentOffset = c.SrcIn + start
+    }
+    videoTS, audioTS := st.currentVideoRTPTS, st.currentAudioSamples
+    st.mu.Unlock()
+    markAiring(st, db, bufferedChunk{segPath: c.Video, dur: c.Dur - start, isAd: c.IsAd, videoID: c.VideoID, effective_advance: c.Dur - start}, time.Now())
+    wall := time.Now()
+    for _, s := range samples {
+        time.Sleep(time.Until(wall.Add(time.Duration((s.at - start) * float64(time.Second)))))
+        select {
+        case <-stop:
+            return false
+        default:
+        }
+        since := time.Duration((s.at - start) * float64(time.Second))
+        track := st.trackAudio
+        s.sample.PacketTimestamp = audioTS + rtpTicks(since, 48000)
+        if s.video {
+            track = st.trackVideo
+            s.sample.PacketTimestamp = videoTS + rtpTicks(since, ClockRate)
+            if !p.advance(gen, c.Start.Add(time.Duration(s.at*float64(time.Second)))) {
+                return false
+            }
+        }
+        if err := track.WriteSample(s.sample); err != nil {
+            errorLogger.Printf("Station %s (adsEnabled: %v): DVR sample write error for %s: %v", st.name, st.adsEnabled, c.Video, err)
+        }
+        // Keep the cursor's clocks running past what it sent, so the next
+        // chunk, or a jump, continues forward.
+        st.mu.Lock()
+        if s.video {
+            st.currentVideoRTPTS = s.sample.PacketTimestamp + rtpTicks(s.sample.Duration, ClockRate)
+        } else {
+            st.currentAudioSamples = s.sample.PacketTimestamp + rtpTicks(s.sample.Duration, 48000)
+        }
+        st.mu.Unlock()
+    }
+    return p.advance(gen, c.end())
+}
+
+func isKeyframe(frame []byte) bool {
+    for _, nalu := range splitNALUs(frame) {
+        if len(nalu) > 0 && nalu[0]&0x1F == 5 {
+            return true
+        }
+    }
+    return false
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+    "database/sql"
+    "encoding/xml"
+    "fmt"
+    "math"
+    "net/http"
+    "path"
+    "strings"
+    "time"
+    "github.com/gin-gonic/gin"
+    "config/schedule"
+)
+
+const (
+    GuideDefaultSpan = 24 * time.Hour // guide window when no "to" is given
+    GuideMaxSpan = 7 * 24 * time.Hour
+    guideMaxEntries = 2000 // per station, guards against zero-length loops
+)
+
+// GuideEntry is one programme on a station's guide. Start and Stop include
+// the estimated ad pods at the video's break points.
+type GuideEntry struct {
+    VideoID int64 `json:"video_id"`
+    TitleID int64 `json:"title_id"`
+    Title string `json:"title"`
+    Episode string `json:"episode"`
+    Description string `json:"description,omitempty"`
+    Start time.Time `json:"start"`
+    Stop time.Time `json:"stop"`
+    Duration float64 `json:"duration"` // content seconds
+    Breaks int `json:"breaks"`
+    Scheduled bool `json:"scheduled"`
+    Filler bool `json:"filler"`
+}
+
+// GuideStation is a station's guide over the requested window.
+type GuideStation struct {
+    ID int64 `json:"id"`
+    Name string `json:"name"`
+    Entries []GuideEntry `json:"entries"`
+}
+
+type guideVideo struct {
+    duration float64
+    breaks int
+    titleID int64
+    title string
+    description string
+    episode string
+    commercial bool
+}
+
+// guideBuilder computes guides, caching per-video lookups across stations.
+// podSeconds is the ad break length of the station being built.
+type guideBuilder struct {
+    db *sql.DB
+    podSeconds float64
+    videos map[int64]*guideVideo
+}
+
+func (g *guideBuilder) video(id int64) (*guideVideo, error) {
+    if v, ok := g.videos[id]; ok {
+        return v, nil
+    }
+    v := &guideVideo{}
+    var uri string
+    err := g.db.QueryRow(
+        `SELECT COALESCE(v.duration, 0), v.title_id, COALESCE(t.name, ''), COALESCE(t.description, ''), v.uri,
+            (SELECT COUNT(*) FROM video_metadata vm WHERE vm.video_id = v.id AND vm.metadata_type_id = 1),
+            EXISTS (SELECT 1 FROM video_tags vt WHERE vt.video_id = v.id AND vt.tag_id = 4)
+         FROM videos v LEFT JOIN titles t ON t.id = v.title_id WHERE v.id = $1`,
+        id).Scan(&v.duration, &v.titleID, &v.title, &v.description, &uri, &v.breaks, &v.commercial)
+    if err != nil {
+        return nil, fmt.Errorf("video %d: %w", id, err)
+    }
+    // URIs may be Windows paths.
+    episode := path.Base(strings.ReplaceAll(uri, "\\", "/"))
+    v.episode = strings.TrimSuffix(episode, path.Ext(episode))
+    g.videos[id] = v
+    return v, nil
+}
+
+func (g *guideBuilder) estimate(v *guideVideo) float64 {
+    return v.duration + float64(v.breaks)*g.podSeconds
+}
+
+// position is where a station is now: the live station if it is on air, its
+// saved state, which its next load resumes, or else its place in the
+// station_videos loop anchored at unix_start.
+func (g *guideBuilder) position(name string, unixStart int64, queue []int64, now time.Time) (int64, int, float64, error) {
+    mu.Lock()
+    st := stations[name]
+    mu.Unlock()
+    if st != nil {
+        st.mu.Lock()
+        defer st.mu.Unlock()
+        return st.currentVideo, st.currentIndex, st.currentOffset, nil
+    }
+    saved, err := loadStationState(g.db, name)
+    if err != nil {
+        return 0, 0, 0, err
+    }
+    if saved != nil {
+        if idx := resumeIndex(queue, saved); idx >= 0 || saved.currentIndex < 0 {
+            return saved.currentVideo, idx, saved.currentOffset, nil
+        }
+    }
+    total := 0.0
+    for _, vid := range queue {
+        v, err := g.video(vid)
+        if err != nil {
+            return 0, 0, 0, err
+        }
+        if !v.commercial {
+            total += v.duration
+        }
+    }
+    if total <= 0 {
+        return queue[0], 0, 0, nil
+    }
+    offset := math.Mod(float64(now.Unix()-unixStart), total)
+    for i, vid := range queue {
+        v := g.videos[vid]
+        if v.commercial || v.duration <= 0 {
+            continue
+        }
+        if offset < v.duration {
+            return vid, i, offset, nil
+        }
+        offset -= v.duration
+    }
+    return queue[0], 0, 0, nil
+}
+
+// station computes one station's guide over [from, to). It walks forward from
+// what is on air now the way advanceVideo does: the schedule's pick where a
+// block covers the time, the next station_videos entry otherwise.
+func (g *guideBuilder) station(id int64, name string, unixStart int64, from, to time.Time) (GuideStation, error) {
+    gs := GuideStation{ID: id, Name: name, Entries: []GuideEntry{}}
+    rows, err := g.db.Query(`SELECT video_id FROM station_videos WHERE station_id = $1 ORDER BY id ASC`, id)
+    if err != nil {
+        return gs, err
+    }
+    var queue []int64
+    for rows.Next() {
+        var vid int64
+        if err := rows.Scan(&vid); err != nil {
+            rows.Close()
+            return gs, err
+        }
+        queue = append(queue, vid)
+    }
+    rows.Close()
+    if err := rows.Err(); err != nil {
+        return gs, err
+    }
+    if len(queue) == 0 {
+        return gs, nil
+    }
+    now := time.Now()
+    vid, idx, offset, err := g.position(name, unixStart, queue, now)
+    if err != nil {
+        return gs, err
+    }
+    t := now.Add(-time.Duration(offset * float64(time.Second)))
+    planner, err := (&schedule.Engine{DB: g.db, PodSeconds: g.podSeconds}).Planner(id, t)
+    if err != nil {
+        return gs, err
+    }
+    var pick *schedule.Pick
+    for n := 0; t.Before(to) && n < guideMaxEntries; n++ {
+        if n > 0 {
+            if pick, err = planner.Next(t); err != nil {
+                return gs, err
+            }
+            if pick != nil {
+                vid = pick.VideoID
+                idx = queueIndex(queue, vid)
+            } else {
+                idx = (idx + 1) % len(queue)
+                vid = queue[idx]
+            }
+        }
+        v, err := g.video(vid)
+        if err != nil {
+            return gs, err
+        }
+        if v.duration <= 0 {
+            continue
+        }
+        stop := t.Add(time.Duration(g.estimate(v) * float64(time.Second)))
+        if stop.After(from) {
+            gs.Entries = append(gs.Entries, GuideEntry{
+                VideoID: vid,
+                TitleID: v.titleID,
+                Title: v.title,
+                Episode: v.episode,
+                Description: v.description,
+                Start: t,
+                Stop: stop,
+                Duration: v.duration,
+                Breaks: v.breaks,
+                Scheduled: pick != nil,
+                Filler: pick != nil && pick.Filler,
+            })
+        }
+        t = stop
+    }
+    return gs, nil
+}
+
+// buildGuide computes the guide for every station, or only the named one.
+// It returns sql.ErrNoRows if the named station does not exist.
+func buildGuide(db *sql.DB, stationName string, from, to time.Time, adsEnabled bool) ([]GuideStation, error) {
+    g := &guideBuilder{db: db, videos: make(map[int64]*guideVideo)}
+    query := `SELECT id, name, unix_start, ad_break_target_seconds FROM stations`
+    var args []interface{}
+    if stationName != "" {
+        query += ` WHERE name = $1`
+        args = append(args, stationName)
+    }
+    rows, err := db.Query(query+` ORDER BY name ASC`, args...)
+    if err != nil {
+        return nil, err
+    }
+    type stationRow struct {
+        id int64
+        name string
+        unixStart int64
+        adTarget sql.NullFloat64
+    }
+    var list []stationRow
+    for rows.Next() {
+        var s stationRow
+        if err := rows.Scan(&s.id, &s.name, &s.unixStart, &s.adTarget); err != nil {
+            rows.Close()
+            return nil, err
+        }
+        list = append(list, s)
+    }
+    rows.Close()
+    if err := rows.Err(); err != nil {
+        return nil, err
+    }
+    if stationName != "" && len(list) == 0 {
+        return nil, sql.ErrNoRows
+    }
+    guide := make([]GuideStation, 0, len(list))
+    for _, s := range list {
+        // Pods are built to the station's break target, so that is what
+        // each break point adds.
+        g.podSeconds = 0
+        if adsEnabled {
+            g.podSeconds = cfg.Ads.BreakTargetSeconds
+            if s.adTarget.Valid && s.adTarget.Float64 > 0 {
+                g.podSeconds = s.adTarget.Float64
+            }
+        }
+        gs, err := g.station(s.id, s.name, s.unixStart, from, to)
+        if err != nil {
+            return nil, fmt.Errorf("station %s: %w", s.name, err)
+        }
+        guide = append(guide, gs)
+    }
+    return guide, nil
+}
+
+// guideWindow reads the from/to query parameters (RFC 3339).
+func guideWindow(c *gin.Context) (time.Time, time.Time, error) {
+    from := time.Now()
+    var err error
+    if s := c.Query("from"); s != "" {
+        if from, err = time.Parse(time.RFC3339, s); err != nil {
+            return from, from, fmt.Errorf("invalid from, expected RFC 3339")
+        }
+    }
+    to := from.Add(GuideDefaultSpan)
+    if s := c.Query("to"); s != "" {
+        if to, err = time.Parse(time.RFC3339, s); err != nil {
+            return from, to, fmt.Errorf("invalid to, expected RFC 3339")
+        }
+    }
+    if !to.After(from) || to.Sub(from) > GuideMaxSpan {
+        return from, to, fmt.Errorf("to must be after from and at most %s later", GuideMaxSpan)
+    }
+    return from, to, nil
+}
+
+// guideHandler serves /api/guide?station=&from=&to=&adsEnabled=.
+func guideHandler(db *sql.DB, c *gin.Context) {
+    from, to, err := guideWindow(c)
+    if err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+        return
+    }
+    guide, err := buildGuide(db, c.Query("station"), from, to, c.Query("adsEnabled") != "false")
+    if err == sql.ErrNoRows {
+        c.JSON(http.StatusNotFound, gin.H{"error": "Invalid station"})
+        return
+    }
+    if err != nil {
+        errorLogger.Printf("Failed to build guide: %v", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to build guide"})
+        return
+    }
+    c.JSON(http.StatusOK, guide)
+}
+
+type xmltvDoc struct {
+    XMLName xml.Name `xml:"tv"`
+    GeneratorName string `xml:"generator-info-name,attr"`
+    Channels []xmltvChannel `xml:"channel"`
+    Programmes []xmltvProgramme `xml:"programme"`
+}
+
+type xmltvChannel struct {
+    ID string `xml:"id,attr"`
+    DisplayName string `xml:"display-name"`
+}
+
+type xmltvProgramme struct {
+    Start string `xml:"start,attr"`
+    Stop string `xml:"stop,attr"`
+    Channel string `xml:"channel,attr"`
+    Title string `xml:"title"`
+    SubTitle string `xml:"sub-title,omitempty"`
+    Desc string `xml:"desc,omitempty"`
+    Length *xmltvLength `xml:"length,omitempty"`
+}
+
+type xmltvLength struct {
+    Units string `xml:"units,attr"`
+    Value int `xml:",chardata"`
+}
+
+const xmltvTimeLayout = "20060102150405 -0700"
+
+func xmltvChannelID(st GuideStation) string {
+    return fmt.Sprintf("%s.%d", sanitizeTrackID(st.Name), st.ID)
+}
+
+// xmltvHandler serves /guide.xml with the same parameters as /api/guide.
+func xmltvHandler(db *sql.DB, c *gin.Context) {
+    from, to, err := guideWindow(c)
+    if err != nil {
+        c.String(http.StatusBadRequest, err.Error())
+        return
+    }
+    guide, err := buildGuide(db, c.Query("station"), from, to, c.Query("adsEnabled") != "false")
+    if err == sql.ErrNoRows {
+        c.String(http.StatusNotFound, "Invalid station")
+        return
+    }
+    if err != nil {
+        errorLogger.Printf("Failed to build XMLTV guide: %v", err)
+        c.String(http.StatusInternalServerError, "Failed to build guide")
+        return
+    }
+    doc := xmltvDoc{GeneratorName: "video_server"}
+    for _, st := range guide {
+        channel := xmltvChannelID(st)
+        doc.Channels = append(doc.Channels, xmltvChannel{ID: channel, DisplayName: st.Name})
+        for _, e := range st.Entries {
+            title := e.Title
+            if title == "" {
+                title = e.Episode
+            }
+            doc.Programmes = append(doc.Programmes, xmltvProgramme{
+                Start: e.Start.Format(xmltvTimeLayout),
+                Stop: e.Stop.Format(xmltvTimeLayout),
+                Channel: channel,
+                Title: title,
+                SubTitle: e.Episode,
+                Desc: e.Description,
+                Length: &xmltvLength{Units: "seconds", Value: int(math.Round(e.Duration))},
+            })
+        }
+    }
+    out, err := xml.MarshalIndent(doc, "", "  ")
+    if err != nil {
+        errorLogger.Printf("Failed to encode XMLTV guide: %v", err)
+        c.String(http.StatusInternalServerError, "Failed to build guide")
+        return
+    }
+    c.Data(http.StatusOK, "application/xml; charset=utf-8", append([]byte(xml.Header+`<!DOCTYPE tv SYSTEM "xmltv.dtd">`+"\n"), out...))
+}
@@ -0,0 +1,407 @@
+package main
+
+import (
+    "fmt"
+    "strings"
+)
+
+const (
+    DefaultH264Fmtp = "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42c034"
+    naluTypeSPS = 7
+    naluTypePPS = 8
+)
+
+// SPSInfo holds the fields of an H.264 sequence parameter set that matter for
+// SDP negotiation and pacing.
+type SPSInfo struct {
+    ProfileIDC uint8
+    ConstraintFlags uint8
+    LevelIDC uint8
+    SPSID uint
+    ChromaFormatIDC uint
+    Width int
+    Height int
+    FrameMbsOnly bool
+    SarWidth uint
+    SarHeight uint
+    TimingInfoPresent bool
+    NumUnitsInTick uint32
+    TimeScale uint32
+    FixedFrameRate bool
+}
+
+func (br *bitReader) readBits(n int) (uint, error) {
+    var val uint
+    for i := 0; i < n; i++ {
+        bit, err := br.readBit()
+        if err != nil {
+            return 0, err
+        }
+        val = (val << 1) | bit
+    }
+    return val, nil
+}
+
+func (br *bitReader) readFlag() (bool, error) {
+    bit, err := br.readBit()
+    return bit == 1, err
+}
+
+func (br *bitReader) readSe() (int, error) {
+    ue, err := br.readUe()
+    if err != nil {
+        return 0, err
+    }
+    if ue%2 == 1 {
+        return int((ue + 1) / 2), nil
+    }
+    return -int(ue / 2), nil
+}
+
+// unescapeRBSP strips emulation prevention bytes (00 00 03) from a NALU payload.
+func unescapeRBSP(ebsp []byte) []byte {
+    rbsp := make([]byte, 0, len(ebsp))
+    for i := 0; i < len(ebsp); {
+        if i+2 < len(ebsp) && ebsp[i] == 0 && ebsp[i+1] == 0 && ebsp[i+2] == 3 {
+            rbsp = append(rbsp, 0, 0)
+            i += 3
+        } else {
+            rbsp = append(rbsp, ebsp[i])
+            i++
+        }
+    }
+    return rbsp
+}
+
+func skipScalingList(br *bitReader, size int) error {
+    lastScale, nextScale := 8, 8
+    for j := 0; j < size; j++ {
+        if nextScale != 0 {
+            delta, err := br.readSe()
+            if err != nil {
+                return err
+            }
+            nextScale = (lastScale + delta + 256) % 256
+        }
+        if nextScale != 0 {
+            lastScale = nextScale
+        }
+    }
+    return nil
+}
+
+// parseSPS decodes an SPS NALU (including its one-byte NAL header).
+func parseSPS(nalu []byte) (*SPSInfo, error) {
+    if len(nalu) < 4 {
+        return nil, fmt.Errorf("SPS NALU too short")
+    }
+    if int(nalu[0]&0x1F) != naluTypeSPS {
+        return nil, fmt.Errorf("NALU type %d is not an SPS", nalu[0]&0x1F)
+    }
+    br := newBitReader(unescapeRBSP(nalu[1:]))
+    sps := &SPSInfo{ChromaFormatIDC: 1}
+    var err error
+    var v uint
+    readU := func(n int) uint {
+        if err != nil {
+            return 0
+        }
+        v, err = br.readBits(n)
+        return v
+    }
+    readUe := func() uint {
+        if err != nil {
+            return 0
+        }
+        v, err = br.readUe()
+        return v
+    }
+    readSe := func() int {
+        if err != nil {
+            return 0
+        }
+        var s int
+        s, err = br.readSe()
+        return s
+    }
+    readFlag := func() bool {
+        return readU(1) == 1
+    }
+    sps.ProfileIDC = uint8(readU(8))
+    sps.ConstraintFlags = uint8(readU(8))
+    sps.LevelIDC = uint8(readU(8))
+    sps.SPSID = readUe()
+    switch sps.ProfileIDC {
+    case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+        sps.ChromaFormatIDC = readUe()
+        if sps.ChromaFormatIDC == 3 {
+            readU(1) // separate_colour_plane_flag
+        }
+        readUe() // bit_depth_luma_minus8
+        readUe() // bit_depth_chroma_minus8
+        readU(1) // qpprime_y_zero_transform_bypass_flag
+        if readFlag() { // seq_scaling_matrix_present_flag
+            lists := 8
+            if sps.ChromaFormatIDC == 3 {
+                lists = 12
+            }
+            for i := 0; i < lists && err == nil; i++ {
+                if readFlag() {
+                    size := 16
+                    if i >= 6 {
+                        size = 64
+                    }
+                    if err == nil {
+                        err = skipScalingList(br, size)
+                    }
+                }
+            }
+        }
+    }
+    readUe() // log2_max_frame_num_minus4
+    pocType := readUe()
+    if pocType == 0 {
+        readUe() // log2_max_pic_order_cnt_lsb_minus4
+    } else if pocType == 1 {
+        readU(1) // delta_pic_order_always_zero_flag
+        readSe() // offset_for_non_ref_pic
+        readSe() // offset_for_top_to_bottom_field
+        cycle := readUe()
+        for i := uint(0); i < cycle && err == nil; i++ {
+            readSe()
+        }
+    }
+    readUe() // max_num_ref_frames
+    readU(1) // gaps_in_frame_num_value_allowed_flag
+    widthMbs := readUe() + 1
+    heightMapUnits := readUe() + 1
+    sps.FrameMbsOnly = readFlag()
+    if !sps.FrameMbsOnly {
+        readU(1) // mb_adaptive_frame_field_flag
+    }
+    readU(1) // direct_8x8_inference_flag
+    var cropLeft, cropRight, cropTop, cropBottom uint
+    if readFlag() {
+        cropLeft = readUe()
+        cropRight = readUe()
+        cropTop = readUe()
+        cropBottom = readUe()
+    }
+    if err != nil {
+        return nil, fmt.Errorf("truncated SPS: %v", err)
+    }
+    frameHeightFactor := uint(1)
+    if !sps.FrameMbsOnly {
+        frameHeightFactor = 2
+    }
+    cropUnitX, cropUnitY := uint(1), frameHeightFactor
+    switch sps.ChromaFormatIDC {
+    case 1:
+        cropUnitX, cropUnitY = 2, 2*frameHeightFactor
+    case 2:
+        cropUnitX, cropUnitY = 2, frameHeightFactor
+    }
+    sps.Width = int(widthMbs*16 - (cropLeft+cropRight)*cropUnitX)
+    sps.Height = int(heightMapUnits*16*frameHeightFactor - (cropTop+cropBottom)*cropUnitY)
+    if readFlag() { // vui_parameters_present_flag
+        if readFlag() { // aspect_ratio_info_present_flag
+            idc := readU(8)
+            if idc == 255 {
+                sps.SarWidth = readU(16)
+                sps.SarHeight = readU(16)
+            } else if int(idc) < len(sarTable) {
+                sps.SarWidth = sarTable[idc][0]
+                sps.SarHeight = sarTable[idc][1]
+            }
+        }
+        if readFlag() { // overscan_info_present_flag
+            readU(1)
+        }
+        if readFlag() { // video_signal_type_present_flag
+            readU(4)
+            if readFlag() { // colour_description_present_flag
+                readU(24)
+            }
+        }
+        if readFlag() { // chroma_loc_info_present_flag
+            readUe()
+            readUe()
+        }
+        if readFlag() { // timing_info_present_flag
+            sps.NumUnitsInTick = uint32(readU(32))
+            sps.TimeScale = uint32(readU(32))
+            sps.FixedFrameRate = readFlag()
+            sps.TimingInfoPresent = err == nil
+        }
+    }
+    // A truncated VUI still leaves the profile, level and resolution usable.
+    return sps, nil
+}
+
+var sarTable = [][2]uint{
+    {0, 0}, {1, 1}, {12, 11}, {10, 11}, {16, 11}, {40, 33}, {24, 11}, {20, 11},
+    {32, 11}, {80, 33}, {18, 11}, {15, 11}, {64, 33}, {160, 99}, {4, 3}, {3, 2}, {2, 1},
+}
+
+// ProfileLevelID returns the six hex digit profile-level-id used in SDP fmtp.
+func (s *SPSInfo) ProfileLevelID() string {
+    return fmt.Sprintf("%02x%02x%02x", s.ProfileIDC, s.ConstraintFlags, s.LevelIDC)
+}
+
+// FmtpLine builds the SDP fmtp line advertised for this SPS.
+func (s *SPSInfo) FmtpLine() string {
+    return "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=" + s.ProfileLevelID()
+}
+
+// FrameRate returns the frame rate signalled in the VUI timing info, if any.
+// H.264 time_scale counts field ticks, hence the factor of two.
+func (s *SPSInfo) FrameRate() (fpsPair, bool) {
+    if !s.TimingInfoPresent || s.NumUnitsInTick == 0 || s.TimeScale == 0 {
+        return fpsPair{}, false
+    }
+    return fpsPair{num: int(s.TimeScale), den: int(s.NumUnitsInTick) * 2}, true
+}
+
+func (s *SPSInfo) String() string {
+    return fmt.Sprintf("profile=%d constraints=0x%02x level=%d %dx%d sar=%d:%d timing=%v(%d/%d)", s.ProfileIDC, s.ConstraintFlags, s.LevelIDC, s.Width, s.Height, s.SarWidth, s.SarHeight, s.TimingInfoPresent, s.TimeScale, s.NumUnitsInTick)
+}
+
+// h264Profiles maps profile_idc and the constraint_set flags to the RFC 6184
+// profile they signal, as browsers match them: an entry applies when
+// ConstraintFlags&mask == value. Constrained Baseline is spelled 42c0, 42e0
+// or 4240 depending on the encoder.
+var h264Profiles = []struct {
+    idc, mask, value uint8
+    name string
+}{
+    {0x42, 0x4F, 0x40, "constrained-baseline"},
+    {0x4D, 0x8F, 0x80, "constrained-baseline"},
+    {0x58, 0xCF, 0xC0, "constrained-baseline"},
+    {0x42, 0x4F, 0x00, "baseline"},
+    {0x58, 0xCF, 0x80, "baseline"},
+    {0x4D, 0xAF, 0x00, "main"},
+    {0x64, 0xFF, 0x00, "high"},
+    {0x64, 0xFF, 0x0C, "constrained-high"},
+    {0xF4, 0xFF, 0x00, "predictive-high-444"},
+}
+
+// Profile returns the RFC 6184 profile of s, or "" if it is not one WebRTC
+// negotiates.
+func (s *SPSInfo) Profile() string {
+    for _, p := range h264Profiles {
+        if s.ProfileIDC == p.idc && s.ConstraintFlags&p.mask == p.value {
+            return p.name
+        }
+    }
+    return ""
+}
+
+// sameProfile reports whether s and other signal the same RFC 6184 profile.
+// Profiles outside the table only match an identical profile_idc and
+// constraint byte.
+func (s *SPSInfo) sameProfile(other *SPSInfo) bool {
+    if p := s.Profile(); p != "" {
+        return p == other.Profile()
+    }
+    return s.ProfileIDC == other.ProfileIDC && s.ConstraintFlags == other.ConstraintFlags
+}
+
+// compatibleWith reports whether a decoder negotiated for s can decode a stream
+// described by other: the same profile, and a level no higher.
+func (s *SPSInfo) compatibleWith(other *SPSInfo) bool {
+    if s == nil || other == nil {
+        return true
+    }
+    return s.sameProfile(other) && other.LevelIDC <= s.LevelIDC
+}
+
+// findSPS returns the first SPS NALU in nalus, or nil.
+func findSPS(nalus [][]byte) []byte {
+    for _, nalu := range nalus {
+        if len(nalu) > 0 && int(nalu[0]&0x1F) == naluTypeSPS {
+            return nalu
+        }
+    }
+    return nil
+}
+
+// profileLevelIDFromFmtp extracts the profile-level-id value from an fmtp line.
+func profileLevelIDFromFmtp(fmtp string) string {
+    for _, param := range strings.Split(fmtp, ";") {
+        kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+        if len(kv) == 2 && strings.EqualFold(kv[0], "profile-level-id") {
+            return strings.ToLower(kv[1])
+        }
+    }
+    return ""
+}
+
+// spsFromFmtp rebuilds the profile/constraint/level triple from an fmtp line.
+func spsFromFmtp(fmtp string) *SPSInfo {
+    id := profileLevelIDFromFmtp(fmtp)
+    if len(id) != 6 {
+        return nil
+    }
+    var p, c, l uint8
+    if _, err := fmt.Sscanf(id, "%02x%02x%02x", &p, &c, &l); err != nil {
+        return nil
+    }
+    return &SPSInfo{ProfileIDC: p, ConstraintFlags: c, LevelIDC: l}
+}
+
+// offerFmtp picks the fmtp line to register for a new peer. Every viewer shares
+// the station's track, so once one fmtp has been negotiated it is reused; before
+// that the SPS of the most recently processed chunk is used. Caller holds st.mu.
+func (st *Station) offerFmtp() string {
+    if st.negotiatedFmtp != "" {
+        return st.negotiatedFmtp
+    }
+    if st.sps != nil {
+        return st.sps.FmtpLine()
+    }
+    if st.fmtpLine != "" {
+        return st.fmtpLine
+    }
+    return DefaultH264Fmtp
+}
+
+// offerSupportsFmtp reports whether a remote offer lists an H.264 format with
+// packetization-mode=1 and the same RFC 6184 profile as fmtp. Levels are not
+// compared: browsers offer 3.1 and accept higher with
+// level-asymmetry-allowed. Offers without any H.264 fmtp lines are let
+// through so pion can make the final decision.
+func offerSupportsFmtp(offerSDP, fmtp string) bool {
+    want := spsFromFmtp(fmtp)
+    if want == nil {
+        return true
+    }
+    h264PTs := map[string]bool{}
+    var fmtpLines []string
+    for _, line := range strings.Split(offerSDP, "\n") {
+        line = strings.TrimSpace(line)
+        if strings.HasPrefix(line, "a=rtpmap:") && strings.Contains(strings.ToUpper(line), "H264/") {
+            if fields := strings.Fields(strings.TrimPrefix(line, "a=rtpmap:")); len(fields) > 0 {
+                h264PTs[fields[0]] = true
+            }
+        } else if strings.HasPrefix(line, "a=fmtp:") {
+            fmtpLines = append(fmtpLines, strings.TrimPrefix(line, "a=fmtp:"))
+        }
+    }
+    if len(h264PTs) == 0 {
+        return true
+    }
+    for _, line := range fmtpLines {
+        fields := strings.SplitN(line, " ", 2)
+        if len(fields) != 2 || !h264PTs[fields[0]] {
+            continue
+        }
+        if !strings.Contains(fields[1], "packetization-mode=1") {
+            continue
+        }
+        have := spsFromFmtp(fields[1])
+        if have != nil && have.sameProfile(want) {
+            return true
+        }
+    }
+    return false
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+    "bytes"
+    "fmt"
+    "testing"
+)
+
+// bitWriter builds RBSP bit strings for the SPS tests.
+type bitWriter struct {
+    data []byte
+    n int
+}
+
+func (w *bitWriter) bits(v uint64, n int) {
+    for i := n - 1; i >= 0; i-- {
+        if w.n%8 == 0 {
+            w.data = append(w.data, 0)
+        }
+        if v>>uint(i)&1 == 1 {
+            w.data[len(w.data)-1] |= 0x80 >> uint(w.n%8)
+        }
+        w.n++
+    }
+}
+
+func (w *bitWriter) flag(b bool) {
+    if b {
+        w.bits(1, 1)
+    } else {
+        w.bits(0, 1)
+    }
+}
+
+func (w *bitWriter) ue(v uint) {
+    code := uint64(v) + 1
+    size := 0
+    for c := code; c > 1; c >>= 1 {
+        size++
+    }
+    w.bits(0, size)
+    w.bits(code, size+1)
+}
+
+// testSPS is what buildSPS encodes.
+type testSPS struct {
+    profile, constraints, level uint8
+    widthMbs, heightMapUnits uint
+    frameMbsOnly bool
+    cropBottom uint
+    sarIdc uint8
+    units, scale uint32 // VUI timing, written when scale is set
+}
+
+// buildSPS encodes s as an SPS NALU with header, the way x264 lays one out:
+// POC type 0, one reference frame and, for high profiles, 4:2:0 8-bit with no
+// scaling matrices.
+func buildSPS(s testSPS) []byte {
+    w := &bitWriter{}
+    w.bits(uint64(s.profile), 8)
+    w.bits(uint64(s.constraints), 8)
+    w.bits(uint64(s.level), 8)
+    w.ue(0) // seq_parameter_set_id
+    if s.profile == 100 {
+        w.ue(1) // chroma_format_idc
+        w.ue(0) // bit_depth_luma_minus8
+        w.ue(0) // bit_depth_chroma_minus8
+        w.flag(false) // qpprime_y_zero_transform_bypass_flag
+        w.flag(false) // seq_scaling_matrix_present_flag
+    }
+    w.ue(0) // log2_max_frame_num_minus4
+    w.ue(0) // pic_order_cnt_type
+    w.ue(2) // log2_max_pic_order_cnt_lsb_minus4
+    w.ue(1) // max_num_ref_frames
+    w.flag(false) // gaps_in_frame_num_value_allowed_flag
+    w.ue(s.widthMbs - 1)
+    w.ue(s.heightMapUnits - 1)
+    w.flag(s.frameMbsOnly)
+    if !s.frameMbsOnly {
+        w.flag(false) // mb_adaptive_frame_field_flag
+    }
+    w.flag(true) // direct_8x8_inference_flag
+    w.flag(s.cropBottom > 0)
+    if s.cropBottom > 0 {
+        w.ue(0)
+        w.ue(0)
+        w.ue(0)
+        w.ue(s.cropBottom)
+    }
+    vui := s.sarIdc > 0 || s.scale > 0
+    w.flag(vui)
+    if vui {
+        w.flag(s.sarIdc > 0)
+        if s.sarIdc > 0 {
+            w.bits(uint64(s.sarIdc), 8)
+        }
+        w.flag(false) // overscan_info_present_flag
+        w.flag(false) // video_signal_type_present_flag
+        w.flag(false) // chroma_loc_info_present_flag
+        w.flag(s.scale > 0)
+        if s.scale > 0 {
+            w.bits(uint64(s.units), 32)
+            w.bits(uint64(s.scale), 32)
+            w.flag(true)
+        }
+    }
+    w.bits(1, 1) // rbsp_stop_one_bit
+    return append([]byte{0x67}, escapeRBSP(w.data)...)
+}
+
+// escapeRBSP inserts emulation prevention bytes, the inverse of unescapeRBSP.
+func escapeRBSP(rbsp []byte) []byte {
+    var out []byte
+    zeros := 0
+    for _, b := range rbsp {
+        if zeros == 2 && b <= 3 {
+            out = append(out, 3)
+            zeros = 0
+        }
+        out = append(out, b)
+        if b == 0 {
+            zeros++
+        } else {
+            zeros = 0
+        }
+    }
+    return out
+}
+
+func TestParseSPS(t *testing.T) {
+    tests := []struct {
+        name string
+        sps testSPS
+        profileLevelID string
+        width, height int
+        sar [2]uint
+        fps fpsPair
+    }{
+        {"constrained baseline 3.1 720p", testSPS{profile: 66, constraints: 0xc0, level: 31, widthMbs: 80, heightMapUnits: 45, frameMbsOnly: true}, "42c01f", 1280, 720, [2]uint{}, fpsPair{}},
+        {"constrained baseline 5.2", testSPS{profile: 66, constraints: 0xc0, level: 52, widthMbs: 120, heightMapUnits: 68, frameMbsOnly: true, cropBottom: 4}, "42c034", 1920, 1080, [2]uint{}, fpsPair{}},
+        {"main 3.0 interlaced 480i", testSPS{profile: 77, constraints: 0x40, level: 30, widthMbs: 45, heightMapUnits: 15, sarIdc: 3}, "4d401e", 720, 480, [2]uint{10, 11}, fpsPair{}},
+        {"high 4.0 1080p 29.97", testSPS{profile: 100, level: 40, widthMbs: 120, heightMapUnits: 68, frameMbsOnly: true, cropBottom: 4, sarIdc: 1, units: 1001, scale: 60000}, "640028", 1920, 1080, [2]uint{1, 1}, fpsPair{num: 60000, den: 2002}},
+    }
+    for _, tt := range tests {
+        sps, err := parseSPS(buildSPS(tt.sps))
+        if err != nil {
+            t.Errorf("%s: parseSPS: %v", tt.name, err)
+            continue
+        }
+        if got := sps.ProfileLevelID(); got != tt.profileLevelID {
+            t.Errorf("%s: ProfileLevelID = %s, want %s", tt.name, got, tt.profileLevelID)
+        }
+        if want := "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=" + tt.profileLevelID; sps.FmtpLine() != want {
+            t.Errorf("%s: FmtpLine = %s, want %s", tt.name, sps.FmtpLine(), want)
+        }
+        if sps.Width != tt.width || sps.Height != tt.height {
+            t.Errorf("%s: size %dx%d, want %dx%d", tt.name, sps.Width, sps.Height, tt.width, tt.height)
+        }
+        if sps.SarWidth != tt.sar[0] || sps.SarHeight != tt.sar[1] {
+            t.Errorf("%s: sar %d:%d, want %d:%d", tt.name, sps.SarWidth, sps.SarHeight, tt.sar[0], tt.sar[1])
+        }
+        fps, ok := sps.FrameRate()
+        if ok != (tt.fps != fpsPair{}) || fps != tt.fps {
+            t.Errorf("%s: FrameRate = %v %v, want %v", tt.name, fps, ok, tt.fps)
+        }
+        if back := spsFromFmtp(sps.FmtpLine()); back == nil || !back.compatibleWith(sps) {
+            t.Errorf("%s: fmtp %s does not round-trip", tt.name, sps.FmtpLine())
+        }
+    }
+}
+
+func TestParseSPSDefaultFmtp(t *testing.T) {
+    sps, err := parseSPS(buildSPS(testSPS{profile: 66, constraints: 0xc0, level: 52, widthMbs: 80, heightMapUnits: 45, frameMbsOnly: true}))
+    if err != nil {
+        t.Fatalf("parseSPS: %v", err)
+    }
+    if sps.FmtpLine() != DefaultH264Fmtp {
+        t.Errorf("FmtpLine = %s, want DefaultH264Fmtp %s", sps.FmtpLine(), DefaultH264Fmtp)
+    }
+}
+
+func TestParseSPSErrors(t *testing.T) {
+    high := buildSPS(testSPS{profile: 100, level: 40, widthMbs: 120, heightMapUnits: 68, frameMbsOnly: true})
+    tests := []struct {
+        name string
+        nalu []byte
+    }{
+        {"empty", nil},
+        {"too short", []byte{0x67, 0x42, 0xc0}},
+        {"pps", append([]byte{0x68}, high[1:]...)},
+        {"truncated", high[:6]},
+    }
+    for _, tt := range tests {
+        if sps, err := parseSPS(tt.nalu); err == nil {
+            t.Errorf("%s: parseSPS = %v, want an error", tt.name, sps)
+        }
+    }
+}
+
+func TestUnescapeRBSP(t *testing.T) {
+    tests := []struct {
+        in, want []byte
+    }{
+        {[]byte{0x42, 0xc0, 0x1f}, []byte{0x42, 0xc0, 0x1f}},
+        {[]byte{0x00, 0x00, 0x03, 0x01}, []byte{0x00, 0x00, 0x01}},
+        {[]byte{0x64, 0x00, 0x00, 0x03, 0x00, 0x00, 0x03, 0x03}, []byte{0x64, 0x00, 0x00, 0x00, 0x00, 0x03}},
+        {[]byte{0x00, 0x00, 0x03}, []byte{0x00, 0x00}},
+    }
+    for _, tt := range tests {
+        if got := unescapeRBSP(tt.in); !bytes.Equal(got, tt.want) {
+            t.Errorf("unescapeRBSP(% x) = % x, want % x", tt.in, got, tt.want)
+        }
+        if got := unescapeRBSP(escapeRBSP(tt.want)); !bytes.Equal(got, tt.want) {
+            t.Errorf("escape/unescape of % x = % x", tt.want, got)
+        }
+    }
+}
+
+func TestProfileLevelIDFromFmtp(t *testing.T) {
+    tests := []struct {
+        fmtp, want string
+    }{
+        {DefaultH264Fmtp, "42c034"},
+        {"packetization-mode=1; Profile-Level-Id=42E01F", "42e01f"},
+        {"packetization-mode=1", ""},
+    }
+    for _, tt := range tests {
+        if got := profileLevelIDFromFmtp(tt.fmtp); got != tt.want {
+            t.Errorf("profileLevelIDFromFmtp(%q) = %q, want %q", tt.fmtp, got, tt.want)
+        }
+    }
+}
+
+// chromeOffer is the video section of a Chrome 120 offer, trimmed of the
+// formats it lists besides H.264 and VP8.
+const chromeOffer = "v=0\r\n" +
+    "o=- 4611731400430051336 2 IN IP4 127.0.0.1\r\n" +
+    "s=-\r\n" +
+    "t=0 0\r\n" +
+    "a=group:BUNDLE 0 1\r\n" +
+    "m=video 9 UDP/TLS/RTP/SAVPF 96 97 102 103 104 105 106 107 108 109 127 125 39 40\r\n" +
+    "c=IN IP4 0.0.0.0\r\n" +
+    "a=mid:0\r\n" +
+    "a=recvonly\r\n" +
+    "a=rtcp-mux\r\n" +
+    "a=rtpmap:96 VP8/90000\r\n" +
+    "a=rtcp-fb:96 nack pli\r\n" +
+    "a=rtpmap:97 rtx/90000\r\n" +
+    "a=fmtp:97 apt=96\r\n" +
+    "a=rtpmap:102 H264/90000\r\n" +
+    "a=rtcp-fb:102 nack pli\r\n" +
+    "a=fmtp:102 level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42001f\r\n" +
+    "a=rtpmap:103 rtx/90000\r\n" +
+    "a=fmtp:103 apt=102\r\n" +
+    "a=rtpmap:104 H264/90000\r\n" +
+    "a=fmtp:104 level-asymmetry-allowed=1;packetization-mode=0;profile-level-id=42001f\r\n" +
+    "a=rtpmap:105 rtx/90000\r\n" +
+    "a=fmtp:105 apt=104\r\n" +
+    "a=rtpmap:106 H264/90000\r\n" +
+    "a=fmtp:106 level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f\r\n" +
+    "a=rtpmap:107 rtx/90000\r\n" +
+    "a=fmtp:107 apt=106\r\n" +
+    "a=rtpmap:108 H264/90000\r\n" +
+    "a=fmtp:108 level-asymmetry-allowed=1;packetization-mode=0;profile-level-id=42e01f\r\n" +
+    "a=rtpmap:109 rtx/90000\r\n" +
+    "a=fmtp:109 apt=108\r\n" +
+    "a=rtpmap:127 H264/90000\r\n" +
+    "a=fmtp:127 level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=4d001f\r\n" +
+    "a=rtpmap:125 rtx/90000\r\n" +
+    "a=fmtp:125 apt=127\r\n" +
+    "a=rtpmap:39 H264/90000\r\n" +
+    "a=fmtp:39 level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=640c1f\r\n" +
+    "a=rtpmap:40 rtx/90000\r\n" +
+    "a=fmtp:40 apt=39\r\n"
+
+// firefoxOffer is the video section of a Firefox 121 offer.
+const firefoxOffer = "v=0\r\n" +
+    "o=mozilla...THIS_IS_SDPARTA-99.0 1969766405787419436 0 IN IP4 0.0.0.0\r\n" +
+    "s=-\r\n" +
+    "t=0 0\r\n" +
+    "m=video 9 UDP/TLS/RTP/SAVPF 120 124 121 125 126 127 97 98\r\n" +
+    "c=IN IP4 0.0.0.0\r\n" +
+    "a=recvonly\r\n" +
+    "a=fmtp:126 profile-level-id=42e01f;level-asymmetry-allowed=1;packetization-mode=1\r\n" +
+    "a=fmtp:97 profile-level-id=42e01f;level-asymmetry-allowed=1\r\n" +
+    "a=fmtp:120 max-fs=12288;max-fr=60\r\n" +
+    "a=fmtp:121 max-fs=12288;max-fr=60\r\n" +
+    "a=fmtp:127 apt=126\r\n" +
+    "a=fmtp:98 apt=97\r\n" +
+    "a=rtpmap:120 VP8/90000\r\n" +
+    "a=rtpmap:121 VP9/90000\r\n" +
+    "a=rtpmap:126 H264/90000\r\n" +
+    "a=rtpmap:97 H264/90000\r\n"
+
+// h264Offer is an offer listing only the given H.264 fmtp parameters.
+func h264Offer(fmtps ...string) string {
+    sdp := "v=0\r\nm=video 9 UDP/TLS/RTP/SAVPF\r\n"
+    for i, f := range fmtps {
+        sdp += fmt.Sprintf("a=rtpmap:%d H264/90000\r\na=fmtp:%d %s\r\n", 100+i, 100+i, f)
+    }
+    return sdp
+}
+
+func TestOfferSupportsFmtp(t *testing.T) {
+    tests := []struct {
+        name, offer, fmtp string
+        want bool
+    }{
+        {"chrome, station default", chromeOffer, DefaultH264Fmtp, true},
+        {"firefox, station default", firefoxOffer, DefaultH264Fmtp, true},
+        {"safari 42401f", h264Offer("packetization-mode=1;profile-level-id=640c1f", "packetization-mode=1;profile-level-id=42401f"), DefaultH264Fmtp, true},
+        {"constrained baseline 42e0 station", chromeOffer, "packetization-mode=1;profile-level-id=42e028", true},
+        {"chrome, constrained high station", chromeOffer, "packetization-mode=1;profile-level-id=640c34", true},
+        {"chrome, main station", chromeOffer, "packetization-mode=1;profile-level-id=4d0028", true},
+        {"only baseline", h264Offer("packetization-mode=1;profile-level-id=42001f"), DefaultH264Fmtp, false},
+        {"only main and high", h264Offer("packetization-mode=1;profile-level-id=4d001f", "packetization-mode=1;profile-level-id=640c1f"), DefaultH264Fmtp, false},
+        {"constrained baseline without packetization-mode=1", h264Offer("profile-level-id=42e01f;level-asymmetry-allowed=1"), DefaultH264Fmtp, false},
+        {"no H.264 at all", "v=0\r\nm=video 9 UDP/TLS/RTP/SAVPF 96\r\na=rtpmap:96 VP8/90000\r\n", DefaultH264Fmtp, true},
+        {"high 4:4:4 station", chromeOffer, "packetization-mode=1;profile-level-id=f40032", false},
+    }
+    for _, tt := range tests {
+        if got := offerSupportsFmtp(tt.offer, tt.fmtp); got != tt.want {
+            t.Errorf("%s: offerSupportsFmtp = %v, want %v", tt.name, got, tt.want)
+        }
+    }
+}
+
+func TestSPSProfile(t *testing.T) {
+    tests := []struct {
+        profileLevelID, want string
+    }{
+        {"42c034", "constrained-baseline"},
+        {"42e01f", "constrained-baseline"},
+        {"42401f", "constrained-baseline"},
+        {"4d801f", "constrained-baseline"},
+        {"42001f", "baseline"},
+        {"4d001f", "main"},
+        {"640028", "high"},
+        {"640c1f", "constrained-high"},
+        {"6e0028", ""},
+    }
+    for _, tt := range tests {
+        sps := spsFromFmtp("profile-level-id=" + tt.profileLevelID)
+        if got := sps.Profile(); got != tt.want {
+            t.Errorf("Profile of %s = %q, want %q", tt.profileLevelID, got, tt.want)
+        }
+    }
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+    "database/sql"
+    "log"
+    "net/http"
+    "os"
+    "path/filepath"
+    "strings"
+    "time"
+    "github.com/gin-gonic/gin"
+    "video_server/video"
+)
+
+const (
+    HLSViewerTimeout = 30 * time.Second // an HLS client counts as a viewer this long after its last request
+    HLSPlaylistWait = 20 * time.Second // how long a first playlist request waits for the first segment
+)
+
+// packageForHLS hands a chunk that is about to be transmitted to the station's
+// HLS packager, if any client is watching over HLS. airStart is when its
+// first frame goes out over WebRTC.
+func packageForHLS(st *Station, frames [][]byte, chunk bufferedChunk, audioData []byte, segPath string, cue *video.Cue, airStart time.Time) {
+    if len(frames) == 0 {
+        return
+    }
+    st.mu.Lock()
+    p := st.hls
+    discontinuity := st.hlsDiscontinuity
+    st.hlsDiscontinuity = false
+    st.mu.Unlock()
+    if p == nil {
+        return
+    }
+    p.Enqueue(video.Chunk{
+        Frames: frames,
+        Duration: chunk.dur,
+        AudioOgg: audioData,
+        Discontinuity: discontinuity,
+        Label: segPath,
+        Start: airStart,
+        Cue: cue,
+    })
+}
+
+// touchHLSViewer records an HLS request for st. The first request creates the
+// packager and counts as one viewer until no request has been seen for
+// HLSViewerTimeout.
+func touchHLSViewer(st *Station, db *sql.DB) (*video.Packager, error) {
+    st.mu.Lock()
+    st.hlsLastAccess = time.Now()
+    if st.hls != nil {
+        p := st.hls
+        st.mu.Unlock()
+        return p, nil
+    }
+    p, err := video.NewPackager(filepath.Join(cfg.Paths.HLSDir, sanitizeTrackID(st.name)), video.DefaultSegmentDuration, video.DefaultWindowSize)
+    if err != nil {
+        st.mu.Unlock()
+        return nil, err
+    }
+    st.hls = p
+    st.mu.Unlock()
+    if err := addViewer(st, db); err != nil {
+        st.mu.Lock()
+        if st.hls == p {
+            st.hls = nil
+        }
+        st.mu.Unlock()
+        p.Close()
+        return nil, err
+    }
+    go hlsWatchdog(st, p)
+    return p, nil
+}
+
+// hlsWatchdog releases the HLS viewer slot once clients stop polling.
+func hlsWatchdog(st *Station, p *video.Packager) {
+    ticker := time.NewTicker(5 * time.Second)
+    defer ticker.Stop()
+    for range ticker.C {
+        st.mu.Lock()
+        if st.hls != p {
+            st.mu.Unlock()
+            return
+        }
+        if time.Since(st.hlsLastAccess) < HLSViewerTimeout {
+            st.mu.Unlock()
+            continue
+        }
+        st.hls = nil
+        st.mu.Unlock()
+        log.Printf("Station %s: No HLS requests for %v, stopping HLS output", st.name, HLSViewerTimeout)
+        go p.Close()
+        removeViewer(st)
+        return
+    }
+}
+
+// hlsHandler serves /hls/<station>/playlist.m3u8 and its segments. Only the
+// ad-supported variant of a station is packaged.
+func hlsHandler(db *sql.DB, c *gin.Context) {
+    parts := strings.SplitN(strings.TrimPrefix(c.Param("path"), "/"), "/", 2)
+    if len(parts) != 2 || parts[0] == "" {
+        c.String(http.StatusNotFound, "Expected /hls/<station>/playlist.m3u8")
+        return
+    }
+    stationName, file := parts[0], parts[1]
+    isPlaylist := file == video.PlaylistName
+    if !isPlaylist && (!strings.HasPrefix(file, "segment_") || !strings.HasSuffix(file, ".ts") || strings.ContainsAny(file, `/\`)) {
+        c.String(http.StatusNotFound, "Not found")
+        return
+    }
+    st, errMsg := lookupStation(db, stationName, true)
+    if st == nil {
+        c.String(http.StatusNotFound, errMsg)
+        return
+    }
+    p, err := touchHLSViewer(st, db)
+    if err != nil {
+        errorLogger.Printf("Station %s: Failed to start HLS output: %v", stationName, err)
+        c.String(http.StatusInternalServerError, "Failed to start HLS output")
+        return
+    }
+    fullPath := filepath.Join(p.Dir, file)
+    if isPlaylist {
+        deadline := time.Now().Add(HLSPlaylistWait)
+        for {
+            if _, err := os.Stat(fullPath); err == nil || time.Now().After(deadline) {
+                break
+            }
+            time.Sleep(500 * time.Millisecond)
+        }
+        c.Header("Content-Type", "application/vnd.apple.mpegurl")
+        c.Header("Cache-Control", "no-cache")
+    } else {
+        c.Header("Content-Type", "video/mp2t")
+    }
+    if _, err := os.Stat(fullPath); err != nil {
+        c.Header("Retry-After", "2")
+        c.String(http.StatusNotFound, "Not available yet")
+        return
+    }
+    c.File(fullPath)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+    "bytes"
+    "time"
+    "github.com/pion/rtcp"
+    "github.com/pion/webrtc/v3"
+)
+
+// keyframeMinInterval spaces out keyframes resent to one viewer, which keeps
+// asking with PLIs until it decodes one.
+const keyframeMinInterval = 500 * time.Millisecond
+
+// keyframeCache is the last IDR access unit of one rendition of a video
+// track, with the SPS/PPS it decodes against, so a viewer that joins
+// mid-GOP or loses packets can be sent it with the next frame instead of
+// waiting up to a keyint for the next one.
+type keyframeCache struct {
+    sps []byte
+    pps []byte
+    au []byte // Annex B: SPS, PPS, IDR slices
+}
+
+// note records frame if it is a keyframe, and any SPS/PPS in it.
+func (k *keyframeCache) note(frame []byte) {
+    idr := false
+    hasSPS, hasPPS := false, false
+    for _, nalu := range splitNALUs(frame) {
+        if len(nalu) == 0 {
+            continue
+        }
+        switch nalu[0] & 0x1F {
+        case naluTypeSPS:
+            k.sps, hasSPS = nalu, true
+        case naluTypePPS:
+            k.pps, hasPPS = nalu, true
+        case 5:
+            idr = true
+        }
+    }
+    if !idr {
+        return
+    }
+    k.au = nil
+    if hasSPS && hasPPS {
+        k.au = frame
+    } else if k.sps != nil && k.pps != nil {
+        var au bytes.Buffer
+        for _, n := range [][]byte{k.sps, k.pps} {
+            au.Write([]byte{0x00, 0x00, 0x00, 0x01})
+            au.Write(n)
+        }
+        au.Write(frame)
+        k.au = au.Bytes()
+    }
+}
+
+// wantKeyframe asks for a keyframe for the binding with ssrc. The track
+// answers at its next frame, so the RTP timeline never runs backwards.
+func (t *stationTrack) wantKeyframe(ssrc webrtc.SSRC) {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    for _, b := range t.bindings {
+        if b.ssrc == ssrc && time.Since(b.lastKeyframe) >= keyframeMinInterval {
+            b.lastKeyframe = time.Now()
+            b.keyframePending = true
+        }
+    }
+}
+
+// keyframeFor is what to send a binding that asked for a keyframe in place of
+// frame, from rendition k: nil if frame is a keyframe itself (as at every
+// chunk start) or none is cached yet. The caller sends it at frame's
+// timestamp with a payloader of its own, so the track's keeps its SPS/PPS
+// state. Caller holds t.mu.
+func (t *stationTrack) keyframeFor(k int, frame []byte) []byte {
+    if isKeyframe(frame) {
+        return nil
+    }
+    return t.keyframes[k].au
+}
+
+// isKeyframeRequest reports whether p is a PLI or FIR.
+func isKeyframeRequest(p rtcp.Packet) bool {
+    switch p.(type) {
+    case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+        return true
+    }
+    return false
+}
+
+// requestKeyframe answers a PLI or FIR read from sender by sending this
+// viewer the station's last keyframe in place of its next frame.
+func (vs *viewerSession) requestKeyframe(sender *webrtc.RTPSender) {
+    t, ok := sender.Track().(*stationTrack)
+    if !ok || t.Kind() != webrtc.RTPCodecTypeVideo {
+        return
+    }
+    encodings := sender.GetParameters().Encodings
+    if len(encodings) == 0 {
+        return
+    }
+    t.wantKeyframe(encodings[0].SSRC)
+}
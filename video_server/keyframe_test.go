@@ -0,0 +1,75 @@
+package main
+
+import (
+    "testing"
+    "github.com/pion/rtp"
+    "github.com/pion/webrtc/v3"
+    "github.com/pion/webrtc/v3/pkg/media"
+)
+
+// recordingWriter keeps the RTP headers written to a binding.
+type recordingWriter struct {
+    headers []rtp.Header
+}
+
+func (w *recordingWriter) WriteRTP(h *rtp.Header, payload []byte) (int, error) {
+    w.headers = append(w.headers, *h)
+    return len(payload), nil
+}
+
+func (w *recordingWriter) Write(b []byte) (int, error) {
+    return len(b), nil
+}
+
+func TestWantKeyframe(t *testing.T) {
+    track, err := newStationTrack(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: 90000}, "video", "station")
+    if err != nil {
+        t.Fatal(err)
+    }
+    asker, other := &recordingWriter{}, &recordingWriter{}
+    track.bindings = []*trackBinding{
+        {ssrc: 1, writeStream: asker, sequencer: rtp.NewFixedSequencer(0)},
+        {ssrc: 2, writeStream: other, sequencer: rtp.NewFixedSequencer(0)},
+    }
+    start := []byte{0, 0, 0, 1, 0x67, 0x42, 0xc0, 0x1f, 0, 0, 0, 1, 0x68, 0xce, 0, 0, 0, 1, 0x65, 0x88, 0x84}
+    delta := []byte{0, 0, 0, 1, 0x41, 0x9a, 0x02}
+    write := func(frame []byte, ts uint32, chunkStart bool) {
+        if err := track.WriteRenditions([]media.Sample{{Data: frame, PacketTimestamp: ts}}, chunkStart); err != nil {
+            t.Fatal(err)
+        }
+    }
+    write(start, 1000, true)
+    write(delta, 4000, false)
+    track.wantKeyframe(1)
+    write(delta, 7000, false)
+    track.wantKeyframe(1) // within keyframeMinInterval, ignored
+    write(delta, 10000, false)
+    // asker: STAP-A + IDR, delta, the cached STAP-A + IDR at 7000, delta.
+    wantAsker := []uint32{1000, 1000, 4000, 7000, 7000, 10000}
+    wantOther := []uint32{1000, 1000, 4000, 7000, 10000}
+    for _, tt := range []struct {
+        name string
+        got []rtp.Header
+        want []uint32
+    }{{"asker", asker.headers, wantAsker}, {"other", other.headers, wantOther}} {
+        if len(tt.got) != len(tt.want) {
+            t.Errorf("%s: %d packets, want %d", tt.name, len(tt.got), len(tt.want))
+            continue
+        }
+        for i, h := range tt.got {
+            if h.Timestamp != tt.want[i] || h.SequenceNumber != uint16(i) {
+                t.Errorf("%s: packet %d at ts %d seq %d, want ts %d seq %d", tt.name, i, h.Timestamp, h.SequenceNumber, tt.want[i], i)
+            }
+        }
+    }
+    track.bindings[0].lastKeyframe = track.bindings[0].lastKeyframe.Add(-keyframeMinInterval)
+    track.wantKeyframe(1)
+    before := len(asker.headers)
+    write(start, 13000, true)
+    if n := len(asker.headers) - before; n != 2 {
+        t.Errorf("keyframe asked for before a chunk start sent %d packets, want the chunk's own 2", n)
+    }
+    if track.bindings[0].keyframePending {
+        t.Errorf("keyframe request still pending after a chunk start")
+    }
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+    "database/sql"
+    "fmt"
+    "log"
+    "math"
+    "math/rand"
+    "os"
+    "os/exec"
+    "path/filepath"
+    "sync"
+    "time"
+)
+
+const (
+    syncedPodWait = 30 * time.Second // how long the ad-free variant waits for the main station's pod
+    syncedPodTTL = time.Hour
+    slateMinDur = 0.05
+)
+
+// podKey identifies one break of one airing of a video.
+type podKey struct {
+    videoID int64
+    breakTime float64
+}
+
+type syncedPod struct {
+    dur float64
+    at time.Time
+}
+
+// syncedPods holds, per station name, how long the ad-supported station's
+// recent pods ran, so the ad-free variant can fill its breaks to match.
+var syncedPods = struct {
+    sync.Mutex
+    m map[string]map[podKey]syncedPod
+}{m: make(map[string]map[podKey]syncedPod)}
+
+var promoCatalog []podCandidate
+
+// loadPromoCatalog loads the station promos the ad-free variant can air in
+// its breaks.
+func loadPromoCatalog(db *sql.DB, promoTag string) error {
+    rows, err := db.Query(
+        `SELECT v.id, v.duration FROM videos v
+         WHERE v.duration > 0 AND EXISTS (SELECT 1 FROM video_tags vt JOIN tags t ON t.id = vt.tag_id WHERE vt.video_id = v.id AND t.name = $1)
+         ORDER BY v.id`, promoTag)
+    if err != nil {
+        return err
+    }
+    defer rows.Close()
+    promoCatalog = nil
+    for rows.Next() {
+        var c podCandidate
+        if err := rows.Scan(&c.id, &c.dur); err != nil {
+            return err
+        }
+        c.bumper = true
+        promoCatalog = append(promoCatalog, c)
+    }
+    return rows.Err()
+}
+
+// recordSyncedPod notes the length of a pod the ad-supported station queued,
+// 0 when it skipped the break.
+func recordSyncedPod(st *Station, videoID int64, bp *BreakPoint, dur float64) {
+    now := time.Now()
+    syncedPods.Lock()
+    defer syncedPods.Unlock()
+    pods := syncedPods.m[st.name]
+    if pods == nil {
+        pods = make(map[podKey]syncedPod)
+        syncedPods.m[st.name] = pods
+    }
+    for k, p := range pods {
+        if now.Sub(p.at) > syncedPodTTL {
+            delete(pods, k)
+        }
+    }
+    pods[podKey{videoID, bp.Time}] = syncedPod{dur: dur, at: now}
+}
+
+// syncedPodDuration is how long the ad-free variant st fills the break at bp:
+// the length of the main station's pod for it. While the main station is on
+// air but has not built that pod yet it returns false and the caller retries;
+// after syncedPodWait, or when the main station is off air, the break target
+// stands in. The caller holds st.mu.
+func syncedPodDuration(st *Station, videoID int64, bp *BreakPoint) (float64, bool) {
+    syncedPods.Lock()
+    p, ok := syncedPods.m[st.name][podKey{videoID, bp.Time}]
+    syncedPods.Unlock()
+    if ok && time.Since(p.at) <= syncedPodTTL {
+        st.podWaitSince = time.Time{}
+        return p.dur, true
+    }
+    waited := !st.podWaitSince.IsZero() && time.Since(st.podWaitSince) >= syncedPodWait
+    if main := siblingStation(st); main != nil && !waited {
+        main.mu.Lock()
+        onAir := main.viewers > 0
+        main.mu.Unlock()
+        if onAir {
+            if st.podWaitSince.IsZero() {
+                st.podWaitSince = time.Now()
+                log.Printf("Station %s (adsEnabled: %v): Waiting for the ad pod at %.3fs of video %d", st.name, st.adsEnabled, bp.Time, videoID)
+            }
+            return 0, false
+        }
+    }
+    st.podWaitSince = time.Time{}
+    target, _ := breakTarget(st, bp)
+    log.Printf("Station %s (adsEnabled: %v): No ad pod to match at %.3fs of video %d, filling the %.1fs target", st.name, st.adsEnabled, bp.Time, videoID, target)
+    return target, true
+}
+
+// siblingStation is the loaded other variant of st, if any. Cursors and
+// on-demand video have none.
+func siblingStation(st *Station) *Station {
+    if st.live != nil || st.vod {
+        return nil
+    }
+    mu.Lock()
+    defer mu.Unlock()
+    if st.adsEnabled {
+        return noAdsStations[st.name]
+    }
+    return stations[st.name]
+}
+
+// syncWithSibling moves st, which is about to go on air, to what its other
+// variant is airing, so switching between the two lands on the same moment.
+// The caller must not hold st.mu.
+func syncWithSibling(st *Station) {
+    sib := siblingStation(st)
+    if sib == nil || sib == st {
+        return
+    }
+    sib.mu.Lock()
+    if sib.viewers == 0 {
+        sib.mu.Unlock()
+        return
+    }
+    videoQueue := append([]int64(nil), sib.videoQueue...)
+    currentVideo, currentIndex, currentOffset := sib.currentVideo, sib.currentIndex, sib.currentOffset
+    sib.mu.Unlock()
+    st.mu.Lock()
+    st.videoQueue = videoQueue
+    st.currentVideo = currentVideo
+    st.currentIndex = currentIndex
+    st.currentOffset = currentOffset
+    st.mu.Unlock()
+    log.Printf("Station %s (adsEnabled: %v): Synced to the other variant: video %d at %.3fs", st.name, st.adsEnabled, currentVideo, currentOffset)
+}
+
+// queueBreakFiller fills dur seconds of the ad-free variant's break with
+// promos, when configured, and slate for the rest. It returns the seconds
+// queued. The caller holds st.mu.
+func queueBreakFiller(st *Station, db *sql.DB, videoID int64, bp *BreakPoint, dur float64) float64 {
+    total := 0.0
+    if cfg.Ads.NoAdsFiller == "promos" {
+        rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+        for _, i := range rng.Perm(len(promoCatalog)) {
+            promo := promoCatalog[i]
+            if total+promo.dur > dur {
+                continue
+            }
+            segments, spsPPS, fmtpLine, actualDur, fps, err := processVideo(st, promo.id, db, 0, promo.dur, "", 0, 0, 0, 0, "")
+            if err != nil || len(segments) == 0 || actualDur <= 0 || total+actualDur > dur+slateMinDur {
+                errorLogger.Printf("Station %s (adsEnabled: %v): Skipping promo %d (%.3fs): %v", st.name, st.adsEnabled, promo.id, actualDur, err)
+                for _, seg := range segments {
+                    removeChunkFiles(seg)
+                }
+                continue
+            }
+            queueFillerChunk(st, segments[0], spsPPS, fmtpLine, actualDur, fps, promo.id)
+            total += actualDur
+            log.Printf("Station %s (adsEnabled: %v): Queued promo %d with duration %.3fs at break %.3fs", st.name, st.adsEnabled, promo.id, actualDur, bp.Time)
+        }
+    }
+    if rest := dur - total; rest >= slateMinDur {
+        segments, spsPPS, fmtpLine, actualDur, fps, err := processSlate(st, rest)
+        if err != nil {
+            errorLogger.Printf("Station %s (adsEnabled: %v): Failed to make %.3fs slate for break %.3fs of video %d: %v", st.name, st.adsEnabled, rest, bp.Time, videoID, err)
+        } else {
+            queueFillerChunk(st, segments[0], spsPPS, fmtpLine, actualDur, fps, 0)
+            total += actualDur
+            log.Printf("Station %s (adsEnabled: %v): Queued slate with duration %.3fs at break %.3fs", st.name, st.adsEnabled, actualDur, bp.Time)
+        }
+    }
+    return total
+}
+
+func queueFillerChunk(st *Station, segPath string, spsPPS [][]byte, fmtpLine string, dur float64, fps fpsPair, videoID int64) {
+    if len(st.spsPPS) == 0 {
+        st.spsPPS = spsPPS
+        st.fmtpLine = fmtpLine
+    }
+    st.segmentList = append(st.segmentList, bufferedChunk{
+        segPath: segPath,
+        dur: dur,
+        isAd: true,
+        filler: true,
+        videoID: videoID,
+        fps: fps,
+        effective_advance: 0,
+    })
+}
+
+// processSlate encodes dur seconds of cfg.Ads.SlateImage, or black, over
+// silence with the same settings processVideo uses, at the station's output
+// profile or else the size and frame rate of what it is airing. Its return
+// values match processVideo's.
+func processSlate(st *Station, dur float64) ([]string, [][]byte, string, float64, fpsPair, error) {
+    width, height := 1280, 720
+    if st.output.width > 0 {
+        width, height = st.output.width, st.output.height
+    } else if st.sps != nil && st.sps.Width > 0 && st.sps.Height > 0 {
+        width, height = st.sps.Width, st.sps.Height
+    }
+    fps := fpsPair{num: DefaultFPSNum, den: DefaultFPSDen}
+    if st.output.width > 0 {
+        fps = st.output.fps
+    } else {
+        for i := len(st.segmentList) - 1; i >= 0; i-- {
+            if f := st.segmentList[i].fps; f.num > 0 && f.den > 0 {
+                fps = f
+                break
+            }
+        }
+    }
+    frames := int(math.Round(dur * float64(fps.num) / float64(fps.den)))
+    if frames < 1 {
+        frames = 1
+    }
+    actualDur := float64(frames) * float64(fps.den) / float64(fps.num)
+    if err := os.MkdirAll(cfg.Paths.SegmentDir, 0755); err != nil {
+        return nil, nil, "", 0, fpsPair{}, fmt.Errorf("failed to create webrtc_segments directory: %v", err)
+    }
+    baseName := fmt.Sprintf("%s_slate_%d", segmentBaseName(st), time.Now().UnixNano())
+    segPath := filepath.Join(cfg.Paths.SegmentDir, baseName+".h264")
+    opusPath := filepath.Join(cfg.Paths.SegmentDir, baseName+".opus")
+    rate := fmt.Sprintf("%d/%d", fps.num, fps.den)
+    scale := fmt.Sprintf("scale=%d:%d:force_original_aspect_ratio=decrease,pad=%d:%d:(ow-iw)/2:(oh-ih)/2,setsar=1", width, height, width, height)
+    args := []string{"-y"}
+    if cfg.Ads.SlateImage != "" {
+        args = append(args, "-loop", "1", "-framerate", rate, "-i", cfg.Ads.SlateImage)
+    } else {
+        args = append(args, "-f", "lavfi", "-i", fmt.Sprintf("color=c=black:s=%dx%d:r=%s", width, height, rate))
+    }
+    gopSize := int(math.Round(float64(fps.num) / float64(fps.den) * 2))
+    args = append(args,
+        "-frames:v", fmt.Sprintf("%d", frames),
+        "-vf", scale,
+        "-c:v", "libx264",
+        "-preset", "ultrafast",
+        "-crf", "23",
+        "-bf", "0",
+        "-maxrate", fmt.Sprintf("%dk", mainMaxrateKbps),
+        "-bufsize", fmt.Sprintf("%dk", 2*mainMaxrateKbps),
+        "-profile:v", "baseline",
+        "-level", "5.2",
+        "-pix_fmt", "yuv420p",
+        "-r", rate,
+        "-fps_mode", "cfr",
+        "-force_key_frames", "expr:eq(n,0)",
+        "-sc_threshold", "0",
+        "-x264-params", fmt.Sprintf("keyint=%d:min-keyint=1:scenecut=0", gopSize),
+        "-bsf:v", "h264_mp4toannexb",
+        "-threads", "0",
+        "-f", "h264",
+        segPath,
+    )
+    output, err := exec.Command("ffmpeg", args...).CombinedOutput()
+    if err != nil {
+        errorLogger.Printf("Station %s: ffmpeg slate video failed for %s: %v: %s", st.name, segPath, err, string(output))
+        return nil, nil, "", 0, fpsPair{}, fmt.Errorf("ffmpeg slate video failed: %v", err)
+    }
+    output, err = exec.Command("ffmpeg",
+        "-y",
+        "-f", "lavfi",
+        "-i", fmt.Sprintf("anullsrc=r=48000:cl=stereo:d=%.6f", actualDur),
+        "-c:a", "libopus",
+        "-b:a", "128k",
+        "-ar", "48000",
+        "-ac", "2",
+        "-frame_duration", "20",
+        "-page_duration", "960",
+        "-application", "audio",
+        "-vbr", "on",
+        "-map_metadata", "-1",
+        "-f", "opus",
+        opusPath,
+    ).CombinedOutput()
+    if err != nil {
+        errorLogger.Printf("Station %s: ffmpeg slate audio failed for %s: %v: %s", st.name, opusPath, err, string(output))
+        os.Remove(segPath)
+        return nil, nil, "", 0, fpsPair{}, fmt.Errorf("ffmpeg slate audio failed: %v", err)
+    }
+    data, err := os.ReadFile(segPath)
+    if err != nil || len(data) == 0 {
+        os.Remove(segPath)
+        os.Remove(opusPath)
+        return nil, nil, "", 0, fpsPair{}, fmt.Errorf("failed to read slate segment %s: %v", segPath, err)
+    }
+    var spsPPS [][]byte
+    for _, nalu := range splitNALUs(data) {
+        if len(nalu) == 0 {
+            continue
+        }
+        if nalType := nalu[0] & 0x1F; nalType == 7 {
+            spsPPS = append(spsPPS, nalu)
+        } else if nalType == 8 && len(spsPPS) > 0 {
+            spsPPS = append(spsPPS, nalu)
+            break
+        }
+    }
+    fmtpLine := DefaultH264Fmtp
+    if len(spsPPS) > 0 {
+        if sps, err := parseSPS(spsPPS[0]); err == nil {
+            fmtpLine = sps.FmtpLine()
+        }
+    }
+    log.Printf("Station %s: Made %.3fs slate %s (%d frames at %s)", st.name, actualDur, segPath, frames, rate)
+    return []string{segPath}, spsPPS, fmtpLine, actualDur, fps, nil
+}
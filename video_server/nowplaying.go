@@ -0,0 +1,227 @@
+package main
+
+import (
+    "database/sql"
+    "log"
+    "net/http"
+    "time"
+    "github.com/gin-gonic/gin"
+    "github.com/pion/webrtc/v3"
+)
+
+const UpNextItems = 5 // items listed after what is on air
+
+// NowPlayingItem is a program or commercial on a station's air.
+type NowPlayingItem struct {
+    VideoID int64 `json:"video_id"`
+    TitleID int64 `json:"title_id"`
+    Title string `json:"title"`
+    Episode string `json:"episode"`
+    Duration float64 `json:"duration"`
+    IsAd bool `json:"is_ad"`
+}
+
+// NowPlaying is served by /api/stations/:name/now and pushed on the event
+// data channel as "now_playing" whenever the sender moves to a new chunk.
+type NowPlaying struct {
+    Type string `json:"type"`
+    Station string `json:"station"`
+    AdsEnabled bool `json:"ads_enabled"`
+    OnAir bool `json:"on_air"` // false when nobody is watching and the station is paused
+    Current *NowPlayingItem `json:"current"`
+    Program *NowPlayingItem `json:"program"` // the program an ad break interrupts, or Current
+    Position float64 `json:"position"` // seconds into Program
+    AdAiring bool `json:"ad_airing"`
+    UpNext []NowPlayingItem `json:"up_next"`
+    Time time.Time `json:"time"`
+}
+
+// airingChunk records the chunk the sender is transmitting.
+type airingChunk struct {
+    chunk bufferedChunk
+    start time.Time
+}
+
+// nowPlayingSnapshot is the part of a live station's state a NowPlaying is
+// built from, copied under st.mu.
+type nowPlayingSnapshot struct {
+    name string
+    adsEnabled bool
+    airing *airingChunk
+    currentVideo int64
+    currentOffset float64
+    buffered []bufferedChunk
+    queued []int64
+}
+
+func snapshotNowPlaying(st *Station) nowPlayingSnapshot {
+    st.mu.Lock()
+    defer st.mu.Unlock()
+    s := nowPlayingSnapshot{
+        name: st.name,
+        adsEnabled: st.adsEnabled,
+        airing: st.airing,
+        currentVideo: st.currentVideo,
+        currentOffset: st.currentOffset,
+        buffered: append([]bufferedChunk(nil), st.segmentList...),
+    }
+    // After the buffer, the queue continues past the current video. When the
+    // schedule is driving the station this is only what the loop would play.
+    if n := len(st.videoQueue); n > 0 {
+        for i := 1; i <= n && len(s.queued) < UpNextItems; i++ {
+            s.queued = append(s.queued, st.videoQueue[(st.currentIndex+i+n)%n])
+        }
+    }
+    return s
+}
+
+func nowPlayingItem(g *guideBuilder, videoID int64, isAd bool) NowPlayingItem {
+    item := NowPlayingItem{VideoID: videoID, IsAd: isAd}
+    if videoID == 0 {
+        return item // slate in an ad-free break
+    }
+    v, err := g.video(videoID)
+    if err != nil {
+        log.Printf("Now playing: %v", err)
+        return item
+    }
+    item.TitleID = v.titleID
+    item.Title = v.title
+    item.Episode = v.episode
+    item.Duration = v.duration
+    return item
+}
+
+// buildNowPlaying resolves a snapshot into titles and positions.
+func buildNowPlaying(db *sql.DB, s nowPlayingSnapshot, now time.Time) NowPlaying {
+    g := &guideBuilder{db: db, videos: make(map[int64]*guideVideo)}
+    np := NowPlaying{Type: "now_playing", Station: s.name, AdsEnabled: s.adsEnabled, OnAir: true, UpNext: []NowPlayingItem{}, Time: now}
+    program := nowPlayingItem(g, s.currentVideo, false)
+    np.Program = &program
+    np.Position = s.currentOffset
+    rest := s.buffered
+    if s.airing != nil {
+        c := s.airing.chunk
+        if c.isAd {
+            current := nowPlayingItem(g, c.videoID, true)
+            np.Current = &current
+            np.AdAiring = true
+        } else {
+            np.Current = np.Program
+            // currentOffset only moves once a chunk has gone out.
+            elapsed := now.Sub(s.airing.start).Seconds()
+            if elapsed > c.effective_advance {
+                elapsed = c.effective_advance
+            }
+            if c.videoID == s.currentVideo {
+                np.Position += elapsed
+            }
+        }
+        if len(rest) > 0 && rest[0].segPath == c.segPath {
+            rest = rest[1:]
+        }
+    } else {
+        np.Current = np.Program
+    }
+    last := NowPlayingItem{VideoID: np.Current.VideoID, IsAd: np.Current.IsAd}
+    for _, c := range rest {
+        if len(np.UpNext) >= UpNextItems {
+            break
+        }
+        if c.videoID == last.VideoID && c.isAd == last.IsAd {
+            continue
+        }
+        last = nowPlayingItem(g, c.videoID, c.isAd)
+        np.UpNext = append(np.UpNext, last)
+    }
+    for _, vid := range s.queued {
+        if len(np.UpNext) >= UpNextItems {
+            break
+        }
+        if (vid == last.VideoID && !last.IsAd) || vid == s.currentVideo {
+            continue
+        }
+        last = nowPlayingItem(g, vid, false)
+        np.UpNext = append(np.UpNext, last)
+    }
+    return np
+}
+
+// idleNowPlaying describes a station nobody is watching from its guide: what
+// it would air if someone tuned in now.
+func idleNowPlaying(db *sql.DB, name string, adsEnabled bool, now time.Time) (NowPlaying, error) {
+    np := NowPlaying{Type: "now_playing", Station: name, AdsEnabled: adsEnabled, UpNext: []NowPlayingItem{}, Time: now}
+    guide, err := buildGuide(db, name, now, now.Add(GuideDefaultSpan), adsEnabled)
+    if err != nil {
+        return np, err
+    }
+    for i, e := range guide[0].Entries {
+        item := NowPlayingItem{VideoID: e.VideoID, TitleID: e.TitleID, Title: e.Title, Episode: e.Episode, Duration: e.Duration}
+        if i == 0 {
+            np.Current = &item
+            np.Program = &item
+            np.Position = now.Sub(e.Start).Seconds()
+            if np.Position > e.Duration {
+                np.Position = e.Duration
+            }
+            continue
+        }
+        if len(np.UpNext) >= UpNextItems {
+            break
+        }
+        np.UpNext = append(np.UpNext, item)
+    }
+    return np, nil
+}
+
+// markAiring records the chunk the sender is about to transmit and pushes the
+// new state to the station's event channels.
+func markAiring(st *Station, db *sql.DB, chunk bufferedChunk, now time.Time) {
+    st.mu.Lock()
+    st.airing = &airingChunk{chunk: chunk, start: now}
+    listening := len(st.eventChannels) > 0
+    st.mu.Unlock()
+    if !listening {
+        return
+    }
+    go func() {
+        broadcastEvent(st, buildNowPlaying(db, snapshotNowPlaying(st), now))
+    }()
+}
+
+// sendNowPlaying sends the current state to a single event channel, so a new
+// viewer's overlay fills in before the next chunk boundary.
+func sendNowPlaying(st *Station, db *sql.DB, dc *webrtc.DataChannel) {
+    np := buildNowPlaying(db, snapshotNowPlaying(st), time.Now())
+    if err := sendEvent(dc, np); err != nil {
+        log.Printf("Station %s: Failed to send now playing on data channel: %v", st.name, err)
+    }
+}
+
+// nowPlayingHandler serves /api/stations/:name/now?adsEnabled=.
+func nowPlayingHandler(db *sql.DB, c *gin.Context) {
+    name := c.Param("name")
+    adsEnabled := c.Query("adsEnabled") != "false"
+    mu.Lock()
+    st := stations[name]
+    if !adsEnabled {
+        st = noAdsStations[name]
+    }
+    mu.Unlock()
+    now := time.Now()
+    if st != nil {
+        c.JSON(http.StatusOK, buildNowPlaying(db, snapshotNowPlaying(st), now))
+        return
+    }
+    np, err := idleNowPlaying(db, name, adsEnabled, now)
+    if err == sql.ErrNoRows {
+        c.JSON(http.StatusNotFound, gin.H{"error": "Invalid station"})
+        return
+    }
+    if err != nil {
+        errorLogger.Printf("Station %s: Failed to build now playing: %v", name, err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to build now playing"})
+        return
+    }
+    c.JSON(http.StatusOK, np)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+    "database/sql"
+    "fmt"
+    "config"
+)
+
+// outputProfile is the picture processVideo encodes a station's chunks to, so
+// every chunk shares one SPS/PPS and frame rate. A zero width keeps each
+// source's own size and frame rate.
+type outputProfile struct {
+    width int
+    height int
+    fps fpsPair
+    fit string
+}
+
+// stationOutput is the station's output_* columns over cfg.Output. A
+// stationID of 0, as on-demand video has, gets the config's profile.
+func stationOutput(db *sql.DB, stationID int64) outputProfile {
+    o := cfg.Output
+    if stationID != 0 {
+        var width, height sql.NullInt64
+        var fps, fit sql.NullString
+        err := db.QueryRow("SELECT output_width, output_height, output_fps, output_fit FROM stations WHERE id = $1", stationID).Scan(&width, &height, &fps, &fit)
+        if err != nil {
+            errorLogger.Printf("Station %d: Failed to load output profile, using the config's: %v", stationID, err)
+        } else {
+            if width.Valid {
+                o.Width = int(width.Int64)
+            }
+            if height.Valid {
+                o.Height = int(height.Int64)
+            }
+            if fps.Valid {
+                o.FPS = fps.String
+            }
+            if fit.Valid {
+                o.Fit = fit.String
+            }
+        }
+        if err := config.ValidateOutput(o); err != nil {
+            errorLogger.Printf("Station %d: Invalid output profile, using the config's: %v", stationID, err)
+            o = cfg.Output
+        }
+    }
+    num, den, _ := config.ParseFrameRate(o.FPS)
+    return outputProfile{width: o.Width, height: o.Height, fps: fpsPair{num: num, den: den}, fit: o.Fit}
+}
+
+// filter is the -vf chain that brings a source to the profile's size: square
+// pixels first, so anamorphic sources keep their shape, then the fit.
+func (o outputProfile) filter() string {
+    if o.width == 0 {
+        return ""
+    }
+    w, h := o.width, o.height
+    sar := "scale=trunc(iw*sar/2)*2:ih,setsar=1"
+    switch o.fit {
+    case config.FitCrop:
+        return fmt.Sprintf("%s,scale=%d:%d:force_original_aspect_ratio=increase,crop=%d:%d,setsar=1", sar, w, h, w, h)
+    case config.FitStretch:
+        return fmt.Sprintf("%s,scale=%d:%d,setsar=1", sar, w, h)
+    }
+    return fmt.Sprintf("%s,scale=%d:%d:force_original_aspect_ratio=decrease:force_divisible_by=2,pad=%d:%d:(ow-iw)/2:(oh-ih)/2:black,setsar=1", sar, w, h, w, h)
+}
+
+func (o outputProfile) String() string {
+    if o.width == 0 {
+        return "native"
+    }
+    return fmt.Sprintf("%dx%d@%d/%d %s", o.width, o.height, o.fps.num, o.fps.den, o.fit)
+}
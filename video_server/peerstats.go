@@ -0,0 +1,201 @@
+package main
+
+import (
+    "crypto/sha256"
+    "encoding/hex"
+    "net/http"
+    "sort"
+    "time"
+    "github.com/gin-gonic/gin"
+    "github.com/pion/interceptor"
+    "github.com/pion/interceptor/pkg/cc"
+    "github.com/pion/interceptor/pkg/gcc"
+    "github.com/pion/interceptor/pkg/nack"
+    "github.com/pion/interceptor/pkg/report"
+    "github.com/pion/interceptor/pkg/stats"
+    "github.com/pion/webrtc/v3"
+)
+
+// peerFeedback is what the interceptors of one peer connection learn about
+// its viewer. Either field is nil if its interceptor was not built.
+type peerFeedback struct {
+    stats stats.Getter
+    bwe cc.BandwidthEstimator
+}
+
+// registerInterceptors adds to r what a sending peer connection wants:
+// retransmission of packets the viewer NACKs, from a buffer of
+// webrtc.nack_buffer_packets per stream; RTCP sender reports; transport-wide
+// sequence numbers so the viewer sends TWCC feedback; and stats. With
+// renditions configured it also runs Google congestion control on that
+// feedback, for adaptRenditions. What the peer connection built from r
+// learns ends up in fb.
+func registerInterceptors(m *webrtc.MediaEngine, r *interceptor.Registry, fb *peerFeedback) error {
+    responder, err := nack.NewResponderInterceptor(nack.ResponderSize(cfg.WebRTC.NACKBufferPackets))
+    if err != nil {
+        return err
+    }
+    r.Add(responder)
+    sender, err := report.NewSenderInterceptor()
+    if err != nil {
+        return err
+    }
+    r.Add(sender)
+    if len(cfg.Output.Renditions) > 0 {
+        controller, err := cc.NewInterceptor(func() (cc.BandwidthEstimator, error) {
+            return gcc.NewSendSideBWE(gcc.SendSideBWEInitialBitrate(mainMaxrateKbps*1000), gcc.SendSideBWEPacer(gcc.NewNoOpPacer()))
+        })
+        if err != nil {
+            return err
+        }
+        controller.OnNewPeerConnection(func(_ string, bwe cc.BandwidthEstimator) {
+            fb.bwe = bwe
+        })
+        r.Add(controller)
+    }
+    if err := webrtc.ConfigureTWCCHeaderExtensionSender(m, r); err != nil {
+        return err
+    }
+    statsInterceptor, err := stats.NewInterceptor()
+    if err != nil {
+        return err
+    }
+    statsInterceptor.OnNewPeerConnection(func(_ string, g stats.Getter) {
+        fb.stats = g
+    })
+    r.Add(statsInterceptor)
+    return nil
+}
+
+// trackStats is one sender's stream as the stats interceptor saw it: what
+// was sent, and what the viewer's receiver reports say about it.
+type trackStats struct {
+    Kind string `json:"kind"`
+    SSRC uint32 `json:"ssrc"`
+    PacketsSent uint64 `json:"packets_sent"`
+    BytesSent uint64 `json:"bytes_sent"`
+    NACKCount uint32 `json:"nack_count"`
+    PLICount uint32 `json:"pli_count"`
+    FIRCount uint32 `json:"fir_count"`
+    PacketsLost int64 `json:"packets_lost"`
+    FractionLost float64 `json:"fraction_lost"`
+    JitterMs float64 `json:"jitter_ms"`
+    RTTMs float64 `json:"rtt_ms"`
+}
+
+type sessionStats struct {
+    ID string `json:"id"` // statsID of the session, not its WHEP id
+    Station string `json:"station"`
+    AdsEnabled bool `json:"ads_enabled"`
+    State string `json:"state"`
+    ConnectedAt *time.Time `json:"connected_at,omitempty"`
+    LastReport *time.Time `json:"last_report,omitempty"`
+    Rendition int `json:"rendition"` // 0 the main stream, else 1-based into output.renditions
+    EstimateKbps float64 `json:"estimate_kbps,omitempty"`
+    Tracks []trackStats `json:"tracks"`
+}
+
+func (vs *viewerSession) statsSnapshot() sessionStats {
+    st := vs.station()
+    s := sessionStats{ID: statsID(vs.id), Station: st.name, AdsEnabled: st.adsEnabled, State: vs.pc.ConnectionState().String(), Tracks: []trackStats{}}
+    vs.mu.Lock()
+    if !vs.connectedAt.IsZero() {
+        at := vs.connectedAt
+        s.ConnectedAt = &at
+    }
+    if !vs.lastReport.IsZero() {
+        at := vs.lastReport
+        s.LastReport = &at
+    }
+    vs.mu.Unlock()
+    s.EstimateKbps = vs.estimateKbps(time.Now())
+    for _, sender := range vs.pc.GetSenders() {
+        track := sender.Track()
+        encodings := sender.GetParameters().Encodings
+        if track == nil || len(encodings) == 0 {
+            continue
+        }
+        ssrc := uint32(encodings[0].SSRC)
+        if t, ok := track.(*stationTrack); ok && t.Kind() == webrtc.RTPCodecTypeVideo {
+            s.Rendition = t.rendition(encodings[0].SSRC)
+        }
+        if vs.feedback == nil || vs.feedback.stats == nil {
+            continue
+        }
+        got := vs.feedback.stats.Get(ssrc)
+        if got == nil {
+            continue
+        }
+        s.Tracks = append(s.Tracks, trackStats{
+            Kind: track.Kind().String(),
+            SSRC: ssrc,
+            PacketsSent: got.OutboundRTPStreamStats.PacketsSent,
+            BytesSent: got.OutboundRTPStreamStats.BytesSent,
+            NACKCount: got.OutboundRTPStreamStats.NACKCount,
+            PLICount: got.OutboundRTPStreamStats.PLICount,
+            FIRCount: got.OutboundRTPStreamStats.FIRCount,
+            PacketsLost: got.RemoteInboundRTPStreamStats.PacketsLost,
+            FractionLost: got.RemoteInboundRTPStreamStats.FractionLost,
+            JitterMs: got.RemoteInboundRTPStreamStats.Jitter * 1000,
+            RTTMs: float64(got.RemoteInboundRTPStreamStats.RoundTripTime) / float64(time.Millisecond),
+        })
+    }
+    return s
+}
+
+// sessionsStatsHandler lists every viewer session with its per-track loss,
+// jitter and round-trip time, worst first by fraction lost.
+func sessionsStatsHandler(c *gin.Context) {
+    sessionsMu.Lock()
+    sessions := make([]*viewerSession, 0, len(viewerSessions))
+    for _, vs := range viewerSessions {
+        sessions = append(sessions, vs)
+    }
+    sessionsMu.Unlock()
+    out := make([]sessionStats, 0, len(sessions))
+    for _, vs := range sessions {
+        out = append(out, vs.statsSnapshot())
+    }
+    sort.Slice(out, func(i, j int) bool {
+        if li, lj := worstLoss(out[i]), worstLoss(out[j]); li != lj {
+            return li > lj
+        }
+        return out[i].ID < out[j].ID
+    })
+    c.JSON(http.StatusOK, out)
+}
+
+// statsID is the id the stats API lists a session under. The session id is
+// all it takes to end or renegotiate a session, so the stats API shows a
+// one-way hash of it instead.
+func statsID(id string) string {
+    sum := sha256.Sum256([]byte(id))
+    return hex.EncodeToString(sum[:8])
+}
+
+func sessionStatsHandler(c *gin.Context) {
+    var vs *viewerSession
+    sessionsMu.Lock()
+    for id, s := range viewerSessions {
+        if statsID(id) == c.Param("session") {
+            vs = s
+            break
+        }
+    }
+    sessionsMu.Unlock()
+    if vs == nil {
+        c.JSON(http.StatusNotFound, gin.H{"error": "Unknown session"})
+        return
+    }
+    c.JSON(http.StatusOK, vs.statsSnapshot())
+}
+
+func worstLoss(s sessionStats) float64 {
+    worst := 0.0
+    for _, t := range s.Tracks {
+        if t.FractionLost > worst {
+            worst = t.FractionLost
+        }
+    }
+    return worst
+}
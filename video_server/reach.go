@@ -0,0 +1,72 @@
+package main
+
+import (
+    "time"
+)
+
+// adReach counts the viewers of one ad airing.
+type adReach struct {
+    atStart int // sessions connected when the ad started
+    reached int // sessions that reported receiving media while it aired
+    completed int // of atStart, those still open when it ended
+    dropped int // of atStart, those that disconnected before it ended
+}
+
+func stationSessions(st *Station) []*viewerSession {
+    sessionsMu.Lock()
+    defer sessionsMu.Unlock()
+    var out []*viewerSession
+    for _, vs := range viewerSessions {
+        if vs.st == st {
+            out = append(out, vs)
+        }
+    }
+    return out
+}
+
+// connectedSessions returns the station's sessions whose peer connection is
+// up.
+func connectedSessions(st *Station) []*viewerSession {
+    var out []*viewerSession
+    for _, vs := range stationSessions(st) {
+        vs.mu.Lock()
+        up := !vs.connectedAt.IsZero() && vs.closedAt.IsZero()
+        vs.mu.Unlock()
+        if up {
+            out = append(out, vs)
+        }
+    }
+    return out
+}
+
+// measureAdReach works out the reach of an ad transmitted from from to to,
+// given the sessions connected when it started. Viewers who joined during the
+// ad count towards reached only.
+func measureAdReach(st *Station, atStart []*viewerSession, from, to time.Time) *adReach {
+    r := &adReach{atStart: len(atStart)}
+    seen := make(map[*viewerSession]bool)
+    for _, vs := range atStart {
+        seen[vs] = true
+        vs.mu.Lock()
+        if !vs.closedAt.IsZero() && vs.closedAt.Before(to) {
+            r.dropped++
+        } else {
+            r.completed++
+        }
+        if vs.lastReport.After(from) {
+            r.reached++
+        }
+        vs.mu.Unlock()
+    }
+    for _, vs := range stationSessions(st) {
+        if seen[vs] {
+            continue
+        }
+        vs.mu.Lock()
+        if !vs.connectedAt.IsZero() && vs.connectedAt.Before(to) && vs.lastReport.After(from) {
+            r.reached++
+        }
+        vs.mu.Unlock()
+    }
+    return r
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+    "fmt"
+    "log"
+    "os"
+    "os/exec"
+    "strings"
+    "sync"
+    "time"
+    "github.com/pion/webrtc/v3"
+    "github.com/pion/webrtc/v3/pkg/media"
+)
+
+// mainMaxrateKbps caps the main stream, the top of the rendition ladder.
+const mainMaxrateKbps = 5000
+
+// How adaptRenditions moves a viewer along the ladder.
+const (
+    renditionInterval = time.Second
+    renditionUpHold = 10 * time.Second // since the last switch, before trying a rung up
+    renditionDownHold = 30 * time.Second // since the last step down, before trying a rung up
+    renditionLossDown = 0.10 // fraction lost that steps down
+    renditionLossUp = 0.02 // fraction lost below which a step up is allowed
+    rembMaxAge = 5 * time.Second
+)
+
+// renditionPath is where rendition k (1 the highest below the main stream)
+// of the chunk at segPath is encoded.
+func renditionPath(segPath string, k int) string {
+    return fmt.Sprintf("%s_r%d.h264", strings.TrimSuffix(segPath, ".h264"), k)
+}
+
+// removeChunkFiles deletes a chunk's video, audio and rendition files.
+// Renditions still being encoded are deleted once their encode finishes.
+func removeChunkFiles(segPath string) {
+    os.Remove(segPath)
+    os.Remove(strings.Replace(segPath, ".h264", ".opus", 1))
+    if !abandonRenditions(segPath) {
+        removeRenditions(segPath)
+    }
+}
+
+func removeRenditions(segPath string) {
+    for k := 1; k <= len(cfg.Output.Renditions); k++ {
+        os.Remove(renditionPath(segPath, k))
+    }
+}
+
+// renditionJob is a chunk's renditions being encoded in the background.
+type renditionJob struct {
+    abandoned bool // the chunk was sent or dropped first; remove the files when done
+}
+
+// renditionJobs are the encodes still running, by the main chunk's path.
+var renditionJobs = make(map[string]*renditionJob)
+var renditionJobsMu sync.Mutex
+
+// abandonRenditions reports whether segPath's renditions are still being
+// encoded, and if so leaves their files for the encode to remove.
+func abandonRenditions(segPath string) bool {
+    renditionJobsMu.Lock()
+    defer renditionJobsMu.Unlock()
+    job := renditionJobs[segPath]
+    if job == nil {
+        return false
+    }
+    job.abandoned = true
+    return true
+}
+
+// encodeRenditions starts transcoding the main chunk at segPath into each of
+// cfg.Output.Renditions, next to it, and returns without waiting. The
+// renditions are encoded side by side. They keep the chunk's frames and
+// keyframe interval, so every rendition's IDRs line up with the main
+// stream's and a viewer can switch at any chunk start. A rendition that
+// fails, or is not ready when the chunk is sent, is left out; its viewers
+// get the main stream for that chunk.
+func encodeRenditions(st *Station, segPath string, fps fpsPair, gopSize int) {
+    if len(cfg.Output.Renditions) == 0 {
+        return
+    }
+    job := &renditionJob{}
+    renditionJobsMu.Lock()
+    renditionJobs[segPath] = job
+    renditionJobsMu.Unlock()
+    go func() {
+        var wg sync.WaitGroup
+        for i, r := range cfg.Output.Renditions {
+            wg.Add(1)
+            go func() {
+                defer wg.Done()
+                encodeRendition(st, segPath, i+1, r.Height, r.MaxrateKbps, fps, gopSize)
+            }()
+        }
+        wg.Wait()
+        renditionJobsMu.Lock()
+        delete(renditionJobs, segPath)
+        abandoned := job.abandoned
+        renditionJobsMu.Unlock()
+        if abandoned {
+            removeRenditions(segPath)
+        }
+    }()
+}
+
+// encodeRendition transcodes the chunk at segPath into rendition k.
+func encodeRendition(st *Station, segPath string, k, height, maxrateKbps int, fps fpsPair, gopSize int) {
+    out := renditionPath(segPath, k)
+    args := []string{
+        "-y",
+        "-framerate", fmt.Sprintf("%d/%d", fps.num, fps.den),
+        "-i", segPath,
+        "-vf", fmt.Sprintf("scale=-2:%d,setsar=1", height),
+        "-c:v", "libx264",
+        "-preset", "ultrafast",
+        "-crf", "23",
+        "-bf", "0",
+        "-maxrate", fmt.Sprintf("%dk", maxrateKbps),
+        "-bufsize", fmt.Sprintf("%dk", 2*maxrateKbps),
+        "-profile:v", "baseline",
+        "-level", "5.2",
+        "-pix_fmt", "yuv420p",
+        "-fps_mode", "passthrough",
+        "-force_key_frames", "expr:eq(n,0)",
+        "-sc_threshold", "0",
+        "-x264-params", fmt.Sprintf("keyint=%d:min-keyint=1:scenecut=0", gopSize),
+        "-threads", "0",
+        "-f", "h264",
+        out,
+    }
+    output, err := exec.Command("ffmpeg", args...).CombinedOutput()
+    if err != nil {
+        errorLogger.Printf("Station %s: ffmpeg %dp rendition failed for %s: %v: %s", st.name, height, segPath, err, string(output))
+        os.Remove(out)
+        return
+    }
+    log.Printf("Station %s: Encoded %dp rendition %s", st.name, height, out)
+}
+
+// loadRenditions reads the chunk's renditions for the sender and removes
+// their files. A rendition that is missing, as for slates, still encoding,
+// or whose frames do not match the main stream's is nil.
+func loadRenditions(st *Station, segPath string, frames int) [][][]byte {
+    if abandonRenditions(segPath) {
+        errorLogger.Printf("Station %s (adsEnabled: %v): Renditions of %s are still encoding, sending the main stream only", st.name, st.adsEnabled, segPath)
+        return make([][][]byte, len(cfg.Output.Renditions))
+    }
+    var out [][][]byte
+    for k := 1; k <= len(cfg.Output.Renditions); k++ {
+        path := renditionPath(segPath, k)
+        data, err := os.ReadFile(path)
+        os.Remove(path)
+        var rendition [][]byte
+        if err == nil {
+            rendition = groupFrames(st, splitNALUs(data), nil, path)
+            if len(rendition) != frames {
+                errorLogger.Printf("Station %s (adsEnabled: %v): Rendition %s has %d frames, main stream %d, leaving it out", st.name, st.adsEnabled, path, len(rendition), frames)
+                rendition = nil
+            }
+        } else if !os.IsNotExist(err) {
+            errorLogger.Printf("Station %s (adsEnabled: %v): Failed to read rendition %s: %v", st.name, st.adsEnabled, path, err)
+        }
+        out = append(out, rendition)
+    }
+    return out
+}
+
+// frameSamples is frame i of the main stream and of each rendition, for
+// stationTrack.WriteRenditions.
+func frameSamples(frames [][]byte, renditions [][][]byte, i int, dur time.Duration, ts uint32) []media.Sample {
+    samples := []media.Sample{{Data: frames[i], Duration: dur, PacketTimestamp: ts}}
+    for _, rendition := range renditions {
+        s := media.Sample{Duration: dur, PacketTimestamp: ts}
+        if rendition != nil {
+            s.Data = rendition[i]
+        }
+        samples = append(samples, s)
+    }
+    return samples
+}
+
+// ladderKbps is the maxrate of the main stream and each rendition, highest
+// first.
+func ladderKbps() []int {
+    ladder := []int{mainMaxrateKbps}
+    for _, r := range cfg.Output.Renditions {
+        ladder = append(ladder, r.MaxrateKbps)
+    }
+    return ladder
+}
+
+// chooseRendition is the rung, 0 the main stream, a viewer on rung current
+// moves to. Heavy loss, or a bandwidth estimate below what it is being
+// sent, steps it down, straight to the highest rung whose maxrate fits the
+// estimate if that is lower still. The estimate only ever runs a little
+// ahead of what is sent, so it cannot show that a higher rung would fit:
+// after a quiet spell with little loss the viewer tries one rung up, and
+// comes back down if that congests. estimateKbps and sentKbps are 0 when
+// unknown.
+func chooseRendition(ladder []int, current int, estimateKbps, sentKbps, loss float64, sinceSwitch, sinceDown time.Duration) int {
+    lowest := len(ladder) - 1
+    congested := loss > renditionLossDown || (estimateKbps > 0 && sentKbps > 0 && estimateKbps < 0.9*sentKbps)
+    if congested {
+        if current == lowest {
+            return current
+        }
+        next := current + 1
+        if estimateKbps > 0 {
+            for next < lowest && float64(ladder[next]) > estimateKbps {
+                next++
+            }
+        }
+        return next
+    }
+    if current > 0 && loss < renditionLossUp && sinceSwitch >= renditionUpHold && sinceDown >= renditionDownHold && (estimateKbps == 0 || sentKbps == 0 || estimateKbps >= sentKbps) {
+        return current - 1
+    }
+    return current
+}
+
+// estimateKbps is the lower of the congestion controller's target bitrate
+// and a recent REMB, 0 if there is neither.
+func (vs *viewerSession) estimateKbps(now time.Time) float64 {
+    estimate := 0.0
+    if vs.feedback != nil && vs.feedback.bwe != nil {
+        estimate = float64(vs.feedback.bwe.GetTargetBitrate()) / 1000
+    }
+    vs.mu.Lock()
+    remb, rembAt := vs.remb, vs.rembAt
+    vs.mu.Unlock()
+    if remb > 0 && now.Sub(rembAt) < rembMaxAge && (estimate == 0 || remb/1000 < estimate) {
+        estimate = remb / 1000
+    }
+    return estimate
+}
+
+// adaptRenditions moves the session's video between the main stream and the
+// configured renditions, checking every renditionInterval. The track makes
+// the switch at the next chunk start. It does nothing without renditions.
+func (vs *viewerSession) adaptRenditions() {
+    ladder := ladderKbps()
+    if len(ladder) < 2 {
+        return
+    }
+    go func() {
+        ticker := time.NewTicker(renditionInterval)
+        defer ticker.Stop()
+        want := 0
+        var lastSwitch, lastDown time.Time
+        var lastBytes uint64
+        var lastAt time.Time
+        for range ticker.C {
+            vs.mu.Lock()
+            closed := !vs.closedAt.IsZero()
+            vs.mu.Unlock()
+            if closed {
+                return
+            }
+            if vs.pc.ConnectionState() != webrtc.PeerConnectionStateConnected {
+                continue
+            }
+            var track *stationTrack
+            var ssrc webrtc.SSRC
+            for _, sender := range vs.pc.GetSenders() {
+                t, ok := sender.Track().(*stationTrack)
+                encodings := sender.GetParameters().Encodings
+                if ok && t.Kind() == webrtc.RTPCodecTypeVideo && len(encodings) > 0 {
+                    track, ssrc = t, encodings[0].SSRC
+                }
+            }
+            if track == nil {
+                continue
+            }
+            now := time.Now()
+            var sentKbps, loss float64
+            if vs.feedback != nil && vs.feedback.stats != nil {
+                if got := vs.feedback.stats.Get(uint32(ssrc)); got != nil {
+                    bytes := got.OutboundRTPStreamStats.BytesSent
+                    if !lastAt.IsZero() && bytes >= lastBytes {
+                        sentKbps = float64(bytes-lastBytes) * 8 / 1000 / now.Sub(lastAt).Seconds()
+                    }
+                    lastBytes, lastAt = bytes, now
+                    loss = got.RemoteInboundRTPStreamStats.FractionLost
+                }
+            }
+            if lastSwitch.IsZero() {
+                lastSwitch = now
+            }
+            estimate := vs.estimateKbps(now)
+            if next := chooseRendition(ladder, want, estimate, sentKbps, loss, now.Sub(lastSwitch), now.Sub(lastDown)); next != want {
+                log.Printf("Station %s: Session %s moving to rendition %d of %d (estimate %.0fkbps, sending %.0fkbps, loss %.1f%%)", vs.station().name, vs.id, next, len(ladder)-1, estimate, sentKbps, loss*100)
+                if next > want {
+                    lastDown = now
+                }
+                want, lastSwitch = next, now
+            }
+            // Again every tick: a playback switch binds a new track.
+            track.setRendition(ssrc, want)
+        }
+    }()
+}
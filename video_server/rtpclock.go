@@ -0,0 +1,209 @@
+package main
+
+import (
+    "fmt"
+    "strings"
+    "sync"
+    "time"
+    "github.com/pion/rtp"
+    "github.com/pion/rtp/codecs"
+    "github.com/pion/webrtc/v3"
+    "github.com/pion/webrtc/v3/pkg/media"
+)
+
+const rtpMTU = 1200 // what pion's own packetizer uses
+
+// stationTrack is one of a station's outgoing tracks. Unlike
+// webrtc.TrackLocalStaticSample, whose packetizer starts a new random
+// timestamp on every bind and ignores PacketTimestamp, it sends each sample
+// at the PacketTimestamp the station's clock gives it, which the report
+// interceptor's sender reports map to wall-clock time. It keeps its own
+// bindings, each with its own sequence, so it can send one viewer a packet
+// the others do not get (see keyframe.go) or a different rendition of the
+// same frame (see renditions.go).
+type stationTrack struct {
+    id string
+    streamID string
+    codec webrtc.RTPCodecCapability
+    kind webrtc.RTPCodecType
+    mu sync.Mutex
+    bindings []*trackBinding
+    payloaders []rtp.Payloader // per rendition, 0 the main stream
+    keyframes []keyframeCache // per rendition
+}
+
+// trackBinding is one peer connection's sender of a stationTrack.
+type trackBinding struct {
+    id string
+    ssrc webrtc.SSRC
+    payloadType webrtc.PayloadType
+    writeStream webrtc.TrackLocalWriter
+    sequencer rtp.Sequencer
+    rendition int // what it is sent from the next chunk start
+    sent int // the rendition its last sample came from
+    lastKeyframe time.Time
+    keyframePending bool // a PLI or FIR is waiting for the next frame
+}
+
+func newStationTrack(c webrtc.RTPCodecCapability, id, streamID string) (*stationTrack, error) {
+    t := &stationTrack{id: id, streamID: streamID, codec: c}
+    switch strings.ToLower(c.MimeType) {
+    case strings.ToLower(webrtc.MimeTypeH264):
+        t.kind = webrtc.RTPCodecTypeVideo
+    case strings.ToLower(webrtc.MimeTypeOpus):
+        t.kind = webrtc.RTPCodecTypeAudio
+    default:
+        return nil, fmt.Errorf("no payloader for %s", c.MimeType)
+    }
+    t.payloaders = []rtp.Payloader{t.newPayloader()}
+    t.keyframes = make([]keyframeCache, 1)
+    return t, nil
+}
+
+func (t *stationTrack) newPayloader() rtp.Payloader {
+    if t.kind == webrtc.RTPCodecTypeVideo {
+        return &codecs.H264Payloader{}
+    }
+    return &codecs.OpusPayloader{}
+}
+
+// Bind picks the negotiated codec with the track's MIME type; the media
+// engine registers one of each.
+func (t *stationTrack) Bind(ctx webrtc.TrackLocalContext) (webrtc.RTPCodecParameters, error) {
+    for _, codec := range ctx.CodecParameters() {
+        if !strings.EqualFold(codec.MimeType, t.codec.MimeType) {
+            continue
+        }
+        t.mu.Lock()
+        t.bindings = append(t.bindings, &trackBinding{
+            id: ctx.ID(),
+            ssrc: ctx.SSRC(),
+            payloadType: codec.PayloadType,
+            writeStream: ctx.WriteStream(),
+            sequencer: rtp.NewRandomSequencer(),
+        })
+        t.mu.Unlock()
+        return codec, nil
+    }
+    return webrtc.RTPCodecParameters{}, webrtc.ErrUnsupportedCodec
+}
+
+func (t *stationTrack) Unbind(ctx webrtc.TrackLocalContext) error {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    for i, b := range t.bindings {
+        if b.id == ctx.ID() {
+            t.bindings = append(t.bindings[:i], t.bindings[i+1:]...)
+            return nil
+        }
+    }
+    return webrtc.ErrUnbindFailed
+}
+
+func (t *stationTrack) ID() string { return t.id }
+func (t *stationTrack) RID() string { return "" }
+func (t *stationTrack) StreamID() string { return t.streamID }
+func (t *stationTrack) Kind() webrtc.RTPCodecType { return t.kind }
+
+// WriteSample packetizes s at s.PacketTimestamp and sends it to every
+// binding. An empty sample sends nothing, so the sender's bound checks are
+// harmless.
+func (t *stationTrack) WriteSample(s media.Sample) error {
+    return t.WriteRenditions([]media.Sample{s}, false)
+}
+
+// WriteRenditions sends one frame: samples[0] to bindings on the main stream
+// and samples[k] to those on rendition k, or samples[0] where samples[k] is
+// empty. At a chunk start, where every rendition begins with an IDR, each
+// binding first moves to the rendition setRendition last asked for. A
+// binding waiting on wantKeyframe gets the cached keyframe in this frame's
+// place, at its timestamp.
+func (t *stationTrack) WriteRenditions(samples []media.Sample, chunkStart bool) error {
+    if len(samples) == 0 || len(samples[0].Data) == 0 {
+        return nil
+    }
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    for len(t.payloaders) < len(samples) {
+        t.payloaders = append(t.payloaders, t.newPayloader())
+        t.keyframes = append(t.keyframes, keyframeCache{})
+    }
+    if t.kind == webrtc.RTPCodecTypeVideo {
+        // Keep every rendition's keyframe cache current, watched or not.
+        for k, s := range samples {
+            if len(s.Data) > 0 {
+                t.keyframes[k].note(s.Data)
+            }
+        }
+    }
+    payloads := make([][][]byte, len(samples))
+    var errs []string
+    for _, b := range t.bindings {
+        k := b.sent
+        if chunkStart {
+            k = b.rendition
+        }
+        if k >= len(samples) || len(samples[k].Data) == 0 {
+            k = 0
+        }
+        b.sent = k
+        framePayloads := payloads[k]
+        if b.keyframePending {
+            b.keyframePending = false
+            if au := t.keyframeFor(k, samples[k].Data); au != nil {
+                framePayloads = (&codecs.H264Payloader{}).Payload(rtpMTU, au)
+            }
+        }
+        if framePayloads == nil {
+            payloads[k] = t.payloaders[k].Payload(rtpMTU, samples[k].Data)
+            framePayloads = payloads[k]
+        }
+        for i, payload := range framePayloads {
+            header := rtp.Header{
+                Version: 2,
+                Marker: i == len(framePayloads)-1,
+                SequenceNumber: b.sequencer.NextSequenceNumber(),
+                Timestamp: samples[k].PacketTimestamp,
+                SSRC: uint32(b.ssrc),
+                PayloadType: uint8(b.payloadType),
+            }
+            if _, err := b.writeStream.WriteRTP(&header, payload); err != nil {
+                errs = append(errs, err.Error())
+                break
+            }
+        }
+    }
+    if len(errs) > 0 {
+        return fmt.Errorf("%s", strings.Join(errs, "; "))
+    }
+    return nil
+}
+
+// setRendition picks the rendition the binding with ssrc is sent from the
+// next chunk start on.
+func (t *stationTrack) setRendition(ssrc webrtc.SSRC, k int) {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    for _, b := range t.bindings {
+        if b.ssrc == ssrc {
+            b.rendition = k
+        }
+    }
+}
+
+// rendition is what the binding with ssrc is being sent now.
+func (t *stationTrack) rendition(ssrc webrtc.SSRC) int {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    for _, b := range t.bindings {
+        if b.ssrc == ssrc {
+            return b.sent
+        }
+    }
+    return 0
+}
+
+// rtpTicks is d in units of clockRate.
+func rtpTicks(d time.Duration, clockRate uint32) uint32 {
+    return uint32(int64(d) * int64(clockRate) / int64(time.Second))
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+    "database/sql"
+    "log"
+    "time"
+    "config/schedule"
+)
+
+const recentScheduledLimit = 8 // scheduled videos whose chunks may still be buffered
+
+// scheduleEngine returns the station's schedule engine, creating it on first
+// use. The caller holds st.mu.
+func scheduleEngine(st *Station, db *sql.DB) *schedule.Engine {
+    if st.schedule != nil {
+        return st.schedule
+    }
+    podSeconds := 0.0
+    if st.adsEnabled {
+        podSeconds, _ = breakTarget(st, &BreakPoint{})
+    }
+    st.schedule = &schedule.Engine{DB: db, PodSeconds: podSeconds}
+    return st.schedule
+}
+
+// scheduledPick asks the schedule what airs at t. It returns nil when the
+// station has no block covering t, in which case the station keeps looping
+// station_videos. Only the ad-supported station records its picks; the no-ads
+// variant and viewers' cursors follow what it recorded. The caller holds
+// st.mu.
+func scheduledPick(st *Station, db *sql.DB, t time.Time) *schedule.Pick {
+    if st.id == 0 {
+        return nil
+    }
+    pick, err := scheduleEngine(st, db).Next(st.id, t, st.adsEnabled && st.live == nil)
+    if err != nil {
+        errorLogger.Printf("Station %s (adsEnabled: %v): Schedule lookup failed, falling back to station_videos: %v", st.name, st.adsEnabled, err)
+        return nil
+    }
+    if pick != nil {
+        st.recentScheduled = append(st.recentScheduled, pick.VideoID)
+        if len(st.recentScheduled) > recentScheduledLimit {
+            st.recentScheduled = st.recentScheduled[len(st.recentScheduled)-recentScheduledLimit:]
+        }
+    }
+    return pick
+}
+
+// advanceVideo moves the station on to its next video: the schedule's pick for
+// when the buffered chunks run out, or the next entry of videoQueue. On-demand
+// video has no next one and is left at its end. The caller holds st.mu.
+func advanceVideo(st *Station, db *sql.DB) {
+    if st.vod {
+        st.currentOffset = getVideoDur(st.currentVideo, db)
+        return
+    }
+    airTime := time.Now()
+    for _, chunk := range st.segmentList {
+        airTime = airTime.Add(time.Duration(chunk.dur * float64(time.Second)))
+    }
+    if pick := scheduledPick(st, db, airTime); pick != nil {
+        st.currentVideo = pick.VideoID
+        st.currentIndex = queueIndex(st.videoQueue, pick.VideoID)
+        log.Printf("Station %s (adsEnabled: %v): Schedule picked video %d (block %d, filler: %v) for %s", st.name, st.adsEnabled, pick.VideoID, pick.BlockID, pick.Filler, airTime.Format(time.RFC3339))
+    } else {
+        // currentIndex is -1 after a scheduled video that is not in the queue;
+        // the loop then picks up from the start.
+        st.currentIndex = (st.currentIndex + 1) % len(st.videoQueue)
+        st.currentVideo = st.videoQueue[st.currentIndex]
+    }
+    st.currentOffset = 0.0
+    st.spsPPS = nil
+    st.fmtpLine = ""
+}
+
+func queueIndex(videoQueue []int64, videoID int64) int {
+    for i, vid := range videoQueue {
+        if vid == videoID {
+            return i
+        }
+    }
+    return -1
+}
+
+// isQueued reports whether chunks of videoID still belong on air: it is in the
+// station's queue or was recently picked by the schedule. The caller holds st.mu.
+func isQueued(st *Station, videoID int64) bool {
+    if queueIndex(st.videoQueue, videoID) >= 0 {
+        return true
+    }
+    for _, vid := range st.recentScheduled {
+        if vid == videoID {
+            return true
+        }
+    }
+    return false
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+    "crypto/rand"
+    "encoding/hex"
+    "fmt"
+    "log"
+    "net/http"
+    "sync"
+    "time"
+    "github.com/gin-gonic/gin"
+    "github.com/pion/rtcp"
+    "github.com/pion/webrtc/v3"
+)
+
+const candidateStreamTimeout = 30 * time.Second // give up on a candidate stream whose gathering never finishes
+
+// viewerSession is one viewer's peer connection, addressable by ID so that
+// follow-up requests (WHEP PATCH/DELETE, trickled candidates) can find it.
+// It holds one viewer slot on its station until closed.
+type viewerSession struct {
+    id string
+    st *Station
+    pc *webrtc.PeerConnection
+    feedback *peerFeedback
+    releaseOnce sync.Once
+    mu sync.Mutex
+    candidates []webrtc.ICECandidateInit
+    gatheringDone bool
+    changed chan struct{} // closed and replaced whenever candidates or gatheringDone change
+    connectedAt time.Time // first time the peer connection connected, zero before
+    closedAt time.Time
+    lastReport time.Time // last RTCP receiver report, i.e. the viewer is getting media
+    remb float64 // last REMB, in bits per second
+    rembAt time.Time
+    switchMu sync.Mutex // serialises playback switches; st itself is guarded by sessionsMu
+}
+
+var viewerSessions = make(map[string]*viewerSession)
+var sessionsMu sync.Mutex
+
+func newSessionID() (string, error) {
+    b := make([]byte, 16)
+    if _, err := rand.Read(b); err != nil {
+        return "", err
+    }
+    return hex.EncodeToString(b), nil
+}
+
+// newViewerSession registers a session for pc. The caller has already
+// counted the viewer with addViewer; close gives the slot back.
+func newViewerSession(st *Station, pc *webrtc.PeerConnection, feedback *peerFeedback) (*viewerSession, error) {
+    id, err := newSessionID()
+    if err != nil {
+        return nil, err
+    }
+    vs := &viewerSession{id: id, st: st, pc: pc, feedback: feedback, changed: make(chan struct{})}
+    sessionsMu.Lock()
+    viewerSessions[id] = vs
+    sessionsMu.Unlock()
+    return vs, nil
+}
+
+func lookupViewerSession(id string) *viewerSession {
+    sessionsMu.Lock()
+    defer sessionsMu.Unlock()
+    return viewerSessions[id]
+}
+
+// close releases the viewer slot and forgets the session. Safe to call more
+// than once.
+func (vs *viewerSession) close() {
+    vs.releaseOnce.Do(func() {
+        vs.switchMu.Lock()
+        defer vs.switchMu.Unlock()
+        sessionsMu.Lock()
+        delete(viewerSessions, vs.id)
+        st := vs.st
+        sessionsMu.Unlock()
+        removeViewer(st)
+        vs.mu.Lock()
+        vs.closedAt = time.Now()
+        if !vs.gatheringDone {
+            vs.gatheringDone = true
+            close(vs.changed)
+            vs.changed = make(chan struct{})
+        }
+        vs.mu.Unlock()
+        log.Printf("Station %s: Session %s closed", st.name, vs.id)
+    })
+    if err := vs.pc.Close(); err != nil {
+        log.Printf("Failed to close PC: %v", err)
+    }
+}
+
+// errorMessage tells a viewer on the events channel why its session is about
+// to close.
+type errorMessage struct {
+    Type string `json:"type"`
+    Error string `json:"error"`
+}
+
+// refuseViewers sends reason to st's viewers as an error event and closes
+// their sessions, so that they reconnect and negotiate the stream afresh.
+func refuseViewers(st *Station, reason string) {
+    broadcastEvent(st, errorMessage{Type: "error", Error: reason})
+    for _, vs := range stationSessions(st) {
+        vs.close()
+    }
+}
+
+// setState notes when the session's peer connection first connects.
+func (vs *viewerSession) setState(s webrtc.PeerConnectionState) {
+    if s != webrtc.PeerConnectionStateConnected {
+        return
+    }
+    vs.mu.Lock()
+    if vs.connectedAt.IsZero() {
+        vs.connectedAt = time.Now()
+    }
+    vs.mu.Unlock()
+}
+
+// readReceiverReports drains RTCP from each of the session's senders, noting
+// when the viewer last reported receiving media and its REMB bandwidth
+// estimate, and answering its keyframe requests. It must be called once the
+// tracks are added; the readers exit when the peer connection closes.
+func (vs *viewerSession) readReceiverReports() {
+    for _, sender := range vs.pc.GetSenders() {
+        go func(sender *webrtc.RTPSender) {
+            for {
+                pkts, _, err := sender.ReadRTCP()
+                if err != nil {
+                    return
+                }
+                for _, p := range pkts {
+                    if _, ok := p.(*rtcp.ReceiverReport); ok {
+                        vs.mu.Lock()
+                        vs.lastReport = time.Now()
+                        vs.mu.Unlock()
+                    } else if remb, ok := p.(*rtcp.ReceiverEstimatedMaximumBitrate); ok {
+                        vs.mu.Lock()
+                        vs.remb, vs.rembAt = float64(remb.Bitrate), time.Now()
+                        vs.mu.Unlock()
+                    } else if isKeyframeRequest(p) {
+                        vs.requestKeyframe(sender)
+                    }
+                }
+            }
+        }(sender)
+    }
+}
+
+// collectCandidates buffers the server's ICE candidates for trickling. It
+// must be called before the local description is set.
+func (vs *viewerSession) collectCandidates() {
+    vs.pc.OnICECandidate(func(c *webrtc.ICECandidate) {
+        vs.mu.Lock()
+        defer vs.mu.Unlock()
+        if vs.gatheringDone {
+            return
+        }
+        if c == nil {
+            vs.gatheringDone = true
+        } else {
+            vs.candidates = append(vs.candidates, c.ToJSON())
+        }
+        close(vs.changed)
+        vs.changed = make(chan struct{})
+    })
+}
+
+// candidatesFrom returns the candidates gathered after the first n, whether
+// gathering has finished, and a channel that is closed on the next change.
+func (vs *viewerSession) candidatesFrom(n int) ([]webrtc.ICECandidateInit, bool, <-chan struct{}) {
+    vs.mu.Lock()
+    defer vs.mu.Unlock()
+    var pending []webrtc.ICECandidateInit
+    if n < len(vs.candidates) {
+        pending = append(pending, vs.candidates[n:]...)
+    }
+    return pending, vs.gatheringDone, vs.changed
+}
+
+// candidateStreamHandler streams the server's ICE candidates for a trickle
+// session as server-sent events: one "candidate" event per candidate, then
+// "end" once gathering completes.
+func candidateStreamHandler(c *gin.Context) {
+    vs := lookupViewerSession(c.Param("session"))
+    if vs == nil {
+        c.JSON(404, gin.H{"error": "Unknown session"})
+        return
+    }
+    c.Header("Content-Type", "text/event-stream")
+    c.Header("Cache-Control", "no-cache")
+    c.Header("Connection", "keep-alive")
+    c.Status(http.StatusOK)
+    timeout := time.After(candidateStreamTimeout)
+    sent := 0
+    for {
+        pending, done, changed := vs.candidatesFrom(sent)
+        for _, candidate := range pending {
+            c.SSEvent("candidate", candidate)
+            sent++
+        }
+        if done {
+            c.SSEvent("end", gin.H{})
+            c.Writer.Flush()
+            return
+        }
+        c.Writer.Flush()
+        select {
+        case <-changed:
+        case <-timeout:
+            log.Printf("Station %s: Session %s candidate stream timed out after %d candidates", vs.st.name, vs.id, sent)
+            return
+        case <-c.Request.Context().Done():
+            return
+        }
+    }
+}
+
+// remoteCandidateHandler adds a candidate trickled by the client, in the JSON
+// form of RTCIceCandidate. An empty candidate marks the end of candidates.
+func remoteCandidateHandler(c *gin.Context) {
+    vs := lookupViewerSession(c.Param("session"))
+    if vs == nil {
+        c.JSON(404, gin.H{"error": "Unknown session"})
+        return
+    }
+    var candidate webrtc.ICECandidateInit
+    if err := c.BindJSON(&candidate); err != nil {
+        log.Printf("JSON bind error: %v", err)
+        c.JSON(400, gin.H{"error": err.Error()})
+        return
+    }
+    if candidate.Candidate == "" {
+        c.Status(http.StatusNoContent)
+        return
+    }
+    if err := vs.pc.AddICECandidate(candidate); err != nil {
+        log.Printf("Station %s: Session %s rejected candidate %q: %v", vs.st.name, vs.id, candidate.Candidate, err)
+        c.JSON(400, gin.H{"error": fmt.Sprintf("invalid candidate: %v", err)})
+        return
+    }
+    c.Status(http.StatusNoContent)
+}
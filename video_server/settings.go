@@ -0,0 +1,48 @@
+package main
+
+import (
+    "fmt"
+    "github.com/pion/webrtc/v3"
+    "config"
+)
+
+var cfg *config.Config
+
+var networkTypes = map[string]webrtc.NetworkType{
+    "udp4": webrtc.NetworkTypeUDP4,
+    "udp6": webrtc.NetworkTypeUDP6,
+    "tcp4": webrtc.NetworkTypeTCP4,
+    "tcp6": webrtc.NetworkTypeTCP6,
+}
+
+// newSettingEngine applies the configured network types, UDP port range and
+// NAT 1:1 mapping to a pion SettingEngine.
+func newSettingEngine(w config.WebRTCConfig) (webrtc.SettingEngine, error) {
+    s := webrtc.SettingEngine{}
+    var types []webrtc.NetworkType
+    for _, name := range w.EffectiveNetworkTypes() {
+        types = append(types, networkTypes[name])
+    }
+    s.SetNetworkTypes(types)
+    if w.UDPPortMin != 0 {
+        if err := s.SetEphemeralUDPPortRange(w.UDPPortMin, w.UDPPortMax); err != nil {
+            return s, fmt.Errorf("invalid UDP port range %d-%d: %v", w.UDPPortMin, w.UDPPortMax, err)
+        }
+    }
+    if len(w.NAT1To1IPs) > 0 {
+        candidateType := webrtc.ICECandidateTypeHost
+        if w.NAT1To1CandidateType == "srflx" {
+            candidateType = webrtc.ICECandidateTypeSrflx
+        }
+        s.SetNAT1To1IPs(w.NAT1To1IPs, candidateType)
+    }
+    return s, nil
+}
+
+func iceServers(w config.WebRTCConfig) []webrtc.ICEServer {
+    servers := make([]webrtc.ICEServer, 0, len(w.ICEServers))
+    for _, s := range w.ICEServers {
+        servers = append(servers, webrtc.ICEServer{URLs: s.URLs, Username: s.Username, Credential: s.Credential})
+    }
+    return servers
+}
@@ -1,4 +1,4 @@
 echo Starting Go server...
-start /B /WAIT go run video_server.go
+start /B /WAIT go run .
 echo Server stopped. Press any key to continue...
 pause
\ No newline at end of file
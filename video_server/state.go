@@ -0,0 +1,126 @@
+package main
+
+import (
+    "database/sql"
+    "log"
+    "time"
+)
+
+const StateSaveInterval = 10 * time.Second
+
+// stationState is the playback position persisted in station_state.
+type stationState struct {
+    currentVideo int64
+    currentIndex int
+    currentOffset float64
+    adSeconds float64
+    videoRTPTS uint32
+    audioRTPTS uint32
+    savedAt time.Time
+}
+
+// loadStationState returns the persisted state for a station, or nil if none
+// has been saved yet.
+func loadStationState(db *sql.DB, stationName string) (*stationState, error) {
+    var s stationState
+    var videoTS, audioTS int64
+    err := db.QueryRow(
+        `SELECT ss.current_video, ss.current_index, ss.current_offset, ss.ad_seconds, ss.video_rtp_ts, ss.audio_rtp_ts, ss.saved_at
+         FROM station_state ss JOIN stations s ON ss.station_id = s.id WHERE s.name = $1`,
+        stationName).Scan(&s.currentVideo, &s.currentIndex, &s.currentOffset, &s.adSeconds, &videoTS, &audioTS, &s.savedAt)
+    if err == sql.ErrNoRows {
+        return nil, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+    s.videoRTPTS = uint32(videoTS)
+    s.audioRTPTS = uint32(audioTS)
+    return &s, nil
+}
+
+// resumeIndex finds where a persisted state's video sits in the station's
+// queue, preferring the saved index if it still matches. It returns -1 if the
+// video has been removed from the station.
+func resumeIndex(videoIds []int64, s *stationState) int {
+    if s.currentIndex >= 0 && s.currentIndex < len(videoIds) && videoIds[s.currentIndex] == s.currentVideo {
+        return s.currentIndex
+    }
+    for i, vid := range videoIds {
+        if vid == s.currentVideo {
+            return i
+        }
+    }
+    return -1
+}
+
+// saveStationState persists the station's position. Only ad-supported
+// stations are saved; no-ads variants are derived from them on load and
+// viewers' cursors and on-demand video are not kept.
+func saveStationState(db *sql.DB, st *Station) error {
+    if !st.adsEnabled || st.live != nil || st.vod {
+        return nil
+    }
+    st.mu.Lock()
+    s := stationState{
+        currentVideo: st.currentVideo,
+        currentIndex: st.currentIndex,
+        currentOffset: st.currentOffset,
+        adSeconds: st.adSeconds,
+        videoRTPTS: st.currentVideoRTPTS,
+        audioRTPTS: st.currentAudioSamples,
+    }
+    st.mu.Unlock()
+    if s.currentVideo == 0 {
+        return nil
+    }
+    _, err := db.Exec(
+        `INSERT INTO station_state (station_id, current_video, current_index, current_offset, ad_seconds, video_rtp_ts, audio_rtp_ts, saved_at)
+         SELECT id, $2, $3, $4, $5, $6, $7, now() FROM stations WHERE name = $1
+         ON CONFLICT (station_id) DO UPDATE SET
+             current_video = EXCLUDED.current_video,
+             current_index = EXCLUDED.current_index,
+             current_offset = EXCLUDED.current_offset,
+             ad_seconds = EXCLUDED.ad_seconds,
+             video_rtp_ts = EXCLUDED.video_rtp_ts,
+             audio_rtp_ts = EXCLUDED.audio_rtp_ts,
+             saved_at = EXCLUDED.saved_at`,
+        st.name, s.currentVideo, s.currentIndex, s.currentOffset, s.adSeconds, int64(s.videoRTPTS), int64(s.audioRTPTS))
+    return err
+}
+
+// saveAllStationStates persists every loaded station that is on air.
+func saveAllStationStates(db *sql.DB) {
+    mu.Lock()
+    var live []*Station
+    for _, st := range stations {
+        live = append(live, st)
+    }
+    mu.Unlock()
+    for _, st := range live {
+        st.mu.Lock()
+        onAir := st.viewers > 0
+        st.mu.Unlock()
+        if !onAir {
+            continue
+        }
+        if err := saveStationState(db, st); err != nil {
+            errorLogger.Printf("Station %s: Failed to save state: %v", st.name, err)
+        }
+    }
+}
+
+// stateSaver persists station positions every StateSaveInterval.
+func stateSaver(db *sql.DB) {
+    ticker := time.NewTicker(StateSaveInterval)
+    defer ticker.Stop()
+    for range ticker.C {
+        saveAllStationStates(db)
+    }
+}
+
+// saveStateOnExit is called on SIGINT/SIGTERM before the process exits.
+func saveStateOnExit(db *sql.DB) {
+    log.Printf("Saving station state before shutdown")
+    saveAllStationStates(db)
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+    "database/sql"
+    "encoding/json"
+    "math"
+    "math/rand"
+    "net/http"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+    "github.com/gin-gonic/gin"
+)
+
+// targetingTemperature turns scores into pick weights: every this many points
+// make a commercial e times as likely to be tried first.
+const targetingTemperature = 2.0
+
+// adProfile is what contextual targeting knows about a program or commercial:
+// its title's metadata overlaid with the video's own, plus its tags.
+type adProfile struct {
+    yearFrom int // 0 when unknown; a decade such as "1990s" spans 1990-1999
+    yearTo int
+    countries []string
+    platforms []string
+    holidays []string
+}
+
+// holidaySeasons is when each holiday tag is in season, as inclusive
+// month/day ranges.
+var holidaySeasons = map[string][2][2]int{
+    "halloween": {{10, 1}, {10, 31}},
+    "thanksgiving": {{11, 1}, {11, 30}},
+    "christmas": {{11, 20}, {12, 31}},
+}
+
+var adProfiles = make(map[int64]*adProfile)
+
+func inSeason(holiday string, at time.Time) bool {
+    season, ok := holidaySeasons[holiday]
+    if !ok {
+        return false
+    }
+    md := int(at.Month())*100 + at.Day()
+    return md >= season[0][0]*100+season[0][1] && md <= season[1][0]*100+season[1][1]
+}
+
+// metadataStrings flattens a metadata value (string, number or array) into
+// lower-case strings.
+func metadataStrings(raw []byte) []string {
+    var v interface{}
+    if err := json.Unmarshal(raw, &v); err != nil {
+        return nil
+    }
+    var out []string
+    var walk func(interface{})
+    walk = func(v interface{}) {
+        switch x := v.(type) {
+        case string:
+            if s := strings.ToLower(strings.TrimSpace(x)); s != "" {
+                out = append(out, s)
+            }
+        case float64:
+            out = append(out, strconv.FormatFloat(x, 'f', -1, 64))
+        case []interface{}:
+            for _, e := range x {
+                walk(e)
+            }
+        }
+    }
+    walk(v)
+    return out
+}
+
+// parseYears reads "1997", "1997-1999" or "1990s".
+func parseYears(s string) (int, int) {
+    if strings.HasSuffix(s, "s") {
+        if y, err := strconv.Atoi(strings.TrimSuffix(s, "s")); err == nil {
+            if y%10 == 0 {
+                return y, y + 9
+            }
+        }
+    }
+    if from, to, ok := strings.Cut(s, "-"); ok {
+        f, err1 := strconv.Atoi(strings.TrimSpace(from))
+        t, err2 := strconv.Atoi(strings.TrimSpace(to))
+        if err1 == nil && err2 == nil && f <= t {
+            return f, t
+        }
+    }
+    if y, err := strconv.ParseFloat(s, 64); err == nil {
+        return int(y), int(y)
+    }
+    return 0, 0
+}
+
+func (p *adProfile) apply(name string, raw []byte) {
+    values := metadataStrings(raw)
+    switch name {
+    case "year":
+        for _, v := range values {
+            if from, to := parseYears(v); from > 0 {
+                p.yearFrom, p.yearTo = from, to
+            }
+        }
+    case "country":
+        p.countries = values
+    case "platform":
+        p.platforms = values
+    }
+}
+
+// commercialPlatform reads the platform from a ".../Commercials/<platform>/..."
+// URI.
+func commercialPlatform(uri string) string {
+    parts := strings.Split(strings.ReplaceAll(uri, "\\", "/"), "/")
+    for i := 0; i+2 < len(parts); i++ {
+        if strings.EqualFold(parts[i], "commercials") {
+            return strings.ToLower(parts[i+1])
+        }
+    }
+    return ""
+}
+
+// loadAdProfiles builds the targeting profile of every video in ids.
+func loadAdProfiles(db *sql.DB, ids []int64) (map[int64]*adProfile, error) {
+    profiles := make(map[int64]*adProfile)
+    if len(ids) == 0 {
+        return profiles, nil
+    }
+    idList := make([]string, len(ids))
+    for i, id := range ids {
+        idList[i] = strconv.FormatInt(id, 10)
+        profiles[id] = &adProfile{}
+    }
+    array := "{" + strings.Join(idList, ",") + "}"
+    // Title metadata first so the video's own values override it.
+    rows, err := db.Query(
+        `SELECT v.id, mt.name, m.value, 0 AS own FROM videos v
+             JOIN title_metadata m ON m.title_id = v.title_id JOIN metadata_types mt ON mt.id = m.metadata_type_id
+             WHERE v.id = ANY($1::bigint[]) AND mt.name IN ('year', 'country', 'platform')
+         UNION ALL
+         SELECT m.video_id, mt.name, m.value, 1 FROM video_metadata m JOIN metadata_types mt ON mt.id = m.metadata_type_id
+             WHERE m.video_id = ANY($1::bigint[]) AND mt.name IN ('year', 'country', 'platform')
+         ORDER BY 4`, array)
+    if err != nil {
+        return nil, err
+    }
+    for rows.Next() {
+        var id int64
+        var name string
+        var raw []byte
+        var own int
+        if err := rows.Scan(&id, &name, &raw, &own); err != nil {
+            rows.Close()
+            return nil, err
+        }
+        profiles[id].apply(name, raw)
+    }
+    rows.Close()
+    if err := rows.Err(); err != nil {
+        return nil, err
+    }
+    rows, err = db.Query(
+        `SELECT v.id, v.uri, COALESCE(array_to_string(ARRAY(
+             SELECT t.name FROM video_tags vt JOIN tags t ON t.id = vt.tag_id WHERE vt.video_id = v.id), ','), '')
+         FROM videos v WHERE v.id = ANY($1::bigint[])`, array)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+    for rows.Next() {
+        var id int64
+        var uri, tags string
+        if err := rows.Scan(&id, &uri, &tags); err != nil {
+            return nil, err
+        }
+        p := profiles[id]
+        if len(p.platforms) == 0 {
+            if platform := commercialPlatform(uri); platform != "" {
+                p.platforms = []string{platform}
+            }
+        }
+        for _, tag := range strings.Split(tags, ",") {
+            if _, ok := holidaySeasons[strings.ToLower(tag)]; ok {
+                p.holidays = append(p.holidays, strings.ToLower(tag))
+            }
+        }
+    }
+    return profiles, rows.Err()
+}
+
+func overlaps(a, b []string) bool {
+    for _, x := range a {
+        for _, y := range b {
+            if x == y {
+                return true
+            }
+        }
+    }
+    return false
+}
+
+// scoreAd rates how well a commercial suits a program airing at at. Zero is
+// neutral; matches on platform, era, country and holiday add points, a
+// commercial from after the program's era or an out-of-season holiday
+// commercial loses them.
+func scoreAd(program, ad *adProfile, at time.Time) float64 {
+    score := 0.0
+    if len(program.platforms) > 0 && len(ad.platforms) > 0 && overlaps(program.platforms, ad.platforms) {
+        score += 3
+    }
+    if program.yearFrom > 0 && ad.yearFrom > 0 {
+        // Distance between the two year ranges; 0 when they overlap.
+        gap := 0
+        if ad.yearFrom > program.yearTo {
+            gap = ad.yearFrom - program.yearTo
+        } else if program.yearFrom > ad.yearTo {
+            gap = program.yearFrom - ad.yearTo
+        }
+        switch {
+        case gap <= 2:
+            score += 3
+        case gap <= 5:
+            score += 1
+        case ad.yearFrom > program.yearTo:
+            score -= 2 // anachronistic
+        }
+    }
+    if len(program.countries) > 0 && len(ad.countries) > 0 {
+        if overlaps(program.countries, ad.countries) {
+            score += 2
+        } else {
+            score -= 1
+        }
+    }
+    for _, h := range ad.holidays {
+        switch {
+        case inSeason(h, at), overlaps(program.holidays, []string{h}):
+            score += 3
+        default:
+            score -= 5
+        }
+    }
+    return score
+}
+
+// adScorer returns the targeting score function for a break in videoID
+// airing at at, or nil when the program's profile cannot be loaded.
+func adScorer(st *Station, db *sql.DB, videoID int64, at time.Time) func(c podCandidate) float64 {
+    profiles, err := loadAdProfiles(db, []int64{videoID})
+    if err != nil {
+        errorLogger.Printf("Station %s (adsEnabled: %v): Failed to load targeting profile for video %d: %v", st.name, st.adsEnabled, videoID, err)
+        return nil
+    }
+    program := profiles[videoID]
+    return func(c podCandidate) float64 {
+        ad := adProfiles[c.id]
+        if ad == nil {
+            return 0
+        }
+        return scoreAd(program, ad, at)
+    }
+}
+
+// weightedOrder returns the indexes of ads in a random order that favours
+// higher scores (weighted sampling without replacement). A nil score is a
+// uniform shuffle.
+func weightedOrder(ads []podCandidate, score func(podCandidate) float64, rng *rand.Rand) []int {
+    if score == nil {
+        return rng.Perm(len(ads))
+    }
+    keys := make([]float64, len(ads))
+    order := make([]int, len(ads))
+    for i, c := range ads {
+        u := rng.Float64()
+        for u == 0 {
+            u = rng.Float64()
+        }
+        keys[i] = math.Log(u) / math.Exp(score(c)/targetingTemperature)
+        order[i] = i
+    }
+    sort.Slice(order, func(a, b int) bool { return keys[order[a]] > keys[order[b]] })
+    return order
+}
+
+type adScore struct {
+    VideoID int64 `json:"video_id"`
+    Duration float64 `json:"duration"`
+    Score float64 `json:"score"`
+}
+
+// adScoresHandler serves /api/videos/:id/ad-scores?at=, the targeting score of
+// every commercial for a break in the video, best first.
+func adScoresHandler(db *sql.DB, c *gin.Context) {
+    videoID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+    if err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+        return
+    }
+    at := time.Now()
+    if s := c.Query("at"); s != "" {
+        if at, err = time.Parse(time.RFC3339, s); err != nil {
+            c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid at, expected RFC 3339"})
+            return
+        }
+    }
+    profiles, err := loadAdProfiles(db, []int64{videoID})
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+        return
+    }
+    scores := make([]adScore, 0, len(adCatalog))
+    for _, ad := range adCatalog {
+        s := 0.0
+        if p := adProfiles[ad.id]; p != nil {
+            s = scoreAd(profiles[videoID], p, at)
+        }
+        scores = append(scores, adScore{VideoID: ad.id, Duration: ad.dur, Score: s})
+    }
+    sort.SliceStable(scores, func(i, j int) bool { return scores[i].Score > scores[j].Score })
+    c.JSON(http.StatusOK, scores)
+}
@@ -0,0 +1,543 @@
+package main
+
+import (
+    "database/sql"
+    "encoding/xml"
+    "errors"
+    "fmt"
+    "io"
+    "log"
+    "math"
+    "math/rand"
+    "net/http"
+    "net/url"
+    "os"
+    "os/exec"
+    "path"
+    "path/filepath"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+)
+
+const maxVASTWrappers = 5 // wrapper redirects followed before giving up on an ad
+
+// VAST 3/4 and VMAP 1.0 documents, reduced to what ad decisioning uses.
+// encoding/xml matches on local names, so the vmap: prefix needs no mapping.
+
+type vastDoc struct {
+    XMLName xml.Name `xml:"VAST"`
+    Version string `xml:"version,attr"`
+    Ads []vastAd `xml:"Ad"`
+    Errors []vastURL `xml:"Error"`
+}
+
+type vastAd struct {
+    ID string `xml:"id,attr"`
+    Sequence int `xml:"sequence,attr"`
+    InLine *vastInLine `xml:"InLine"`
+    Wrapper *vastWrapper `xml:"Wrapper"`
+}
+
+type vastInLine struct {
+    AdTitle string `xml:"AdTitle"`
+    Impressions []vastURL `xml:"Impression"`
+    Errors []vastURL `xml:"Error"`
+    Creatives []vastCreative `xml:"Creatives>Creative"`
+}
+
+type vastWrapper struct {
+    AdTagURI vastURL `xml:"VASTAdTagURI"`
+    Impressions []vastURL `xml:"Impression"`
+    Errors []vastURL `xml:"Error"`
+    Creatives []vastCreative `xml:"Creatives>Creative"`
+}
+
+type vastCreative struct {
+    Linear *vastLinear `xml:"Linear"`
+}
+
+type vastLinear struct {
+    Duration string `xml:"Duration"`
+    MediaFiles []vastMediaFile `xml:"MediaFiles>MediaFile"`
+    Tracking []vastTracking `xml:"TrackingEvents>Tracking"`
+}
+
+type vastMediaFile struct {
+    Delivery string `xml:"delivery,attr"`
+    Type string `xml:"type,attr"`
+    Width int `xml:"width,attr"`
+    Height int `xml:"height,attr"`
+    URL string `xml:",chardata"`
+}
+
+type vastTracking struct {
+    Event string `xml:"event,attr"`
+    URL string `xml:",chardata"`
+}
+
+type vastURL struct {
+    URL string `xml:",chardata"`
+}
+
+type vmapDoc struct {
+    XMLName xml.Name `xml:"VMAP"`
+    Breaks []vmapBreak `xml:"AdBreak"`
+}
+
+type vmapBreak struct {
+    TimeOffset string `xml:"timeOffset,attr"`
+    BreakType string `xml:"breakType,attr"`
+    AdSource struct {
+        VASTAdData *struct {
+            VAST vastDoc `xml:"VAST"`
+        } `xml:"VASTAdData"`
+        AdTagURI vastURL `xml:"AdTagURI"`
+    } `xml:"AdSource"`
+}
+
+// adTracking is the VAST tracking of one ad as it is transmitted.
+type adTracking struct {
+    impressions []string
+    errors []string
+    events map[string][]string // VAST event name -> tracking URLs
+}
+
+// adQuartiles are the progress points at which tracking fires, with the VAST
+// events due at each.
+var adQuartiles = []struct {
+    at float64
+    events []string
+}{
+    {0, []string{"creativeView", "start"}},
+    {0.25, []string{"firstQuartile"}},
+    {0.5, []string{"midpoint"}},
+    {0.75, []string{"thirdQuartile"}},
+    {1, []string{"complete"}},
+}
+
+// adTracker fires an ad's impression and quartile tracking as the sender
+// reports how much of its chunk has been transmitted. A nil tracker is a
+// no-op, which is what every non-VAST chunk gets.
+type adTracker struct {
+    t *adTracking
+    next int
+}
+
+func newAdTracker(chunk bufferedChunk) *adTracker {
+    if chunk.track == nil {
+        return nil
+    }
+    return &adTracker{t: chunk.track}
+}
+
+func (a *adTracker) progress(frac float64) {
+    if a == nil {
+        return
+    }
+    for a.next < len(adQuartiles) && frac >= adQuartiles[a.next].at {
+        if a.next == 0 {
+            fireTracking(a.t.impressions, 0)
+        }
+        for _, ev := range adQuartiles[a.next].events {
+            fireTracking(a.t.events[ev], 0)
+        }
+        a.next++
+    }
+}
+
+func (t *adTracking) merge(o *adTracking) {
+    t.impressions = append(t.impressions, o.impressions...)
+    t.errors = append(t.errors, o.errors...)
+    for ev, urls := range o.events {
+        t.events[ev] = append(t.events[ev], urls...)
+    }
+}
+
+// expandVASTMacros fills the standard VAST macros of a tracking URL.
+func expandVASTMacros(u string, errorCode int) string {
+    r := strings.NewReplacer(
+        "[TIMESTAMP]", url.QueryEscape(time.Now().Format(time.RFC3339)),
+        "[CACHEBUSTING]", fmt.Sprintf("%08d", rand.Intn(100000000)),
+        "[ERRORCODE]", strconv.Itoa(errorCode),
+    )
+    return r.Replace(u)
+}
+
+// fireTracking requests each tracking URL in the background; failures are
+// logged and otherwise ignored, as VAST expects.
+func fireTracking(urls []string, errorCode int) {
+    for _, u := range urls {
+        if u == "" {
+            continue
+        }
+        go func(u string) {
+            client := &http.Client{Timeout: 10 * time.Second}
+            resp, err := client.Get(expandVASTMacros(u, errorCode))
+            if err != nil {
+                errorLogger.Printf("VAST tracking request %s failed: %v", u, err)
+                return
+            }
+            io.Copy(io.Discard, resp.Body)
+            resp.Body.Close()
+        }(u)
+    }
+}
+
+// decisionURL expands the macros of the configured ad server URL for a break.
+func decisionURL(st *Station, videoID int64, bp *BreakPoint, target float64, at time.Time) string {
+    r := strings.NewReplacer(
+        "[STATION]", url.QueryEscape(st.name),
+        "[STATION_ID]", strconv.FormatInt(st.id, 10),
+        "[VIDEO_ID]", strconv.FormatInt(videoID, 10),
+        "[BREAK_TIME]", strconv.FormatFloat(bp.Time, 'f', 3, 64),
+        "[POD_DURATION]", strconv.FormatFloat(target, 'f', 3, 64),
+        "[TIMESTAMP]", url.QueryEscape(at.Format(time.RFC3339)),
+        "[CACHEBUSTING]", fmt.Sprintf("%08d", rand.Intn(100000000)),
+    )
+    return r.Replace(cfg.Ads.DecisionURL)
+}
+
+func fetchAdDocument(u string) ([]byte, error) {
+    client := &http.Client{Timeout: time.Duration(cfg.Ads.DecisionTimeoutSeconds * float64(time.Second))}
+    resp, err := client.Get(u)
+    if err != nil {
+        return nil, err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode == http.StatusNoContent {
+        return nil, nil
+    }
+    if resp.StatusCode != http.StatusOK {
+        return nil, fmt.Errorf("ad server returned %s", resp.Status)
+    }
+    return io.ReadAll(io.LimitReader(resp.Body, 4<<20))
+}
+
+// parseVASTTime reads HH:MM:SS or HH:MM:SS.mmm.
+func parseVASTTime(s string) (float64, bool) {
+    parts := strings.Split(strings.TrimSpace(s), ":")
+    if len(parts) != 3 {
+        return 0, false
+    }
+    h, err1 := strconv.Atoi(parts[0])
+    m, err2 := strconv.Atoi(parts[1])
+    sec, err3 := strconv.ParseFloat(parts[2], 64)
+    if err1 != nil || err2 != nil || err3 != nil {
+        return 0, false
+    }
+    return float64(h*3600+m*60) + sec, true
+}
+
+// vmapOffset is where a VMAP break sits in a video of videoDur seconds.
+// Positional offsets ("#1") are not supported.
+func vmapOffset(offset string, videoDur float64) (float64, bool) {
+    switch offset = strings.TrimSpace(offset); {
+    case offset == "start":
+        return 0, true
+    case offset == "end":
+        return videoDur, true
+    case strings.HasSuffix(offset, "%"):
+        p, err := strconv.ParseFloat(strings.TrimSuffix(offset, "%"), 64)
+        return videoDur * p / 100, err == nil
+    }
+    return parseVASTTime(offset)
+}
+
+// vmapBreakVAST returns the VAST for the linear VMAP break closest to
+// breakTime, within a second of it.
+func vmapBreakVAST(doc *vmapDoc, breakTime, videoDur float64) (*vastDoc, error) {
+    var best *vmapBreak
+    bestDiff := 1.0
+    for i := range doc.Breaks {
+        b := &doc.Breaks[i]
+        if b.BreakType != "" && !strings.Contains(b.BreakType, "linear") {
+            continue
+        }
+        if at, ok := vmapOffset(b.TimeOffset, videoDur); ok && math.Abs(at-breakTime) <= bestDiff {
+            best, bestDiff = b, math.Abs(at-breakTime)
+        }
+    }
+    if best == nil {
+        return nil, nil
+    }
+    if best.AdSource.VASTAdData != nil {
+        return &best.AdSource.VASTAdData.VAST, nil
+    }
+    if u := strings.TrimSpace(best.AdSource.AdTagURI.URL); u != "" {
+        data, err := fetchAdDocument(u)
+        if err != nil || data == nil {
+            return nil, err
+        }
+        var vast vastDoc
+        if err := xml.Unmarshal(data, &vast); err != nil {
+            return nil, fmt.Errorf("failed to parse VAST from %s: %w", u, err)
+        }
+        return &vast, nil
+    }
+    return nil, nil
+}
+
+// decidedAd is a linear ad resolved through any wrappers.
+type decidedAd struct {
+    id string
+    sequence int
+    duration float64
+    media []vastMediaFile
+    track *adTracking
+}
+
+func trimmedURLs(urls []vastURL) []string {
+    var out []string
+    for _, u := range urls {
+        if s := strings.TrimSpace(u.URL); s != "" {
+            out = append(out, s)
+        }
+    }
+    return out
+}
+
+// linearTracking gathers the tracking of the first linear creative and returns
+// it with that creative.
+func linearTracking(creatives []vastCreative, impressions, errs []vastURL) (*adTracking, *vastLinear) {
+    t := &adTracking{impressions: trimmedURLs(impressions), errors: trimmedURLs(errs), events: make(map[string][]string)}
+    for _, c := range creatives {
+        if c.Linear == nil {
+            continue
+        }
+        for _, tr := range c.Linear.Tracking {
+            if u := strings.TrimSpace(tr.URL); u != "" {
+                t.events[tr.Event] = append(t.events[tr.Event], u)
+            }
+        }
+        return t, c.Linear
+    }
+    return t, nil
+}
+
+// resolveVAST flattens the ads of a VAST document, following wrappers up to
+// maxVASTWrappers deep and carrying their tracking down to the inline ad.
+func resolveVAST(doc *vastDoc, depth int) []decidedAd {
+    var ads []decidedAd
+    for _, ad := range doc.Ads {
+        switch {
+        case ad.InLine != nil:
+            track, linear := linearTracking(ad.InLine.Creatives, ad.InLine.Impressions, ad.InLine.Errors)
+            if linear == nil {
+                continue
+            }
+            dur, _ := parseVASTTime(linear.Duration)
+            ads = append(ads, decidedAd{id: ad.ID, sequence: ad.Sequence, duration: dur, media: linear.MediaFiles, track: track})
+        case ad.Wrapper != nil:
+            track, _ := linearTracking(ad.Wrapper.Creatives, ad.Wrapper.Impressions, ad.Wrapper.Errors)
+            u := strings.TrimSpace(ad.Wrapper.AdTagURI.URL)
+            if depth >= maxVASTWrappers || u == "" {
+                fireTracking(track.errors, 302) // wrapper limit reached
+                continue
+            }
+            data, err := fetchAdDocument(u)
+            var inner vastDoc
+            if err == nil && data != nil {
+                err = xml.Unmarshal(data, &inner)
+            }
+            if err != nil || data == nil {
+                errorLogger.Printf("VAST wrapper %s for ad %s failed: %v", u, ad.ID, err)
+                fireTracking(track.errors, 301) // wrapper timeout or error
+                continue
+            }
+            for _, in := range resolveVAST(&inner, depth+1) {
+                in.track.merge(track)
+                if in.sequence == 0 {
+                    in.sequence = ad.Sequence
+                }
+                ads = append(ads, in)
+            }
+        }
+    }
+    // Pods play in sequence order; stand-alone ads (no sequence) follow.
+    sort.SliceStable(ads, func(i, j int) bool {
+        si, sj := ads[i].sequence, ads[j].sequence
+        if si == 0 || sj == 0 {
+            return si != 0 && sj == 0
+        }
+        return si < sj
+    })
+    return ads
+}
+
+// mediaFileName is the file name a media file URL points at.
+func mediaFileName(u string) string {
+    if parsed, err := url.Parse(u); err == nil && parsed.Path != "" {
+        if name, err := url.PathUnescape(path.Base(parsed.Path)); err == nil {
+            return name
+        }
+    }
+    return filepath.Base(u)
+}
+
+// libraryVideo finds the library video a media file refers to by file name.
+func libraryVideo(db *sql.DB, name string) (int64, float64, error) {
+    var id int64
+    var dur sql.NullFloat64
+    err := db.QueryRow(
+        `SELECT id, duration FROM videos WHERE regexp_replace(uri, '^.*[/\\]', '') = $1 ORDER BY duration IS NULL, id LIMIT 1`,
+        name).Scan(&id, &dur)
+    return id, dur.Float64, err
+}
+
+// ingestMediaFile downloads a media file into the configured ingest directory
+// and adds it to the library as an untitled commercial.
+func ingestMediaFile(db *sql.DB, mf vastMediaFile, name string) (int64, float64, error) {
+    uri := filepath.ToSlash(filepath.Join(cfg.Ads.IngestDir, name))
+    dst := filepath.Join(videoBaseDir, uri)
+    if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+        return 0, 0, err
+    }
+    resp, err := http.Get(strings.TrimSpace(mf.URL))
+    if err != nil {
+        return 0, 0, err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        return 0, 0, fmt.Errorf("media server returned %s", resp.Status)
+    }
+    tmp := dst + ".part"
+    f, err := os.Create(tmp)
+    if err != nil {
+        return 0, 0, err
+    }
+    _, err = io.Copy(f, resp.Body)
+    if cerr := f.Close(); err == nil {
+        err = cerr
+    }
+    if err == nil {
+        err = os.Rename(tmp, dst)
+    }
+    if err != nil {
+        os.Remove(tmp)
+        return 0, 0, err
+    }
+    out, err := exec.Command("ffprobe", "-v", "error", "-show_entries", "format=duration", "-of", "default=noprint_wrappers=1:nokey=1", dst).Output()
+    if err != nil {
+        return 0, 0, fmt.Errorf("ffprobe failed for %s: %v", dst, err)
+    }
+    dur, err := strconv.ParseFloat(strings.TrimSpace(string(out)), 64)
+    if err != nil {
+        return 0, 0, fmt.Errorf("failed to parse duration of %s: %v", dst, err)
+    }
+    var id int64
+    if err := db.QueryRow(`INSERT INTO videos (title_id, uri, duration) VALUES (0, $1, $2) RETURNING id`, uri, dur).Scan(&id); err != nil {
+        return 0, 0, err
+    }
+    if _, err := db.Exec(`INSERT INTO video_tags (video_id, tag_id) VALUES ($1, 4)`, id); err != nil {
+        return 0, 0, err
+    }
+    log.Printf("Ingested ad server media %s as video %d (%.3fs)", uri, id, dur)
+    return id, dur, nil
+}
+
+// mediaVideo maps an ad's media files to a library video: any file already in
+// the library wins, otherwise the first progressive MP4 (or any progressive
+// file) is ingested when an ingest directory is configured.
+func mediaVideo(db *sql.DB, ad decidedAd) (int64, float64, error) {
+    for _, mf := range ad.media {
+        id, dur, err := libraryVideo(db, mediaFileName(strings.TrimSpace(mf.URL)))
+        if err == nil {
+            if dur <= 0 {
+                dur = ad.duration
+            }
+            return id, dur, nil
+        }
+        if !errors.Is(err, sql.ErrNoRows) {
+            return 0, 0, err
+        }
+    }
+    if cfg.Ads.IngestDir == "" {
+        return 0, 0, fmt.Errorf("no media file of ad %s is in the library", ad.id)
+    }
+    var pick *vastMediaFile
+    for i, mf := range ad.media {
+        if mf.Delivery == "streaming" || strings.TrimSpace(mf.URL) == "" {
+            continue
+        }
+        if pick == nil || (mf.Type == "video/mp4" && pick.Type != "video/mp4") {
+            pick = &ad.media[i]
+        }
+    }
+    if pick == nil {
+        return 0, 0, fmt.Errorf("ad %s has no progressive media file", ad.id)
+    }
+    return ingestMediaFile(db, *pick, mediaFileName(strings.TrimSpace(pick.URL)))
+}
+
+// decideAdPod asks the configured ad server to fill a break. Ads are taken in
+// sequence while they fit target+tolerance and the rest is filled with
+// bumpers. It returns nil when no ad server is configured or nothing it
+// returned can be played, leaving the break to the internal picker.
+// On-demand video never asks, so previews fire no tracking.
+func decideAdPod(st *Station, db *sql.DB, videoID int64, bp *BreakPoint, target, tolerance float64, at time.Time, bumpers []podCandidate) []podCandidate {
+    if cfg.Ads.DecisionURL == "" || st.vod {
+        return nil
+    }
+    u := decisionURL(st, videoID, bp, target, at)
+    data, err := fetchAdDocument(u)
+    if err != nil {
+        errorLogger.Printf("Station %s (adsEnabled: %v): Ad decision request %s failed, using internal picker: %v", st.name, st.adsEnabled, u, err)
+        return nil
+    }
+    if data == nil {
+        return nil
+    }
+    var root struct {
+        XMLName xml.Name
+    }
+    if err := xml.Unmarshal(data, &root); err != nil {
+        errorLogger.Printf("Station %s (adsEnabled: %v): Unparseable ad decision response from %s, using internal picker: %v", st.name, st.adsEnabled, u, err)
+        return nil
+    }
+    var vast *vastDoc
+    switch root.XMLName.Local {
+    case "VAST":
+        vast = &vastDoc{}
+        err = xml.Unmarshal(data, vast)
+    case "VMAP":
+        var vmap vmapDoc
+        if err = xml.Unmarshal(data, &vmap); err == nil {
+            vast, err = vmapBreakVAST(&vmap, bp.Time, getVideoDur(videoID, db))
+        }
+    default:
+        err = fmt.Errorf("unexpected root element %s", root.XMLName.Local)
+    }
+    if err != nil || vast == nil {
+        if err != nil {
+            errorLogger.Printf("Station %s (adsEnabled: %v): Bad ad decision response from %s, using internal picker: %v", st.name, st.adsEnabled, u, err)
+        }
+        return nil
+    }
+    if len(vast.Ads) == 0 {
+        fireTracking(trimmedURLs(vast.Errors), 303) // no ads after wrapper/empty response
+        return nil
+    }
+    var pod []podCandidate
+    total := 0.0
+    for _, ad := range resolveVAST(vast, 0) {
+        id, dur, err := mediaVideo(db, ad)
+        if err != nil {
+            errorLogger.Printf("Station %s (adsEnabled: %v): Skipping VAST ad %s: %v", st.name, st.adsEnabled, ad.id, err)
+            fireTracking(ad.track.errors, 401) // file not found
+            continue
+        }
+        if dur <= 0 || total+dur > target+tolerance {
+            fireTracking(ad.track.errors, 202) // duration not supported
+            continue
+        }
+        pod = append(pod, podCandidate{id: id, dur: dur, track: ad.track})
+        total += dur
+    }
+    if len(pod) == 0 {
+        return nil
+    }
+    log.Printf("Station %s (adsEnabled: %v): Ad server filled %.3fs of a %.1fs break with %d ads", st.name, st.adsEnabled, total, target, len(pod))
+    return fillWithBumpers(pod, total, longestFirst(bumpers), target, tolerance)
+}
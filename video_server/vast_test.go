@@ -0,0 +1,241 @@
+package main
+
+import (
+    "encoding/xml"
+    "fmt"
+    "io"
+    "log"
+    "net/http"
+    "net/http/httptest"
+    "net/url"
+    "sort"
+    "strings"
+    "testing"
+    "time"
+    "config"
+)
+
+// stubAdXML is an inline ad as misc/vast_stub.go serves it.
+func stubAdXML(base, id string, seq int, dur, file string) string {
+    var b strings.Builder
+    fmt.Fprintf(&b, `<Ad id="%s" sequence="%d"><InLine><AdSystem>vast_stub</AdSystem><AdTitle>%s</AdTitle>`, id, seq, id)
+    fmt.Fprintf(&b, `<Impression><![CDATA[%s/track?ad=%s&event=impression]]></Impression>`, base, id)
+    fmt.Fprintf(&b, `<Error><![CDATA[%s/track?ad=%s&event=error&code=[ERRORCODE]]]></Error>`, base, id)
+    fmt.Fprintf(&b, `<Creatives><Creative><Linear><Duration>%s</Duration><TrackingEvents>`, dur)
+    for _, ev := range []string{"creativeView", "start", "firstQuartile", "midpoint", "thirdQuartile", "complete"} {
+        fmt.Fprintf(&b, `<Tracking event="%s">%s/track?ad=%s&amp;event=%s&amp;t=[TIMESTAMP]</Tracking>`, ev, base, id, ev)
+    }
+    fmt.Fprintf(&b, `</TrackingEvents><MediaFiles><MediaFile delivery="progressive" type="video/mp4">%s/media/%s</MediaFile></MediaFiles>`, base, url.PathEscape(file))
+    b.WriteString(`</Linear></Creative></Creatives></InLine></Ad>`)
+    return b.String()
+}
+
+// trackingHits records the tracking requests a stub server receives as
+// "ad event", or "ad error code" for error beacons.
+type trackingHits chan string
+
+func (h trackingHits) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    q := r.URL.Query()
+    hit := q.Get("ad") + " " + q.Get("event")
+    if code := q.Get("code"); code != "" {
+        hit += " " + code
+    }
+    h <- hit
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// wait returns the next n hits, sorted, failing the test if they do not all
+// arrive.
+func (h trackingHits) wait(t *testing.T, n int) []string {
+    t.Helper()
+    var got []string
+    timeout := time.After(5 * time.Second)
+    for len(got) < n {
+        select {
+        case hit := <-h:
+            got = append(got, hit)
+        case <-timeout:
+            t.Fatalf("got %d tracking requests %v, want %d", len(got), got, n)
+        }
+    }
+    sort.Strings(got)
+    return got
+}
+
+func (h trackingHits) none(t *testing.T) {
+    t.Helper()
+    select {
+    case hit := <-h:
+        t.Fatalf("unexpected tracking request %s", hit)
+    case <-time.After(100 * time.Millisecond):
+    }
+}
+
+func newVASTTestServer(t *testing.T, mux *http.ServeMux) *httptest.Server {
+    t.Helper()
+    cfg = config.Default()
+    errorLogger = log.New(io.Discard, "", 0)
+    srv := httptest.NewServer(mux)
+    t.Cleanup(srv.Close)
+    return srv
+}
+
+func TestResolveVASTWrapperMediaFiles(t *testing.T) {
+    mux := http.NewServeMux()
+    srv := newVASTTestServer(t, mux)
+    mux.HandleFunc("/vast", func(w http.ResponseWriter, r *http.Request) {
+        fmt.Fprintf(w, `<VAST version="4.0">%s%s</VAST>`,
+            stubAdXML(srv.URL, "second", 2, "00:00:15.500", "Second Ad.mp4"),
+            stubAdXML(srv.URL, "first", 1, "00:00:30", "first.mp4"))
+    })
+    mux.HandleFunc("/wrapper", func(w http.ResponseWriter, r *http.Request) {
+        fmt.Fprintf(w, `<VAST version="4.0"><Ad id="wrapper"><Wrapper><AdSystem>vast_stub</AdSystem><VASTAdTagURI><![CDATA[%s/vast]]></VASTAdTagURI><Impression><![CDATA[%s/track?ad=wrapper&event=impression]]></Impression></Wrapper></Ad></VAST>`, srv.URL, srv.URL)
+    })
+    data, err := fetchAdDocument(srv.URL + "/wrapper")
+    if err != nil {
+        t.Fatalf("fetchAdDocument: %v", err)
+    }
+    doc := &vastDoc{}
+    if err := xml.Unmarshal(data, doc); err != nil {
+        t.Fatalf("unmarshal wrapper: %v", err)
+    }
+    ads := resolveVAST(doc, 0)
+    want := []struct {
+        id string
+        duration float64
+        file string
+    }{
+        {"first", 30, "first.mp4"},
+        {"second", 15.5, "Second Ad.mp4"},
+    }
+    if len(ads) != len(want) {
+        t.Fatalf("resolved %d ads, want %d", len(ads), len(want))
+    }
+    for i, w := range want {
+        ad := ads[i]
+        if ad.id != w.id || ad.duration != w.duration {
+            t.Errorf("ad %d = %s %.3fs, want %s %.3fs", i, ad.id, ad.duration, w.id, w.duration)
+        }
+        if len(ad.media) != 1 {
+            t.Fatalf("ad %s has %d media files, want 1", ad.id, len(ad.media))
+        }
+        if got := mediaFileName(strings.TrimSpace(ad.media[0].URL)); got != w.file {
+            t.Errorf("ad %s media file = %q, want %q", ad.id, got, w.file)
+        }
+        if n := len(ad.track.impressions); n != 2 {
+            t.Errorf("ad %s has %d impressions, want its own and the wrapper's", ad.id, n)
+        }
+    }
+}
+
+func TestMediaFileName(t *testing.T) {
+    tests := []struct {
+        url string
+        want string
+    }{
+        {"http://localhost:8090/media/Second%20Ad.mp4", "Second Ad.mp4"},
+        {"https://cdn.example.com/ads/first.mp4?cb=123", "first.mp4"},
+        {"ads/local.mp4", "local.mp4"},
+    }
+    for _, tt := range tests {
+        if got := mediaFileName(tt.url); got != tt.want {
+            t.Errorf("mediaFileName(%q) = %q, want %q", tt.url, got, tt.want)
+        }
+    }
+}
+
+func TestDecideAdPodFallsBackToInternalPicker(t *testing.T) {
+    hits := make(trackingHits, 16)
+    mux := http.NewServeMux()
+    srv := newVASTTestServer(t, mux)
+    mux.Handle("/track", hits)
+    mux.HandleFunc("/empty", func(w http.ResponseWriter, r *http.Request) {
+        w.WriteHeader(http.StatusNoContent)
+    })
+    mux.HandleFunc("/fail", func(w http.ResponseWriter, r *http.Request) {
+        http.Error(w, "boom", http.StatusInternalServerError)
+    })
+    mux.HandleFunc("/garbage", func(w http.ResponseWriter, r *http.Request) {
+        fmt.Fprint(w, "not xml")
+    })
+    mux.HandleFunc("/html", func(w http.ResponseWriter, r *http.Request) {
+        fmt.Fprint(w, "<html></html>")
+    })
+    mux.HandleFunc("/noads", func(w http.ResponseWriter, r *http.Request) {
+        fmt.Fprintf(w, `<VAST version="4.0"><Error><![CDATA[%s/track?ad=none&event=error&code=[ERRORCODE]]]></Error></VAST>`, srv.URL)
+    })
+    st := &Station{name: "test", id: 1, adsEnabled: true}
+    bp := &BreakPoint{Time: 300}
+    tests := []struct {
+        path string
+        hits []string
+    }{
+        {"/empty", nil},
+        {"/fail", nil},
+        {"/garbage", nil},
+        {"/html", nil},
+        {"/noads", []string{"none error 303"}},
+    }
+    for _, tt := range tests {
+        cfg.Ads.DecisionURL = srv.URL + tt.path + "?dur=[POD_DURATION]"
+        if pod := decideAdPod(st, nil, 1, bp, 120, 5, time.Now(), nil); pod != nil {
+            t.Errorf("%s: decideAdPod = %v, want nil", tt.path, pod)
+        }
+        if got := hits.wait(t, len(tt.hits)); fmt.Sprint(got) != fmt.Sprint(tt.hits) {
+            t.Errorf("%s: tracking %v, want %v", tt.path, got, tt.hits)
+        }
+        hits.none(t)
+    }
+    cfg.Ads.DecisionURL = ""
+    if pod := decideAdPod(st, nil, 1, bp, 120, 5, time.Now(), nil); pod != nil {
+        t.Errorf("no decision URL: decideAdPod = %v, want nil", pod)
+    }
+    cfg.Ads.DecisionURL = srv.URL + "/noads"
+    if pod := decideAdPod(&Station{name: "vod", vod: true}, nil, 1, bp, 120, 5, time.Now(), nil); pod != nil {
+        t.Errorf("on-demand: decideAdPod = %v, want nil", pod)
+    }
+    hits.none(t)
+}
+
+func TestAdTrackerFiresImpressionAndQuartiles(t *testing.T) {
+    hits := make(trackingHits, 16)
+    mux := http.NewServeMux()
+    srv := newVASTTestServer(t, mux)
+    mux.Handle("/track", hits)
+    mux.HandleFunc("/vast", func(w http.ResponseWriter, r *http.Request) {
+        fmt.Fprintf(w, `<VAST version="4.0">%s</VAST>`, stubAdXML(srv.URL, "ad", 1, "00:00:30", "ad.mp4"))
+    })
+    data, err := fetchAdDocument(srv.URL + "/vast")
+    if err != nil {
+        t.Fatalf("fetchAdDocument: %v", err)
+    }
+    doc := &vastDoc{}
+    if err := xml.Unmarshal(data, doc); err != nil {
+        t.Fatalf("unmarshal: %v", err)
+    }
+    ads := resolveVAST(doc, 0)
+    if len(ads) != 1 {
+        t.Fatalf("resolved %d ads, want 1", len(ads))
+    }
+    if newAdTracker(bufferedChunk{}) != nil {
+        t.Errorf("newAdTracker of a chunk without tracking is not nil")
+    }
+    tracker := newAdTracker(bufferedChunk{track: ads[0].track})
+    steps := []struct {
+        frac float64
+        want []string
+    }{
+        {0, []string{"ad creativeView", "ad impression", "ad start"}},
+        {0.1, nil},
+        {0.6, []string{"ad firstQuartile", "ad midpoint"}},
+        {1, []string{"ad complete", "ad thirdQuartile"}},
+        {1, nil},
+    }
+    for _, s := range steps {
+        tracker.progress(s.frac)
+        if got := hits.wait(t, len(s.want)); fmt.Sprint(got) != fmt.Sprint(s.want) {
+            t.Errorf("progress(%.2f) fired %v, want %v", s.frac, got, s.want)
+        }
+        hits.none(t)
+    }
+}
@@ -0,0 +1,376 @@
+package video
+
+import (
+    "bytes"
+    "fmt"
+    "log"
+    "math"
+    "os"
+    "os/exec"
+    "path/filepath"
+    "strings"
+    "sync"
+    "time"
+)
+
+const (
+    DefaultSegmentDuration = 6.0
+    DefaultWindowSize = 6
+    PlaylistName = "playlist.m3u8"
+    timelineStart = 10 * ClockRate // keep early PCR values away from zero
+    dateRangeFormat = "2006-01-02T15:04:05.000Z07:00"
+)
+
+// Chunk is one transmitted station chunk handed to the packager. Frames are
+// Annex B access units in decode order; AudioOgg is the chunk's Ogg/Opus file.
+// Start is the wall-clock time the chunk goes out, and Cue, if set, marks an
+// ad break boundary at its first frame. Each segment is published once it
+// has gone out in full, so the playlist never runs ahead of the station.
+type Chunk struct {
+    Frames [][]byte
+    Duration float64
+    AudioOgg []byte
+    Discontinuity bool
+    Label string
+    Start time.Time
+    Cue *Cue
+}
+
+type segment struct {
+    seq uint64
+    name string
+    dur float64
+    discontinuity bool
+    programDate time.Time
+    tags []string
+}
+
+// Packager turns station chunks into MPEG-TS segments and maintains a live
+// sliding-window playlist for them.
+type Packager struct {
+    Dir string
+    SegmentDuration float64
+    WindowSize int
+    mu sync.Mutex
+    segments []segment
+    retired []string
+    nextSeq uint64
+    discontinuitySeq uint64
+    targetDuration int
+    pts uint64
+    openCue *Cue
+    openCueStart time.Time
+    dropped bool
+    closed bool
+    queue chan Chunk
+    stop chan struct{} // closed by Close so a waiting segment is published at once
+    done chan struct{}
+}
+
+// NewPackager creates dir, clears any stale output in it and starts the
+// packaging worker.
+func NewPackager(dir string, segmentDuration float64, windowSize int) (*Packager, error) {
+    if segmentDuration <= 0 {
+        segmentDuration = DefaultSegmentDuration
+    }
+    if windowSize <= 0 {
+        windowSize = DefaultWindowSize
+    }
+    if err := os.MkdirAll(dir, 0755); err != nil {
+        return nil, fmt.Errorf("failed to create HLS dir: %w", err)
+    }
+    if stale, err := filepath.Glob(filepath.Join(dir, "*.ts")); err == nil {
+        for _, f := range stale {
+            os.Remove(f)
+        }
+    }
+    os.Remove(filepath.Join(dir, PlaylistName))
+    p := &Packager{
+        Dir: dir,
+        SegmentDuration: segmentDuration,
+        WindowSize: windowSize,
+        pts: timelineStart,
+        queue: make(chan Chunk, 16),
+        stop: make(chan struct{}),
+        done: make(chan struct{}),
+    }
+    go p.run()
+    return p, nil
+}
+
+// Enqueue hands a chunk to the worker without blocking the caller. Chunks are
+// dropped (and the next one flagged as a discontinuity) if the worker falls
+// behind.
+func (p *Packager) Enqueue(c Chunk) {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    if p.closed {
+        return
+    }
+    select {
+    case p.queue <- c:
+    default:
+        log.Printf("HLS %s: packager queue full, dropping chunk %s", p.Dir, c.Label)
+        p.pts += uint64(math.Round(c.Duration * ClockRate))
+        p.dropped = true
+    }
+}
+
+// Close stops the worker after it drains the queued chunks.
+func (p *Packager) Close() {
+    p.mu.Lock()
+    if p.closed {
+        p.mu.Unlock()
+        return
+    }
+    p.closed = true
+    close(p.queue)
+    close(p.stop)
+    p.mu.Unlock()
+    <-p.done
+}
+
+func (p *Packager) run() {
+    defer close(p.done)
+    for c := range p.queue {
+        if err := p.addChunk(c); err != nil {
+            log.Printf("HLS %s: failed to package chunk %s: %v", p.Dir, c.Label, err)
+        }
+    }
+}
+
+type audioFrame struct {
+    pts uint64
+    data []byte
+}
+
+func (p *Packager) addChunk(c Chunk) error {
+    if len(c.Frames) == 0 || c.Duration <= 0 {
+        return fmt.Errorf("empty chunk")
+    }
+    p.mu.Lock()
+    base := p.pts
+    p.pts += uint64(math.Round(c.Duration * ClockRate))
+    discontinuity := c.Discontinuity || p.dropped
+    p.dropped = false
+    p.mu.Unlock()
+    if c.Start.IsZero() {
+        c.Start = time.Now()
+    }
+    var audio []audioFrame
+    if len(c.AudioOgg) > 0 {
+        adts, err := TranscodeToADTS(c.AudioOgg)
+        if err != nil {
+            log.Printf("HLS %s: audio transcode failed for %s, segment will be silent: %v", p.Dir, c.Label, err)
+        } else {
+            frames, err := SplitADTS(adts)
+            if err != nil {
+                log.Printf("HLS %s: %v (kept %d frames)", p.Dir, err, len(frames))
+            }
+            var samples uint64
+            for _, f := range frames {
+                audio = append(audio, audioFrame{pts: base + samples*ClockRate/uint64(f.SampleRate), data: f.Data})
+                samples += 1024
+            }
+        }
+    }
+    frameTicks := c.Duration * ClockRate / float64(len(c.Frames))
+    // Cut at keyframes once the running segment reaches the target duration.
+    type cut struct{ first, last int }
+    var cuts []cut
+    start := 0
+    for i := 1; i < len(c.Frames); i++ {
+        if float64(i-start)*frameTicks/ClockRate >= p.SegmentDuration && IsKeyframe(c.Frames[i]) {
+            cuts = append(cuts, cut{start, i})
+            start = i
+        }
+    }
+    cuts = append(cuts, cut{start, len(c.Frames)})
+    audioIdx := 0
+    for n, ct := range cuts {
+        segStart := base + uint64(float64(ct.first)*frameTicks)
+        segEnd := base + uint64(float64(ct.last)*frameTicks)
+        var buf bytes.Buffer
+        mux := NewTSMuxer(&buf)
+        if err := mux.WriteTables(); err != nil {
+            return err
+        }
+        var cue *Cue
+        var splice []byte
+        if n == 0 && c.Cue != nil {
+            cue = c.Cue
+            splice = cue.SpliceInsert(segStart)
+            if err := mux.WriteSCTE35(splice); err != nil {
+                return err
+            }
+        }
+        for i := ct.first; i < ct.last; i++ {
+            pts := base + uint64(float64(i)*frameTicks)
+            for audioIdx < len(audio) && audio[audioIdx].pts <= pts {
+                if err := mux.WriteAudio(audio[audioIdx].pts, audio[audioIdx].data); err != nil {
+                    return err
+                }
+                audioIdx++
+            }
+            if err := mux.WriteVideo(pts, c.Frames[i], IsKeyframe(c.Frames[i])); err != nil {
+                return err
+            }
+        }
+        for audioIdx < len(audio) && (audio[audioIdx].pts < segEnd || n == len(cuts)-1) {
+            if err := mux.WriteAudio(audio[audioIdx].pts, audio[audioIdx].data); err != nil {
+                return err
+            }
+            audioIdx++
+        }
+        dur := float64(segEnd-segStart) / ClockRate
+        programDate := c.Start.Add(time.Duration(float64(segStart-base) / ClockRate * float64(time.Second)))
+        p.waitUntil(programDate.Add(time.Duration(dur * float64(time.Second))))
+        if err := p.publish(buf.Bytes(), dur, discontinuity, programDate, cue, splice); err != nil {
+            return err
+        }
+        discontinuity = false
+    }
+    return nil
+}
+
+// waitUntil sleeps until t, or until the packager is closed.
+func (p *Packager) waitUntil(t time.Time) {
+    d := time.Until(t)
+    if d <= 0 {
+        return
+    }
+    timer := time.NewTimer(d)
+    defer timer.Stop()
+    select {
+    case <-timer.C:
+    case <-p.stop:
+    }
+}
+
+// publish writes a finished segment, slides the window and rewrites the playlist.
+func (p *Packager) publish(data []byte, dur float64, discontinuity bool, programDate time.Time, cue *Cue, splice []byte) error {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    seq := p.nextSeq
+    p.nextSeq++
+    name := fmt.Sprintf("segment_%d.ts", seq)
+    if err := writeFileAtomic(filepath.Join(p.Dir, name), data); err != nil {
+        return fmt.Errorf("failed to write segment %s: %w", name, err)
+    }
+    p.segments = append(p.segments, segment{
+        seq: seq,
+        name: name,
+        dur: dur,
+        discontinuity: discontinuity,
+        programDate: programDate,
+        tags: p.cueTagsLocked(programDate, cue, splice),
+    })
+    if td := int(math.Ceil(dur)); td > p.targetDuration {
+        p.targetDuration = td
+    }
+    for len(p.segments) > p.WindowSize {
+        old := p.segments[0]
+        if old.discontinuity {
+            p.discontinuitySeq++
+        }
+        p.segments = p.segments[1:]
+        // Leave the file around for one more window so slow clients can finish it.
+        p.retired = append(p.retired, old.name)
+        if len(p.retired) > p.WindowSize {
+            os.Remove(filepath.Join(p.Dir, p.retired[0]))
+            p.retired = p.retired[1:]
+        }
+    }
+    return writeFileAtomic(filepath.Join(p.Dir, PlaylistName), []byte(p.playlistLocked()))
+}
+
+// cueTagsLocked returns the ad marker tags for a segment starting at
+// programDate, tracking the open break across segments. Both the
+// EXT-X-CUE-OUT/CUE-IN convention and EXT-X-DATERANGE are written, since
+// players and ad stitchers differ in which they read.
+func (p *Packager) cueTagsLocked(programDate time.Time, cue *Cue, splice []byte) []string {
+    var tags []string
+    switch {
+    case cue != nil && cue.Out:
+        p.openCue = cue
+        p.openCueStart = programDate
+        tags = append(tags,
+            fmt.Sprintf(`#EXT-X-DATERANGE:ID="break-%d",START-DATE="%s",PLANNED-DURATION=%.3f,SCTE35-OUT=%s`, cue.ID, programDate.UTC().Format(dateRangeFormat), cue.Duration, HexSCTE35(splice)),
+            fmt.Sprintf("#EXT-X-CUE-OUT:DURATION=%.3f", cue.Duration),
+        )
+    case cue != nil:
+        if p.openCue != nil {
+            tags = append(tags, fmt.Sprintf(`#EXT-X-DATERANGE:ID="break-%d",START-DATE="%s",DURATION=%.3f,SCTE35-IN=%s`, p.openCue.ID, p.openCueStart.UTC().Format(dateRangeFormat), programDate.Sub(p.openCueStart).Seconds(), HexSCTE35(splice)))
+        }
+        tags = append(tags, "#EXT-X-CUE-IN")
+        p.openCue = nil
+    case p.openCue != nil:
+        tags = append(tags, fmt.Sprintf("#EXT-X-CUE-OUT-CONT:ElapsedTime=%.3f,Duration=%.3f", programDate.Sub(p.openCueStart).Seconds(), p.openCue.Duration))
+    }
+    return tags
+}
+
+// Playlist returns the current live media playlist.
+func (p *Packager) Playlist() string {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    return p.playlistLocked()
+}
+
+func (p *Packager) playlistLocked() string {
+    var playlist strings.Builder
+    playlist.WriteString("#EXTM3U\n")
+    playlist.WriteString("#EXT-X-VERSION:3\n")
+    playlist.WriteString(fmt.Sprintf("#EXT-X-TARGETDURATION:%d\n", p.targetDuration))
+    mediaSeq := uint64(0)
+    if len(p.segments) > 0 {
+        mediaSeq = p.segments[0].seq
+    }
+    playlist.WriteString(fmt.Sprintf("#EXT-X-MEDIA-SEQUENCE:%d\n", mediaSeq))
+    playlist.WriteString(fmt.Sprintf("#EXT-X-DISCONTINUITY-SEQUENCE:%d\n", p.discontinuitySeq))
+    for _, s := range p.segments {
+        if s.discontinuity {
+            playlist.WriteString("#EXT-X-DISCONTINUITY\n")
+        }
+        playlist.WriteString("#EXT-X-PROGRAM-DATE-TIME:" + s.programDate.UTC().Format(dateRangeFormat) + "\n")
+        for _, tag := range s.tags {
+            playlist.WriteString(tag + "\n")
+        }
+        playlist.WriteString(fmt.Sprintf("#EXTINF:%.3f,\n", s.dur))
+        playlist.WriteString(s.name + "\n")
+    }
+    return playlist.String()
+}
+
+// TranscodeToADTS converts an Ogg/Opus chunk to an AAC ADTS stream, since
+// HLS clients cannot play Opus in MPEG-TS.
+func TranscodeToADTS(ogg []byte) ([]byte, error) {
+    cmd := exec.Command(
+        "ffmpeg",
+        "-v", "error",
+        "-f", "ogg",
+        "-i", "pipe:0",
+        "-c:a", "aac",
+        "-b:a", "128k",
+        "-ar", "48000",
+        "-ac", "2",
+        "-f", "adts",
+        "pipe:1",
+    )
+    cmd.Stdin = bytes.NewReader(ogg)
+    var stderr bytes.Buffer
+    cmd.Stderr = &stderr
+    out, err := cmd.Output()
+    if err != nil {
+        return nil, fmt.Errorf("ffmpeg adts transcode failed: %w: %s", err, strings.TrimSpace(stderr.String()))
+    }
+    return out, nil
+}
+
+func writeFileAtomic(path string, data []byte) error {
+    tmp := path + ".tmp"
+    if err := os.WriteFile(tmp, data, 0644); err != nil {
+        return err
+    }
+    return os.Rename(tmp, path)
+}
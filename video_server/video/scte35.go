@@ -0,0 +1,72 @@
+package video
+
+import (
+    "encoding/hex"
+    "math"
+)
+
+const (
+    SCTE35PID = 0x0102
+    streamTypeSCTE35 = 0x86
+    spliceInsertCommand = 0x05
+)
+
+// Cue marks an ad break boundary at the start of a chunk. Out cues open a
+// break and carry its planned duration; in cues close it and carry the
+// duration actually spent in the break.
+type Cue struct {
+    ID uint32
+    Out bool
+    Duration float64
+}
+
+// SpliceInsert builds a SCTE-35 splice_info_section carrying a splice_insert
+// command for the cue, timed at pts.
+func (c Cue) SpliceInsert(pts uint64) []byte {
+    cmd := []byte{
+        byte(c.ID >> 24), byte(c.ID >> 16), byte(c.ID >> 8), byte(c.ID),
+        0x7F, // splice_event_cancel_indicator = 0
+    }
+    flags := byte(0x4F) // program_splice_flag, not immediate
+    if c.Out {
+        flags |= 0x80 // out_of_network_indicator
+        if c.Duration > 0 {
+            flags |= 0x20 // duration_flag
+        }
+    }
+    cmd = append(cmd, flags)
+    cmd = append(cmd, encode33(0xFE, pts)...) // splice_time with time_specified_flag
+    if flags&0x20 != 0 {
+        cmd = append(cmd, encode33(0xFE, uint64(math.Round(c.Duration*ClockRate)))...) // break_duration with auto_return
+    }
+    cmd = append(cmd,
+        0x00, 0x01, // unique_program_id
+        0x00, 0x00, // avail_num, avails_expected
+    )
+    sectionLen := 11 + len(cmd) + 2 + 4
+    section := []byte{
+        0xFC,
+        0x30 | byte(sectionLen>>8)&0x0F, byte(sectionLen),
+        0x00, // protocol_version
+        0x00, 0x00, 0x00, 0x00, 0x00, // not encrypted, pts_adjustment = 0
+        0x00, // cw_index
+        0xFF, 0xF0 | byte(len(cmd)>>8)&0x0F, byte(len(cmd)), // tier = 0xFFF, splice_command_length
+        spliceInsertCommand,
+    }
+    section = append(section, cmd...)
+    section = append(section, 0x00, 0x00) // descriptor_loop_length
+    crc := crc32MPEG(section)
+    return append(section, byte(crc>>24), byte(crc>>16), byte(crc>>8), byte(crc))
+}
+
+// encode33 packs a 33-bit value behind seven high flag/reserved bits taken
+// from lead.
+func encode33(lead byte, v uint64) []byte {
+    v &= 0x1FFFFFFFF
+    return []byte{lead&0xFE | byte(v>>32), byte(v >> 24), byte(v >> 16), byte(v >> 8), byte(v)}
+}
+
+// HexSCTE35 formats a splice_info_section the way EXT-X-DATERANGE expects.
+func HexSCTE35(section []byte) string {
+    return "0x" + hex.EncodeToString(section)
+}
@@ -0,0 +1,78 @@
+package video
+
+import (
+    "strings"
+    "testing"
+)
+
+func TestSpliceInsert(t *testing.T) {
+    tests := []struct {
+        name string
+        cue Cue
+        pts uint64
+        duration int64 // break_duration in 90kHz ticks, -1 when absent
+    }{
+        {"out with duration", Cue{ID: 1, Out: true, Duration: 120}, 900000, 120 * ClockRate},
+        {"out without duration", Cue{ID: 0xDEADBEEF, Out: true}, 0x1FFFFFFFF, -1},
+        {"in", Cue{ID: 2, Duration: 118.5}, 123456789, -1},
+        {"out with fractional duration", Cue{ID: 3, Out: true, Duration: 30.0333}, 42, 2702997},
+    }
+    for _, tt := range tests {
+        section := tt.cue.SpliceInsert(tt.pts)
+        if section[0] != 0xFC {
+            t.Errorf("%s: table_id %02x", tt.name, section[0])
+        }
+        if n := int(section[1]&0x0F)<<8 | int(section[2]); n != len(section)-3 {
+            t.Errorf("%s: section_length %d, want %d", tt.name, n, len(section)-3)
+        }
+        if crc := crc32MPEG(section); crc != 0 {
+            t.Errorf("%s: CRC_32 does not check out (residue %08x)", tt.name, crc)
+        }
+        if cmdLen := int(section[11]&0x0F)<<8 | int(section[12]); cmdLen != len(section)-14-2-4 {
+            t.Errorf("%s: splice_command_length %d, want %d", tt.name, cmdLen, len(section)-20)
+        }
+        if section[13] != spliceInsertCommand {
+            t.Fatalf("%s: splice_command_type %02x", tt.name, section[13])
+        }
+        cmd := section[14:]
+        if id := uint32(cmd[0])<<24 | uint32(cmd[1])<<16 | uint32(cmd[2])<<8 | uint32(cmd[3]); id != tt.cue.ID {
+            t.Errorf("%s: splice_event_id %d, want %d", tt.name, id, tt.cue.ID)
+        }
+        flags := cmd[5]
+        if out := flags&0x80 != 0; out != tt.cue.Out {
+            t.Errorf("%s: out_of_network_indicator %v, want %v", tt.name, out, tt.cue.Out)
+        }
+        if flags&0x40 == 0 || flags&0x10 != 0 {
+            t.Errorf("%s: flags %02x, want a timed program splice", tt.name, flags)
+        }
+        if cmd[6]&0x80 == 0 {
+            t.Errorf("%s: time_specified_flag not set", tt.name)
+        }
+        if pts := uint64(cmd[6]&0x01)<<32 | uint64(cmd[7])<<24 | uint64(cmd[8])<<16 | uint64(cmd[9])<<8 | uint64(cmd[10]); pts != tt.pts {
+            t.Errorf("%s: pts_time %d, want %d", tt.name, pts, tt.pts)
+        }
+        hasDuration := flags&0x20 != 0
+        if hasDuration != (tt.duration >= 0) {
+            t.Fatalf("%s: duration_flag %v", tt.name, hasDuration)
+        }
+        if hasDuration {
+            if cmd[11]&0x80 == 0 {
+                t.Errorf("%s: auto_return not set", tt.name)
+            }
+            if d := int64(cmd[11]&0x01)<<32 | int64(cmd[12])<<24 | int64(cmd[13])<<16 | int64(cmd[14])<<8 | int64(cmd[15]); d != tt.duration {
+                t.Errorf("%s: break_duration %d, want %d", tt.name, d, tt.duration)
+            }
+        }
+        if hex := HexSCTE35(section); !strings.HasPrefix(hex, "0xfc30") || len(hex) != 2+2*len(section) {
+            t.Errorf("%s: HexSCTE35 = %s", tt.name, hex)
+        }
+    }
+}
+
+func TestSpliceInsertChangesCRC(t *testing.T) {
+    a := Cue{ID: 1, Out: true, Duration: 60}.SpliceInsert(1000)
+    b := Cue{ID: 1, Out: true, Duration: 60}.SpliceInsert(1001)
+    if string(a[len(a)-4:]) == string(b[len(b)-4:]) {
+        t.Errorf("CRC_32 %x is the same for different splice times", a[len(a)-4:])
+    }
+}
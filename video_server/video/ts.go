@@ -0,0 +1,266 @@
+package video
+
+import (
+    "fmt"
+    "io"
+)
+
+const (
+    tsPacketSize = 188
+    PatPID = 0x0000
+    PmtPID = 0x1000
+    VideoPID = 0x0100
+    AudioPID = 0x0101
+    streamTypeH264 = 0x1B
+    streamTypeAAC = 0x0F
+    streamIDVideo = 0xE0
+    streamIDAudio = 0xC0
+    ClockRate = 90000
+    pcrDelay = 9000 // PCR runs 100ms behind PTS
+)
+
+// TSMuxer writes an MPEG-TS stream with one H.264 and one AAC elementary
+// stream, plus a SCTE-35 PID for ad break cues.
+type TSMuxer struct {
+    w io.Writer
+    cc map[uint16]byte
+    pkt [tsPacketSize]byte
+}
+
+func NewTSMuxer(w io.Writer) *TSMuxer {
+    return &TSMuxer{w: w, cc: make(map[uint16]byte)}
+}
+
+func (m *TSMuxer) nextCC(pid uint16) byte {
+    cc := m.cc[pid]
+    m.cc[pid] = (cc + 1) & 0x0F
+    return cc
+}
+
+// WriteTables emits the PAT and PMT. Each HLS segment starts with them so it
+// can be decoded on its own.
+func (m *TSMuxer) WriteTables() error {
+    pat := []byte{
+        0x00, 0x01, // transport_stream_id
+        0xC1, 0x00, 0x00, // version 0, current, section 0/0
+        0x00, 0x01, // program_number
+        0xE0 | byte(PmtPID>>8), byte(PmtPID&0xFF),
+    }
+    if err := m.writeSection(PatPID, 0x00, pat); err != nil {
+        return err
+    }
+    pmt := []byte{
+        0x00, 0x01, // program_number
+        0xC1, 0x00, 0x00,
+        0xE0 | byte(VideoPID>>8), byte(VideoPID&0xFF), // PCR PID
+        0xF0, 0x06, // program_info_length
+        0x05, 0x04, 'C', 'U', 'E', 'I', // registration descriptor for SCTE-35
+        streamTypeH264, 0xE0 | byte(VideoPID>>8), byte(VideoPID&0xFF), 0xF0, 0x00,
+        streamTypeAAC, 0xE0 | byte(AudioPID>>8), byte(AudioPID&0xFF), 0xF0, 0x00,
+        streamTypeSCTE35, 0xE0 | byte(SCTE35PID>>8), byte(SCTE35PID&0xFF), 0xF0, 0x00,
+    }
+    return m.writeSection(PmtPID, 0x02, pmt)
+}
+
+// WriteSCTE35 writes a complete splice_info_section on the SCTE-35 PID.
+func (m *TSMuxer) WriteSCTE35(section []byte) error {
+    return m.writePSI(SCTE35PID, section)
+}
+
+// writeSection wraps body in a long-form PSI section and writes it in a
+// single packet.
+func (m *TSMuxer) writeSection(pid uint16, tableID byte, body []byte) error {
+    sectionLen := len(body) + 4 // + CRC
+    section := make([]byte, 0, 3+sectionLen)
+    section = append(section, tableID, 0xB0|byte(sectionLen>>8), byte(sectionLen))
+    section = append(section, body...)
+    crc := crc32MPEG(section)
+    section = append(section, byte(crc>>24), byte(crc>>16), byte(crc>>8), byte(crc))
+    return m.writePSI(pid, section)
+}
+
+func (m *TSMuxer) writePSI(pid uint16, section []byte) error {
+    if len(section)+1 > tsPacketSize-4 {
+        return fmt.Errorf("PSI section for PID %d too large: %d bytes", pid, len(section))
+    }
+    pkt := m.pkt[:]
+    pkt[0] = 0x47
+    pkt[1] = 0x40 | byte(pid>>8)&0x1F
+    pkt[2] = byte(pid)
+    pkt[3] = 0x10 | m.nextCC(pid)
+    pkt[4] = 0x00 // pointer_field
+    n := copy(pkt[5:], section)
+    for i := 5 + n; i < tsPacketSize; i++ {
+        pkt[i] = 0xFF
+    }
+    _, err := m.w.Write(pkt)
+    return err
+}
+
+// WriteVideo writes one Annex B access unit. An access unit delimiter is
+// prepended, and keyframes carry the random access indicator.
+func (m *TSMuxer) WriteVideo(pts uint64, au []byte, keyframe bool) error {
+    data := make([]byte, 0, len(au)+6)
+    data = append(data, 0x00, 0x00, 0x00, 0x01, 0x09, 0xF0)
+    data = append(data, au...)
+    return m.writePES(VideoPID, streamIDVideo, pts, data, true, keyframe)
+}
+
+// WriteAudio writes one or more ADTS frames as a single PES packet.
+func (m *TSMuxer) WriteAudio(pts uint64, adts []byte) error {
+    return m.writePES(AudioPID, streamIDAudio, pts, adts, false, false)
+}
+
+func (m *TSMuxer) writePES(pid uint16, streamID byte, pts uint64, data []byte, withPCR, randomAccess bool) error {
+    header := []byte{0x00, 0x00, 0x01, streamID, 0x00, 0x00, 0x80, 0x80, 0x05}
+    if pesLen := len(data) + 8; pesLen <= 0xFFFF {
+        header[4] = byte(pesLen >> 8)
+        header[5] = byte(pesLen)
+    }
+    header = append(header, encodePTS(pts)...)
+    payload := append(header, data...)
+    first := true
+    pkt := m.pkt[:]
+    for len(payload) > 0 {
+        pkt[0] = 0x47
+        pkt[1] = byte(pid>>8) & 0x1F
+        if first {
+            pkt[1] |= 0x40
+        }
+        pkt[2] = byte(pid)
+        var af []byte
+        if first && (withPCR || randomAccess) {
+            flags := byte(0x00)
+            if randomAccess {
+                flags |= 0x40
+            }
+            af = []byte{flags}
+            if withPCR {
+                af[0] |= 0x10
+                pcr := uint64(0)
+                if pts > pcrDelay {
+                    pcr = pts - pcrDelay
+                }
+                af = append(af, encodePCR(pcr)...)
+            }
+        }
+        space := tsPacketSize - 4
+        if af != nil {
+            space -= 1 + len(af)
+        }
+        n := len(payload)
+        if n > space {
+            n = space
+        }
+        if stuff := space - n; stuff > 0 {
+            if af == nil {
+                // The adaptation field length byte itself takes one of the stuffing bytes.
+                af = []byte{}
+                if stuff > 1 {
+                    af = append(af, 0x00)
+                    for i := 0; i < stuff-2; i++ {
+                        af = append(af, 0xFF)
+                    }
+                }
+            } else {
+                for i := 0; i < stuff; i++ {
+                    af = append(af, 0xFF)
+                }
+            }
+        }
+        idx := 4
+        if af != nil {
+            pkt[3] = 0x30 | m.nextCC(pid)
+            pkt[4] = byte(len(af))
+            copy(pkt[5:], af)
+            idx = 5 + len(af)
+        } else {
+            pkt[3] = 0x10 | m.nextCC(pid)
+        }
+        copy(pkt[idx:], payload[:n])
+        if _, err := m.w.Write(pkt); err != nil {
+            return err
+        }
+        payload = payload[n:]
+        first = false
+    }
+    return nil
+}
+
+func encodePTS(pts uint64) []byte {
+    pts &= 0x1FFFFFFFF
+    return []byte{
+        0x21 | byte((pts>>29)&0x0E),
+        byte(pts >> 22),
+        byte((pts>>14)&0xFE) | 0x01,
+        byte(pts >> 7),
+        byte((pts<<1)&0xFE) | 0x01,
+    }
+}
+
+func encodePCR(base uint64) []byte {
+    base &= 0x1FFFFFFFF
+    return []byte{
+        byte(base >> 25),
+        byte(base >> 17),
+        byte(base >> 9),
+        byte(base >> 1),
+        byte(base<<7) | 0x7E,
+        0x00,
+    }
+}
+
+func crc32MPEG(data []byte) uint32 {
+    crc := uint32(0xFFFFFFFF)
+    for _, b := range data {
+        crc ^= uint32(b) << 24
+        for i := 0; i < 8; i++ {
+            if crc&0x80000000 != 0 {
+                crc = (crc << 1) ^ 0x04C11DB7
+            } else {
+                crc <<= 1
+            }
+        }
+    }
+    return crc
+}
+
+// ADTSFrame is one AAC frame including its ADTS header.
+type ADTSFrame struct {
+    Data []byte
+    SampleRate int
+}
+
+var adtsSampleRates = []int{96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350}
+
+// SplitADTS splits a raw ADTS stream into frames.
+func SplitADTS(data []byte) ([]ADTSFrame, error) {
+    var frames []ADTSFrame
+    for i := 0; i+7 <= len(data); {
+        if data[i] != 0xFF || data[i+1]&0xF0 != 0xF0 {
+            return frames, fmt.Errorf("lost ADTS sync at byte %d", i)
+        }
+        frameLen := int(data[i+3]&0x03)<<11 | int(data[i+4])<<3 | int(data[i+5])>>5
+        if frameLen < 7 || i+frameLen > len(data) {
+            return frames, fmt.Errorf("truncated ADTS frame at byte %d", i)
+        }
+        rateIdx := int(data[i+2]>>2) & 0x0F
+        rate := 48000
+        if rateIdx < len(adtsSampleRates) {
+            rate = adtsSampleRates[rateIdx]
+        }
+        frames = append(frames, ADTSFrame{Data: data[i : i+frameLen], SampleRate: rate})
+        i += frameLen
+    }
+    return frames, nil
+}
+
+// IsKeyframe reports whether an Annex B access unit contains an IDR slice.
+func IsKeyframe(au []byte) bool {
+    for i := 0; i+3 < len(au); i++ {
+        if au[i] == 0 && au[i+1] == 0 && au[i+2] == 1 && au[i+3]&0x1F == 5 {
+            return true
+        }
+    }
+    return false
+}
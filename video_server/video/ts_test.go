@@ -0,0 +1,194 @@
+package video
+
+import (
+    "bytes"
+    "testing"
+)
+
+// decodePTS reads a PES PTS field back, checking its marker bits.
+func decodePTS(t *testing.T, b []byte) uint64 {
+    t.Helper()
+    if b[0]&0xF1 != 0x21 || b[2]&0x01 != 1 || b[4]&0x01 != 1 {
+        t.Errorf("PTS % x has bad prefix or marker bits", b)
+    }
+    return uint64(b[0]>>1&0x07)<<30 | uint64(b[1])<<22 | uint64(b[2]>>1)<<15 | uint64(b[3])<<7 | uint64(b[4]>>1)
+}
+
+// decodePCR reads the 33-bit base of an adaptation field PCR.
+func decodePCR(b []byte) uint64 {
+    return uint64(b[0])<<25 | uint64(b[1])<<17 | uint64(b[2])<<9 | uint64(b[3])<<1 | uint64(b[4]>>7)
+}
+
+func TestEncodePTS(t *testing.T) {
+    tests := []struct {
+        pts uint64
+        want []byte
+    }{
+        {0, []byte{0x21, 0x00, 0x01, 0x00, 0x01}},
+        {90000, []byte{0x21, 0x00, 0x05, 0xBF, 0x21}},
+        {0x1FFFFFFFF, []byte{0x2F, 0xFF, 0xFF, 0xFF, 0xFF}},
+        {0x200000000, []byte{0x21, 0x00, 0x01, 0x00, 0x01}}, // wraps at 33 bits
+        {0x123456789, nil},
+    }
+    for _, tt := range tests {
+        got := encodePTS(tt.pts)
+        if tt.want != nil && !bytes.Equal(got, tt.want) {
+            t.Errorf("encodePTS(%d) = % x, want % x", tt.pts, got, tt.want)
+        }
+        if back := decodePTS(t, got); back != tt.pts&0x1FFFFFFFF {
+            t.Errorf("encodePTS(%d) decodes to %d", tt.pts, back)
+        }
+    }
+}
+
+func TestEncodePCR(t *testing.T) {
+    tests := []struct {
+        base uint64
+        want []byte
+    }{
+        {0, []byte{0x00, 0x00, 0x00, 0x00, 0x7E, 0x00}},
+        {1, []byte{0x00, 0x00, 0x00, 0x00, 0xFE, 0x00}},
+        {0x1FFFFFFFF, []byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFE, 0x00}},
+        {81000, nil},
+    }
+    for _, tt := range tests {
+        got := encodePCR(tt.base)
+        if tt.want != nil && !bytes.Equal(got, tt.want) {
+            t.Errorf("encodePCR(%d) = % x, want % x", tt.base, got, tt.want)
+        }
+        if back := decodePCR(got); back != tt.base {
+            t.Errorf("encodePCR(%d) decodes to %d", tt.base, back)
+        }
+    }
+}
+
+func TestCRC32MPEG(t *testing.T) {
+    if got := crc32MPEG([]byte("123456789")); got != 0x0376E6E7 {
+        t.Errorf("crc32MPEG check value = %08x, want 0376e6e7", got)
+    }
+    if got := crc32MPEG(nil); got != 0xFFFFFFFF {
+        t.Errorf("crc32MPEG(nil) = %08x, want ffffffff", got)
+    }
+}
+
+// tsPacket is the parsed header of one 188-byte packet.
+type tsPacket struct {
+    pusi bool
+    pid uint16
+    cc byte
+    randomAccess bool
+    pcr int64 // -1 without a PCR
+    payload []byte
+}
+
+func parseTS(t *testing.T, data []byte) []tsPacket {
+    t.Helper()
+    if len(data)%tsPacketSize != 0 {
+        t.Fatalf("%d bytes is not a whole number of TS packets", len(data))
+    }
+    var out []tsPacket
+    for off := 0; off < len(data); off += tsPacketSize {
+        pkt := data[off : off+tsPacketSize]
+        if pkt[0] != 0x47 {
+            t.Fatalf("packet at %d has sync byte %02x", off, pkt[0])
+        }
+        p := tsPacket{pusi: pkt[1]&0x40 != 0, pid: uint16(pkt[1]&0x1F)<<8 | uint16(pkt[2]), cc: pkt[3] & 0x0F, pcr: -1}
+        idx := 4
+        if pkt[3]&0x20 != 0 {
+            afLen := int(pkt[4])
+            if afLen > 0 {
+                p.randomAccess = pkt[5]&0x40 != 0
+                if pkt[5]&0x10 != 0 {
+                    p.pcr = int64(decodePCR(pkt[6:12]))
+                }
+            }
+            idx = 5 + afLen
+        }
+        p.payload = pkt[idx:]
+        out = append(out, p)
+    }
+    return out
+}
+
+func TestWritePES(t *testing.T) {
+    au := bytes.Repeat([]byte{0x00, 0x00, 0x01, 0x65, 0x88}, 100)
+    tests := []struct {
+        name string
+        write func(m *TSMuxer) error
+        pid uint16
+        streamID byte
+        pts uint64
+        data []byte
+        pcr int64
+        randomAccess bool
+    }{
+        {"keyframe", func(m *TSMuxer) error { return m.WriteVideo(90000, au, true) }, VideoPID, streamIDVideo, 90000, append([]byte{0x00, 0x00, 0x00, 0x01, 0x09, 0xF0}, au...), 81000, true},
+        {"delta frame near zero", func(m *TSMuxer) error { return m.WriteVideo(3000, au[:20], false) }, VideoPID, streamIDVideo, 3000, append([]byte{0x00, 0x00, 0x00, 0x01, 0x09, 0xF0}, au[:20]...), 0, false},
+        {"audio", func(m *TSMuxer) error { return m.WriteAudio(123456, au[:183]) }, AudioPID, streamIDAudio, 123456, au[:183], -1, false},
+    }
+    for _, tt := range tests {
+        var buf bytes.Buffer
+        m := NewTSMuxer(&buf)
+        if err := tt.write(m); err != nil {
+            t.Fatalf("%s: %v", tt.name, err)
+        }
+        packets := parseTS(t, buf.Bytes())
+        var pes []byte
+        for i, p := range packets {
+            if p.pid != tt.pid {
+                t.Errorf("%s: packet %d on PID %#x, want %#x", tt.name, i, p.pid, tt.pid)
+            }
+            if p.pusi != (i == 0) {
+                t.Errorf("%s: packet %d payload_unit_start_indicator = %v", tt.name, i, p.pusi)
+            }
+            if p.cc != byte(i)&0x0F {
+                t.Errorf("%s: packet %d continuity counter = %d", tt.name, i, p.cc)
+            }
+            if i > 0 && (p.pcr >= 0 || p.randomAccess) {
+                t.Errorf("%s: packet %d repeats the PCR or random access flag", tt.name, i)
+            }
+            pes = append(pes, p.payload...)
+        }
+        if packets[0].pcr != tt.pcr {
+            t.Errorf("%s: PCR = %d, want %d", tt.name, packets[0].pcr, tt.pcr)
+        }
+        if packets[0].randomAccess != tt.randomAccess {
+            t.Errorf("%s: random_access_indicator = %v, want %v", tt.name, packets[0].randomAccess, tt.randomAccess)
+        }
+        if !bytes.Equal(pes[:4], []byte{0x00, 0x00, 0x01, tt.streamID}) {
+            t.Fatalf("%s: PES starts % x", tt.name, pes[:4])
+        }
+        if pesLen := int(pes[4])<<8 | int(pes[5]); pesLen != len(pes)-6 {
+            t.Errorf("%s: PES_packet_length = %d, want %d", tt.name, pesLen, len(pes)-6)
+        }
+        if pes[7] != 0x80 || pes[8] != 5 {
+            t.Errorf("%s: PES flags % x, want PTS only", tt.name, pes[7:9])
+        }
+        if got := decodePTS(t, pes[9:14]); got != tt.pts {
+            t.Errorf("%s: PTS = %d, want %d", tt.name, got, tt.pts)
+        }
+        if !bytes.Equal(pes[14:], tt.data) {
+            t.Errorf("%s: PES payload differs from what was written", tt.name)
+        }
+    }
+}
+
+func TestWriteTables(t *testing.T) {
+    var buf bytes.Buffer
+    m := NewTSMuxer(&buf)
+    if err := m.WriteTables(); err != nil {
+        t.Fatal(err)
+    }
+    packets := parseTS(t, buf.Bytes())
+    for i, want := range []uint16{PatPID, PmtPID} {
+        p := packets[i]
+        if p.pid != want || !p.pusi {
+            t.Errorf("table %d on PID %#x (pusi %v), want %#x", i, p.pid, p.pusi, want)
+        }
+        section := p.payload[1:] // skip pointer_field
+        n := 3 + (int(section[1]&0x0F)<<8 | int(section[2]))
+        if crc := crc32MPEG(section[:n]); crc != 0 {
+            t.Errorf("table on PID %#x fails its CRC (residue %08x)", p.pid, crc)
+        }
+    }
+}
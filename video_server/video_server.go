@@ -4,6 +4,7 @@ import (
     "bytes"
     "database/sql"
     "encoding/json"
+    "flag"
     "fmt"
     "io"
     "log"
@@ -11,53 +12,55 @@ import (
     "math/rand"
     "os"
     "os/exec"
+    "os/signal"
     "path/filepath"
     "runtime"
     "sort"
     "strconv"
     "strings"
     "sync"
+    "syscall"
     "time"
     _ "github.com/lib/pq"
     "github.com/gin-contrib/cors"
     "github.com/gin-gonic/gin"
+    "github.com/pion/interceptor"
     "github.com/pion/webrtc/v3"
     "github.com/pion/webrtc/v3/pkg/media"
     "github.com/pion/webrtc/v3/pkg/media/oggreader"
+    "config"
+    "config/schedule"
+    "config/schema"
+    "video_server/video"
 )
 
 var errorLogger *log.Logger
 
 const (
-    HlsDir = "./webrtc_segments"
-    Port = ":8081"
     ClockRate = 90000
     AudioFrameMs = 20
     DefaultFPSNum = 30000
     DefaultFPSDen = 1001
     DefaultDur = 0.0
     DefaultStation = "default"
-    AdInsertPath = "./ad_insert.exe"
-    DefaultVideoBaseDir = "Z:/Videos"
     DefaultTempPrefix = "ad_insert_"
     ChunkDuration = 30.0 // Process 30-second chunks
     BufferThreshold = 120.0 // Start processing more chunks when buffer < 120s
     maxAdRetries = 5 // Higher retry limit for ads
 )
 
-const dbConnString = "user=postgres password=aaaaaaaaaa dbname=webrtc_tv sslmode=disable host=localhost port=5432"
-
 type fpsPair struct {
     num int
     den int
 }
 
 type BreakPoint struct {
-	Time     float64
-	IsFade   bool
-	Color    string
-	FadeOut  FadePhase
-	FadeIn   FadePhase
+	Time           float64
+	IsFade         bool
+	Color          string
+	FadeOut        FadePhase
+	FadeIn         FadePhase
+	TargetDuration float64 // ad pod length for this break; 0 uses the station's
 }
 
 type FadePhase struct {
@@ -77,6 +80,10 @@ type bufferedChunk struct {
     videoID int64
     fps fpsPair
     effective_advance float64
+    cueOut *adBreak
+    track *adTracking // VAST tracking fired as the chunk is transmitted
+    filler bool // slate or promo in the ad-free variant's break; isAd is also set
+    srcIn float64 // where the chunk starts in its video, for the as-run log
 }
 
 type bitReader struct {
@@ -92,13 +99,26 @@ type LoudnormOutput struct {
 }
 
 type Station struct {
+    id int64
     name string
     segmentList []bufferedChunk
     spsPPS [][]byte
     fmtpLine string
-    trackVideo *webrtc.TrackLocalStaticSample
-    trackAudio *webrtc.TrackLocalStaticSample
+    sps *SPSInfo
+    negotiatedFmtp string
+    hls *video.Packager
+    hlsLastAccess time.Time
+    hlsDiscontinuity bool
+    nextBreakID uint32
+    openBreak *adBreak
+    openBreakStart time.Time
+    airing *airingChunk
+    eventChannels map[*webrtc.DataChannel]struct{}
+    trackVideo *stationTrack
+    trackAudio *stationTrack
     videoQueue []int64
+    schedule *schedule.Engine
+    recentScheduled []int64
     currentVideo int64
     currentIndex int
     currentOffset float64
@@ -107,11 +127,19 @@ type Station struct {
     stopCh chan struct{}
     adsEnabled bool
     mu sync.Mutex
-    currentVideoRTPTS uint32
+    currentVideoRTPTS uint32 // RTP clocks of the station's tracks, monotonic for its lifetime
     currentAudioSamples uint32
+    adSeconds float64
+    adTarget float64 // stations.ad_break_target_seconds, 0 when unset
+    adTolerance float64 // stations.ad_break_tolerance_seconds, -1 when unset
+    output outputProfile
+    podWaitSince time.Time // ad-free variant waiting for the main station's pod
+    live *Station // set on a viewer's start-over, catch-up or DVR cursor
+    cursorID string
+    dvr *dvrPlayer // set on a DVR cursor, which plays retained chunks instead of processing
+    vod bool // a viewer's on-demand video, played once; see newVODStation
 }
 
-var adIDs []int64
 var videoBaseDir string
 var stations = make(map[string]*Station)
 var noAdsStations = make(map[string]*Station)
@@ -160,18 +188,7 @@ func getFirstMbInSlice(nalu []byte) (uint, error) {
     if len(nalu) < 2 {
         return 0, fmt.Errorf("NALU too short")
     }
-    ebsp := nalu[1:]
-    rbsp := make([]byte, 0, len(ebsp))
-    for i := 0; i < len(ebsp); {
-        if i+2 < len(ebsp) && ebsp[i] == 0 && ebsp[i+1] == 0 && ebsp[i+2] == 3 {
-            rbsp = append(rbsp, 0, 0)
-            i += 3
-        } else {
-            rbsp = append(rbsp, ebsp[i])
-            i++
-        }
-    }
-    br := newBitReader(rbsp)
+    br := newBitReader(unescapeRBSP(nalu[1:]))
     return br.readUe()
 }
 
@@ -240,16 +257,15 @@ func processVideo(st *Station, videoID int64, db *sql.DB, startTime, chunkDur fl
         errorLogger.Printf("Station %s: Failed to create temp_encoded_segments directory for video %d: %v", st.name, videoID, err)
         return nil, nil, "", 0, fpsPair{}, fmt.Errorf("failed to create temp_encoded_segments directory for video %d: %v", videoID, err)
     }
-    if err := os.MkdirAll(HlsDir, 0755); err != nil {
+    if err := os.MkdirAll(cfg.Paths.SegmentDir, 0755); err != nil {
         errorLogger.Printf("Station %s: Failed to create webrtc_segments directory: %v", st.name, err)
         return nil, nil, "", 0, fpsPair{}, fmt.Errorf("failed to create webrtc_segments directory: %v", err)
     }
-    safeStationName := strings.ReplaceAll(st.name, " ", "_")
-    baseName := fmt.Sprintf("%s_vid%d_chunk_%.3f", safeStationName, videoID, startTime)
+    baseName := fmt.Sprintf("%s_vid%d_chunk_%.3f", segmentBaseName(st), videoID, startTime)
     segName := baseName + ".h264"
-    fullSegPath := filepath.Join(HlsDir, segName)
+    fullSegPath := filepath.Join(cfg.Paths.SegmentDir, segName)
     opusName := baseName + ".opus"
-    opusPath := filepath.Join(HlsDir, opusName)
+    opusPath := filepath.Join(cfg.Paths.SegmentDir, opusName)
     tempDurMP4 := filepath.Join(tempDir, baseName+"_dur.mp4")
     tempMuxedPath := filepath.Join(tempDir, baseName+"_muxed.mp4")
     var audioData []byte
@@ -325,6 +341,9 @@ func processVideo(st *Station, videoID int64, db *sql.DB, startTime, chunkDur fl
     } else {
         errorLogger.Printf("Station %s: ffprobe failed for original %s: %v", st.name, fullEpisodePath, err)
     }
+    if st.output.width > 0 {
+        fpsNum, fpsDen = st.output.fps.num, st.output.fps.den
+    }
     fps := float64(fpsNum) / float64(fpsDen)
     gopSize := int(math.Round(fps * 2))
     if isFinalChunk {
@@ -356,8 +375,8 @@ func processVideo(st *Station, videoID int64, db *sql.DB, startTime, chunkDur fl
         "-preset", "ultrafast",
         "-crf", "23",
         "-bf", "0",
-        "-maxrate", "5M",
-        "-bufsize", "10M",
+        "-maxrate", fmt.Sprintf("%dk", mainMaxrateKbps),
+        "-bufsize", fmt.Sprintf("%dk", 2*mainMaxrateKbps),
         "-profile:v", "baseline",
         "-level", "5.2",
         "-pix_fmt", "yuv420p",
@@ -438,13 +457,22 @@ func processVideo(st *Station, videoID int64, db *sql.DB, startTime, chunkDur fl
         }
         log.Printf("Station %s: Inserted combined audio filter: %s", st.name, combinedFilter)
     }
-    // Video fade if needed
+    // Scale to the station's output profile, then fade if needed
+    videoFilter := st.output.filter()
     if fadeType != "" && videoD > 0 {
         vfadeType := "out"
         if fadeType == "in" {
             vfadeType = "in"
         }
         vfadeFilter := fmt.Sprintf("fade=t=%s:st=%.4f:d=%.4f:color=%s", vfadeType, videoSt, videoD, color)
+        if videoFilter != "" {
+            videoFilter += "," + vfadeFilter
+        } else {
+            videoFilter = vfadeFilter
+        }
+        log.Printf("Station %s: Applied video fade %s: %s", st.name, fadeType, vfadeFilter)
+    }
+    if videoFilter != "" {
         insertIndex := -1
         for i, arg := range argsMuxed {
             if arg == "-c:v" {
@@ -453,11 +481,10 @@ func processVideo(st *Station, videoID int64, db *sql.DB, startTime, chunkDur fl
             }
         }
         if insertIndex != -1 {
-            argsMuxed = append(argsMuxed[:insertIndex], append([]string{"-vf", vfadeFilter}, argsMuxed[insertIndex:]...)...)
+            argsMuxed = append(argsMuxed[:insertIndex], append([]string{"-vf", videoFilter}, argsMuxed[insertIndex:]...)...)
         } else {
-            argsMuxed = append(argsMuxed, "-vf", vfadeFilter)
+            argsMuxed = append(argsMuxed, "-vf", videoFilter)
         }
-        log.Printf("Station %s: Applied video fade %s: %s", st.name, fadeType, vfadeFilter)
     }
     // Run muxed encode
     cmdMuxed := exec.Command("ffmpeg", argsMuxed...)
@@ -904,8 +931,17 @@ func processVideo(st *Station, videoID int64, db *sql.DB, startTime, chunkDur fl
     } else {
         errorLogger.Printf("Station %s: Warning: Chunk %s has %d NALUs, audio size %d bytes - proceeding but may cause issues", st.name, fullSegPath, len(nalus), len(audioData))
     }
-    fmtpLine = "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42c034"
+    fmtpLine = DefaultH264Fmtp
+    if len(spsPPS) > 0 {
+        if sps, err := parseSPS(spsPPS[0]); err != nil {
+            errorLogger.Printf("Station %s: Failed to parse SPS for %s, using default fmtp: %v", st.name, fullSegPath, err)
+        } else {
+            fmtpLine = sps.FmtpLine()
+            log.Printf("Station %s: SPS for %s: %s", st.name, fullSegPath, sps)
+        }
+    }
     log.Printf("Station %s: Processed segment %s with %d NALUs, %d SPS/PPS, fmtp: %s, hasIDR: %v", st.name, fullSegPath, len(nalus), len(spsPPS), fmtpLine, hasIDR)
+    encodeRenditions(st, fullSegPath, fpsPair{num: fpsNum, den: fpsDen}, gopSize)
     return segments, spsPPS, fmtpLine, actualDur, fpsPair{num: fpsNum, den: fpsDen}, nil
 }
 
@@ -935,6 +971,7 @@ func getBreakPoints(videoID int64, db *sql.DB) ([]BreakPoint, error) {
 					continue // invalid
 				}
 				color, _ := v["color"].(string) // default ""
+				targetDuration, _ := v["target_duration"].(float64)
 				fadeOutMap, _ := v["fade_out"].(map[string]interface{})
 				fadeOutVideoMap, _ := fadeOutMap["video"].(map[string]interface{})
 				fadeOutAudioMap, _ := fadeOutMap["audio"].(map[string]interface{})
@@ -952,9 +989,10 @@ func getBreakPoints(videoID int64, db *sql.DB) ([]BreakPoint, error) {
 				fadeInAudioEnd, _ := fadeInAudioMap["end"].(float64)
 
 				bp := BreakPoint{
-					Time:   timeVal,
-					IsFade: true,
-					Color:  color,
+					Time:           timeVal,
+					IsFade:         true,
+					Color:          color,
+					TargetDuration: targetDuration,
 					FadeOut: FadePhase{
 						Video: FadeRange{Start: fadeOutVideoStart, End: fadeOutVideoEnd},
 						Audio: FadeRange{Start: fadeOutAudioStart, End: fadeOutAudioEnd},
@@ -1000,11 +1038,18 @@ func loadStation(stationName string, db *sql.DB, adsEnabled bool, originalSt *St
     var currentVideoID int64
     var currentVideoIndex int
     var currentOffset float64
-    err := db.QueryRow("SELECT unix_start FROM stations WHERE name = $1", stationName).Scan(&unixStart)
+    var adTarget, adTolerance sql.NullFloat64
+    err := db.QueryRow("SELECT id, unix_start, ad_break_target_seconds, ad_break_tolerance_seconds FROM stations WHERE name = $1", stationName).Scan(&st.id, &unixStart, &adTarget, &adTolerance)
     if err != nil {
         log.Printf("Failed to get unix_start for station %s: %v", stationName, err)
         return nil
     }
+    st.adTarget = adTarget.Float64
+    st.adTolerance = -1
+    if adTolerance.Valid {
+        st.adTolerance = adTolerance.Float64
+    }
+    st.output = stationOutput(db, st.id)
     rows, err := db.Query(
         "SELECT sv.video_id FROM station_videos sv JOIN stations s ON sv.station_id = s.id WHERE s.name = $1 ORDER BY sv.id ASC",
         stationName)
@@ -1037,50 +1082,82 @@ func loadStation(stationName string, db *sql.DB, adsEnabled bool, originalSt *St
             log.Printf("No videos found for station %s", stationName)
             return nil
         }
-        currentTime := time.Now().Unix()
-        elapsedSeconds := float64(currentTime - unixStart)
-        totalQueueDuration, err := getQueueDuration(videoIds, db)
-        if err != nil || totalQueueDuration <= 0 {
-            log.Printf("Failed to get total queue duration for station %s: %v", stationName, err)
-            currentVideoIndex = 0
-            currentVideoID = videoIds[0]
-            currentOffset = 0.0
-        } else {
-            loops := int(elapsedSeconds / totalQueueDuration)
-            remainingSeconds := math.Mod(elapsedSeconds, totalQueueDuration)
-            currentOffset = remainingSeconds
-            log.Printf("Station %s: Elapsed %f seconds, %d loops, remaining %f seconds", stationName, elapsedSeconds, loops, remainingSeconds)
-            for i, vid := range videoIds {
-                var hasCommercialTag bool
-                err = db.QueryRow("SELECT EXISTS (SELECT 1 FROM video_tags vt WHERE vt.video_id = $1 AND vt.tag_id = 4)", vid).Scan(&hasCommercialTag)
-                if err != nil {
-                    log.Printf("Failed to check commercial tag for video %d: %v", vid, err)
-                    continue
-                }
-                if hasCommercialTag {
-                    continue
-                }
-                var duration sql.NullFloat64
-                err = db.QueryRow("SELECT duration FROM videos WHERE id = $1", vid).Scan(&duration)
-                if err != nil {
-                    log.Printf("Failed to get duration for video %d: %v", vid, err)
-                    continue
-                }
-                if duration.Valid && currentOffset >= duration.Float64 {
-                    currentOffset -= duration.Float64
-                    continue
-                }
-                if duration.Valid {
-                    currentVideoIndex = i
-                    currentVideoID = vid
-                    break
-                }
+        resumed := false
+        saved, err := loadStationState(db, stationName)
+        if err != nil {
+            log.Printf("Station %s: Failed to load saved state, using unix_start: %v", stationName, err)
+        } else if saved != nil {
+            // An index of -1 is a scheduled video that is not in station_videos.
+            if idx := resumeIndex(videoIds, saved); idx >= 0 || saved.currentIndex < 0 {
+                currentVideoIndex = idx
+                currentVideoID = saved.currentVideo
+                currentOffset = saved.currentOffset
+                st.adSeconds = saved.adSeconds
+                st.currentVideoRTPTS = saved.videoRTPTS
+                st.currentAudioSamples = saved.audioRTPTS
+                resumed = true
+                log.Printf("Station %s: Resuming saved state from %s: video %d (index %d) at %.3fs, %.1fs of ads aired", stationName, saved.savedAt.Format(time.RFC3339), currentVideoID, currentVideoIndex, currentOffset, saved.adSeconds)
+            } else {
+                log.Printf("Station %s: Saved video %d is no longer on the station, using unix_start", stationName, saved.currentVideo)
             }
-            if currentVideoID == 0 {
-                log.Printf("Station %s: No valid video found, defaulting to first video", stationName)
+        }
+        if !resumed {
+            st.videoQueue = videoIds
+            st.currentIndex = -1
+            if pick := scheduledPick(st, db, time.Now()); pick != nil {
+                currentVideoID = pick.VideoID
+                currentVideoIndex = queueIndex(videoIds, pick.VideoID)
+                currentOffset = 0.0
+                resumed = true
+                log.Printf("Station %s: Starting scheduled video %d (block %d)", stationName, currentVideoID, pick.BlockID)
+            }
+        }
+        if !resumed {
+            currentTime := time.Now().Unix()
+            elapsedSeconds := float64(currentTime - unixStart)
+            totalQueueDuration, err := getQueueDuration(videoIds, db)
+            if err != nil || totalQueueDuration <= 0 {
+                log.Printf("Failed to get total queue duration for station %s: %v", stationName, err)
                 currentVideoIndex = 0
                 currentVideoID = videoIds[0]
                 currentOffset = 0.0
+            } else {
+                loops := int(elapsedSeconds / totalQueueDuration)
+                remainingSeconds := math.Mod(elapsedSeconds, totalQueueDuration)
+                currentOffset = remainingSeconds
+                log.Printf("Station %s: Elapsed %f seconds, %d loops, remaining %f seconds", stationName, elapsedSeconds, loops, remainingSeconds)
+                for i, vid := range videoIds {
+                    var hasCommercialTag bool
+                    err = db.QueryRow("SELECT EXISTS (SELECT 1 FROM video_tags vt WHERE vt.video_id = $1 AND vt.tag_id = 4)", vid).Scan(&hasCommercialTag)
+                    if err != nil {
+                        log.Printf("Failed to check commercial tag for video %d: %v", vid, err)
+                        continue
+                    }
+                    if hasCommercialTag {
+                        continue
+                    }
+                    var duration sql.NullFloat64
+                    err = db.QueryRow("SELECT duration FROM videos WHERE id = $1", vid).Scan(&duration)
+                    if err != nil {
+                        log.Printf("Failed to get duration for video %d: %v", vid, err)
+                        continue
+                    }
+                    if duration.Valid && currentOffset >= duration.Float64 {
+                        currentOffset -= duration.Float64
+                        continue
+                    }
+                    if duration.Valid {
+                        currentVideoIndex = i
+                        currentVideoID = vid
+                        break
+                    }
+                }
+                if currentVideoID == 0 {
+                    log.Printf("Station %s: No valid video found, defaulting to first video", stationName)
+                    currentVideoIndex = 0
+                    currentVideoID = videoIds[0]
+                    currentOffset = 0.0
+                }
             }
         }
     }
@@ -1088,7 +1165,7 @@ func loadStation(stationName string, db *sql.DB, adsEnabled bool, originalSt *St
     st.currentVideo = currentVideoID
     st.currentIndex = currentVideoIndex
     st.currentOffset = currentOffset
-    st.trackVideo, err = webrtc.NewTrackLocalStaticSample(
+    st.trackVideo, err = newStationTrack(
         webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264},
         fmt.Sprintf("video_%s_%t", sanitizeTrackID(stationName), adsEnabled),
         "pion",
@@ -1097,7 +1174,7 @@ func loadStation(stationName string, db *sql.DB, adsEnabled bool, originalSt *St
         log.Printf("Station %s: Failed to create video track: %v", stationName, err)
         return nil
     }
-    st.trackAudio, err = webrtc.NewTrackLocalStaticSample(
+    st.trackAudio, err = newStationTrack(
         webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2},
         fmt.Sprintf("audio_%s_%t", sanitizeTrackID(stationName), adsEnabled),
         "pion",
@@ -1106,7 +1183,7 @@ func loadStation(stationName string, db *sql.DB, adsEnabled bool, originalSt *St
         log.Printf("Station %s: Failed to create audio track: %v", stationName, err)
         return nil
     }
-    log.Printf("Station %s: Initialized at video %d (index %d) with offset %f seconds, adsEnabled: %v", stationName, currentVideoID, currentVideoIndex, currentOffset, adsEnabled)
+    log.Printf("Station %s: Initialized at video %d (index %d) with offset %f seconds, adsEnabled: %v, output: %s", stationName, currentVideoID, currentVideoIndex, currentOffset, adsEnabled, st.output)
     return st
 }
 
@@ -1146,19 +1223,23 @@ func manageProcessing(st *Station, db *sql.DB) {
     const minChunkDur = 0.05
     const minFinalChunkDur = 0.05
     const maxChunkDur = 60.0 // New constant to cap chunk size
+    var decided *podDecision
     for {
         select {
         case <-st.stopCh:
             log.Printf("Station %s (adsEnabled: %v): Stopping processing due to no viewers", st.name, st.adsEnabled)
+            if err := saveStationState(db, st); err != nil {
+                errorLogger.Printf("Station %s (adsEnabled: %v): Failed to save state: %v", st.name, st.adsEnabled, err)
+            }
             st.mu.Lock()
             st.processing = false
             for _, chunk := range st.segmentList {
-                os.Remove(chunk.segPath)
-                os.Remove(strings.Replace(chunk.segPath, ".h264", ".opus", 1))
+                removeChunkFiles(chunk.segPath)
             }
             st.segmentList = nil
             st.spsPPS = nil
             st.fmtpLine = ""
+            st.openBreak = nil
             st.mu.Unlock()
             return
         default:
@@ -1173,17 +1254,9 @@ func manageProcessing(st *Station, db *sql.DB) {
             for i := 0; i < len(st.segmentList); i++ {
                 chunk := st.segmentList[i]
                 if !chunk.isAd && chunk.videoID != st.currentVideo {
-                    found := false
-                    for _, vid := range st.videoQueue {
-                        if vid == chunk.videoID {
-                            found = true
-                            break
-                        }
-                    }
-                    if !found {
+                    if !isQueued(st, chunk.videoID) {
                         log.Printf("Station %s (adsEnabled: %v): Removing stale chunk %s from video %d", st.name, st.adsEnabled, chunk.segPath, chunk.videoID)
-                        os.Remove(chunk.segPath)
-                        os.Remove(strings.Replace(chunk.segPath, ".h264", ".opus", 1))
+                        removeChunkFiles(chunk.segPath)
                         st.segmentList = append(st.segmentList[:i], st.segmentList[i+1:]...)
                         i--
                     }
@@ -1206,27 +1279,21 @@ func manageProcessing(st *Station, db *sql.DB) {
             videoDur := getVideoDur(st.currentVideo, db)
             if videoDur <= 0 {
                 errorLogger.Printf("Station %s: Invalid duration for video %d, advancing", st.name, st.currentVideo)
-                st.currentIndex = (st.currentIndex + 1) % len(st.videoQueue)
-                st.currentVideo = st.videoQueue[st.currentIndex]
-                st.currentOffset = 0.0
-                st.spsPPS = nil
-                st.fmtpLine = ""
-                st.currentVideoRTPTS = 0
-                st.currentAudioSamples = 0
+                advanceVideo(st, db)
                 log.Printf("Station %s (adsEnabled: %v): Transitioned to video %d with offset 0.0s due to invalid duration", st.name, st.adsEnabled, st.currentVideo)
                 st.mu.Unlock()
                 continue
             }
             nextStart := st.currentOffset + sumNonAd
+            if nextStart >= videoDur && st.vod {
+                // Everything is queued; hold until the viewer seeks or leaves.
+                st.mu.Unlock()
+                time.Sleep(time.Second)
+                continue
+            }
             if nextStart >= videoDur {
                 log.Printf("Station %s (adsEnabled: %v): Reached end of video %d (%.3fs >= %.3fs), advancing", st.name, st.adsEnabled, st.currentVideo, nextStart, videoDur)
-                st.currentIndex = (st.currentIndex + 1) % len(st.videoQueue)
-                st.currentVideo = st.videoQueue[st.currentIndex]
-                st.currentOffset = 0.0
-                st.spsPPS = nil
-                st.fmtpLine = ""
-                st.currentVideoRTPTS = 0
-                st.currentAudioSamples = 0
+                advanceVideo(st, db)
                 log.Printf("Station %s (adsEnabled: %v): Transitioned to video %d with offset 0.0s", st.name, st.adsEnabled, st.currentVideo)
                 st.mu.Unlock()
                 continue
@@ -1236,6 +1303,9 @@ func manageProcessing(st *Station, db *sql.DB) {
                 errorLogger.Printf("Station %s (adsEnabled: %v): Failed to get break points for video %d: %v", st.name, st.adsEnabled, st.currentVideo, getBreakPointsErr)
                 breaks = []BreakPoint{}
             }
+            if st.vod && !st.adsEnabled {
+                breaks = nil
+            }
             log.Printf("Station %s (adsEnabled: %v): Break points for video %d: %v", st.name, st.adsEnabled, st.currentVideo, breaks)
             var nextBreak *BreakPoint
             for i := range breaks {
@@ -1253,6 +1323,28 @@ func manageProcessing(st *Station, db *sql.DB) {
             }
             distance := fadeOutStart - nextStart
             var adDurTotal float64
+            var fillDur float64
+            syncFiller := !st.adsEnabled && cfg.Ads.NoAdsSync
+            if distance <= 0 && nextBreak != nil && syncFiller {
+                var ok bool
+                if fillDur, ok = syncedPodDuration(st, st.currentVideo, nextBreak); !ok {
+                    st.mu.Unlock()
+                    time.Sleep(time.Millisecond * 500)
+                    continue
+                }
+            }
+            if distance <= 0 && nextBreak != nil && !syncFiller && !decided.decides(st.currentVideo, nextBreak) {
+                // Choose the pod with the lock released so the ad server and
+                // database never hold up viewers, then cut the break next time
+                // round.
+                videoID, bp := st.currentVideo, *nextBreak
+                target, tolerance := breakTarget(st, nextBreak)
+                lead := math.Max(0, nextBreak.Time+math.Max(nextBreak.FadeOut.Video.End, nextBreak.FadeOut.Audio.End)-nextStart)
+                airAt := time.Now().Add(time.Duration((remainingDur + lead) * float64(time.Second)))
+                st.mu.Unlock()
+                decided = &podDecision{videoID: videoID, breakTime: bp.Time, pod: decidePod(st, db, videoID, &bp, target, tolerance, airAt)}
+                continue
+            }
             if distance <= 0 && nextBreak != nil {
                 // Insert break
                 log.Printf("Station %s (adsEnabled: %v): Inserting ad break at %.3fs for video %d", st.name, st.adsEnabled, nextBreak.Time, st.currentVideo)
@@ -1324,6 +1416,7 @@ func manageProcessing(st *Station, db *sql.DB) {
                                     videoID: st.currentVideo,
                                     fps: fps,
                                     effective_advance: effective,
+                                    srcIn: fadeOutStart,
                                 }
                                 st.segmentList = append(st.segmentList, newChunk)
                                 remainingDur += actualDur
@@ -1337,21 +1430,25 @@ func manageProcessing(st *Station, db *sql.DB) {
                         }
                     }
                 }
-                if len(adIDs) == 0 {
-                    errorLogger.Printf("Station %s (adsEnabled: %v): No adIDs available, skipping ad break", st.name, st.adsEnabled)
+                target, tolerance := breakTarget(st, nextBreak)
+                var pod []podCandidate
+                if syncFiller {
+                    adDurTotal = queueBreakFiller(st, db, st.currentVideo, nextBreak, fillDur)
+                    remainingDur += adDurTotal
                 } else {
-                    availableAds := make([]int64, len(adIDs))
-                    copy(availableAds, adIDs)
+                    pod, decided = decided.pod, nil
+                    if len(pod) == 0 {
+                        errorLogger.Printf("Station %s (adsEnabled: %v): No commercials fit a %.1fs ±%.1fs break, skipping ad break", st.name, st.adsEnabled, target, tolerance)
+                    }
+                }
+                if len(pod) > 0 {
+                    log.Printf("Station %s (adsEnabled: %v): Built ad pod of %d items, %.3fs for target %.1fs ±%.1fs", st.name, st.adsEnabled, len(pod), podDuration(pod), target, tolerance)
                     adDurTotal = 0.0
-                    for i := 0; i < 3 && len(availableAds) > 0; i++ {
-                        idx := rand.Intn(len(availableAds))
-                        adID := availableAds[idx]
-                        adDur := getVideoDur(adID, db)
-                        if adDur <= 0 {
-                            errorLogger.Printf("Station %s (adsEnabled: %v): Invalid duration for ad %d, skipping", st.name, st.adsEnabled, adID)
-                            availableAds = append(availableAds[:idx], availableAds[idx+1:]...)
-                            continue
-                        }
+                    firstAdIdx := -1
+                    var queued []podCandidate
+                    for _, item := range pod {
+                        adID := item.id
+                        adDur := item.dur
                         var adRetryCount int
                         for adRetryCount = 0; adRetryCount < maxAdRetries; adRetryCount++ {
                             var segments []string
@@ -1364,8 +1461,7 @@ func manageProcessing(st *Station, db *sql.DB) {
                             if err != nil {
                                 errorLogger.Printf("Station %s (adsEnabled: %v): Failed to process ad %d (retry %d/%d): %v", st.name, st.adsEnabled, adID, adRetryCount+1, maxAdRetries, err)
                                 if segments != nil && len(segments) > 0 {
-                                    os.Remove(segments[0])
-                                    os.Remove(strings.Replace(segments[0], ".h264", ".opus", 1))
+                                    removeChunkFiles(segments[0])
                                 }
                                 time.Sleep(time.Millisecond * 500)
                                 continue
@@ -1373,8 +1469,7 @@ func manageProcessing(st *Station, db *sql.DB) {
                             if actualDur <= 0 {
                                 errorLogger.Printf("Station %s (adsEnabled: %v): Invalid duration (%.3fs) for ad %d, retrying", st.name, st.adsEnabled, actualDur, adID)
                                 if segments != nil && len(segments) > 0 {
-                                    os.Remove(segments[0])
-                                    os.Remove(strings.Replace(segments[0], ".h264", ".opus", 1))
+                                    removeChunkFiles(segments[0])
                                 }
                                 continue
                             }
@@ -1390,10 +1485,15 @@ func manageProcessing(st *Station, db *sql.DB) {
                                     videoID: adID,
                                     fps: fps,
                                     effective_advance: 0,
+                                    track: item.track,
+                                }
+                                if firstAdIdx < 0 {
+                                    firstAdIdx = len(st.segmentList)
                                 }
                                 st.segmentList = append(st.segmentList, adChunk)
                                 remainingDur += actualDur
                                 adDurTotal += actualDur
+                                queued = append(queued, podCandidate{id: adID, dur: actualDur, bumper: item.bumper})
                                 log.Printf("Station %s (adsEnabled: %v): Queued ad %d with duration %.3fs at break %.3fs", st.name, st.adsEnabled, adID, actualDur, nextBreak.Time)
                             } else {
                                 log.Printf("Station %s (adsEnabled: %v): Negligible ad duration %.3fs for ad %d, skipping", st.name, st.adsEnabled, actualDur, adID)
@@ -1402,11 +1502,20 @@ func manageProcessing(st *Station, db *sql.DB) {
                         }
                         if adRetryCount == maxAdRetries {
                             errorLogger.Printf("Station %s (adsEnabled: %v): All %d retries failed for ad %d, skipping", st.name, st.adsEnabled, maxAdRetries, adID)
-                            availableAds = append(availableAds[:idx], availableAds[idx+1:]...)
-                            continue
                         }
-                        availableAds = append(availableAds[:idx], availableAds[idx+1:]...)
                     }
+                    if firstAdIdx >= 0 {
+                        b := newAdBreak(st, st.currentVideo, nextBreak, adDurTotal)
+                        podID, err := recordAdPod(db, st, st.currentVideo, nextBreak, target, tolerance, podDuration(pod), queued)
+                        if err != nil {
+                            errorLogger.Printf("Station %s (adsEnabled: %v): Failed to record ad pod: %v", st.name, st.adsEnabled, err)
+                        }
+                        b.podID = podID
+                        st.segmentList[firstAdIdx].cueOut = b
+                    }
+                }
+                if st.adsEnabled && cfg.Ads.NoAdsSync && st.live == nil && !st.vod {
+                    recordSyncedPod(st, st.currentVideo, nextBreak, adDurTotal)
                 }
                 resumePoint := nextBreak.Time + outEndMax
                 inVideoStart := nextBreak.FadeIn.Video.Start
@@ -1480,6 +1589,7 @@ func manageProcessing(st *Station, db *sql.DB) {
                                     videoID: st.currentVideo,
                                     fps: fps,
                                     effective_advance: effective,
+                                    srcIn: fadeInStart,
                                 }
                                 st.segmentList = append(st.segmentList, newChunk)
                                 remainingDur += actualDur
@@ -1530,13 +1640,7 @@ func manageProcessing(st *Station, db *sql.DB) {
                     log.Printf("Station %s (adsEnabled: %v): Skipping small final chunk (%.3fs) for video %d", st.name, st.adsEnabled, chunkDur, st.currentVideo)
                     st.currentOffset += chunkDur
                     if st.currentOffset + sumNonAd >= videoDur {
-                        st.currentIndex = (st.currentIndex + 1) % len(st.videoQueue)
-                        st.currentVideo = st.videoQueue[st.currentIndex]
-                        st.currentOffset = 0.0
-                        st.spsPPS = nil
-                        st.fmtpLine = ""
-                        st.currentVideoRTPTS = 0
-                        st.currentAudioSamples = 0
+                        advanceVideo(st, db)
                         log.Printf("Station %s (adsEnabled: %v): Transitioned to video %d with offset 0.0s due to small final skip", st.name, st.adsEnabled, st.currentVideo)
                     }
                     st.mu.Unlock()
@@ -1558,8 +1662,7 @@ func manageProcessing(st *Station, db *sql.DB) {
                     if err != nil {
                         errorLogger.Printf("Station %s (adsEnabled: %v): Failed to process %s chunk for video %d at %.3fs (retry %d/%d): %v", st.name, st.adsEnabled, map[bool]string{true: "final", false: "episode"}[isFinalChunk], st.currentVideo, nextStart, retryCount+1, retryLimit, err)
                         if segments != nil && len(segments) > 0 {
-                            os.Remove(segments[0])
-                            os.Remove(strings.Replace(segments[0], ".h264", ".opus", 1))
+                            removeChunkFiles(segments[0])
                         }
                         time.Sleep(time.Millisecond * 500)
                         continue
@@ -1567,8 +1670,7 @@ func manageProcessing(st *Station, db *sql.DB) {
                     if actualDur <= 0 {
                         errorLogger.Printf("Station %s (adsEnabled: %v): Invalid duration (%.3fs) for chunk %s, retrying", st.name, st.adsEnabled, actualDur, segments[0])
                         if segments != nil && len(segments) > 0 {
-                            os.Remove(segments[0])
-                            os.Remove(strings.Replace(segments[0], ".h264", ".opus", 1))
+                            removeChunkFiles(segments[0])
                         }
                         continue
                     }
@@ -1576,13 +1678,7 @@ func manageProcessing(st *Station, db *sql.DB) {
                 }
                 if retryCount == retryLimit {
                     errorLogger.Printf("Station %s (adsEnabled: %v): Max retries (%d) failed for chunk at %.3fs, advancing video", st.name, st.adsEnabled, retryLimit, nextStart)
-                    st.currentIndex = (st.currentIndex + 1) % len(st.videoQueue)
-                    st.currentVideo = st.videoQueue[st.currentIndex]
-                    st.currentOffset = 0.0
-                    st.spsPPS = nil
-                    st.fmtpLine = ""
-                    st.currentVideoRTPTS = 0
-                    st.currentAudioSamples = 0
+                    advanceVideo(st, db)
                     log.Printf("Station %s (adsEnabled: %v): Transitioned to video %d with offset 0.0s due to failed chunk", st.name, st.adsEnabled, st.currentVideo)
                     st.mu.Unlock()
                     continue
@@ -1600,6 +1696,7 @@ func manageProcessing(st *Station, db *sql.DB) {
                             videoID: st.currentVideo,
                             fps: fps,
                             effective_advance: actualDur,
+                            srcIn: nextStart,
                         }
                         st.segmentList = append(st.segmentList, newChunk)
                         remainingDur += actualDur
@@ -1610,13 +1707,7 @@ func manageProcessing(st *Station, db *sql.DB) {
                         sumNonAd += actualDur
                         log.Printf("Station %s (adsEnabled: %v): Advanced offset by negligible %.3fs without queuing chunk for video %d at %.3fs", st.name, st.adsEnabled, actualDur, st.currentVideo, nextStart)
                         if st.currentOffset >= videoDur {
-                            st.currentIndex = (st.currentIndex + 1) % len(st.videoQueue)
-                            st.currentVideo = st.videoQueue[st.currentIndex]
-                            st.currentOffset = 0.0
-                            st.spsPPS = nil
-                            st.fmtpLine = ""
-                            st.currentVideoRTPTS = 0
-                            st.currentAudioSamples = 0
+                            advanceVideo(st, db)
                             log.Printf("Station %s (adsEnabled: %v): Transitioned to video %d with offset 0.0s due to negligible advance", st.name, st.adsEnabled, st.currentVideo)
                         }
                     }
@@ -1664,17 +1755,9 @@ func sender(st *Station, db *sql.DB) {
             }
             isFinalChunk := !chunk.isAd && (st.currentOffset+sumNonAd >= videoDur || math.Abs(st.currentOffset+sumNonAd-videoDur) < 0.001)
             if !chunk.isAd && chunk.videoID != st.currentVideo {
-                found := false
-                for _, vid := range st.videoQueue {
-                    if vid == chunk.videoID {
-                        found = true
-                        break
-                    }
-                }
-                if !found {
+                if !isQueued(st, chunk.videoID) {
                     errorLogger.Printf("Station %s (adsEnabled: %v): Discarding stale non-ad chunk from video %d (current video %d, segment: %s)", st.name, st.adsEnabled, chunk.videoID, st.currentVideo, chunk.segPath)
-                    os.Remove(chunk.segPath)
-                    os.Remove(strings.Replace(chunk.segPath, ".h264", ".opus", 1))
+                    removeChunkFiles(chunk.segPath)
                     st.segmentList = st.segmentList[1:]
                     log.Printf("Station %s (adsEnabled: %v): Removed stale chunk %s, new segmentList: %v", st.name, st.adsEnabled, chunk.segPath, st.segmentList)
                     st.mu.Unlock()
@@ -1686,13 +1769,13 @@ func sender(st *Station, db *sql.DB) {
             fpsDen := chunk.fps.den
             fps := float64(fpsNum) / float64(fpsDen)
             log.Printf("Station %s (adsEnabled: %v): Processing chunk %d/%d: segPath=%s, videoID=%d, isAd=%v, dur=%.3fs, effective_advance=%.3fs, fps=%d/%d", st.name, st.adsEnabled, 1, len(st.segmentList), chunk.segPath, chunk.videoID, chunk.isAd, chunk.dur, chunk.effective_advance, fpsNum, fpsDen)
+            viewers := st.viewers
             st.mu.Unlock()
             data, err := os.ReadFile(segPath)
             if err != nil || len(data) == 0 {
                 errorLogger.Printf("Station %s (adsEnabled: %v): %s segment %s read error: %v", st.name, st.adsEnabled, map[bool]string{true: "Final", false: "Segment"}[isFinalChunk], segPath, err)
                 st.mu.Lock()
-                os.Remove(segPath) // Clean up even if missing
-                os.Remove(strings.Replace(segPath, ".h264", ".opus", 1))
+                removeChunkFiles(segPath) // Clean up even if missing
                 st.segmentList = st.segmentList[1:]
                 st.mu.Unlock()
                 continue
@@ -1701,8 +1784,7 @@ func sender(st *Station, db *sql.DB) {
             if len(nalus) == 0 {
                 errorLogger.Printf("Station %s (adsEnabled: %v): No NALUs found in segment %s", st.name, st.adsEnabled, segPath)
                 st.mu.Lock()
-                os.Remove(segPath)
-                os.Remove(strings.Replace(segPath, ".h264", ".opus", 1))
+                removeChunkFiles(segPath)
                 st.segmentList = st.segmentList[1:]
                 st.mu.Unlock()
                 continue
@@ -1723,6 +1805,28 @@ func sender(st *Station, db *sql.DB) {
                 chunkSpsPPS = st.spsPPS
                 log.Printf("Station %s (adsEnabled: %v): Using station SPS/PPS for chunk %s", st.name, st.adsEnabled, segPath)
             }
+            if spsNALU := findSPS(chunkSpsPPS); spsNALU != nil {
+                chunkSPS, err := parseSPS(spsNALU)
+                if err != nil {
+                    errorLogger.Printf("Station %s (adsEnabled: %v): Failed to parse SPS for %s: %v", st.name, st.adsEnabled, segPath, err)
+                } else {
+                    st.mu.Lock()
+                    if negotiated := spsFromFmtp(st.negotiatedFmtp); !negotiated.compatibleWith(chunkSPS) {
+                        errorLogger.Printf("Station %s (adsEnabled: %v): Chunk %s has SPS profile-level-id %s, incompatible with negotiated %s; closing viewers to renegotiate", st.name, st.adsEnabled, segPath, chunkSPS.ProfileLevelID(), negotiated.ProfileLevelID())
+                        st.sps = chunkSPS
+                        st.negotiatedFmtp = ""
+                        st.mu.Unlock()
+                        refuseViewers(st, fmt.Sprintf("Stream changed to H.264 profile-level-id %s; reconnect to continue", chunkSPS.ProfileLevelID()))
+                        continue
+                    }
+                    if st.sps == nil || st.sps.ProfileLevelID() != chunkSPS.ProfileLevelID() || st.sps.Width != chunkSPS.Width || st.sps.Height != chunkSPS.Height {
+                        log.Printf("Station %s (adsEnabled: %v): Stream SPS changed at %s: %s", st.name, st.adsEnabled, segPath, chunkSPS)
+                        st.hlsDiscontinuity = st.sps != nil
+                    }
+                    st.sps = chunkSPS
+                    st.mu.Unlock()
+                }
+            }
             testSample := media.Sample{Data: []byte{}, Duration: time.Duration(0)}
             if err := st.trackVideo.WriteSample(testSample); err != nil {
                 if strings.Contains(err.Error(), "not bound") {
@@ -1736,7 +1840,7 @@ func sender(st *Station, db *sql.DB) {
                         close(st.stopCh)
                         st.stopCh = make(chan struct{})
                     }
-                    newTrackVideo, err2 := webrtc.NewTrackLocalStaticSample(
+                    newTrackVideo, err2 := newStationTrack(
                         webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264},
                         fmt.Sprintf("video_%s_%t", sanitizeTrackID(st.name), st.adsEnabled),
                         "pion",
@@ -1760,73 +1864,32 @@ func sender(st *Station, db *sql.DB) {
             if err != nil {
                 errorLogger.Printf("Station %s (adsEnabled: %v): Failed to read audio %s: %v", st.name, st.adsEnabled, audioPath, err)
                 st.mu.Lock()
-                os.Remove(segPath)
-                os.Remove(audioPath)
+                removeChunkFiles(segPath)
                 st.segmentList = st.segmentList[1:]
                 st.mu.Unlock()
                 continue
             }
+            frames := groupFrames(st, nalus, chunkSpsPPS, segPath)
+            renditions := loadRenditions(st, segPath, len(frames))
+            airStart := time.Now()
+            cue := chunkCue(st, chunk, airStart)
+            markAiring(st, db, chunk, airStart)
+            var podID int64
+            st.mu.Lock()
+            if chunk.isAd && st.openBreak != nil {
+                podID = st.openBreak.podID
+            }
+            st.mu.Unlock()
+            tracker := newAdTracker(chunk)
+            var reachStart []*viewerSession
+            if chunk.isAd && !chunk.filler {
+                reachStart = connectedSessions(st)
+            }
+            packageForHLS(st, frames, chunk, audioData, segPath, cue, airStart)
             var transmissionWG sync.WaitGroup
             transmissionWG.Add(2)
-            go func(nalus [][]byte, startTS uint32) {
+            go func(frames [][]byte, startTS uint32) {
                 defer transmissionWG.Done()
-                var allNALUs [][]byte
-                if len(chunkSpsPPS) > 0 {
-                    allNALUs = append(chunkSpsPPS, nalus...)
-                    log.Printf("Station %s (adsEnabled: %v): Prefixed %d SPS/PPS NALUs to %s", st.name, st.adsEnabled, len(chunkSpsPPS), segPath)
-                } else {
-                    allNALUs = nalus
-                }
-                var frames [][]byte
-                var currentFrame [][]byte
-                var hasVCL bool
-                for _, nalu := range allNALUs {
-                    if len(nalu) == 0 {
-                        continue
-                    }
-                    nalType := int(nalu[0] & 0x1F)
-                    isVCL := nalType >= 1 && nalType <= 5
-                    if hasVCL && !isVCL {
-                        var frameData bytes.Buffer
-                        for _, n := range currentFrame {
-                            frameData.Write([]byte{0x00, 0x00, 0x00, 0x01})
-                            frameData.Write(n)
-                        }
-                        frames = append(frames, frameData.Bytes())
-                        currentFrame = [][]byte{nalu}
-                        hasVCL = false
-                    } else {
-                        if isVCL {
-                            firstMb, err := getFirstMbInSlice(nalu)
-                            if err != nil {
-                                errorLogger.Printf("Station %s (adsEnabled: %v): Failed to parse first_mb_in_slice for NALU in %s: %v", st.name, st.adsEnabled, segPath, err)
-                                continue
-                            }
-                            if firstMb == 0 && len(currentFrame) > 0 && hasVCL {
-                                var frameData bytes.Buffer
-                                for _, n := range currentFrame {
-                                    frameData.Write([]byte{0x00, 0x00, 0x00, 0x01})
-                                    frameData.Write(n)
-                                }
-                                frames = append(frames, frameData.Bytes())
-                                currentFrame = nil
-                                hasVCL = false
-                            }
-                            currentFrame = append(currentFrame, nalu)
-                            hasVCL = true
-                        } else {
-                            currentFrame = append(currentFrame, nalu)
-                        }
-                    }
-                }
-                if len(currentFrame) > 0 {
-                    var frameData bytes.Buffer
-                    for _, n := range currentFrame {
-                        frameData.Write([]byte{0x00, 0x00, 0x00, 0x01})
-                        frameData.Write(n)
-                    }
-                    frames = append(frames, frameData.Bytes())
-                }
                 if len(frames) == 0 {
                     errorLogger.Printf("Station %s (adsEnabled: %v): No frames in segment %s", st.name, st.adsEnabled, segPath)
                     st.mu.Lock()
@@ -1858,20 +1921,16 @@ func sender(st *Station, db *sql.DB) {
                         }
                         boundChecked = true
                     }
-                    sample := media.Sample{
-                        Data: frames[frameIdx],
-                        Duration: frameInterval,
-                        PacketTimestamp: videoTimestamp,
-                    }
-                    if err := st.trackVideo.WriteSample(sample); err != nil {
+                    if err := st.trackVideo.WriteRenditions(frameSamples(frames, renditions, frameIdx, frameInterval, videoTimestamp), true); err != nil {
                         errorLogger.Printf("Station %s (adsEnabled: %v): Video sample %d write error for %s: %v", st.name, st.adsEnabled, frameIdx, segPath, err)
                         st.mu.Lock()
                         st.currentVideoRTPTS = currentVideoTS
                         st.mu.Unlock()
                         return
                     }
-                    videoTimestamp += uint32(frameIntervalSeconds * float64(videoClockRate))
                     frameIdx++
+                    videoTimestamp = startTS + uint32(math.Round(float64(frameIdx) * frameIntervalSeconds * videoClockRate))
+                    tracker.progress(0)
                     log.Printf("Station %s (adsEnabled: %v): Sent first video frame immediately for %s", st.name, st.adsEnabled, segPath)
                 }
                 if frameIdx < actualFrames {
@@ -1881,21 +1940,17 @@ func sender(st *Station, db *sql.DB) {
                         if frameIdx >= actualFrames {
                             break
                         }
-                        sample := media.Sample{
-                            Data: frames[frameIdx],
-                            Duration: frameInterval,
-                            PacketTimestamp: videoTimestamp,
-                        }
-                        if err := st.trackVideo.WriteSample(sample); err != nil {
+                        if err := st.trackVideo.WriteRenditions(frameSamples(frames, renditions, frameIdx, frameInterval, videoTimestamp), false); err != nil {
                             errorLogger.Printf("Station %s (adsEnabled: %v): Video sample %d write error for %s: %v", st.name, st.adsEnabled, frameIdx, segPath, err)
                             st.mu.Lock()
-                            st.currentVideoRTPTS = currentVideoTS
+                            st.currentVideoRTPTS = videoTimestamp
                             st.mu.Unlock()
                             return
                         }
-                        videoTimestamp += uint32(frameIntervalSeconds * float64(videoClockRate))
                         frameIdx++
-                        if isFinalChunk && videoTimestamp >= expectedSamples {
+                        videoTimestamp = startTS + uint32(math.Round(float64(frameIdx) * frameIntervalSeconds * videoClockRate))
+                        tracker.progress(float64(frameIdx) / float64(actualFrames))
+                        if isFinalChunk && videoTimestamp-startTS >= expectedSamples {
                             break
                         }
                     }
@@ -1904,7 +1959,7 @@ func sender(st *Station, db *sql.DB) {
                 st.currentVideoRTPTS = videoTimestamp
                 st.mu.Unlock()
                 log.Printf("Station %s (adsEnabled: %v): Completed video transmission for %s, final videoTS=%d", st.name, st.adsEnabled, segPath, videoTimestamp)
-            }(nalus, currentVideoTS)
+            }(frames, currentVideoTS)
             go func(audioData []byte, startTS uint32) {
                 defer transmissionWG.Done()
                 const sampleRate = 48000
@@ -1974,7 +2029,7 @@ func sender(st *Station, db *sql.DB) {
                     prevGranule = header.GranulePosition
                     cumulTime += pktDur
                     packetIdx++
-                    if isFinalChunk && audioTimestamp >= expectedSamples {
+                    if isFinalChunk && audioTimestamp-startTS >= expectedSamples {
                         break
                     }
                 }
@@ -1989,26 +2044,35 @@ func sender(st *Station, db *sql.DB) {
                 transmissionWG.Wait()
                 close(doneCh)
             }()
+            completed := true
             select {
             case <-doneCh:
                 log.Printf("Station %s (adsEnabled: %v): Transmission completed normally for %s", st.name, st.adsEnabled, segPath)
             case <-time.After(time.Duration(chunk.dur*float64(time.Second)) + 20*time.Second):
                 errorLogger.Printf("Station %s (adsEnabled: %v): Timeout waiting for audio/video transmission for %s", st.name, st.adsEnabled, segPath)
+                completed = false
+            }
+            airEnd := time.Now()
+            var reach *adReach
+            if chunk.isAd && !chunk.filler {
+                reach = measureAdReach(st, reachStart, airStart, airEnd)
             }
+            logAsRun(st, chunk, podID, airStart, airEnd, viewers, completed, reach)
+            retained := retainChunk(st, chunk, segPath, audioPath, airStart)
             st.mu.Lock()
-            os.Remove(segPath)
-            os.Remove(audioPath)
+            if !retained {
+                removeChunkFiles(segPath)
+            }
+            if chunk.isAd && !chunk.filler {
+                st.adSeconds += chunk.dur
+            }
             if !chunk.isAd && chunk.videoID == st.currentVideo {
                 st.currentOffset += chunk.effective_advance
                 log.Printf("Station %s (adsEnabled: %v): Updated offset to %.3fs for video %d after successful transmission (effective advance %.3fs)", st.name, st.adsEnabled, st.currentOffset, st.currentVideo, chunk.effective_advance)
-                if videoDur > 0 && (st.currentOffset >= videoDur || math.Abs(st.currentOffset-videoDur) < 0.001) {
+                if videoDur > 0 && !st.vod && (st.currentOffset >= videoDur || math.Abs(st.currentOffset-videoDur) < 0.001) {
                     log.Printf("Station %s (adsEnabled: %v): Completed video %d, advancing to next", st.name, st.adsEnabled, st.currentVideo)
-                    st.currentIndex = (st.currentIndex + 1) % len(st.videoQueue)
-                    st.currentVideo = st.videoQueue[st.currentIndex]
-                    st.currentOffset = 0.0
-                    st.spsPPS = nil
-                    st.fmtpLine = ""
                     st.segmentList = []bufferedChunk{}
+                    advanceVideo(st, db)
                     log.Printf("Station %s (adsEnabled: %v): Transitioned to video %d with offset 0.0s", st.name, st.adsEnabled, st.currentVideo)
                 }
             }
@@ -2028,6 +2092,69 @@ func min(a, b int) int {
     return b
 }
 
+// groupFrames prefixes the chunk's SPS/PPS and groups its NALUs into Annex B
+// access units, splitting on non-VCL NALUs and on first_mb_in_slice == 0.
+func groupFrames(st *Station, nalus [][]byte, chunkSpsPPS [][]byte, segPath string) [][]byte {
+    var allNALUs [][]byte
+    if len(chunkSpsPPS) > 0 {
+        allNALUs = append(chunkSpsPPS, nalus...)
+        log.Printf("Station %s (adsEnabled: %v): Prefixed %d SPS/PPS NALUs to %s", st.name, st.adsEnabled, len(chunkSpsPPS), segPath)
+    } else {
+        allNALUs = nalus
+    }
+    var frames [][]byte
+    var currentFrame [][]byte
+    var hasVCL bool
+    for _, nalu := range allNALUs {
+        if len(nalu) == 0 {
+            continue
+        }
+        nalType := int(nalu[0] & 0x1F)
+        isVCL := nalType >= 1 && nalType <= 5
+        if hasVCL && !isVCL {
+            var frameData bytes.Buffer
+            for _, n := range currentFrame {
+                frameData.Write([]byte{0x00, 0x00, 0x00, 0x01})
+                frameData.Write(n)
+            }
+            frames = append(frames, frameData.Bytes())
+            currentFrame = [][]byte{nalu}
+            hasVCL = false
+        } else {
+            if isVCL {
+                firstMb, err := getFirstMbInSlice(nalu)
+                if err != nil {
+                    errorLogger.Printf("Station %s (adsEnabled: %v): Failed to parse first_mb_in_slice for NALU in %s: %v", st.name, st.adsEnabled, segPath, err)
+                    continue
+                }
+                if firstMb == 0 && len(currentFrame) > 0 && hasVCL {
+                    var frameData bytes.Buffer
+                    for _, n := range currentFrame {
+                        frameData.Write([]byte{0x00, 0x00, 0x00, 0x01})
+                        frameData.Write(n)
+                    }
+                    frames = append(frames, frameData.Bytes())
+                    currentFrame = nil
+                    hasVCL = false
+                }
+                currentFrame = append(currentFrame, nalu)
+                hasVCL = true
+            } else {
+                currentFrame = append(currentFrame, nalu)
+            }
+        }
+    }
+    if len(currentFrame) > 0 {
+        var frameData bytes.Buffer
+        for _, n := range currentFrame {
+            frameData.Write([]byte{0x00, 0x00, 0x00, 0x01})
+            frameData.Write(n)
+        }
+        frames = append(frames, frameData.Bytes())
+    }
+    return frames
+}
+
 func splitNALUs(data []byte) [][]byte {
     if len(data) == 0 {
         return nil
@@ -2060,73 +2187,120 @@ func splitNALUs(data []byte) [][]byte {
     return nalus
 }
 
-func signalingHandler(db *sql.DB, c *gin.Context) {
-    stationName := c.Query("station")
-    if stationName == "" {
-        stationName = DefaultStation
-    }
-    adsEnabled := c.Query("adsEnabled") != "false"
+// lookupStation returns the loaded station for name, loading it (and, for the
+// no-ads variant, its ad-supported base station) on first use. On failure it
+// returns nil and a message suitable for the client.
+func lookupStation(db *sql.DB, stationName string, adsEnabled bool) (*Station, string) {
     mu.Lock()
-    var st *Station
-    var ok bool
+    defer mu.Unlock()
     if adsEnabled {
-        st, ok = stations[stationName]
+        st, ok := stations[stationName]
         if !ok {
             st = loadStation(stationName, db, true, nil)
             if st == nil {
-                mu.Unlock()
-                c.JSON(400, gin.H{"error": "Invalid station"})
-                return
+                return nil, "Invalid station"
             }
             stations[stationName] = st
         }
-    } else {
-        st, ok = noAdsStations[stationName]
-        if !ok {
-            originalSt, origOk := stations[stationName]
-            if !origOk {
-                originalSt = loadStation(stationName, db, true, nil)
-                if originalSt == nil {
-                    mu.Unlock()
-                    c.JSON(400, gin.H{"error": "Base station does not exist"})
-                    return
-                }
-                stations[stationName] = originalSt
+        return st, ""
+    }
+    st, ok := noAdsStations[stationName]
+    if !ok {
+        originalSt, origOk := stations[stationName]
+        if !origOk {
+            originalSt = loadStation(stationName, db, true, nil)
+            if originalSt == nil {
+                return nil, "Base station does not exist"
             }
-            st = loadStation(stationName, db, false, originalSt)
-            if st == nil {
-                mu.Unlock()
-                c.JSON(400, gin.H{"error": "Failed to create no-ads station"})
-                return
-            }
-            noAdsStations[stationName] = st
-            log.Printf("Created no-ads station for %s", stationName)
+            stations[stationName] = originalSt
+        }
+        st = loadStation(stationName, db, false, originalSt)
+        if st == nil {
+            return nil, "Failed to create no-ads station"
         }
+        noAdsStations[stationName] = st
+        log.Printf("Created no-ads station for %s", stationName)
     }
-    mu.Unlock()
-    log.Printf("Signaling for station %s, adsEnabled: %v", stationName, adsEnabled)
-    var msg struct {
-        Type string `json:"type"`
-        SDP string `json:"sdp,omitempty"`
+    return st, ""
+}
+
+// addViewer counts a new viewer and starts the station's processing and
+// sender goroutines when it is the first one.
+func addViewer(st *Station, db *sql.DB) error {
+    st.mu.Lock()
+    st.viewers++
+    if st.viewers > 1 {
+        st.mu.Unlock()
+        return nil
     }
-    if err := c.BindJSON(&msg); err != nil {
-        log.Printf("JSON bind error: %v", err)
-        c.JSON(400, gin.H{"error": err.Error()})
+    st.stopCh = make(chan struct{})
+    st.processing = true
+    if err := os.MkdirAll(cfg.Paths.SegmentDir, 0755); err != nil {
+        st.viewers--
+        st.mu.Unlock()
+        return fmt.Errorf("failed to create webrtc_segments directory: %v", err)
+    }
+    st.mu.Unlock()
+    if cfg.Ads.NoAdsSync && st.live == nil {
+        syncWithSibling(st)
+    }
+    if st.dvr != nil {
+        go playDVR(st, db)
+        return nil
+    }
+    go manageProcessing(st, db)
+    go sender(st, db)
+    return nil
+}
+
+// removeViewer drops a viewer. When the last one leaves, the station's
+// goroutines are stopped and it is unloaded so the next viewer reloads it.
+func removeViewer(st *Station) {
+    st.mu.Lock()
+    defer st.mu.Unlock()
+    if st.viewers <= 0 {
+        return
+    }
+    st.viewers--
+    if st.viewers > 0 {
         return
     }
+    close(st.stopCh)
+    st.stopCh = make(chan struct{})
+    st.negotiatedFmtp = ""
+    if st.hls != nil {
+        go st.hls.Close()
+        st.hls = nil
+    }
+    mu.Lock()
+    if !st.adsEnabled {
+        if noAdsStations[st.name] == st {
+            delete(noAdsStations, st.name)
+            log.Printf("Removed no-ads station %s due to no viewers", st.name)
+        }
+    } else if stations[st.name] == st {
+        delete(stations, st.name)
+        log.Printf("Removed station %s due to no viewers", st.name)
+    }
+    mu.Unlock()
+}
+
+// newStationPeerConnection builds a peer connection offering the station's
+// H.264 format and Opus, with the interceptors registerInterceptors adds and
+// the feedback they collect.
+func newStationPeerConnection(videoFmtp string) (*webrtc.PeerConnection, *peerFeedback, error) {
     m := &webrtc.MediaEngine{}
     if err := m.RegisterCodec(webrtc.RTPCodecParameters{
         RTPCodecCapability: webrtc.RTPCodecCapability{
             MimeType: webrtc.MimeTypeH264,
             ClockRate: 90000,
-            SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42c034",
-            RTCPFeedback: []webrtc.RTCPFeedback{{"goog-remb", ""}, {"ccm", "fir"}, {"nack", ""}, {"nack", "pli"}},
+            SDPFmtpLine: videoFmtp,
+            RTCPFeedback: []webrtc.RTCPFeedback{{Type: "goog-remb"}, {Type: "ccm", Parameter: "fir"}, {Type: "nack"}, {Type: "nack", Parameter: "pli"}, {Type: webrtc.TypeRTCPFBTransportCC}},
         },
         PayloadType: 96,
     }, webrtc.RTPCodecTypeVideo); err != nil {
         log.Printf("RegisterCodec video error: %v", err)
-        c.JSON(500, gin.H{"error": err.Error()})
-        return
+        return nil, nil, err
     }
     if err := m.RegisterCodec(webrtc.RTPCodecParameters{
         RTPCodecCapability: webrtc.RTPCodecCapability{
@@ -2134,155 +2308,176 @@ func signalingHandler(db *sql.DB, c *gin.Context) {
             ClockRate: 48000,
             Channels: 2,
             SDPFmtpLine: "minptime=10;useinbandfec=1;stereo=1",
+            RTCPFeedback: []webrtc.RTCPFeedback{{Type: webrtc.TypeRTCPFBTransportCC}},
         },
         PayloadType: 111,
     }, webrtc.RTPCodecTypeAudio); err != nil {
         log.Printf("RegisterCodec audio error: %v", err)
-        c.JSON(500, gin.H{"error": err.Error()})
-        return
+        return nil, nil, err
+    }
+    s, err := newSettingEngine(cfg.WebRTC)
+    if err != nil {
+        log.Printf("SettingEngine error: %v", err)
+        return nil, nil, err
     }
-    s := webrtc.SettingEngine{}
-    s.SetNetworkTypes([]webrtc.NetworkType{webrtc.NetworkTypeUDP4, webrtc.NetworkTypeTCP4})
-    api := webrtc.NewAPI(webrtc.WithMediaEngine(m), webrtc.WithSettingEngine(s))
+    r := &interceptor.Registry{}
+    fb := &peerFeedback{}
+    if err := registerInterceptors(m, r, fb); err != nil {
+        log.Printf("Interceptor error: %v", err)
+        return nil, nil, err
+    }
+    api := webrtc.NewAPI(webrtc.WithMediaEngine(m), webrtc.WithSettingEngine(s), webrtc.WithInterceptorRegistry(r))
     pc, err := api.NewPeerConnection(webrtc.Configuration{
-        ICEServers: []webrtc.ICEServer{
-            {URLs: []string{"stun:stun.l.google.com:19302"}},
-            {URLs: []string{"turn:openrelay.metered.ca:80"}, Username: "openrelayproject", Credential: "openrelayproject"},
-            {URLs: []string{"turn:openrelay.metered.ca:443"}, Username: "openrelayproject", Credential: "openrelayproject"},
-        },
+        ICEServers: iceServers(cfg.WebRTC),
     })
     if err != nil {
         log.Printf("NewPeerConnection error: %v", err)
-        c.JSON(500, gin.H{"error": err.Error()})
+        return nil, nil, err
+    }
+    return pc, fb, nil
+}
+
+// answerStationOffer applies a viewer's offer, attaches the station tracks and
+// returns the answer. With waitGathering the answer carries every candidate;
+// otherwise it is returned straight away and candidates are trickled.
+func answerStationOffer(st *Station, pc *webrtc.PeerConnection, offerSDP string, waitGathering bool) (*webrtc.SessionDescription, error) {
+    offer := webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: offerSDP}
+    if err := pc.SetRemoteDescription(offer); err != nil {
+        log.Printf("SetRemoteDescription error: %v", err)
+        return nil, err
+    }
+    if _, err := pc.AddTrack(st.trackVideo); err != nil {
+        log.Printf("AddTrack video error: %v", err)
+        return nil, err
+    }
+    if _, err := pc.AddTrack(st.trackAudio); err != nil {
+        log.Printf("AddTrack audio error: %v", err)
+        return nil, err
+    }
+    log.Printf("Station %s: Tracks added", st.name)
+    answer, err := pc.CreateAnswer(nil)
+    if err != nil {
+        log.Printf("CreateAnswer error: %v", err)
+        return nil, err
+    }
+    gatherComplete := webrtc.GatheringCompletePromise(pc)
+    if err := pc.SetLocalDescription(answer); err != nil {
+        log.Printf("SetLocalDescription error: %v", err)
+        return nil, err
+    }
+    if !waitGathering {
+        return &answer, nil
+    }
+    <-gatherComplete
+    return pc.LocalDescription(), nil
+}
+
+func signalingHandler(db *sql.DB, c *gin.Context) {
+    stationName := c.Query("station")
+    if stationName == "" {
+        stationName = DefaultStation
+    }
+    adsEnabled := c.Query("adsEnabled") != "false"
+    var st *Station
+    var errMsg string
+    if video := c.Query("video"); video != "" {
+        // On-demand video only breaks for ads when asked to.
+        adsEnabled = c.Query("adsEnabled") == "true"
+        st, errMsg = vodStation(db, video, c.Query("position"), adsEnabled)
+    } else {
+        st, errMsg = lookupStation(db, stationName, adsEnabled)
+    }
+    if st == nil {
+        c.JSON(400, gin.H{"error": errMsg})
         return
     }
-    st.mu.Lock()
-    st.viewers++
-    startGoroutines := false
-    if st.viewers == 1 {
-        startGoroutines = true
-        st.stopCh = make(chan struct{})
-        st.processing = true
-        if err := os.MkdirAll(HlsDir, 0755); err != nil {
-            log.Printf("Station %s: Failed to create webrtc_segments directory: %v", st.name, err)
-            st.viewers--
-            st.mu.Unlock()
-            if startGoroutines {
-                go manageProcessing(st, db)
-                go sender(st, db)
-            }
-            c.JSON(500, gin.H{"error": "Failed to create webrtc_segments directory"})
-            pc.Close()
+    stationName = st.name
+    playback := c.DefaultQuery("playback", PlaybackLive)
+    if playback != PlaybackLive && st.vod {
+        c.JSON(400, gin.H{"error": "Playback modes do not apply to on-demand video"})
+        return
+    }
+    if playback != PlaybackLive {
+        cursor, err := newCursorStation(db, st, playback)
+        if err != nil {
+            c.JSON(400, gin.H{"error": err.Error()})
             return
         }
-        // Removed synchronous initial build loop; manageProcessing will handle it asynchronously
+        st = cursor
+    }
+    log.Printf("Signaling for station %s, adsEnabled: %v, playback: %s", stationName, adsEnabled, playback)
+    var msg struct {
+        Type string `json:"type"`
+        SDP string `json:"sdp,omitempty"`
+        Trickle bool `json:"trickle,omitempty"`
     }
+    if err := c.BindJSON(&msg); err != nil {
+        log.Printf("JSON bind error: %v", err)
+        c.JSON(400, gin.H{"error": err.Error()})
+        return
+    }
+    if msg.Type != "offer" {
+        c.JSON(400, gin.H{"error": "Expected an offer"})
+        return
+    }
+    st.mu.Lock()
+    videoFmtp := st.offerFmtp()
     st.mu.Unlock()
-    if startGoroutines {
-        go manageProcessing(st, db)
-        go sender(st, db)
+    if !offerSupportsFmtp(msg.SDP, videoFmtp) {
+        log.Printf("Station %s: Offer has no H.264 format compatible with %s, refusing", stationName, videoFmtp)
+        c.JSON(406, gin.H{"error": "Offer does not support the station's H.264 profile", "fmtp": videoFmtp})
+        return
     }
+    pc, feedback, err := newStationPeerConnection(videoFmtp)
+    if err != nil {
+        c.JSON(500, gin.H{"error": err.Error()})
+        return
+    }
+    st.mu.Lock()
+    if st.negotiatedFmtp == "" {
+        st.negotiatedFmtp = videoFmtp
+    }
+    st.mu.Unlock()
+    if err := addViewer(st, db); err != nil {
+        log.Printf("Station %s: %v", st.name, err)
+        c.JSON(500, gin.H{"error": err.Error()})
+        pc.Close()
+        return
+    }
+    sess, err := newViewerSession(st, pc, feedback)
+    if err != nil {
+        removeViewer(st)
+        c.JSON(500, gin.H{"error": err.Error()})
+        pc.Close()
+        return
+    }
+    pc.OnDataChannel(func(dc *webrtc.DataChannel) {
+        attachEventChannel(st, db, dc)
+        sess.handlePlaybackCommands(db, dc)
+    })
     pc.OnICEConnectionStateChange(func(state webrtc.ICEConnectionState) {
         log.Printf("Station %s: ICE state: %s", stationName, state.String())
     })
-    if msg.Type == "offer" {
-        offer := webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: msg.SDP}
-        if err := pc.SetRemoteDescription(offer); err != nil {
-            log.Printf("SetRemoteDescription error: %v", err)
-            st.mu.Lock()
-            st.viewers--
-            if st.viewers == 0 {
-                close(st.stopCh)
-                st.stopCh = make(chan struct{})
-            }
-            st.mu.Unlock()
-            c.JSON(500, gin.H{"error": err.Error()})
-            pc.Close()
-            return
-        }
-        if _, err = pc.AddTrack(st.trackVideo); err != nil {
-            log.Printf("AddTrack video error: %v", err)
-            st.mu.Lock()
-            st.viewers--
-            if st.viewers == 0 {
-                close(st.stopCh)
-                st.stopCh = make(chan struct{})
-            }
-            st.mu.Unlock()
-            c.JSON(500, gin.H{"error": err.Error()})
-            pc.Close()
-            return
-        }
-        if _, err = pc.AddTrack(st.trackAudio); err != nil {
-            log.Printf("AddTrack audio error: %v", err)
-            st.mu.Lock()
-            st.viewers--
-            if st.viewers == 0 {
-                close(st.stopCh)
-                st.stopCh = make(chan struct{})
-            }
-            st.mu.Unlock()
-            c.JSON(500, gin.H{"error": err.Error()})
-            pc.Close()
-            return
-        }
-        log.Printf("Station %s: Tracks added", stationName)
-        answer, err := pc.CreateAnswer(nil)
-        if err != nil {
-            log.Printf("CreateAnswer error: %v", err)
-            st.mu.Lock()
-            st.viewers--
-            if st.viewers == 0 {
-                close(st.stopCh)
-                st.stopCh = make(chan struct{})
-            }
-            st.mu.Unlock()
-            c.JSON(500, gin.H{"error": err.Error()})
-            pc.Close()
-            return
-        }
-        gatherComplete := webrtc.GatheringCompletePromise(pc)
-        if err := pc.SetLocalDescription(answer); err != nil {
-            log.Printf("SetLocalDescription error: %v", err)
-            st.mu.Lock()
-            st.viewers--
-            if st.viewers == 0 {
-                close(st.stopCh)
-                st.stopCh = make(chan struct{})
-            }
-            st.mu.Unlock()
-            c.JSON(500, gin.H{"error": err.Error()})
-            pc.Close()
-            return
-        }
-        <-gatherComplete
-        log.Printf("Station %s: SDP Answer: %s", stationName, pc.LocalDescription().SDP)
-        c.JSON(200, gin.H{"type": "answer", "sdp": pc.LocalDescription().SDP})
-    }
     pc.OnConnectionStateChange(func(s webrtc.PeerConnectionState) {
         log.Printf("Station %s: PC state: %s", stationName, s.String())
+        sess.setState(s)
         if s == webrtc.PeerConnectionStateFailed || s == webrtc.PeerConnectionStateDisconnected {
-            st.mu.Lock()
-            st.viewers--
-            if st.viewers == 0 {
-                close(st.stopCh)
-                st.stopCh = make(chan struct{})
-                mu.Lock()
-                if !st.adsEnabled {
-                    delete(noAdsStations, stationName)
-                    log.Printf("Removed no-ads station %s due to no viewers", stationName)
-                } else {
-                    delete(stations, stationName)
-                    log.Printf("Removed station %s due to no viewers", stationName)
-                }
-                mu.Unlock()
-            }
-            st.mu.Unlock()
-            if err := pc.Close(); err != nil {
-                log.Printf("Failed to close PC: %v", err)
-            }
+            sess.close()
         }
     })
+    if msg.Trickle {
+        sess.collectCandidates()
+    }
+    answer, err := answerStationOffer(st, pc, msg.SDP, !msg.Trickle)
+    if err != nil {
+        sess.close()
+        c.JSON(500, gin.H{"error": err.Error()})
+        return
+    }
+    sess.readReceiverReports()
+    sess.adaptRenditions()
+    log.Printf("Station %s: SDP Answer (trickle: %v): %s", stationName, msg.Trickle, answer.SDP)
+    c.JSON(200, gin.H{"type": "answer", "sdp": answer.SDP, "session_id": sess.id})
 }
 
 func indexHandler(c *gin.Context) {
@@ -2561,12 +2756,18 @@ func main() {
     }
     defer errorLogFile.Close()
     errorLogger = log.New(errorLogFile, "", log.LstdFlags)
+    configPath := flag.String("config", "", "path to the shared config file")
+    flag.Parse()
+    if cfg, err = config.Load(*configPath); err != nil {
+        log.Fatal(err)
+    }
+    log.Printf("Loaded config from %s", cfg.Source())
     runtime.GOMAXPROCS(runtime.NumCPU())
     rand.Seed(time.Now().UnixNano())
-    if err := os.MkdirAll(HlsDir, 0755); err != nil {
+    if err := os.MkdirAll(cfg.Paths.SegmentDir, 0755); err != nil {
         log.Fatal(err)
     }
-    db, err := sql.Open("postgres", dbConnString)
+    db, err := sql.Open("postgres", cfg.Database.DSN)
     if err != nil {
         log.Fatal(err)
     }
@@ -2575,38 +2776,55 @@ func main() {
         log.Fatal("DB ping failed: ", err)
     }
     log.Println("Connected to PostgreSQL DB")
-    videoBaseDir = os.Getenv("VIDEO_BASE_DIR")
-    if videoBaseDir == "" {
-        videoBaseDir = DefaultVideoBaseDir
+    if err := schema.Ensure(db); err != nil {
+        log.Fatal(err)
     }
+    videoBaseDir = cfg.Paths.VideoBaseDir
     log.Printf("Using video base directory: %s", videoBaseDir)
     if err := updateVideoDurations(db); err != nil {
         log.Printf("Failed to update video durations: %v", err)
     }
-    rows, err := db.Query("SELECT v.id FROM videos v JOIN video_tags vt ON v.id = vt.video_id WHERE vt.tag_id = 4")
-    if err != nil {
-        log.Fatalf("Failed to load ad IDs: %v", err)
+    if err := loadPodCatalogs(db, cfg.Ads.BumperTag); err != nil {
+        log.Fatalf("Failed to load commercials: %v", err)
     }
-    defer rows.Close()
-    for rows.Next() {
-        var id int64
-        if err := rows.Scan(&id); err != nil {
-            log.Printf("Failed to scan ad ID: %v", err)
-            continue
+    log.Printf("Loaded %d commercials and %d bumpers", len(adCatalog), len(bumperCatalog))
+    if cfg.Ads.NoAdsSync && cfg.Ads.NoAdsFiller == "promos" {
+        if err := loadPromoCatalog(db, cfg.Ads.PromoTag); err != nil {
+            log.Fatalf("Failed to load promos: %v", err)
         }
-        adIDs = append(adIDs, id)
+        log.Printf("Loaded %d promos for ad-free breaks", len(promoCatalog))
     }
-    if err := rows.Err(); err != nil {
-        log.Fatalf("Error iterating ad IDs: %v", err)
-    }
-    log.Printf("Loaded %d commercials", len(adIDs))
+    go stateSaver(db)
+    startAsRunWriter(db)
+    if cfg.DVR.WindowSeconds > 0 {
+        if err := loadDVR(); err != nil {
+            log.Printf("Failed to load DVR buffers: %v", err)
+        }
+        go dvrJanitor()
+    }
+    sigCh := make(chan os.Signal, 1)
+    signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+    go func() {
+        <-sigCh
+        saveStateOnExit(db)
+        os.Exit(0)
+    }()
     r := gin.Default()
     r.Use(cors.Default())
     r.POST("/signal", func(c *gin.Context) { signalingHandler(db, c) })
+    r.GET("/signal/:session/candidates", candidateStreamHandler)
+    r.POST("/signal/:session/candidates", remoteCandidateHandler)
     r.GET("/", indexHandler)
-    r.GET("/hls/*path", func(c *gin.Context) {
-        c.String(404, "Use WebRTC")
-    })
-    log.Printf("WebRTC TV server on %s. Stations will be loaded on demand.", Port)
-    log.Fatal(r.Run(Port))
+    r.GET("/hls/*path", func(c *gin.Context) { hlsHandler(db, c) })
+    r.POST("/whep/:station", func(c *gin.Context) { whepOfferHandler(db, c) })
+    r.PATCH("/whep/:station/:session", whepPatchHandler)
+    r.DELETE("/whep/:station/:session", whepDeleteHandler)
+    r.GET("/api/stations/:name/now", func(c *gin.Context) { nowPlayingHandler(db, c) })
+    r.GET("/api/videos/:id/ad-scores", func(c *gin.Context) { adScoresHandler(db, c) })
+    r.GET("/api/guide", func(c *gin.Context) { guideHandler(db, c) })
+    r.GET("/api/sessions", sessionsStatsHandler)
+    r.GET("/api/sessions/:session", sessionStatsHandler)
+    r.GET("/guide.xml", func(c *gin.Context) { xmltvHandler(db, c) })
+    log.Printf("WebRTC TV server on %s. Stations will be loaded on demand.", cfg.VideoServer.Listen)
+    log.Fatal(r.Run(cfg.VideoServer.Listen))
 }
\ No newline at end of file
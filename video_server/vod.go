@@ -0,0 +1,107 @@
+package main
+
+import (
+    "database/sql"
+    "fmt"
+    "log"
+    "strconv"
+    "github.com/pion/webrtc/v3"
+)
+
+// newVODStation creates a private station that plays one library video on
+// demand from offset, through the same processing and sender loops as a
+// station. It plays the video once and holds at its end. With adsEnabled it
+// breaks at the video's stored break points with pods from the catalog; it
+// never calls the ad decision server and, like a cursor, records nothing
+// about the breaks it airs.
+func newVODStation(db *sql.DB, videoID int64, offset float64, adsEnabled bool) (*Station, error) {
+    dur := getVideoDur(videoID, db)
+    if dur <= 0 {
+        return nil, fmt.Errorf("video %d does not exist or has no duration", videoID)
+    }
+    if offset < 0 || offset >= dur {
+        return nil, fmt.Errorf("position %.3fs is outside video %d (%.3fs)", offset, videoID, dur)
+    }
+    id, err := newSessionID()
+    if err != nil {
+        return nil, err
+    }
+    st := &Station{
+        name: fmt.Sprintf("vod_%d", videoID),
+        videoQueue: []int64{videoID},
+        currentVideo: videoID,
+        currentOffset: offset,
+        stopCh: make(chan struct{}),
+        adsEnabled: adsEnabled,
+        adTolerance: -1,
+        output: stationOutput(db, 0),
+        cursorID: id[:8],
+        vod: true,
+    }
+    st.trackVideo, err = newStationTrack(
+        webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264},
+        fmt.Sprintf("video_%s_%t", sanitizeTrackID(st.name), adsEnabled),
+        "pion",
+    )
+    if err != nil {
+        return nil, fmt.Errorf("failed to create video track: %v", err)
+    }
+    st.trackAudio, err = newStationTrack(
+        webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2},
+        fmt.Sprintf("audio_%s_%t", sanitizeTrackID(st.name), adsEnabled),
+        "pion",
+    )
+    if err != nil {
+        return nil, fmt.Errorf("failed to create audio track: %v", err)
+    }
+    log.Printf("Station %s (adsEnabled: %v): On-demand session %s playing video %d from %.3fs", st.name, st.adsEnabled, st.cursorID, videoID, offset)
+    return st, nil
+}
+
+// vodStation is lookupStation for /signal?video=ID&position=S.
+func vodStation(db *sql.DB, video, position string, adsEnabled bool) (*Station, string) {
+    videoID, err := strconv.ParseInt(video, 10, 64)
+    if err != nil {
+        return nil, "Invalid video"
+    }
+    offset := 0.0
+    if position != "" {
+        if offset, err = strconv.ParseFloat(position, 64); err != nil {
+            return nil, "Invalid position"
+        }
+    }
+    st, err := newVODStation(db, videoID, offset, adsEnabled)
+    if err != nil {
+        return nil, err.Error()
+    }
+    return st, ""
+}
+
+// seek restarts the session's on-demand video at position, on a new VOD
+// station whose tracks replace the current ones.
+func (vs *viewerSession) seek(db *sql.DB, dc *webrtc.DataChannel, position float64) (*Station, error) {
+    vs.switchMu.Lock()
+    defer vs.switchMu.Unlock()
+    vs.mu.Lock()
+    closed := !vs.closedAt.IsZero()
+    vs.mu.Unlock()
+    if closed {
+        return nil, fmt.Errorf("session closed")
+    }
+    old := vs.station()
+    if !old.vod {
+        return nil, fmt.Errorf("seek works on on-demand video only")
+    }
+    next, err := newVODStation(db, old.videoQueue[0], position, old.adsEnabled)
+    if err != nil {
+        return nil, err
+    }
+    old.mu.Lock()
+    next.negotiatedFmtp = old.negotiatedFmtp
+    old.mu.Unlock()
+    if err := vs.moveTo(db, dc, old, next); err != nil {
+        return nil, err
+    }
+    log.Printf("Station %s: Session %s seeked to %.3fs", next.name, vs.id, position)
+    return next, nil
+}
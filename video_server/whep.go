@@ -0,0 +1,170 @@
+package main
+
+import (
+    "database/sql"
+    "fmt"
+    "io"
+    "log"
+    "mime"
+    "net/http"
+    "net/url"
+    "strings"
+    "github.com/gin-gonic/gin"
+    "github.com/pion/webrtc/v3"
+)
+
+func lookupWHEPSession(c *gin.Context) *viewerSession {
+    ws := lookupViewerSession(c.Param("session"))
+    if ws == nil || ws.st.name != c.Param("station") {
+        return nil
+    }
+    return ws
+}
+
+func hasContentType(c *gin.Context, want string) bool {
+    mediaType, _, err := mime.ParseMediaType(c.GetHeader("Content-Type"))
+    return err == nil && mediaType == want
+}
+
+// whepOfferHandler implements the WHEP POST: the body is the viewer's SDP
+// offer, and the answer is returned with the session's resource URL in the
+// Location header. ?adsEnabled=false selects the no-ads variant, as on /signal.
+func whepOfferHandler(db *sql.DB, c *gin.Context) {
+    if !hasContentType(c, "application/sdp") {
+        c.String(http.StatusUnsupportedMediaType, "Expected application/sdp")
+        return
+    }
+    stationName := c.Param("station")
+    adsEnabled := c.Query("adsEnabled") != "false"
+    body, err := io.ReadAll(c.Request.Body)
+    if err != nil || len(body) == 0 {
+        c.String(http.StatusBadRequest, "Missing SDP offer")
+        return
+    }
+    offerSDP := string(body)
+    st, errMsg := lookupStation(db, stationName, adsEnabled)
+    if st == nil {
+        c.String(http.StatusNotFound, errMsg)
+        return
+    }
+    log.Printf("WHEP offer for station %s, adsEnabled: %v", stationName, adsEnabled)
+    st.mu.Lock()
+    videoFmtp := st.offerFmtp()
+    st.mu.Unlock()
+    if !offerSupportsFmtp(offerSDP, videoFmtp) {
+        log.Printf("Station %s: WHEP offer has no H.264 format compatible with %s, refusing", stationName, videoFmtp)
+        c.String(http.StatusNotAcceptable, "Offer does not support the station's H.264 profile (%s)", videoFmtp)
+        return
+    }
+    pc, feedback, err := newStationPeerConnection(videoFmtp)
+    if err != nil {
+        c.String(http.StatusInternalServerError, err.Error())
+        return
+    }
+    st.mu.Lock()
+    if st.negotiatedFmtp == "" {
+        st.negotiatedFmtp = videoFmtp
+    }
+    st.mu.Unlock()
+    if err := addViewer(st, db); err != nil {
+        log.Printf("Station %s: %v", st.name, err)
+        c.String(http.StatusInternalServerError, err.Error())
+        pc.Close()
+        return
+    }
+    ws, err := newViewerSession(st, pc, feedback)
+    if err != nil {
+        removeViewer(st)
+        c.String(http.StatusInternalServerError, err.Error())
+        pc.Close()
+        return
+    }
+    pc.OnDataChannel(func(dc *webrtc.DataChannel) {
+        attachEventChannel(st, db, dc)
+    })
+    pc.OnConnectionStateChange(func(s webrtc.PeerConnectionState) {
+        log.Printf("Station %s: WHEP session %s PC state: %s", stationName, ws.id, s.String())
+        ws.setState(s)
+        if s == webrtc.PeerConnectionStateFailed || s == webrtc.PeerConnectionStateDisconnected || s == webrtc.PeerConnectionStateClosed {
+            ws.close()
+        }
+    })
+    answer, err := answerStationOffer(st, pc, offerSDP, true)
+    if err != nil {
+        ws.close()
+        c.String(http.StatusInternalServerError, err.Error())
+        return
+    }
+    ws.readReceiverReports()
+    ws.adaptRenditions()
+    c.Header("Location", fmt.Sprintf("/whep/%s/%s", url.PathEscape(stationName), ws.id))
+    c.Header("Access-Control-Expose-Headers", "Location")
+    c.Data(http.StatusCreated, "application/sdp", []byte(answer.SDP))
+}
+
+// whepPatchHandler accepts trickled ICE candidates for a session as an
+// application/trickle-ice-sdpfrag body. ICE restarts are not supported.
+func whepPatchHandler(c *gin.Context) {
+    ws := lookupWHEPSession(c)
+    if ws == nil {
+        c.String(http.StatusNotFound, "Unknown WHEP session")
+        return
+    }
+    if !hasContentType(c, "application/trickle-ice-sdpfrag") {
+        c.String(http.StatusUnsupportedMediaType, "Expected application/trickle-ice-sdpfrag")
+        return
+    }
+    body, err := io.ReadAll(c.Request.Body)
+    if err != nil {
+        c.String(http.StatusBadRequest, err.Error())
+        return
+    }
+    remoteUfrag := ""
+    if remote := ws.pc.RemoteDescription(); remote != nil {
+        remoteUfrag = sdpAttribute(remote.SDP, "ice-ufrag")
+    }
+    if ufrag := sdpAttribute(string(body), "ice-ufrag"); ufrag != "" && remoteUfrag != "" && ufrag != remoteUfrag {
+        c.String(http.StatusMethodNotAllowed, "ICE restarts are not supported, start a new session")
+        return
+    }
+    var mid *string
+    for _, line := range strings.Split(string(body), "\n") {
+        line = strings.TrimSpace(line)
+        switch {
+        case strings.HasPrefix(line, "a=mid:"):
+            m := strings.TrimPrefix(line, "a=mid:")
+            mid = &m
+        case strings.HasPrefix(line, "a=candidate:"):
+            candidate := webrtc.ICECandidateInit{Candidate: strings.TrimPrefix(line, "a="), SDPMid: mid}
+            if err := ws.pc.AddICECandidate(candidate); err != nil {
+                log.Printf("Station %s: WHEP session %s rejected candidate %q: %v", ws.st.name, ws.id, line, err)
+                c.String(http.StatusBadRequest, err.Error())
+                return
+            }
+        }
+    }
+    c.Status(http.StatusNoContent)
+}
+
+// whepDeleteHandler tears a session down.
+func whepDeleteHandler(c *gin.Context) {
+    ws := lookupWHEPSession(c)
+    if ws == nil {
+        c.String(http.StatusNotFound, "Unknown WHEP session")
+        return
+    }
+    ws.close()
+    c.Status(http.StatusOK)
+}
+
+// sdpAttribute returns the value of the first a=<name>: line in sdp.
+func sdpAttribute(sdp, name string) string {
+    prefix := "a=" + name + ":"
+    for _, line := range strings.Split(sdp, "\n") {
+        line = strings.TrimSpace(line)
+        if strings.HasPrefix(line, prefix) {
+            return strings.TrimPrefix(line, prefix)
+        }
+    }
+    return ""
+}